@@ -2,12 +2,15 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -16,17 +19,21 @@ import (
 	"golang.org/x/sys/windows/svc/eventlog"
 
 	"guard/internal/admin"
+	"guard/internal/capture"
 	"guard/internal/common"
 	"guard/internal/config"
 	"guard/internal/firewall"
+	"guard/internal/handoff"
 	"guard/internal/limiter"
 	"guard/internal/proxy"
+	"guard/internal/store"
 )
 
 var (
 	configPath  = flag.String("config", "", "Ruta al archivo de configuración (default: busca config.json)")
 	profileName = flag.String("profile", "login", "Perfil a usar: login o game")
 	logLevel    = flag.String("log-level", "", "Override del nivel de log (debug|info|warn|error)")
+	takeover    = flag.Bool("takeover", false, "Tomar el listener del proceso que atiende handoff_socket (actualización sin corte)")
 	serviceName = "GuardLogin"
 )
 
@@ -75,15 +82,30 @@ func (s *guardService) Execute(args []string, r <-chan svc.ChangeRequest, change
 			case svc.Stop, svc.Shutdown:
 				log.Printf("[INFO] recibido comando de detención del servicio")
 				cancel()
-				changes <- svc.Status{State: svc.StopPending}
-				select {
-				case err := <-errChan:
-					if err != nil {
-						log.Printf("[ERROR] error al detener: %v", err)
+				// Apagado ordenado: mientras se esperan las sesiones abiertas, avisar al
+				// SCM que la detención avanza para que no dé el servicio por colgado
+				grace := time.Duration(max(s.cfg.ShutdownGraceSeconds, 0)) * time.Second
+				timeout := time.After(grace + 10*time.Second)
+				hint := time.NewTicker(2 * time.Second)
+				checkpoint := uint32(1)
+				changes <- svc.Status{State: svc.StopPending, CheckPoint: checkpoint, WaitHint: 5000}
+			wait:
+				for {
+					select {
+					case err := <-errChan:
+						if err != nil {
+							log.Printf("[ERROR] error al detener: %v", err)
+						}
+						break wait
+					case <-hint.C:
+						checkpoint++
+						changes <- svc.Status{State: svc.StopPending, CheckPoint: checkpoint, WaitHint: 5000}
+					case <-timeout:
+						log.Printf("[WARN] timeout esperando que guard termine")
+						break wait
 					}
-				case <-time.After(10 * time.Second):
-					log.Printf("[WARN] timeout esperando que guard termine")
 				}
+				hint.Stop()
 				return false, 0
 			case svc.Interrogate:
 				changes <- c.CurrentStatus
@@ -204,13 +226,22 @@ func runGuard(ctx context.Context, cfg config.ProfileConfig) error {
 	log.Printf("[INFO] config validada OK")
 
 	logger := common.NewLogger(common.LogLevel(cfg.LogLevel))
-	idleTimeout := time.Duration(cfg.IdleTimeoutSeconds) * time.Second
-	if idleTimeout <= 0 {
-		idleTimeout = 20 * time.Second
+	rejects := common.NewRejectCounters()
+	settings, err := proxySettings(cfg)
+	if err != nil {
+		return fmt.Errorf("config inválida: %w", err)
 	}
-	backendDialTimeout := time.Duration(cfg.BackendDialTimeoutSeconds) * time.Second
-	if backendDialTimeout <= 0 {
-		backendDialTimeout = 5 * time.Second
+	live := proxy.NewLive(settings)
+
+	// Traspaso (-takeover): el proceso anterior suelta listener, store, firewall y API
+	// admin antes de que este los abra, y termina sus sesiones por su cuenta
+	var inherited *handoff.Handoff
+	if *takeover {
+		h, err := takeoverListener(cfg, live)
+		if err != nil {
+			return err
+		}
+		inherited = h
 	}
 
 	lim := limiter.New(
@@ -224,15 +255,76 @@ func runGuard(ctx context.Context, cfg config.ProfileConfig) error {
 		cfg.CleanupEverySeconds,
 	)
 	defer lim.Stop()
+	if err := applyLimits(lim, cfg, nil); err != nil {
+		return fmt.Errorf("config inválida: %w", err)
+	}
+	if inherited != nil && len(inherited.Limiter) > 0 {
+		var snap limiter.Snapshot
+		if err := json.Unmarshal(inherited.Limiter, &snap); err != nil {
+			log.Printf("[WARN] handoff: estado del limiter inválido, se descarta: %v", err)
+		} else {
+			log.Printf("[INFO] handoff: estado del limiter restaurado (%d IPs)", lim.Import(snap))
+		}
+	}
+	if len(cfg.AllowCIDRs) > 0 || len(cfg.DenyCIDRs) > 0 {
+		log.Printf("[INFO] allowlist=%d denylist=%d rangos", len(cfg.AllowCIDRs), len(cfg.DenyCIDRs))
+	}
+	if cfg.EnableSubnetLimit {
+		log.Printf("[INFO] límites por subred habilitados: /%d IPv4, /%d IPv6, refill=%.1f/s burst=%.0f max_live=%d block_after_ips=%d",
+			cfg.SubnetV4Prefix, cfg.SubnetV6Prefix, cfg.SubnetRefillPerSec, cfg.SubnetBurst, cfg.SubnetMaxLiveConns, cfg.SubnetBlockAfterIPs)
+	}
+
+	// Store persistente de bans (opcional): historial de backoff y expiraciones de firewall
+	var st *store.Store
+	if cfg.StoreFile != "" {
+		opened, err := store.Open(common.ExePath(cfg.StoreFile), time.Duration(cfg.StoreRetentionDays)*24*time.Hour)
+		if err != nil {
+			return err
+		}
+		st = opened
+		defer st.Close()
+		lim.SetHistory(st)
+		ips, fwBans := st.Stats()
+		log.Printf("[INFO] store %s cargado: ips_con_historial=%d bans_firewall=%d", cfg.StoreFile, ips, fwBans)
+	}
+
+	// Captura de los primeros bytes de clientes rechazados o marcados (opcional)
+	var cw *capture.Writer
+	if cfg.CaptureDir != "" {
+		opened, err := capture.New(captureOptions(cfg, "login"), capturePolicy(cfg))
+		if err != nil {
+			return err
+		}
+		cw = opened
+		defer cw.Close()
+		live.SetCapturer(cw)
+		log.Printf("[INFO] captura habilitada en %s (motivos: %s, más IPs marcadas desde la API admin)", cfg.CaptureDir, strings.Join(cfg.CaptureReasons, ","))
+	}
 
 	var fw *firewall.Manager
 	if cfg.EnableFirewallAutoban {
-		fw = firewall.New(cfg.FirewallBlockSeconds)
+		backend, err := firewall.NewBackend(cfg.FirewallBackend, "login", nil)
+		if err != nil {
+			return fmt.Errorf("firewall: %w", err)
+		}
+		var fwState firewall.State
+		if st != nil {
+			fwState = st
+		} else if cfg.FirewallStateFile != "" {
+			fwState = firewall.NewFileState(common.ExePath(cfg.FirewallStateFile), backend.Name())
+		}
+		fw = firewall.New(cfg.FirewallBlockSeconds, backend, fwState)
+		fw.SetIPv6Prefix(cfg.IPv6ClientPrefix)
 		defer fw.Stop()
+		log.Printf("[INFO] firewall autoban habilitado (backend=%s)", fw.BackendName())
 	}
 
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
+	// La API admin sigue respondiendo durante el apagado ordenado (sesiones restantes)
+	adminCtx, stopAdmin := context.WithCancel(context.Background())
+	defer stopAdmin()
+	adminDone := make(chan struct{})
 
 	// Solo manejar señales si estamos en modo consola
 	isIntSess, _ := svc.IsAnInteractiveSession()
@@ -243,6 +335,9 @@ func runGuard(ctx context.Context, cfg config.ProfileConfig) error {
 			<-sig
 			log.Println("[INFO] shutdown signal received")
 			cancel()
+			<-sig
+			log.Println("[WARN] segunda señal de shutdown: cortando las sesiones sin esperar")
+			live.CloseSessions()
 		}()
 	}
 
@@ -263,12 +358,18 @@ func runGuard(ctx context.Context, cfg config.ProfileConfig) error {
 	if fw != nil {
 		go fw.RunScheduler(ctx.Done())
 	}
+	if st != nil {
+		go st.Run(ctx)
+	}
 
-	// Sistema de protección contra sobrecarga con auto-recuperación (solo para login)
+	// Sistema de protección contra sobrecarga con auto-recuperación (solo para login).
+	// Los umbrales se protegen con overloadMu porque la recarga de config los cambia.
 	var (
 		overloadMu          sync.RWMutex
 		isOverloaded        bool
 		overloadStartTime   time.Time
+		maxTotalConns       = cfg.MaxTotalConns
+		maxDrainSeconds     = cfg.MaxDrainSeconds
 		overloadThreshold   = uint64(cfg.MaxTotalConns * 80 / 100)
 		criticalThreshold   = uint64(cfg.MaxTotalConns * 90 / 100)
 		rejectRateThreshold = 50.0
@@ -287,13 +388,213 @@ func runGuard(ctx context.Context, cfg config.ProfileConfig) error {
 		}
 		adminSrv = admin.New(lim, fw, "login", shouldDrainFn, logger.GetRejectCount, cfg.MaxTotalConns)
 		adminSrv.SetAccessControl(cfg.AdminAllowIPs, cfg.AdminToken)
+		if err := adminSrv.SetHistoryFile(common.ExePath(cfg.MetricsFile)); err != nil {
+			log.Printf("[WARN] %v (se empieza con el historial vacío)", err)
+		}
+		if err := adminSrv.SetAuditFile(common.ExePath(cfg.AuditFile), int64(cfg.AuditFileMB)<<20, cfg.AuditKeepFiles); err != nil {
+			log.Printf("[WARN] %v (los eventos quedan solo en memoria)", err)
+		}
+		defer adminSrv.CloseAudit()
+		adminSrv.SetOverloadFn(func() bool {
+			overloadMu.RLock()
+			defer overloadMu.RUnlock()
+			return isOverloaded
+		})
+		if fw != nil {
+			adminSrv.AddEvent("fw_reconcile", "", fw.Reconciled().String())
+		}
 		go func() {
-			if err := adminSrv.Start(ctx, cfg.AdminListenAddr); err != nil {
+			defer close(adminDone)
+			if err := adminSrv.Start(adminCtx, cfg.AdminListenAddr); err != nil {
 				log.Printf("[WARN] admin server terminó: %v", err)
 			}
 		}()
 	}
 
+	if adminSrv == nil {
+		close(adminDone)
+	}
+
+	// Salud de los backends
+	live.OnBackendChange(func(addr string, healthy bool, detail string) {
+		if healthy {
+			log.Printf("[INFO] backend %s disponible nuevamente", addr)
+		} else {
+			log.Printf("[WARN] backend %s caído, se deriva a los restantes: %s", addr, detail)
+		}
+	})
+	live.OnBreakerChange(func(addr string, open bool, detail string) {
+		if open {
+			log.Printf("[WARN] circuit breaker abierto para backend %s (%s) - rechazando sin esperar dial", addr, detail)
+			if adminSrv != nil {
+				adminSrv.AddEvent("backend_down", addr, detail)
+			}
+		} else {
+			log.Printf("[INFO] circuit breaker cerrado para backend %s (%s)", addr, detail)
+			if adminSrv != nil {
+				adminSrv.AddEvent("backend_up", addr, detail)
+			}
+		}
+	})
+	if adminSrv != nil {
+		adminSrv.SetBackendsFn(live.Backends)
+		adminSrv.SetSessionsFn(live.Sessions)
+		adminSrv.SetSessionTable(live)
+		adminSrv.SetTrafficSource(live)
+		adminSrv.SetProxyStats(live)
+		adminSrv.SetRejectCounters(rejects)
+		if cw != nil {
+			adminSrv.SetCapture(cw)
+		}
+	}
+
+	// Escalado por subred: demasiadas IPs del mismo rango en tempblock → ban del rango entero
+	lim.OnSubnetBlock(func(prefix string, ips int, until time.Time) {
+		log.Printf("[WARN] subred %s bloqueada: %d IPs en tempblock, hasta %s", prefix, ips, until.Format(time.RFC3339))
+		if fw != nil {
+			if err := fw.BlockCIDR(prefix); err != nil {
+				log.Printf("[WARN] firewall ban de subred %s falló: %v", prefix, err)
+			}
+		}
+		if adminSrv != nil {
+			adminSrv.AddEvent("subnet_ban", prefix, fmt.Sprintf("ips=%d", ips))
+		}
+	})
+
+	// Recarga de config en caliente: al cambiar el archivo o por POST /api/config/reload.
+	// Si la config nueva no valida se descarta entera y sigue vigente la anterior;
+	// si valida pero algo no se puede aplicar (límites, listen_addr) se aplica el resto.
+	current := cfg
+	var reloadMu sync.Mutex
+	reload := func(source string) (string, error) {
+		reloadMu.Lock()
+		defer reloadMu.Unlock()
+
+		next, err := config.LoadProfile(*configPath, *profileName)
+		if err == nil {
+			if *logLevel != "" {
+				next.LogLevel = *logLevel
+			}
+			err = config.Validate(next)
+		}
+		var nextSettings proxy.Settings
+		if err == nil {
+			nextSettings, err = proxySettings(next)
+		}
+		if err != nil {
+			log.Printf("[WARN] recarga de config (%s) descartada, se mantiene la anterior: %v", source, err)
+			if adminSrv != nil {
+				adminSrv.AddEvent("config_reload_failed", "", err.Error())
+			}
+			return "", err
+		}
+
+		changed := config.Diff(current, next)
+		if len(changed) == 0 {
+			log.Printf("[INFO] recarga de config (%s): sin cambios", source)
+			return "sin cambios", nil
+		}
+
+		lim.SetParams(next.MaxLiveConnsPerIP, next.AttemptRefillPerSec, next.AttemptBurst,
+			next.DeniesBeforeTempBlock, next.TempBlockSeconds, next.MaxTotalConns,
+			next.StaleAfterSeconds, next.CleanupEverySeconds)
+		// Lo que no se puede aplicar queda como en current: la próxima recarga lo
+		// reintenta y /api/config/reload responde con el error
+		var failed []string
+		if err := applyLimits(lim, next, changed); err != nil {
+			log.Printf("[WARN] recarga de config (%s): límites: %v; se mantienen los anteriores", source, err)
+			failed = append(failed, "límites: "+err.Error())
+			config.Revert(&next, current, limitKeys...)
+			if err := applyLimits(lim, next, nil); err != nil {
+				log.Printf("[WARN] recarga de config (%s): restaurando límites: %v", source, err)
+			}
+		}
+		if fw != nil {
+			fw.SetBlockSeconds(next.FirewallBlockSeconds)
+			fw.SetIPv6Prefix(next.IPv6ClientPrefix)
+		}
+		if err := live.Set(nextSettings); err != nil {
+			log.Printf("[WARN] recarga de config (%s): %v", source, err)
+			failed = append(failed, err.Error())
+			config.Revert(&next, current, "listen_addr")
+		}
+		if cw != nil {
+			cw.SetPolicy(capturePolicy(next))
+		}
+		logger.SetLevel(common.LogLevel(next.LogLevel))
+		if adminSrv != nil {
+			adminSrv.SetAccessControl(next.AdminAllowIPs, next.AdminToken)
+			adminSrv.SetMaxConns(next.MaxTotalConns)
+		}
+		overloadMu.Lock()
+		maxTotalConns = next.MaxTotalConns
+		maxDrainSeconds = next.MaxDrainSeconds
+		overloadThreshold = uint64(next.MaxTotalConns * 80 / 100)
+		criticalThreshold = uint64(next.MaxTotalConns * 90 / 100)
+		overloadMu.Unlock()
+		current = next
+
+		var restart []string
+		for _, k := range changed {
+			if config.RequiresRestart(k) {
+				restart = append(restart, k)
+			}
+		}
+		summary := strings.Join(changed, ",")
+		log.Printf("[INFO] config recargada (%s): %s", source, summary)
+		if len(restart) > 0 {
+			summary += " (requieren reinicio: " + strings.Join(restart, ",") + ")"
+			log.Printf("[WARN] cambios que solo se aplican al reiniciar: %s", strings.Join(restart, ","))
+		}
+		if len(failed) > 0 {
+			summary += " (no aplicado: " + strings.Join(failed, "; ") + ")"
+		}
+		if adminSrv != nil {
+			adminSrv.AddEvent("config_reload", "", summary)
+		}
+		if len(failed) > 0 {
+			return summary, fmt.Errorf("config recargada en parte: no se aplicó %s", strings.Join(failed, "; "))
+		}
+		return summary, nil
+	}
+	if adminSrv != nil {
+		adminSrv.SetReloadFn(func() (string, error) { return reload("admin") })
+	}
+	if path := config.FindPath(*configPath); path != "" {
+		go config.Watch(ctx, path, func() { _, _ = reload("archivo") })
+	}
+
+	// Traspaso a un proceso nuevo: deja de aceptar y suelta todo lo que el nuevo va a
+	// abrir; las sesiones en curso se terminan con el apagado ordenado de siempre
+	if cfg.HandoffSocket != "" {
+		go serveHandoff(ctx, cfg, live, lim, func() {
+			n := live.Sessions()
+			log.Printf("[INFO] handoff: el proceso nuevo tomó el listener, terminando %d sesiones en curso", n)
+			if adminSrv != nil {
+				adminSrv.AddEvent("handoff", "", fmt.Sprintf("sessions=%d", n))
+			}
+			cancel()
+			lim.SetHistory(nil)
+			if fw != nil {
+				fw.Stop()
+			}
+			if st != nil {
+				if err := st.Close(); err != nil {
+					log.Printf("[WARN] handoff: %v", err)
+				}
+			}
+			if adminSrv != nil {
+				adminSrv.CloseAudit()
+			}
+			stopAdmin()
+			select {
+			case <-adminDone:
+			case <-time.After(5 * time.Second):
+				log.Printf("[WARN] handoff: la API admin no terminó a tiempo")
+			}
+		})
+	}
+
 	// Verificación rápida de sobrecarga crítica cada 2 segundos
 	go func() {
 		tick := time.NewTicker(2 * time.Second)
@@ -307,11 +608,11 @@ func runGuard(ctx context.Context, cfg config.ProfileConfig) error {
 				overloadMu.Lock()
 
 				// Verificar timeout de drain
-				if cfg.MaxDrainSeconds > 0 && inDrainMode && !drainStartTime.IsZero() &&
-					time.Since(drainStartTime) > time.Duration(cfg.MaxDrainSeconds)*time.Second {
+				if maxDrainSeconds > 0 && inDrainMode && !drainStartTime.IsZero() &&
+					time.Since(drainStartTime) > time.Duration(maxDrainSeconds)*time.Second {
 					inDrainMode = false
 					drainStartTime = time.Time{}
-					log.Printf("[WARN] DRAIN timeout (%ds) - forzando salida, active_conns=%d", cfg.MaxDrainSeconds, active)
+					log.Printf("[WARN] DRAIN timeout (%ds) - forzando salida, active_conns=%d", maxDrainSeconds, active)
 					if adminSrv != nil {
 						adminSrv.SetDrainSince(time.Time{})
 						adminSrv.AddEvent("drain_off", "", "timeout")
@@ -353,27 +654,28 @@ func runGuard(ctx context.Context, cfg config.ProfileConfig) error {
 	go func() {
 		tick := time.NewTicker(10 * time.Second)
 		defer tick.Stop()
+		prevReasons := rejects.Snapshot("login")
 		for {
 			select {
 			case <-ctx.Done():
 				return
 			case <-tick.C:
 				active, ips := lim.Stats()
-				rej := logger.GetRejectCount()
-				prev := logger.GetLastReject()
-				logger.SetLastReject(rej)
-				rate := float64(rej-prev) / 10.0
+				reasons := rejects.Snapshot("login")
+				rate := overloadRejectRate(common.RejectRates(prevReasons, reasons, 10))
+				prevReasons = reasons
 
 				overloadMu.Lock()
+				limit := maxTotalConns
 				wasOverloaded := isOverloaded
 				currentInDrain := inDrainMode
 
 				// Verificar timeout de drain también aquí
-				if cfg.MaxDrainSeconds > 0 && inDrainMode && !drainStartTime.IsZero() &&
-					time.Since(drainStartTime) > time.Duration(cfg.MaxDrainSeconds)*time.Second {
+				if maxDrainSeconds > 0 && inDrainMode && !drainStartTime.IsZero() &&
+					time.Since(drainStartTime) > time.Duration(maxDrainSeconds)*time.Second {
 					inDrainMode = false
 					drainStartTime = time.Time{}
-					log.Printf("[WARN] DRAIN timeout (%ds) - forzando salida, active_conns=%d", cfg.MaxDrainSeconds, active)
+					log.Printf("[WARN] DRAIN timeout (%ds) - forzando salida, active_conns=%d", maxDrainSeconds, active)
 					if adminSrv != nil {
 						adminSrv.SetDrainSince(time.Time{})
 						adminSrv.AddEvent("drain_off", "", "timeout")
@@ -388,7 +690,7 @@ func runGuard(ctx context.Context, cfg config.ProfileConfig) error {
 				if isOverloaded && !wasOverloaded {
 					overloadStartTime = time.Now()
 					log.Printf("[WARN] SOBRECARGA DETECTADA: active_conns=%d (limite=%d) rejects_per_10s=%.1f - Activando protección agresiva",
-						active, cfg.MaxTotalConns, rate)
+						active, limit, rate)
 					if adminSrv != nil {
 						adminSrv.AddEvent("overload_start", "", fmt.Sprintf("active=%d rate=%.1f", active, rate))
 					}
@@ -430,7 +732,7 @@ func runGuard(ctx context.Context, cfg config.ProfileConfig) error {
 
 				if shouldLog {
 					log.Printf("[INFO] metrics active_conns=%d ips_in_memory=%d rejects_per_10s=%.1f semaphore_used=%d/%d overload=%v",
-						active, ips, rate, active, cfg.MaxTotalConns, isOverloaded)
+						active, ips, rate, active, limit, isOverloaded)
 				}
 			}
 		}
@@ -450,6 +752,7 @@ func runGuard(ctx context.Context, cfg config.ProfileConfig) error {
 	}
 	onReject := func(ip, reason string) {
 		logger.IncrementReject()
+		rejects.Inc("login", reason)
 		switch reason {
 		case "overload":
 			// solo contar, no loggear spam
@@ -458,6 +761,25 @@ func runGuard(ctx context.Context, cfg config.ProfileConfig) error {
 			logger.LogMsg(2, ip, "reject rate client=%s", ip)
 		case "live_limit":
 			logger.LogMsg(2, ip, "reject live_limit client=%s", ip)
+		case "denylist":
+			logger.LogMsg(2, ip, "reject denylist client=%s", ip)
+		case "proxy_header":
+			// ip es el upstream confiable: no se penaliza
+			logger.LogMsg(2, ip, "reject proxy_header upstream=%s (header PROXY ausente o inválido)", ip)
+		case "proxy_untrusted":
+			logger.LogMsg(2, ip, "reject proxy_untrusted client=%s (header PROXY desde origen no confiable)", ip)
+		case "subnet_rate":
+			lim.RecordDeny(ip)
+			logger.LogMsg(2, ip, "reject subnet_rate client=%s subnet=%s", ip, lim.SubnetOf(ip))
+		case "subnet_live_limit":
+			logger.LogMsg(2, ip, "reject subnet_live_limit client=%s subnet=%s", ip, lim.SubnetOf(ip))
+		case "subnet_block":
+			subnet := lim.SubnetOf(ip)
+			logger.LogMsg(2, ip, "reject subnet_block client=%s subnet=%s", ip, subnet)
+			if fw != nil && subnet != "" {
+				// Re-encolar por si el ban de firewall venció antes que el bloqueo de la subred
+				_ = fw.BlockCIDR(subnet)
+			}
 		case "global_limit":
 			logger.LogMsg(2, ip, "reject global_limit client=%s", ip)
 		case "tempblock":
@@ -476,6 +798,20 @@ func runGuard(ctx context.Context, cfg config.ProfileConfig) error {
 			}
 		case "backend_fail":
 			logger.LogMsg(3, ip, "backend connect fail client=%s", ip)
+		case "backend_unavailable":
+			logger.LogMsg(2, ip, "reject backend_unavailable client=%s (circuit breaker abierto)", ip)
+		case "handshake_timeout":
+			// Conectó y no envió el primer payload a tiempo (slowloris): cuenta como violación
+			lim.RecordViolation(ip)
+			logger.LogMsg(2, ip, "reject handshake_timeout client=%s", ip)
+		case "bad_handshake":
+			// El primer payload no cumple handshake_rules (scanner, otro protocolo): cuenta como violación
+			lim.RecordViolation(ip)
+			logger.LogMsg(2, ip, "reject bad_handshake client=%s", ip)
+		case "throughput":
+			// Sesión cortada por exceder el caudal (shape_disconnect): cuenta como violación
+			lim.RecordViolation(ip)
+			logger.LogMsg(2, ip, "reject throughput client=%s (límite de caudal excedido)", ip)
 		default:
 			logger.LogMsg(2, ip, "reject reason=%s client=%s", reason, ip)
 		}
@@ -500,12 +836,30 @@ func runGuard(ctx context.Context, cfg config.ProfileConfig) error {
 		return inDrainMode
 	}
 
+	if opts := settings.Options; len(opts.TrustedProxies) > 0 {
+		log.Printf("[INFO] PROXY protocol habilitado para %d upstreams confiables: %v", len(cfg.ProxyProtocolTrusted), cfg.ProxyProtocolTrusted)
+	}
+	if len(cfg.Backends) > 0 {
+		addrs := make([]string, 0, len(cfg.Backends))
+		for _, b := range cfg.Backends {
+			addrs = append(addrs, b.Addr)
+		}
+		log.Printf("[INFO] %d backends (%s): %s", len(addrs), cfg.BackendStrategy, strings.Join(addrs, ", "))
+	}
+	if settings.Options.SendProxy != "" {
+		log.Printf("[INFO] enviando header PROXY %s al backend %s", settings.Options.SendProxy, cfg.BackendAddr)
+	}
+
 	log.Printf("[INFO] iniciando proxy.Run...")
-	err := proxy.Run(ctx, cfg.ListenAddr, cfg.BackendAddr, idleTimeout, backendDialTimeout,
-		tryAccept, onAccept, onReject, onRelease, shouldDrain)
+	err = proxy.RunLive(ctx, live, tryAccept, onAccept, onReject, onRelease, shouldDrain)
 
 	log.Printf("[INFO] proxy.Run retornó, error: %v", err)
 	log.Printf("[INFO] ctx.Err(): %v", ctx.Err())
+	if ctx.Err() != nil {
+		gracefulStop(live, adminSrv)
+	} else {
+		live.CloseSessions()
+	}
 
 	if err != nil {
 		if ctx.Err() != nil {
@@ -524,3 +878,240 @@ func runGuard(ctx context.Context, cfg config.ProfileConfig) error {
 	log.Printf("[WARN] esto puede indicar que el listener se cerró inesperadamente")
 	return fmt.Errorf("proxy terminó inesperadamente")
 }
+
+// proxySettings arma la configuración del proxy a partir del perfil, con los
+// timeouts por defecto si no se especificaron.
+func proxySettings(cfg config.ProfileConfig) (proxy.Settings, error) {
+	s := proxy.Settings{
+		ListenAddr:         cfg.ListenAddr,
+		BackendAddr:        cfg.BackendAddr,
+		IdleTimeout:        time.Duration(cfg.IdleTimeoutSeconds) * time.Second,
+		BackendDialTimeout: time.Duration(cfg.BackendDialTimeoutSeconds) * time.Second,
+	}
+	if s.IdleTimeout <= 0 {
+		s.IdleTimeout = 20 * time.Second
+	}
+	if s.BackendDialTimeout <= 0 {
+		s.BackendDialTimeout = 5 * time.Second
+	}
+	for _, c := range cfg.ProxyProtocolTrusted {
+		p, err := limiter.ParsePrefix(c)
+		if err != nil {
+			return proxy.Settings{}, fmt.Errorf("proxy_protocol_trusted: %w", err)
+		}
+		s.Options.TrustedProxies = append(s.Options.TrustedProxies, p)
+	}
+	s.Options.SendProxy = cfg.BackendProxyProtocol
+	for _, b := range cfg.Backends {
+		s.Backends = append(s.Backends, proxy.Backend{Addr: b.Addr, Weight: b.Weight})
+	}
+	s.Strategy = cfg.BackendStrategy
+	if cfg.ShutdownGraceSeconds > 0 {
+		s.ShutdownGrace = time.Duration(cfg.ShutdownGraceSeconds) * time.Second
+	}
+	if cfg.BreakerFailures > 0 {
+		s.Breaker = proxy.Breaker{
+			Failures: cfg.BreakerFailures,
+			OpenFor:  time.Duration(cfg.BreakerOpenSeconds) * time.Second,
+		}
+	}
+	if cfg.HandshakeTimeoutSeconds > 0 {
+		s.Handshake = proxy.Handshake{
+			Timeout:  time.Duration(cfg.HandshakeTimeoutSeconds) * time.Second,
+			MinBytes: cfg.HandshakeMinBytes,
+		}
+	}
+	if r := cfg.HandshakeRules; r != nil {
+		v, err := proxy.CompileRules(r.LengthRanges, r.PrefixesHex, r.AllowRegex, r.DenyRegex, r.MaxHeaderBytes, r.HeaderDelimiterHex)
+		if err != nil {
+			return proxy.Settings{}, fmt.Errorf("handshake_rules: %w", err)
+		}
+		s.Validator = v
+	}
+	s.Shaping = proxy.Shaping{
+		In: proxy.ShapeLimit{
+			ConnBytesPerSec: cfg.ShapeInConnBytesPerSec,
+			ConnReadsPerSec: cfg.ShapeInConnReadsPerSec,
+			IPBytesPerSec:   cfg.ShapeInIPBytesPerSec,
+			IPReadsPerSec:   cfg.ShapeInIPReadsPerSec,
+		},
+		Out: proxy.ShapeLimit{
+			ConnBytesPerSec: cfg.ShapeOutConnBytesPerSec,
+			ConnReadsPerSec: cfg.ShapeOutConnReadsPerSec,
+			IPBytesPerSec:   cfg.ShapeOutIPBytesPerSec,
+			IPReadsPerSec:   cfg.ShapeOutIPReadsPerSec,
+		},
+		Burst:      time.Duration(cfg.ShapeBurstSeconds * float64(time.Second)),
+		Disconnect: cfg.ShapeDisconnect,
+	}
+	if cfg.MaintenanceResponseFile != "" {
+		msg, err := os.ReadFile(common.ExePath(cfg.MaintenanceResponseFile))
+		if err != nil {
+			return proxy.Settings{}, fmt.Errorf("maintenance_response_file: %w", err)
+		}
+		s.Maintenance = msg
+	}
+	if cfg.HealthCheckIntervalSecs > 0 {
+		s.HealthCheck = proxy.HealthCheck{
+			Interval: time.Duration(cfg.HealthCheckIntervalSecs) * time.Second,
+			Timeout:  time.Duration(cfg.HealthCheckTimeoutSecs) * time.Second,
+			Fall:     cfg.HealthCheckFall,
+			Rise:     cfg.HealthCheckRise,
+		}
+	}
+	return s, nil
+}
+
+// captureOptions arma los archivos de captura del perfil a partir de la config.
+func captureOptions(cfg config.ProfileConfig, profile string) capture.Options {
+	return capture.Options{
+		Dir:      common.ExePath(cfg.CaptureDir),
+		Profile:  profile,
+		Format:   cfg.CaptureFormat,
+		FileSize: int64(cfg.CaptureFileMB) << 20,
+		Keep:     cfg.CaptureKeepFiles,
+	}
+}
+
+// capturePolicy arma qué se captura a partir de la config (se aplica en caliente).
+func capturePolicy(cfg config.ProfileConfig) capture.Policy {
+	return capture.Policy{
+		Bytes:          cfg.CaptureBytes,
+		Reasons:        cfg.CaptureReasons,
+		PerIPPerMinute: cfg.CapturePerIPPerMinute,
+	}
+}
+
+// limitKeys son los campos que aplica applyLimits; si falla una recarga se
+// revierten todos juntos.
+var limitKeys = []string{"allow_cidrs", "deny_cidrs", "ipv6_client_prefix", "enable_subnet_limit",
+	"subnet_v4_prefix", "subnet_v6_prefix", "subnet_refill_per_sec", "subnet_burst",
+	"subnet_max_live_conns", "subnet_block_after_ips"}
+
+// applyLimits aplica al limiter las listas CIDR, el agrupamiento IPv6 y los límites
+// por subred del perfil. Se usa al arrancar (changed nil) y en cada recarga de
+// config; las listas CIDR solo se recargan si allow_cidrs o deny_cidrs están en
+// changed (los cambios hechos desde la API admin se conservan igual, ver
+// limiter.CIDRList).
+func applyLimits(lim *limiter.Limiter, cfg config.ProfileConfig, changed []string) error {
+	if changed == nil || slices.Contains(changed, "allow_cidrs") || slices.Contains(changed, "deny_cidrs") {
+		if err := lim.SetCIDRs(cfg.AllowCIDRs, cfg.DenyCIDRs); err != nil {
+			return err
+		}
+	}
+	if err := lim.SetIPv6Prefix(cfg.IPv6ClientPrefix); err != nil {
+		return err
+	}
+	if !cfg.EnableSubnetLimit {
+		lim.ClearSubnetLimits()
+		return nil
+	}
+	return lim.SetSubnetLimits(limiter.SubnetConfig{
+		V4Bits:        cfg.SubnetV4Prefix,
+		V6Bits:        cfg.SubnetV6Prefix,
+		RefillPerSec:  cfg.SubnetRefillPerSec,
+		Burst:         cfg.SubnetBurst,
+		MaxLive:       cfg.SubnetMaxLiveConns,
+		BlockAfterIPs: cfg.SubnetBlockAfterIPs,
+	})
+}
+
+// takeoverListener toma el listener del proceso que atiende cfg.HandoffSocket y lo
+// deja listo en live. Retorna el traspaso para restaurar el estado del limiter.
+func takeoverListener(cfg config.ProfileConfig, live *proxy.Live) (*handoff.Handoff, error) {
+	if cfg.HandoffSocket == "" {
+		return nil, fmt.Errorf("-takeover requiere handoff_socket en la config")
+	}
+	path := common.ExePath(cfg.HandoffSocket)
+	h, err := handoff.Takeover(path, *profileName, cfg.HandoffTransferState, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if h.Listener != nil && h.ListenAddr != cfg.ListenAddr {
+		log.Printf("[WARN] handoff: el proceso anterior escucha en %s pero listen_addr es %s; se abre un listener nuevo", h.ListenAddr, cfg.ListenAddr)
+		h.Listener.Close()
+		h.Listener = nil
+	}
+	if err := h.Ready(); err != nil {
+		if h.Listener != nil {
+			h.Listener.Close()
+		}
+		return nil, err
+	}
+	ln := h.Listener
+	if ln == nil {
+		// Sin fd heredado: el puerto queda libre cuando el anterior confirma
+		if ln, err = handoff.ListenRetry(cfg.ListenAddr, 5*time.Second); err != nil {
+			return nil, fmt.Errorf("handoff: no se pudo abrir %s: %w", cfg.ListenAddr, err)
+		}
+	}
+	live.UseListener(ln)
+	log.Printf("[INFO] handoff: listener %s tomado del proceso anterior (heredado=%v, estado del limiter=%v)",
+		cfg.ListenAddr, h.Listener != nil, len(h.Limiter) > 0)
+	return h, nil
+}
+
+// serveHandoff atiende el socket de control hasta que un proceso nuevo tome el
+// listener (ver takeoverListener) o ctx se cancele.
+func serveHandoff(ctx context.Context, cfg config.ProfileConfig, live *proxy.Live, lim *limiter.Limiter, release func()) {
+	offer := func(wantState bool) (handoff.Offer, error) {
+		o := handoff.Offer{ListenAddr: live.Get().ListenAddr, Listener: live.Listener()}
+		if wantState {
+			data, err := json.Marshal(lim.Export())
+			if err != nil {
+				return o, err
+			}
+			o.Limiter = data
+		}
+		return o, nil
+	}
+	path := common.ExePath(cfg.HandoffSocket)
+	log.Printf("[INFO] handoff: socket de control en %s", path)
+	if err := handoff.Serve(ctx, path, *profileName, offer, release); err != nil {
+		log.Printf("[WARN] %v", err)
+	}
+}
+
+// gracefulStop se llama con el listener ya cerrado: espera a que terminen las
+// sesiones en curso durante el período de gracia y corta las que queden.
+func gracefulStop(live *proxy.Live, adminSrv *admin.Server) {
+	grace := live.Get().ShutdownGrace
+	n := live.Sessions()
+	log.Printf("[INFO] shutdown: listener cerrado, %d sesiones activas, período de gracia %v", n, grace)
+	if adminSrv != nil {
+		adminSrv.SetShutdownSince(time.Now())
+		adminSrv.AddEvent("shutdown_start", "", fmt.Sprintf("sessions=%d grace=%v", n, grace))
+	}
+	forced := live.Drain(grace, func(remaining int64, left time.Duration) {
+		log.Printf("[INFO] shutdown: %d sesiones activas, %v de gracia restantes", remaining, left.Round(time.Second))
+	})
+	if forced > 0 {
+		log.Printf("[WARN] shutdown: período de gracia vencido, cortando %d sesiones", forced)
+	} else {
+		log.Printf("[INFO] shutdown: todas las sesiones terminaron")
+	}
+	if adminSrv != nil {
+		adminSrv.AddEvent("shutdown_done", "", fmt.Sprintf("forced=%d", forced))
+	}
+}
+
+// overloadIgnored son los motivos de rechazo que no cuentan para detectar
+// sobrecarga: los de overload los genera la propia protección (la mantendrían
+// activa) y los de backend no dependen de la carga de clientes.
+var overloadIgnored = map[string]bool{
+	"overload":            true,
+	"backend_fail":        true,
+	"backend_unavailable": true,
+}
+
+// overloadRejectRate suma los rechazos/s por motivo que cuentan para la
+// detección de sobrecarga.
+func overloadRejectRate(rates map[string]float64) float64 {
+	var total float64
+	for reason, r := range rates {
+		if !overloadIgnored[reason] {
+			total += r
+		}
+	}
+	return total
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	_ "embed"
 	"encoding/json"
@@ -14,8 +15,11 @@ import (
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
+
+	"guard/internal/sse"
 )
 
 //go:embed panel.html
@@ -248,6 +252,20 @@ func main() {
 		io.Copy(w, resp.Body)
 	})
 
+	// ─── Stream de todos los nodos: /api/stream ──────────────────────────────
+	// Una conexión SSE por nodo y servicio hacia /api/stream del guard; sus mensajes
+	// se re-publican con el nodo y el servicio en un hub con secuencia propia, así el
+	// navegador retoma con Last-Event-ID aunque cada guard numere por su cuenta.
+	// Las conexiones a los guards solo se mantienen mientras haya navegadores mirando.
+	rootCtx, stopFollow := context.WithCancel(context.Background())
+	hub := sse.New(5000)
+	follow := &followers{ctx: rootCtx, hub: hub, nodes: cfg.Nodes}
+	mux.HandleFunc("/api/stream", func(w http.ResponseWriter, r *http.Request) {
+		follow.acquire()
+		defer follow.release()
+		hub.Serve(w, r, nil)
+	})
+
 	srv := &http.Server{
 		Addr:         *listenFlag,
 		Handler:      localhostOnly(mux),
@@ -259,6 +277,8 @@ func main() {
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		<-sig
+		stopFollow()
+		hub.Close()
 		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 		defer cancel()
 		_ = srv.Shutdown(ctx)
@@ -286,3 +306,185 @@ func localhostOnly(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// streamMsg es un mensaje de un guard re-publicado por el panel.
+type streamMsg struct {
+	Node string          `json:"node"`
+	Svc  string          `json:"svc"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// streamIdle es cuánto se espera sin datos (el guard envía un ping cada 15s)
+// antes de dar la conexión por caída.
+const streamIdle = 45 * time.Second
+
+// followLinger es cuánto siguen conectados los followStream después de que se va
+// el último cliente de /api/stream (al recargar la página el navegador vuelve enseguida).
+const followLinger = 30 * time.Second
+
+// followers corre un followStream por nodo y servicio mientras haya clientes en
+// /api/stream: arrancan con el primero y se detienen followLinger después de que
+// se va el último, o al cancelarse ctx (apagado del panel).
+type followers struct {
+	ctx   context.Context
+	hub   *sse.Hub
+	nodes []NodeCfg
+
+	mu     sync.Mutex
+	subs   int
+	cancel context.CancelFunc // nil = detenidos
+	linger *time.Timer
+}
+
+// acquire registra un cliente y arranca los followStream si estaban detenidos.
+func (f *followers) acquire() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.subs++
+	if f.linger != nil {
+		f.linger.Stop()
+		f.linger = nil
+	}
+	if f.cancel != nil || f.ctx.Err() != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(f.ctx)
+	f.cancel = cancel
+	for i := range f.nodes {
+		n := &f.nodes[i]
+		go followStream(ctx, f.hub, n, "login", n.LoginURL)
+		go followStream(ctx, f.hub, n, "game", n.GameURL)
+	}
+}
+
+// release saca un cliente; con el último programa la detención de los followStream.
+func (f *followers) release() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.subs--
+	if f.subs > 0 || f.cancel == nil {
+		return
+	}
+	var t *time.Timer
+	t = time.AfterFunc(followLinger, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		// Un acquire posterior ya canceló (o reemplazó) este timer
+		if f.linger != t || f.subs > 0 {
+			return
+		}
+		f.linger = nil
+		f.cancel()
+		f.cancel = nil
+	})
+	f.linger = t
+}
+
+// followStream mantiene una conexión a /api/stream de un servicio de node y
+// re-publica sus mensajes en hub hasta que ctx se cancele. Se reconecta con
+// Last-Event-ID para recuperar lo que se perdió, y publica "node_up"/"node_down"
+// al conectar y al perder la conexión.
+func followStream(ctx context.Context, hub *sse.Hub, node *NodeCfg, svc, baseURL string) {
+	var lastID string
+	backoff := time.Second
+	up := false
+	for {
+		err := readStream(ctx, baseURL+"/api/stream", node.Token, &lastID, func() {
+			up = true
+			backoff = time.Second
+			log.Printf("[INFO] stream %s/%s conectado", node.ID, svc)
+			hub.Publish("node_up", streamMsg{Node: node.ID, Svc: svc})
+		}, func(typ string, data []byte) {
+			hub.Publish(typ, streamMsg{Node: node.ID, Svc: svc, Data: data})
+		})
+		if ctx.Err() != nil {
+			// Detenido a propósito: el nodo no se cayó
+			if up {
+				log.Printf("[INFO] stream %s/%s detenido", node.ID, svc)
+			}
+			return
+		}
+		if up {
+			up = false
+			log.Printf("[WARN] stream %s/%s desconectado: %v", node.ID, svc, err)
+			detail, _ := json.Marshal(err.Error())
+			hub.Publish("node_down", streamMsg{Node: node.ID, Svc: svc, Data: detail})
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
+
+// readStream lee un stream SSE: llama a onOpen al conectar y a onMsg con cada
+// mensaje, y actualiza lastID con el último ID recibido. Retorna cuando la
+// conexión se corta o se cancela parent.
+func readStream(parent context.Context, url, token string, lastID *string, onOpen func(), onMsg func(typ string, data []byte)) error {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if *lastID != "" {
+		req.Header.Set("Last-Event-ID", *lastID)
+	}
+	// Sin http.Client.Timeout: la respuesta no termina; el corte por inactividad lo hace idle
+	idle := time.AfterFunc(streamIdle, cancel)
+	defer idle.Stop()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	onOpen()
+
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	var id, typ string
+	var data []byte
+	for sc.Scan() {
+		idle.Reset(streamIdle)
+		line := sc.Text()
+		if line == "" {
+			if len(data) > 0 {
+				if typ == "" {
+					typ = "message"
+				}
+				onMsg(typ, data)
+				if id != "" {
+					*lastID = id
+				}
+			}
+			id, typ, data = "", "", nil
+			continue
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "id":
+			id = value
+		case "event":
+			typ = value
+		case "data":
+			if len(data) > 0 {
+				data = append(data, '\n')
+			}
+			data = append(data, value...)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"guard/internal/sse"
+)
+
+// streamServer simula /api/stream de un guard y cuenta las conexiones abiertas.
+func streamServer(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var open atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		open.Add(1)
+		defer open.Add(-1)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &open
+}
+
+// state retorna, con lock, si hay detención programada y si los followStream corren.
+func (f *followers) state() (lingering, running bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.linger != nil, f.cancel != nil
+}
+
+// waitOpen espera a que haya want conexiones abiertas.
+func waitOpen(t *testing.T, open *atomic.Int32, want int32) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for open.Load() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d conexiones abiertas, se esperaban %d", open.Load(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFollowersStartOnceAndStopOnShutdown(t *testing.T) {
+	srv, open := streamServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hub := sse.New(100)
+	defer hub.Close()
+	f := &followers{ctx: ctx, hub: hub, nodes: []NodeCfg{{ID: "n1", LoginURL: srv.URL, GameURL: srv.URL}}}
+
+	if open.Load() != 0 {
+		t.Fatal("conexiones a los guards antes del primer cliente")
+	}
+	f.acquire()
+	f.acquire()
+	waitOpen(t, open, 2) // una por servicio, no por cliente
+
+	// Con un cliente todavía conectado los followStream siguen
+	f.release()
+	time.Sleep(50 * time.Millisecond)
+	if lingering, _ := f.state(); lingering || open.Load() != 2 {
+		t.Fatal("los followStream se detienen con clientes conectados")
+	}
+
+	cancel()
+	waitOpen(t, open, 0)
+	f.release()
+	f.acquire()
+	time.Sleep(50 * time.Millisecond)
+	if open.Load() != 0 {
+		t.Fatal("los followStream se reiniciaron después del apagado")
+	}
+}
+
+func TestFollowersLingerAfterLastClient(t *testing.T) {
+	srv, open := streamServer(t)
+	hub := sse.New(100)
+	defer hub.Close()
+	f := &followers{ctx: context.Background(), hub: hub, nodes: []NodeCfg{{ID: "n1", LoginURL: srv.URL, GameURL: srv.URL}}}
+
+	f.acquire()
+	waitOpen(t, open, 2)
+	f.release()
+	if lingering, _ := f.state(); !lingering {
+		t.Fatal("el último cliente no programó la detención")
+	}
+	// Un cliente que vuelve dentro de followLinger reutiliza las conexiones
+	f.acquire()
+	if lingering, running := f.state(); lingering || !running {
+		t.Fatal("el cliente que volvió no canceló la detención")
+	}
+	f.release()
+
+	// Vencido followLinger se detienen (se dispara el timer sin esperar)
+	f.mu.Lock()
+	t0 := f.linger
+	f.mu.Unlock()
+	t0.Reset(0)
+	waitOpen(t, open, 0)
+	if _, running := f.state(); running {
+		t.Fatal("followers sigue marcado como corriendo")
+	}
+}
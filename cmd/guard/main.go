@@ -446,7 +446,7 @@ func runGuard(ctx context.Context, cfg Config) error {
 
 	var fw *firewall.Manager
 	if cfg.EnableFirewallAutoban {
-		fw = firewall.New(cfg.FirewallBlockSeconds)
+		fw = firewall.New(cfg.FirewallBlockSeconds, firewall.NewNetsh(firewall.ExecRunner, "guard"), nil)
 	}
 
 	// Crear un contexto cancelable desde el contexto recibido
@@ -553,7 +553,7 @@ func runGuard(ctx context.Context, cfg Config) error {
 
 	// Ejecutar proxy.Run y capturar cualquier error o terminación inesperada
 	log.Printf("[INFO] iniciando proxy.Run...")
-	err := proxy.Run(ctx, cfg.ListenAddr, cfg.BackendAddr, idleTimeout, 0, tryAccept, onAccept, onReject, onRelease, nil)
+	err := proxy.Run(ctx, cfg.ListenAddr, cfg.BackendAddr, idleTimeout, 0, tryAccept, onAccept, onReject, onRelease, nil, proxy.Options{})
 
 	// Loggear información de diagnóstico
 	log.Printf("[INFO] proxy.Run retornó, error: %v", err)
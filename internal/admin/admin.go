@@ -7,64 +7,68 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/netip"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"guard/internal/capture"
+	"guard/internal/common"
 	"guard/internal/firewall"
 	"guard/internal/limiter"
+	"guard/internal/proxy"
+	"guard/internal/sse"
 )
 
-// ─── Historial de métricas ────────────────────────────────────────────────────
+// ─── Tráfico por IP ───────────────────────────────────────────────────────────
 
-const maxSamples = 36 // 6 minutos a 10s por muestra
+// TrafficSource provee los contadores de tráfico del proxy (ver proxy.Live).
+type TrafficSource interface {
+	TotalTraffic() proxy.Traffic
+	TrafficByIP() []proxy.IPTraffic
+}
 
-// MetricSample es un punto de datos en el tiempo.
-type MetricSample struct {
-	T           int64   `json:"t"`            // Unix timestamp
-	ActiveConns int     `json:"active_conns"` // Conexiones activas
-	RejectRate  float64 `json:"reject_rate"`  // Rechazos por segundo
+// talkerRate es el tráfico por segundo de una IP en la última muestra.
+type talkerRate struct {
+	BytesIn  float64
+	BytesOut float64
 }
 
-type metricsHistory struct {
-	mu      sync.Mutex
-	samples []MetricSample
-	lastRej uint64
-	lastT   time.Time
+// talkers guarda el tráfico por IP de la muestra anterior para calcular tasas.
+type talkers struct {
+	mu    sync.Mutex
+	prev  map[string]proxy.Traffic
+	rates map[string]talkerRate
+	lastT time.Time
 }
 
-func (h *metricsHistory) record(active int, totalRej uint64) {
+// record calcula la tasa de cada IP desde la muestra anterior.
+func (t *talkers) record(cur []proxy.IPTraffic) {
 	now := time.Now()
-	h.mu.Lock()
-	defer h.mu.Unlock()
-
-	rate := 0.0
-	if !h.lastT.IsZero() {
-		elapsed := now.Sub(h.lastT).Seconds()
-		if elapsed > 0 {
-			diff := totalRej - h.lastRej
-			rate = float64(diff) / elapsed
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	elapsed := now.Sub(t.lastT).Seconds()
+	prev := make(map[string]proxy.Traffic, len(cur))
+	rates := make(map[string]talkerRate, len(cur))
+	for _, e := range cur {
+		prev[e.IP] = e.Traffic
+		if p, ok := t.prev[e.IP]; ok && elapsed > 0 {
+			rates[e.IP] = talkerRate{
+				BytesIn:  float64(e.BytesIn-p.BytesIn) / elapsed,
+				BytesOut: float64(e.BytesOut-p.BytesOut) / elapsed,
+			}
 		}
 	}
-	h.lastRej = totalRej
-	h.lastT = now
-
-	h.samples = append(h.samples, MetricSample{
-		T:           now.Unix(),
-		ActiveConns: active,
-		RejectRate:  rate,
-	})
-	if len(h.samples) > maxSamples {
-		h.samples = h.samples[len(h.samples)-maxSamples:]
-	}
+	t.prev, t.rates, t.lastT = prev, rates, now
 }
 
-func (h *metricsHistory) get() []MetricSample {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-	out := make([]MetricSample, len(h.samples))
-	copy(out, h.samples)
-	return out
+func (t *talkers) rate(ip string) talkerRate {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.rates[ip]
 }
 
 // ─── EventLog — ring buffer de eventos ────────────────────────────────────────
@@ -73,29 +77,46 @@ const maxEvents = 200
 
 // Event representa un evento del sistema.
 type Event struct {
+	ID     uint64 `json:"id"` // secuencia; continúa entre reinicios si hay archivo de auditoría
 	T      int64  `json:"t"`
-	Type   string `json:"type"`             // "ban","unblock","unblock_all","drain_on","drain_off","overload_start","overload_end"
+	Type   string `json:"type"` // "ban","unblock","unblock_all","drain_on","drain_off","overload_start","overload_end","fw_reconcile","cidr_add","cidr_remove","subnet_ban","config_reload","config_reload_failed","backend_down","backend_up","shutdown_start","shutdown_done","handoff","session_kill"
 	IP     string `json:"ip,omitempty"`
 	Detail string `json:"detail,omitempty"`
+	Caller string `json:"caller,omitempty"` // IP de quien lo pidió por la API admin
+	Auth   string `json:"auth,omitempty"`   // cómo se autenticó el caller: loopback, token o allow_ip
 }
 
 type eventLog struct {
 	mu     sync.Mutex
 	events []Event
+	onAdd  func(Event) // opcional: recibe cada evento nuevo (stream SSE)
+	seq    uint64
+	audit  *auditLog // opcional: archivo permanente de eventos
 }
 
-func (e *eventLog) add(typ, ip, detail string) {
-	e.mu.Lock()
-	defer e.mu.Unlock()
-	e.events = append(e.events, Event{
+func (e *eventLog) add(typ, ip, detail string, c caller) {
+	ev := Event{
 		T:      time.Now().Unix(),
 		Type:   typ,
 		IP:     ip,
 		Detail: detail,
-	})
+		Caller: c.IP,
+		Auth:   c.Auth,
+	}
+	e.mu.Lock()
+	e.seq++
+	ev.ID = e.seq
+	if e.audit != nil {
+		e.audit.append(ev)
+	}
+	e.events = append(e.events, ev)
 	if len(e.events) > maxEvents {
 		e.events = e.events[len(e.events)-maxEvents:]
 	}
+	e.mu.Unlock()
+	if e.onAdd != nil {
+		e.onAdd(ev)
+	}
 }
 
 func (e *eventLog) get() []Event {
@@ -110,21 +131,36 @@ func (e *eventLog) get() []Event {
 
 // Server expone una API HTTP de administración para un proceso guard.
 type Server struct {
-	lim          *limiter.Limiter
-	fw           *firewall.Manager
-	profile      string
-	drainFn      func() bool   // nil si no aplica
-	rejectFn     func() uint64 // retorna total de rechazos acumulados
-	maxConns     int
-	startTime    time.Time
-	history      *metricsHistory
-	evLog        *eventLog
-	drainSince   time.Time
-	drainSinceMu sync.Mutex
-	loadPctFn    func() float64 // opcional: retorna % de carga actual
-	allowedIPs   []string       // IPs adicionales permitidas (además de loopback)
-	authToken    string         // si no vacío, requiere Authorization: Bearer <token> para IPs no-loopback
-	relayMu      sync.Mutex
+	lim           *limiter.Limiter
+	fw            *firewall.Manager
+	profile       string
+	drainFn       func() bool   // nil si no aplica
+	rejectFn      func() uint64 // retorna total de rechazos acumulados
+	maxConns      int
+	startTime     time.Time
+	history       *metricsHistory
+	stream        *sse.Hub
+	lastStatus    map[string]json.RawMessage // último estado publicado en el stream (solo la goroutine de status)
+	historyFile   string                     // opcional: archivo donde se persiste el historial
+	evLog         *eventLog
+	drainSince    time.Time
+	drainSinceMu  sync.Mutex
+	shutdownSince time.Time              // inicio del apagado ordenado (protegido por drainSinceMu)
+	sessionsFn    func() int64           // opcional: sesiones proxyadas en curso
+	sessionTable  SessionTable           // opcional: detalle de sesiones para /api/sessions
+	traffic       TrafficSource          // opcional: contadores de tráfico del proxy
+	capture       *capture.Writer        // opcional: muestras de clientes rechazados o marcados
+	proxyStats    ProxyStats             // opcional: aceptadas y dials para /metrics
+	rejects       *common.RejectCounters // opcional: rechazos por motivo
+	overloadFn    func() bool            // opcional: sobrecarga detectada
+	talkers       *talkers
+	loadPctFn     func() float64               // opcional: retorna % de carga actual
+	backendsFn    func() []proxy.BackendStatus // opcional: estado de salud de los backends
+	aclMu         sync.RWMutex                 // protege allowedIPs, authToken y maxConns (recarga de config)
+	allowedIPs    []string                     // IPs adicionales permitidas (además de loopback)
+	authToken     string                       // si no vacío, requiere Authorization: Bearer <token> para IPs no-loopback
+	reloadFn      func() (string, error)       // opcional: recarga la config y retorna el resumen de cambios
+	relayMu       sync.Mutex
 	relayRegistry map[string]*relayInfo // relay_id → info
 }
 
@@ -142,6 +178,7 @@ type relayInfo struct {
 // New crea un Server de administración.
 func New(lim *limiter.Limiter, fw *firewall.Manager, profile string,
 	drainFn func() bool, rejectFn func() uint64, maxConns int) *Server {
+	stream := sse.New(streamBuffer)
 	return &Server{
 		lim:           lim,
 		fw:            fw,
@@ -150,8 +187,10 @@ func New(lim *limiter.Limiter, fw *firewall.Manager, profile string,
 		rejectFn:      rejectFn,
 		maxConns:      maxConns,
 		startTime:     time.Now(),
-		history:       &metricsHistory{},
-		evLog:         &eventLog{},
+		history:       newMetricsHistory(),
+		stream:        stream,
+		talkers:       &talkers{},
+		evLog:         &eventLog{onAdd: func(ev Event) { stream.Publish("event", ev) }},
 		relayRegistry: make(map[string]*relayInfo),
 	}
 }
@@ -159,9 +198,37 @@ func New(lim *limiter.Limiter, fw *firewall.Manager, profile string,
 // SetAccessControl configura IPs adicionales y token de autorización para la API admin.
 // Si allowedIPs está vacío, solo se permite loopback.
 // Si token está vacío, no se requiere autenticación para las IPs adicionales.
+// Puede llamarse en caliente (recarga de config).
 func (s *Server) SetAccessControl(allowedIPs []string, token string) {
+	s.aclMu.Lock()
 	s.allowedIPs = allowedIPs
 	s.authToken = token
+	s.aclMu.Unlock()
+}
+
+// acl retorna las IPs adicionales y el token vigentes.
+func (s *Server) acl() ([]string, string) {
+	s.aclMu.RLock()
+	defer s.aclMu.RUnlock()
+	return s.allowedIPs, s.authToken
+}
+
+// SetMaxConns actualiza el límite de conexiones informado en /api/status.
+func (s *Server) SetMaxConns(maxConns int) {
+	s.aclMu.Lock()
+	s.maxConns = maxConns
+	s.aclMu.Unlock()
+}
+
+// SetReloadFn establece la función que ejecuta POST /api/config/reload. Retorna un
+// resumen de lo que cambió o el error de validación.
+func (s *Server) SetReloadFn(fn func() (string, error)) {
+	s.reloadFn = fn
+}
+
+// SetBackendsFn establece la función que retorna el estado de los backends para /api/status.
+func (s *Server) SetBackendsFn(fn func() []proxy.BackendStatus) {
+	s.backendsFn = fn
 }
 
 // SetLoadPctFn establece una función que retorna el porcentaje de carga actual.
@@ -176,9 +243,70 @@ func (s *Server) SetDrainSince(t time.Time) {
 	s.drainSinceMu.Unlock()
 }
 
+// SetShutdownSince guarda cuándo empezó el apagado ordenado (listener cerrado,
+// esperando que terminen las sesiones).
+func (s *Server) SetShutdownSince(t time.Time) {
+	s.drainSinceMu.Lock()
+	s.shutdownSince = t
+	s.drainSinceMu.Unlock()
+}
+
+// SetSessionsFn establece la función que retorna las sesiones proxyadas en curso.
+func (s *Server) SetSessionsFn(fn func() int64) {
+	s.sessionsFn = fn
+}
+
+// SessionTable es el registro de sesiones proxyadas en curso (ver proxy.Live).
+type SessionTable interface {
+	ListSessions() []proxy.SessionInfo
+	KillSession(id uint64) (ip string, ok bool)
+	KillSessionsByIP(ip string) int
+}
+
+// SetSessionTable establece el registro que exponen /api/sessions y /api/sessions/kill.
+func (s *Server) SetSessionTable(t SessionTable) {
+	s.sessionTable = t
+}
+
+// SetTrafficSource establece de dónde salen los contadores de tráfico para
+// /api/metrics, /api/ips y /api/top-talkers.
+func (s *Server) SetTrafficSource(t TrafficSource) {
+	s.traffic = t
+}
+
+// SetCapture establece el Writer de capturas que exponen /api/captures*.
+func (s *Server) SetCapture(c *capture.Writer) {
+	s.capture = c
+}
+
+// SetRejectCounters establece el registro de rechazos por motivo que se muestra en
+// /api/status, /api/metrics y /metrics (se leen los del perfil de este Server).
+func (s *Server) SetRejectCounters(c *common.RejectCounters) {
+	s.rejects = c
+}
+
+// rejectsByReason retorna los rechazos acumulados por motivo, o nil si no hay registro.
+func (s *Server) rejectsByReason() map[string]uint64 {
+	if s.rejects == nil {
+		return nil
+	}
+	return s.rejects.Snapshot(s.profile)
+}
+
+// sample registra una muestra de métricas y de tráfico por IP.
+func (s *Server) sample() {
+	active, _ := s.lim.Stats()
+	var total proxy.Traffic
+	if s.traffic != nil {
+		total = s.traffic.TotalTraffic()
+		s.talkers.record(s.traffic.TrafficByIP())
+	}
+	s.stream.Publish("metrics", s.history.record(active, s.rejectFn(), s.rejectsByReason(), total))
+}
+
 // AddEvent registra un evento en el log de eventos.
 func (s *Server) AddEvent(typ, ip, detail string) {
-	s.evLog.add(typ, ip, detail)
+	s.evLog.add(typ, ip, detail, caller{})
 }
 
 // Start arranca el servidor HTTP y bloquea hasta que ctx se cancele.
@@ -186,6 +314,7 @@ func (s *Server) Start(ctx context.Context, listenAddr string) error {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/api/status",      s.handleStatus)
 	mux.HandleFunc("/api/ips",         s.handleIPs)
+	mux.HandleFunc("/api/subnets",     s.handleSubnets)
 	mux.HandleFunc("/api/blocked",     s.handleBlocked)
 	mux.HandleFunc("/api/unblock",     s.handleUnblock)
 	mux.HandleFunc("/api/block",       s.handleBlock)
@@ -194,8 +323,21 @@ func (s *Server) Start(ctx context.Context, listenAddr string) error {
 	mux.HandleFunc("/api/health",      s.handleHealth)
 	mux.HandleFunc("/api/unblock-all", s.handleUnblockAll)
 	mux.HandleFunc("/api/events",      s.handleEvents)
+	mux.HandleFunc("/api/stream",      s.handleStream)
+	mux.HandleFunc("/api/config/reload", s.handleConfigReload)
+	mux.HandleFunc("/api/sessions",    s.handleSessions)
+	mux.HandleFunc("/api/sessions/kill", s.handleSessionsKill)
+	mux.HandleFunc("/api/top-talkers", s.handleTopTalkers)
+	mux.HandleFunc("/api/captures",    s.handleCaptures)
+	mux.HandleFunc("/api/captures/download", s.handleCaptureDownload)
+	mux.HandleFunc("/api/captures/flag", s.handleCaptureFlag)
+	mux.HandleFunc("/api/captures/unflag", s.handleCaptureUnflag)
 	mux.HandleFunc("/api/relay/ping",  s.handleRelayPing)
 	mux.HandleFunc("/api/relay/list",  s.handleRelayList)
+	mux.HandleFunc("/api/cidr",        s.handleCIDRList)
+	mux.HandleFunc("/api/cidr/add",    s.handleCIDRAdd)
+	mux.HandleFunc("/api/cidr/remove", s.handleCIDRRemove)
+	mux.HandleFunc("/metrics",         s.handlePrometheus)
 
 	srv := &http.Server{
 		Addr:         listenAddr,
@@ -204,21 +346,22 @@ func (s *Server) Start(ctx context.Context, listenAddr string) error {
 		WriteTimeout: 5 * time.Second,
 	}
 
-	// Goroutine que registra métricas cada 10 segundos
+	// Goroutine que registra métricas cada 10 segundos y guarda el historial cada minuto
 	go func() {
 		// Primera muestra inmediata
-		active, _ := s.lim.Stats()
-		s.history.record(active, s.rejectFn())
+		s.sample()
 
 		tick := time.NewTicker(10 * time.Second)
 		defer tick.Stop()
-		for {
+		for n := 1; ; n++ {
 			select {
 			case <-ctx.Done():
 				return
 			case <-tick.C:
-				active, _ := s.lim.Stats()
-				s.history.record(active, s.rejectFn())
+				s.sample()
+				if n%6 == 0 {
+					s.saveHistory()
+				}
 			}
 		}
 	}()
@@ -237,15 +380,34 @@ func (s *Server) Start(ctx context.Context, listenAddr string) error {
 		}
 	}()
 
+	// Cambios de estado para /api/stream
+	go func() {
+		tick := time.NewTicker(streamStatusInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick.C:
+				s.publishStatusDelta()
+			}
+		}
+	}()
+
 	go func() {
 		<-ctx.Done()
+		// Cortar los streams SSE para que Shutdown no espere a que los clientes se vayan
+		s.stream.Close()
 		shutCtx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 		defer cancel()
 		_ = srv.Shutdown(shutCtx)
 	}()
 
 	log.Printf("[INFO] admin API [%s] escuchando en %s", s.profile, listenAddr)
-	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	err := srv.ListenAndServe()
+	// Guardar antes de retornar: en un traspaso el proceso nuevo lo carga al arrancar
+	s.saveHistory()
+	if err != nil && err != http.ErrServerClosed {
 		return fmt.Errorf("admin server [%s]: %w", s.profile, err)
 	}
 	return nil
@@ -253,11 +415,34 @@ func (s *Server) Start(ctx context.Context, listenAddr string) error {
 
 // ─── Handlers ─────────────────────────────────────────────────────────────────
 
+// statusResp es la respuesta de /api/status.
+type statusResp struct {
+	Profile       string                `json:"profile"`
+	ActiveConns   int                   `json:"active_conns"`
+	IPCount       int                   `json:"ip_count"`
+	TotalRejects  uint64                `json:"total_rejects"`
+	RejectsBy     map[string]uint64     `json:"rejects_by_reason,omitempty"`
+	DrainMode     bool                  `json:"drain_mode"`
+	DrainSince    int64                 `json:"drain_since"`
+	MaxConns      int                   `json:"max_conns"`
+	LoadPct       float64               `json:"load_pct"`
+	RelayCount    int                   `json:"relay_count"`
+	Backends      []proxy.BackendStatus `json:"backends,omitempty"`
+	Sessions      int64                 `json:"sessions"`
+	ShuttingDown  bool                  `json:"shutting_down"`
+	ShutdownSince int64                 `json:"shutdown_since,omitempty"`
+}
+
 func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	writeJSON(w, s.status())
+}
+
+// status arma el estado del servicio para /api/status y /api/stream.
+func (s *Server) status() statusResp {
 	active, ipCount := s.lim.Stats()
 	drain := false
 	if s.drainFn != nil {
@@ -266,46 +451,57 @@ func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
 
 	s.drainSinceMu.Lock()
 	drainSince := s.drainSince
+	shutdownSince := s.shutdownSince
 	s.drainSinceMu.Unlock()
 
 	drainSinceUnix := int64(0)
 	if !drainSince.IsZero() {
 		drainSinceUnix = drainSince.Unix()
 	}
+	shutdownSinceUnix := int64(0)
+	if !shutdownSince.IsZero() {
+		shutdownSinceUnix = shutdownSince.Unix()
+	}
+	sessions := int64(active)
+	if s.sessionsFn != nil {
+		sessions = s.sessionsFn()
+	}
 
+	s.aclMu.RLock()
+	maxConns := s.maxConns
+	s.aclMu.RUnlock()
 	loadPct := 0.0
 	if s.loadPctFn != nil {
 		loadPct = s.loadPctFn()
-	} else if s.maxConns > 0 {
-		loadPct = float64(active) * 100.0 / float64(s.maxConns)
+	} else if maxConns > 0 {
+		loadPct = float64(active) * 100.0 / float64(maxConns)
 	}
 
 	s.relayMu.Lock()
 	relayCount := len(s.relayRegistry)
 	s.relayMu.Unlock()
 
-	type Resp struct {
-		Profile      string  `json:"profile"`
-		ActiveConns  int     `json:"active_conns"`
-		IPCount      int     `json:"ip_count"`
-		TotalRejects uint64  `json:"total_rejects"`
-		DrainMode    bool    `json:"drain_mode"`
-		DrainSince   int64   `json:"drain_since"`
-		MaxConns     int     `json:"max_conns"`
-		LoadPct      float64 `json:"load_pct"`
-		RelayCount   int     `json:"relay_count"`
+	var backends []proxy.BackendStatus
+	if s.backendsFn != nil {
+		backends = s.backendsFn()
+	}
+
+	return statusResp{
+		Profile:       s.profile,
+		ActiveConns:   active,
+		IPCount:       ipCount,
+		TotalRejects:  s.rejectFn(),
+		RejectsBy:     s.rejectsByReason(),
+		DrainMode:     drain,
+		DrainSince:    drainSinceUnix,
+		MaxConns:      maxConns,
+		LoadPct:       loadPct,
+		RelayCount:    relayCount,
+		Backends:      backends,
+		Sessions:      sessions,
+		ShuttingDown:  shutdownSinceUnix != 0,
+		ShutdownSince: shutdownSinceUnix,
 	}
-	writeJSON(w, Resp{
-		Profile:      s.profile,
-		ActiveConns:  active,
-		IPCount:      ipCount,
-		TotalRejects: s.rejectFn(),
-		DrainMode:    drain,
-		DrainSince:   drainSinceUnix,
-		MaxConns:     s.maxConns,
-		LoadPct:      loadPct,
-		RelayCount:   relayCount,
-	})
 }
 
 func (s *Server) handleIPs(w http.ResponseWriter, r *http.Request) {
@@ -323,6 +519,11 @@ func (s *Server) handleIPs(w http.ResponseWriter, r *http.Request) {
 		TempBlocked bool   `json:"temp_blocked"`
 		BlockUntil  string `json:"block_until,omitempty"`
 		LastSeen    string `json:"last_seen"`
+		proxy.Traffic
+	}
+	var traffic []proxy.IPTraffic
+	if s.traffic != nil {
+		traffic = s.traffic.TrafficByIP()
 	}
 	result := make([]IPResp, 0, len(stats))
 	for _, st := range stats {
@@ -339,6 +540,121 @@ func (s *Server) handleIPs(w http.ResponseWriter, r *http.Request) {
 			TempBlocked: blocked,
 			BlockUntil:  blockUntil,
 			LastSeen:    st.LastSeen.Format(time.RFC3339),
+			Traffic:     trafficOf(traffic, st.IP),
+		})
+	}
+	writeJSON(w, result)
+}
+
+// trafficOf suma el tráfico de key, que puede ser una IP o un grupo IPv6 ("2001:db8::/64").
+func trafficOf(traffic []proxy.IPTraffic, key string) proxy.Traffic {
+	var t proxy.Traffic
+	p, err := netip.ParsePrefix(key)
+	for _, e := range traffic {
+		if e.IP == key {
+			return e.Traffic
+		}
+		if err != nil {
+			continue
+		}
+		if a, aerr := netip.ParseAddr(e.IP); aerr == nil && p.Contains(a) {
+			t.BytesIn += e.BytesIn
+			t.BytesOut += e.BytesOut
+			t.ReadsIn += e.ReadsIn
+			t.ReadsOut += e.ReadsOut
+		}
+	}
+	return t
+}
+
+// handleTopTalkers devuelve las IPs con más tráfico. ?by= elige el criterio: bytes
+// (default, ambos sentidos), bytes_in, bytes_out, reads o rate (bytes/s en la última
+// muestra de 10s); ?n= la cantidad (default 10).
+func (s *Server) handleTopTalkers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	n := 10
+	if v, err := strconv.Atoi(r.URL.Query().Get("n")); err == nil && v > 0 {
+		n = v
+	}
+	type TalkerResp struct {
+		IP           string  `json:"ip"`
+		Sessions     int     `json:"sessions"`
+		BytesInRate  float64 `json:"bytes_in_rate"`
+		BytesOutRate float64 `json:"bytes_out_rate"`
+		proxy.Traffic
+	}
+	var key func(t TalkerResp) float64
+	switch r.URL.Query().Get("by") {
+	case "", "bytes":
+		key = func(t TalkerResp) float64 { return float64(t.BytesIn + t.BytesOut) }
+	case "bytes_in":
+		key = func(t TalkerResp) float64 { return float64(t.BytesIn) }
+	case "bytes_out":
+		key = func(t TalkerResp) float64 { return float64(t.BytesOut) }
+	case "reads":
+		key = func(t TalkerResp) float64 { return float64(t.ReadsIn + t.ReadsOut) }
+	case "rate":
+		key = func(t TalkerResp) float64 { return t.BytesInRate + t.BytesOutRate }
+	default:
+		http.Error(w, "bad request: by debe ser bytes, bytes_in, bytes_out, reads o rate", http.StatusBadRequest)
+		return
+	}
+	result := []TalkerResp{}
+	if s.traffic != nil {
+		for _, e := range s.traffic.TrafficByIP() {
+			rate := s.talkers.rate(e.IP)
+			result = append(result, TalkerResp{
+				IP:           e.IP,
+				Sessions:     e.Sessions,
+				BytesInRate:  rate.BytesIn,
+				BytesOutRate: rate.BytesOut,
+				Traffic:      e.Traffic,
+			})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return key(result[i]) > key(result[j]) })
+	if len(result) > n {
+		result = result[:n]
+	}
+	writeJSON(w, result)
+}
+
+// handleSubnets devuelve el estado de las subredes rastreadas (vacío si el nivel
+// por subred no está habilitado).
+func (s *Server) handleSubnets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	stats := s.lim.GetSubnetStats()
+	now := time.Now()
+	type SubnetResp struct {
+		Prefix     string `json:"prefix"`
+		LiveCount  int    `json:"live_count"`
+		BlockedIPs int    `json:"blocked_ips"`
+		BlockCount int    `json:"block_count"`
+		Blocked    bool   `json:"blocked"`
+		BlockUntil string `json:"block_until,omitempty"`
+		LastSeen   string `json:"last_seen"`
+	}
+	result := make([]SubnetResp, 0, len(stats))
+	for _, st := range stats {
+		blocked := !st.BlockUntil.IsZero() && now.Before(st.BlockUntil)
+		blockUntil := ""
+		if blocked {
+			blockUntil = st.BlockUntil.Format(time.RFC3339)
+		}
+		result = append(result, SubnetResp{
+			Prefix:     st.Prefix,
+			LiveCount:  st.LiveCount,
+			BlockedIPs: st.BlockedIPs,
+			BlockCount: st.BlockCount,
+			Blocked:    blocked,
+			BlockUntil: blockUntil,
+			LastSeen:   st.LastSeen.Format(time.RFC3339),
 		})
 	}
 	writeJSON(w, result)
@@ -391,7 +707,7 @@ func (s *Server) handleUnblock(w http.ResponseWriter, r *http.Request) {
 		_ = s.fw.UnblockIP(req.IP)
 	}
 	log.Printf("[INFO] admin: unblock IP=%s profile=%s", req.IP, s.profile)
-	s.evLog.add("unblock", req.IP, "")
+	s.addEvent(r, "unblock", req.IP, "")
 	writeJSON(w, map[string]string{"status": "ok", "ip": req.IP})
 }
 
@@ -416,7 +732,7 @@ func (s *Server) handleBlock(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	log.Printf("[INFO] admin: block IP=%s profile=%s", req.IP, s.profile)
-	s.evLog.add("ban", req.IP, "manual")
+	s.addEvent(r, "ban", req.IP, "manual")
 	writeJSON(w, map[string]string{"status": "ok", "ip": req.IP})
 }
 
@@ -444,13 +760,46 @@ func (s *Server) handleSysinfo(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// handleMetrics devuelve el historial de muestras de métricas.
+// handleMetrics devuelve el historial de muestras de métricas. Query opcional:
+// from y to (Unix; por defecto los últimos 6 minutos) y step (segundos).
 func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	writeJSON(w, s.history.get())
+	q := r.URL.Query()
+	to := time.Now().Unix()
+	if v := q.Get("to"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "to inválido (Unix en segundos)", http.StatusBadRequest)
+			return
+		}
+		to = n
+	}
+	from := to - int64(defaultMetricsWindow/time.Second)
+	if v := q.Get("from"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "from inválido (Unix en segundos)", http.StatusBadRequest)
+			return
+		}
+		from = n
+	}
+	var step time.Duration
+	if v := q.Get("step"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "step inválido (segundos)", http.StatusBadRequest)
+			return
+		}
+		step = time.Duration(n) * time.Second
+	}
+	if from > to {
+		http.Error(w, "from posterior a to", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, s.history.query(from, to, step))
 }
 
 // handleHealth retorna estado de salud básico del servidor.
@@ -473,17 +822,315 @@ func (s *Server) handleUnblockAll(w http.ResponseWriter, r *http.Request) {
 	}
 	count := s.lim.UnblockAll()
 	log.Printf("[INFO] admin: unblock-all liberados=%d profile=%s", count, s.profile)
-	s.evLog.add("unblock_all", "", fmt.Sprintf("cleared=%d", count))
+	s.addEvent(r, "unblock_all", "", fmt.Sprintf("cleared=%d", count))
 	writeJSON(w, map[string]interface{}{"cleared": count})
 }
 
-// handleEvents retorna el log de eventos recientes.
+// handleEvents retorna el log de eventos recientes. Con filtros (type, ip, since,
+// until, before, limit) busca en el archivo de auditoría, del más nuevo al más
+// viejo; la página siguiente se pide con before = id del último evento recibido.
 func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	writeJSON(w, s.evLog.get())
+	q := r.URL.Query()
+	if len(q) == 0 {
+		writeJSON(w, s.evLog.get())
+		return
+	}
+	eq := eventQuery{IP: q.Get("ip"), Limit: defaultEventsLimit}
+	if v := q.Get("type"); v != "" {
+		eq.Types = strings.Split(v, ",")
+	}
+	if v := q.Get("since"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			http.Error(w, "since inválido (Unix en segundos)", http.StatusBadRequest)
+			return
+		}
+		eq.Since = n
+	}
+	if v := q.Get("until"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			http.Error(w, "until inválido (Unix en segundos)", http.StatusBadRequest)
+			return
+		}
+		eq.Until = n
+	}
+	if v := q.Get("before"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "before inválido (id de evento)", http.StatusBadRequest)
+			return
+		}
+		eq.Before = n
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit inválido", http.StatusBadRequest)
+			return
+		}
+		eq.Limit = min(n, maxEventsLimit)
+	}
+	events, err := s.queryEvents(eq)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, events)
+}
+
+// handleConfigReload relee el archivo de configuración y aplica los cambios en caliente.
+func (s *Server) handleConfigReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.reloadFn == nil {
+		http.Error(w, "recarga de config no disponible", http.StatusServiceUnavailable)
+		return
+	}
+	summary, err := s.reloadFn()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, map[string]string{"status": "ok", "changes": summary})
+}
+
+// handleSessions devuelve las sesiones proxyadas en curso; ?ip= filtra por cliente.
+func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	result := []proxy.SessionInfo{}
+	if s.sessionTable != nil {
+		ip := r.URL.Query().Get("ip")
+		for _, sess := range s.sessionTable.ListSessions() {
+			if ip == "" || sess.IP == ip {
+				result = append(result, sess)
+			}
+		}
+	}
+	writeJSON(w, result)
+}
+
+// handleSessionsKill corta una sesión por id o todas las de una IP (o rango).
+func (s *Server) handleSessionsKill(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.sessionTable == nil {
+		http.Error(w, "registro de sesiones no disponible", http.StatusServiceUnavailable)
+		return
+	}
+	var req struct {
+		ID uint64 `json:"id"`
+		IP string `json:"ip"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.ID == 0 && req.IP == "") {
+		http.Error(w, "bad request: se requiere campo id o ip", http.StatusBadRequest)
+		return
+	}
+	if req.ID != 0 {
+		ip, ok := s.sessionTable.KillSession(req.ID)
+		if !ok {
+			http.Error(w, "sesión no encontrada", http.StatusNotFound)
+			return
+		}
+		log.Printf("[INFO] admin: sesión %d cortada IP=%s profile=%s", req.ID, ip, s.profile)
+		s.addEvent(r, "session_kill", ip, fmt.Sprintf("id=%d", req.ID))
+		writeJSON(w, map[string]interface{}{"status": "ok", "killed": 1})
+		return
+	}
+	n := s.sessionTable.KillSessionsByIP(req.IP)
+	log.Printf("[INFO] admin: %d sesiones cortadas IP=%s profile=%s", n, req.IP, s.profile)
+	if n > 0 {
+		s.addEvent(r, "session_kill", req.IP, fmt.Sprintf("sessions=%d", n))
+	}
+	writeJSON(w, map[string]interface{}{"status": "ok", "killed": n})
+}
+
+// handleCaptures devuelve los archivos de capturas y las IPs marcadas.
+func (s *Server) handleCaptures(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.capture == nil {
+		http.Error(w, "captura no habilitada", http.StatusServiceUnavailable)
+		return
+	}
+	files, err := s.capture.Files()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if files == nil {
+		files = []capture.FileInfo{}
+	}
+	writeJSON(w, map[string]interface{}{"files": files, "flags": s.capture.Flags()})
+}
+
+// handleCaptureDownload descarga un archivo de capturas (?name=).
+func (s *Server) handleCaptureDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.capture == nil {
+		http.Error(w, "captura no habilitada", http.StatusServiceUnavailable)
+		return
+	}
+	name := r.URL.Query().Get("name")
+	f, err := s.capture.Open(name)
+	if err != nil {
+		http.Error(w, "archivo no encontrado", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	http.ServeContent(w, r, name, fi.ModTime(), f)
+}
+
+// handleCaptureFlag marca una IP o rango para capturar sus sesiones y rechazos
+// durante minutes minutos (default 60).
+func (s *Server) handleCaptureFlag(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.capture == nil {
+		http.Error(w, "captura no habilitada", http.StatusServiceUnavailable)
+		return
+	}
+	var req struct {
+		IP      string `json:"ip"`
+		Minutes int    `json:"minutes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.IP == "" {
+		http.Error(w, "bad request: se requiere campo ip", http.StatusBadRequest)
+		return
+	}
+	if req.Minutes <= 0 {
+		req.Minutes = 60
+	}
+	if err := s.capture.Flag(req.IP, time.Duration(req.Minutes)*time.Minute); err != nil {
+		http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("[INFO] admin: captura habilitada IP=%s minutos=%d profile=%s", req.IP, req.Minutes, s.profile)
+	s.addEvent(r, "capture_flag", req.IP, fmt.Sprintf("minutes=%d", req.Minutes))
+	writeJSON(w, map[string]string{"status": "ok", "ip": req.IP})
+}
+
+// handleCaptureUnflag quita la marca de captura de una IP o rango.
+func (s *Server) handleCaptureUnflag(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.capture == nil {
+		http.Error(w, "captura no habilitada", http.StatusServiceUnavailable)
+		return
+	}
+	var req struct {
+		IP string `json:"ip"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.IP == "" {
+		http.Error(w, "bad request: se requiere campo ip", http.StatusBadRequest)
+		return
+	}
+	if !s.capture.Unflag(req.IP) {
+		http.Error(w, "IP no marcada", http.StatusNotFound)
+		return
+	}
+	log.Printf("[INFO] admin: captura deshabilitada IP=%s profile=%s", req.IP, s.profile)
+	s.addEvent(r, "capture_unflag", req.IP, "")
+	writeJSON(w, map[string]string{"status": "ok", "ip": req.IP})
+}
+
+// handleCIDRList devuelve el allowlist y denylist vigentes.
+func (s *Server) handleCIDRList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, map[string][]string{
+		"allow": s.lim.Allowlist().List(),
+		"deny":  s.lim.Denylist().List(),
+	})
+}
+
+// decodeCIDRReq lee {"list":"allow|deny","cidr":"..."} y retorna la lista destino.
+func (s *Server) decodeCIDRReq(w http.ResponseWriter, r *http.Request) (*limiter.CIDRList, string, string, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, "", "", false
+	}
+	var req struct {
+		List string `json:"list"`
+		CIDR string `json:"cidr"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.CIDR == "" {
+		http.Error(w, "bad request: se requieren campos list y cidr", http.StatusBadRequest)
+		return nil, "", "", false
+	}
+	switch req.List {
+	case "allow":
+		return s.lim.Allowlist(), req.List, req.CIDR, true
+	case "deny":
+		return s.lim.Denylist(), req.List, req.CIDR, true
+	}
+	http.Error(w, "bad request: list debe ser allow o deny", http.StatusBadRequest)
+	return nil, "", "", false
+}
+
+// handleCIDRAdd agrega una IP o rango al allowlist o denylist en caliente.
+func (s *Server) handleCIDRAdd(w http.ResponseWriter, r *http.Request) {
+	list, name, cidr, ok := s.decodeCIDRReq(w, r)
+	if !ok {
+		return
+	}
+	added, err := list.Add(cidr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if added {
+		log.Printf("[INFO] admin: cidr add list=%s cidr=%s profile=%s", name, cidr, s.profile)
+		s.addEvent(r, "cidr_add", cidr, name)
+	}
+	writeJSON(w, map[string]interface{}{"status": "ok", "list": name, "cidr": cidr, "added": added})
+}
+
+// handleCIDRRemove quita una IP o rango del allowlist o denylist en caliente.
+func (s *Server) handleCIDRRemove(w http.ResponseWriter, r *http.Request) {
+	list, name, cidr, ok := s.decodeCIDRReq(w, r)
+	if !ok {
+		return
+	}
+	removed, err := list.Remove(cidr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if removed {
+		log.Printf("[INFO] admin: cidr remove list=%s cidr=%s profile=%s", name, cidr, s.profile)
+		s.addEvent(r, "cidr_remove", cidr, name)
+	}
+	writeJSON(w, map[string]interface{}{"status": "ok", "list": name, "cidr": cidr, "removed": removed})
 }
 
 // handleRelayPing registra un heartbeat de un cliente relay.
@@ -493,7 +1140,7 @@ func (s *Server) handleRelayPing(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	if s.authToken == "" || r.Header.Get("Authorization") != "Bearer "+s.authToken {
+	if _, token := s.acl(); token == "" || r.Header.Get("Authorization") != "Bearer "+token {
 		w.Header().Set("WWW-Authenticate", `Bearer realm="guard-admin"`)
 		http.Error(w, "unauthorized", http.StatusUnauthorized)
 		return
@@ -615,14 +1262,16 @@ func (s *Server) accessControl(next http.Handler) http.Handler {
 
 		// Loopback siempre permitido, sin token.
 		if ip.IsLoopback() {
-			next.ServeHTTP(w, r)
+			next.ServeHTTP(w, withCaller(r, host, "loopback"))
 			return
 		}
 
+		allowedIPs, token := s.acl()
+
 		// Si hay token configurado, token correcto = acceso desde cualquier IP.
-		if s.authToken != "" {
-			if r.Header.Get("Authorization") == "Bearer "+s.authToken {
-				next.ServeHTTP(w, r)
+		if token != "" {
+			if r.Header.Get("Authorization") == "Bearer "+token {
+				next.ServeHTTP(w, withCaller(r, host, "token"))
 				return
 			}
 			// Token incorrecto o ausente.
@@ -633,9 +1282,9 @@ func (s *Server) accessControl(next http.Handler) http.Handler {
 
 		// Sin token configurado: caer a IP allowlist.
 		// Usamos ip.Equal(net.ParseIP(aip)) para manejar IPv4-mapped IPv6.
-		for _, aip := range s.allowedIPs {
+		for _, aip := range allowedIPs {
 			if ip.Equal(net.ParseIP(aip)) {
-				next.ServeHTTP(w, r)
+				next.ServeHTTP(w, withCaller(r, host, "allow_ip"))
 				return
 			}
 		}
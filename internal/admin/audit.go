@@ -0,0 +1,376 @@
+package admin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ─── Auditoría — registro permanente de eventos ───────────────────────────────
+
+const (
+	defaultAuditFileSize = 10 << 20 // tamaño a partir del cual se rota
+	defaultAuditKeep     = 10       // archivos que se conservan, incluido el actual
+	defaultEventsLimit   = 100      // eventos por página de /api/events con filtros
+	maxEventsLimit       = 1000
+	auditQueueSize       = 1024            // eventos en espera de escribirse
+	auditRotateRetryMin  = time.Second     // espera tras el primer rotate fallido; se
+	auditRotateRetryMax  = 5 * time.Minute // duplica en cada fallo hasta este tope
+)
+
+// caller identifica a quien llamó a la API admin: su IP y cómo se autenticó
+// ("loopback", "token" o "allow_ip").
+type caller struct {
+	IP   string
+	Auth string
+}
+
+type callerKey struct{}
+
+// withCaller agrega el caller a la request (lo hace accessControl).
+func withCaller(r *http.Request, ip, auth string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), callerKey{}, caller{IP: ip, Auth: auth}))
+}
+
+// callerOf retorna el caller de la request, o uno vacío si no pasó por accessControl.
+func callerOf(r *http.Request) caller {
+	c, _ := r.Context().Value(callerKey{}).(caller)
+	return c
+}
+
+// addEvent registra un evento provocado por una request a la API admin, con el
+// caller que la hizo.
+func (s *Server) addEvent(r *http.Request, typ, ip, detail string) {
+	s.evLog.add(typ, ip, detail, callerOf(r))
+}
+
+// auditLog es el archivo JSONL de eventos de un perfil: solo se agregan líneas y
+// rota por tamaño a path-AAAAMMDD-HHMMSS.uuuuuu.jsonl (el orden de los nombres es
+// el de rotación). Los eventos se encolan y los escribe una única goroutine, así
+// registrar un evento no espera al disco.
+type auditLog struct {
+	path    string
+	maxSize int64
+	keep    int
+
+	// Solo los usa la goroutine de run
+	f       *os.File
+	w       *bufio.Writer
+	size    int64
+	retry   time.Duration // espera entre intentos de rotar tras un fallo (0 = sin fallos)
+	retryAt time.Time     // no se intenta rotar antes de este momento
+
+	mu     sync.RWMutex // protege closed frente a los envíos a queue
+	closed bool
+	queue  chan auditReq
+	done   chan struct{} // se cierra al terminar run
+}
+
+// auditReq es un evento a escribir o, si synced no es nil, un pedido de aviso
+// para cuando todo lo encolado antes ya esté en el archivo.
+type auditReq struct {
+	ev     Event
+	synced chan struct{}
+}
+
+// renameFile es os.Rename; los tests la reemplazan para simular fallos.
+var renameFile = os.Rename
+
+// openAuditLog abre (o crea) el archivo de auditoría y retorna el ID del último
+// evento registrado, para continuar la secuencia.
+func openAuditLog(path string, maxSize int64, keep int) (*auditLog, uint64, error) {
+	if maxSize <= 0 {
+		maxSize = defaultAuditFileSize
+	}
+	if keep <= 0 {
+		keep = defaultAuditKeep
+	}
+	a := &auditLog{path: path, maxSize: maxSize, keep: keep}
+	var lastID uint64
+	files := append(a.rotated(), path)
+	for i := len(files) - 1; i >= 0 && lastID == 0; i-- {
+		_ = readAuditFile(files[i], func(ev Event) bool {
+			lastID = max(lastID, ev.ID)
+			return true
+		})
+	}
+	if err := a.open(); err != nil {
+		return nil, 0, err
+	}
+	a.queue = make(chan auditReq, auditQueueSize)
+	a.done = make(chan struct{})
+	go a.run()
+	return a, lastID, nil
+}
+
+func (a *auditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.f, a.size = f, fi.Size()
+	if a.w == nil {
+		a.w = bufio.NewWriter(f)
+	} else {
+		a.w.Reset(f)
+	}
+	return nil
+}
+
+// rotated retorna los archivos rotados, del más viejo al más nuevo.
+func (a *auditLog) rotated() []string {
+	ext := filepath.Ext(a.path)
+	files, _ := filepath.Glob(strings.TrimSuffix(a.path, ext) + "-*" + ext)
+	sort.Strings(files)
+	return files
+}
+
+// append encola ev para escribirlo. Se llama con el lock de eventLog tomado, así
+// las líneas quedan en el orden de los IDs; solo se bloquea si la cola está llena.
+func (a *auditLog) append(ev Event) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if !a.closed {
+		a.queue <- auditReq{ev: ev}
+	}
+}
+
+// sync espera a que los eventos encolados hasta ahora estén en el archivo.
+func (a *auditLog) sync() {
+	synced := make(chan struct{})
+	a.mu.RLock()
+	if a.closed {
+		a.mu.RUnlock()
+		return
+	}
+	a.queue <- auditReq{synced: synced}
+	a.mu.RUnlock()
+	<-synced
+}
+
+// close escribe los eventos pendientes y cierra el archivo. Los append posteriores
+// se descartan.
+func (a *auditLog) close() {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return
+	}
+	a.closed = true
+	close(a.queue)
+	a.mu.Unlock()
+	<-a.done
+}
+
+// run escribe lo que llega a queue hasta que se cierre. El buffer se vacía cada
+// vez que la cola queda vacía, así un evento llega al archivo apenas no tiene
+// otros detrás.
+func (a *auditLog) run() {
+	defer close(a.done)
+	for req := range a.queue {
+		if req.synced != nil {
+			a.flush()
+			close(req.synced)
+			continue
+		}
+		a.write(req.ev)
+		if len(a.queue) == 0 {
+			a.flush()
+		}
+	}
+	a.flush()
+	if a.f != nil {
+		a.f.Close()
+	}
+}
+
+// write agrega ev al buffer, rotando antes si el archivo superaría maxSize. Si
+// rotar falla se sigue escribiendo en el archivo actual y no se reintenta hasta
+// que pase retry, que se duplica en cada fallo.
+func (a *auditLog) write(ev Event) {
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	if a.f != nil && a.size > 0 && a.size+int64(len(line)) > a.maxSize && !time.Now().Before(a.retryAt) {
+		if err := a.rotate(); err != nil {
+			a.retry = min(max(2*a.retry, auditRotateRetryMin), auditRotateRetryMax)
+			a.retryAt = time.Now().Add(a.retry)
+			log.Printf("[WARN] auditoría: rotando %s: %v (se reintenta en %v)", a.path, err, a.retry)
+		} else {
+			a.retry, a.retryAt = 0, time.Time{}
+		}
+	}
+	if a.f == nil {
+		if err := a.open(); err != nil {
+			log.Printf("[WARN] auditoría: %v", err)
+			return
+		}
+	}
+	n, _ := a.w.Write(line)
+	a.size += int64(n)
+}
+
+// flush vuelca el buffer al archivo. Si falla, el archivo se reabre en la próxima
+// escritura (lo que quedaba en el buffer se pierde).
+func (a *auditLog) flush() {
+	if a.f == nil {
+		return
+	}
+	if err := a.w.Flush(); err != nil {
+		log.Printf("[WARN] auditoría: escribiendo %s: %v", a.path, err)
+		a.f.Close()
+		a.f = nil
+	}
+}
+
+// rotate renombra el archivo actual, abre uno nuevo y borra los rotados que
+// excedan keep.
+func (a *auditLog) rotate() error {
+	a.flush()
+	if a.f != nil {
+		a.f.Close()
+		a.f = nil
+	}
+	ext := filepath.Ext(a.path)
+	name := strings.TrimSuffix(a.path, ext) + "-" + time.Now().Format("20060102-150405.000000") + ext
+	if err := renameFile(a.path, name); err != nil {
+		return err
+	}
+	files := a.rotated()
+	for i := 0; i < len(files)-(a.keep-1); i++ {
+		_ = os.Remove(files[i])
+	}
+	return a.open()
+}
+
+// eventQuery son los filtros de /api/events. Los valores cero no filtran.
+type eventQuery struct {
+	Types  []string
+	IP     string // IP del evento o del caller
+	Since  int64  // Unix, inclusive
+	Until  int64  // Unix, inclusive
+	Before uint64 // solo eventos con ID menor (paginación)
+	Limit  int
+}
+
+func (q eventQuery) match(ev Event) bool {
+	return (len(q.Types) == 0 || slices.Contains(q.Types, ev.Type)) &&
+		(q.IP == "" || ev.IP == q.IP || ev.Caller == q.IP) &&
+		(q.Since == 0 || ev.T >= q.Since) &&
+		(q.Until == 0 || ev.T <= q.Until) &&
+		(q.Before == 0 || ev.ID < q.Before)
+}
+
+// query retorna los eventos que cumplen q, del más nuevo al más viejo. Recorre
+// los archivos desde el actual hacia atrás y saltea los modificados antes de Since.
+func (a *auditLog) query(q eventQuery) ([]Event, error) {
+	a.sync()
+	files := append(a.rotated(), a.path)
+	out := []Event{}
+	for i := len(files) - 1; i >= 0 && len(out) < q.Limit; i-- {
+		if q.Since > 0 {
+			if fi, err := os.Stat(files[i]); err == nil && fi.ModTime().Unix() < q.Since {
+				break
+			}
+		}
+		var matched []Event
+		err := readAuditFile(files[i], func(ev Event) bool {
+			if q.match(ev) {
+				matched = append(matched, ev)
+			}
+			return true
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for j := len(matched) - 1; j >= 0 && len(out) < q.Limit; j-- {
+			out = append(out, matched[j])
+		}
+	}
+	return out, nil
+}
+
+// readAuditFile llama a fn con cada evento de path hasta que retorne false. Las
+// líneas inválidas (p.ej. una escritura cortada) se ignoran.
+func readAuditFile(path string, fn func(Event) bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	for sc.Scan() {
+		var ev Event
+		if json.Unmarshal(sc.Bytes(), &ev) != nil {
+			continue
+		}
+		if !fn(ev) {
+			break
+		}
+	}
+	return sc.Err()
+}
+
+// SetAuditFile abre el archivo de auditoría: desde ahí cada evento se agrega a
+// path, que rota al superar maxSize y conserva keep archivos (0 = defaults de
+// 10 MB y 10 archivos). Debe llamarse antes de registrar eventos.
+func (s *Server) SetAuditFile(path string, maxSize int64, keep int) error {
+	a, lastID, err := openAuditLog(path, maxSize, keep)
+	if err != nil {
+		return fmt.Errorf("auditoría: %w", err)
+	}
+	s.evLog.mu.Lock()
+	s.evLog.audit = a
+	s.evLog.seq = max(s.evLog.seq, lastID)
+	s.evLog.mu.Unlock()
+	return nil
+}
+
+// CloseAudit escribe los eventos pendientes y cierra el archivo de auditoría; los
+// eventos posteriores quedan solo en memoria. Se llama al terminar el proceso o
+// al traspasar el perfil a otro proceso.
+func (s *Server) CloseAudit() {
+	s.evLog.mu.Lock()
+	a := s.evLog.audit
+	s.evLog.audit = nil
+	s.evLog.mu.Unlock()
+	if a != nil {
+		a.close()
+	}
+}
+
+// queryEvents busca en el archivo de auditoría o, si no hay, en el ring buffer.
+func (s *Server) queryEvents(q eventQuery) ([]Event, error) {
+	s.evLog.mu.Lock()
+	a := s.evLog.audit
+	s.evLog.mu.Unlock()
+	if a != nil {
+		return a.query(q)
+	}
+	events := s.evLog.get()
+	out := []Event{}
+	for i := len(events) - 1; i >= 0 && len(out) < q.Limit; i-- {
+		if q.match(events[i]) {
+			out = append(out, events[i])
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,198 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"guard/internal/limiter"
+)
+
+// auditEvents lee los eventos de todos los archivos de a, del más viejo al más nuevo.
+func auditEvents(t *testing.T, a *auditLog) []Event {
+	t.Helper()
+	var out []Event
+	for _, f := range append(a.rotated(), a.path) {
+		err := readAuditFile(f, func(ev Event) bool {
+			out = append(out, ev)
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return out
+}
+
+func TestAuditRotationKeep(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit-login.jsonl")
+	a, lastID, err := openAuditLog(path, 400, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastID != 0 {
+		t.Fatalf("archivo nuevo con último ID %d", lastID)
+	}
+	for i := uint64(1); i <= 60; i++ {
+		a.append(Event{ID: i, T: time.Now().Unix(), Type: "ban", IP: "203.0.113.7", Detail: "rate"})
+	}
+	a.close()
+
+	files := a.rotated()
+	if len(files) != 2 {
+		t.Fatalf("%d archivos rotados, se esperaban 2 (keep=3 con el actual)", len(files))
+	}
+	for _, f := range append(files, path) {
+		fi, err := os.Stat(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() > 400 {
+			t.Fatalf("%s mide %d bytes, más que audit_file_mb", filepath.Base(f), fi.Size())
+		}
+	}
+	// Los archivos que quedan tienen los eventos más nuevos, en orden y sin huecos
+	events := auditEvents(t, a)
+	if len(events) == 0 || events[len(events)-1].ID != 60 {
+		t.Fatalf("no quedó el último evento: %v", events)
+	}
+	for i := 1; i < len(events); i++ {
+		if events[i].ID != events[i-1].ID+1 {
+			t.Fatalf("ID %d después de %d", events[i].ID, events[i-1].ID)
+		}
+	}
+
+	// Al reabrir la secuencia continúa
+	a, lastID, err = openAuditLog(path, 400, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.close()
+	if lastID != 60 {
+		t.Fatalf("último ID %d al reabrir, se esperaba 60", lastID)
+	}
+}
+
+func TestAuditRotateBackoff(t *testing.T) {
+	var renames int
+	renameFile = func(string, string) error {
+		renames++
+		return errors.New("archivo en uso")
+	}
+	t.Cleanup(func() { renameFile = os.Rename })
+
+	path := filepath.Join(t.TempDir(), "audit-login.jsonl")
+	a, _, err := openAuditLog(path, 200, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(1); i <= 30; i++ {
+		a.append(Event{ID: i, T: time.Now().Unix(), Type: "ban", IP: "203.0.113.7"})
+	}
+	a.close()
+
+	if renames != 1 {
+		t.Fatalf("%d intentos de rotar, se esperaba 1 hasta que pase la espera", renames)
+	}
+	if a.retry != auditRotateRetryMin {
+		t.Fatalf("espera de reintento %v, se esperaba %v", a.retry, auditRotateRetryMin)
+	}
+	// Sin poder rotar no se pierde nada: todo sigue en el archivo actual
+	if events := auditEvents(t, a); len(events) != 30 {
+		t.Fatalf("%d eventos en el archivo, se esperaban 30", len(events))
+	}
+}
+
+// getEvents llama a /api/events con query y decodifica la respuesta.
+func getEvents(t *testing.T, s *Server, query string) []Event {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.handleEvents(rec, httptest.NewRequest(http.MethodGet, "/api/events"+query, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("%s: status %d: %s", query, rec.Code, rec.Body)
+	}
+	var events []Event
+	if err := json.Unmarshal(rec.Body.Bytes(), &events); err != nil {
+		t.Fatal(err)
+	}
+	return events
+}
+
+func TestEventsFilterAndPagination(t *testing.T) {
+	lim := limiter.New(10, 100, 100, 3, 60, 1000, 300, 60)
+	defer lim.Stop()
+	s := New(lim, nil, "login", nil, nil, 1000)
+	defer s.stream.Close()
+	if err := s.SetAuditFile(filepath.Join(t.TempDir(), "audit-login.jsonl"), 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer s.CloseAudit()
+
+	// 30 eventos: bans y desbloqueos alternados; los desbloqueos los pide un caller
+	for i := 1; i <= 30; i++ {
+		ip := fmt.Sprintf("203.0.113.%d", i%3)
+		if i%2 == 1 {
+			s.AddEvent("ban", ip, "rate")
+		} else {
+			s.evLog.add("unblock", ip, "", caller{IP: "10.0.0.5", Auth: "token"})
+		}
+	}
+
+	// Paginación de los bans con before = id del último recibido
+	var bans []Event
+	query := "?type=ban&limit=4"
+	for page := 0; ; page++ {
+		events := getEvents(t, s, query)
+		if len(events) == 0 {
+			break
+		}
+		if page > 5 || len(events) > 4 {
+			t.Fatalf("página %d con %d eventos", page, len(events))
+		}
+		for _, ev := range events {
+			if ev.Type != "ban" {
+				t.Fatalf("evento %q con type=ban", ev.Type)
+			}
+			if len(bans) > 0 && ev.ID >= bans[len(bans)-1].ID {
+				t.Fatalf("ID %d después de %d: no van del más nuevo al más viejo", ev.ID, bans[len(bans)-1].ID)
+			}
+			bans = append(bans, ev)
+		}
+		query = fmt.Sprintf("?type=ban&limit=4&before=%d", events[len(events)-1].ID)
+	}
+	if len(bans) != 15 || bans[0].ID != 29 || bans[14].ID != 1 {
+		t.Fatalf("%d bans (del %d al %d), se esperaban 15 del 29 al 1", len(bans), bans[0].ID, bans[len(bans)-1].ID)
+	}
+
+	// ip filtra por la IP del evento o la del caller
+	if got := getEvents(t, s, "?ip=203.0.113.1&type=ban"); len(got) != 5 {
+		t.Fatalf("%d bans de 203.0.113.1, se esperaban 5", len(got))
+	}
+	if got := getEvents(t, s, "?ip=10.0.0.5"); len(got) != 15 || got[0].Auth != "token" {
+		t.Fatalf("%d eventos del caller 10.0.0.5, se esperaban 15 con auth", len(got))
+	}
+	now := time.Now().Unix()
+	if got := getEvents(t, s, fmt.Sprintf("?until=%d", now-3600)); len(got) != 0 {
+		t.Fatalf("%d eventos con until de hace una hora", len(got))
+	}
+	if got := getEvents(t, s, fmt.Sprintf("?since=%d&type=unblock,ban", now-60)); len(got) != 30 {
+		t.Fatalf("%d eventos desde hace un minuto, se esperaban 30", len(got))
+	}
+
+	// Sin parámetros: el ring buffer, del más viejo al más nuevo
+	if got := getEvents(t, s, ""); len(got) != 30 || got[0].ID != 1 {
+		t.Fatalf("ring buffer con %d eventos", len(got))
+	}
+
+	rec := httptest.NewRecorder()
+	s.handleEvents(rec, httptest.NewRequest(http.MethodGet, "/api/events?since=ayer", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("since inválido: status %d, se esperaba 400", rec.Code)
+	}
+}
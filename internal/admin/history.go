@@ -0,0 +1,342 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"guard/internal/common"
+	"guard/internal/proxy"
+)
+
+// ─── Historial de métricas ────────────────────────────────────────────────────
+
+// historyTiers son las resoluciones del historial: una muestra cada step,
+// conservadas durante keep. El primer nivel guarda las muestras tal cual; los
+// siguientes, el promedio de las muestras de cada intervalo.
+var historyTiers = []struct {
+	step, keep time.Duration
+}{
+	{10 * time.Second, time.Hour},
+	{time.Minute, 24 * time.Hour},
+	{10 * time.Minute, 30 * 24 * time.Hour},
+}
+
+// defaultMetricsWindow es lo que retorna /api/metrics sin from: los últimos 6
+// minutos a 10s por muestra.
+const defaultMetricsWindow = 6 * time.Minute
+
+// MetricSample es un punto de datos en el tiempo.
+type MetricSample struct {
+	T            int64              `json:"t"`                      // Unix timestamp
+	ActiveConns  int                `json:"active_conns"`           // Conexiones activas
+	RejectRate   float64            `json:"reject_rate"`            // Rechazos por segundo
+	BytesInRate  float64            `json:"bytes_in_rate"`          // Bytes/s cliente → backend
+	BytesOutRate float64            `json:"bytes_out_rate"`         // Bytes/s backend → cliente
+	ReadsInRate  float64            `json:"reads_in_rate"`          // Lecturas/s cliente → backend
+	ReadsOutRate float64            `json:"reads_out_rate"`         // Lecturas/s backend → cliente
+	RejectRates  map[string]float64 `json:"reject_rates,omitempty"` // Rechazos/s por motivo
+}
+
+// sampleSum acumula las muestras de un intervalo para promediarlas. El promedio
+// de las tasas es la tasa del intervalo completo.
+type sampleSum struct {
+	t   int64 // inicio del intervalo (Unix)
+	n   int
+	sum MetricSample
+}
+
+func (a *sampleSum) add(s MetricSample) {
+	a.n++
+	a.sum.ActiveConns += s.ActiveConns
+	a.sum.RejectRate += s.RejectRate
+	a.sum.BytesInRate += s.BytesInRate
+	a.sum.BytesOutRate += s.BytesOutRate
+	a.sum.ReadsInRate += s.ReadsInRate
+	a.sum.ReadsOutRate += s.ReadsOutRate
+	for reason, r := range s.RejectRates {
+		if a.sum.RejectRates == nil {
+			a.sum.RejectRates = make(map[string]float64)
+		}
+		a.sum.RejectRates[reason] += r
+	}
+}
+
+func (a *sampleSum) avg() MetricSample {
+	n := float64(a.n)
+	out := MetricSample{
+		T:            a.t,
+		ActiveConns:  int(math.Round(float64(a.sum.ActiveConns) / n)),
+		RejectRate:   a.sum.RejectRate / n,
+		BytesInRate:  a.sum.BytesInRate / n,
+		BytesOutRate: a.sum.BytesOutRate / n,
+		ReadsInRate:  a.sum.ReadsInRate / n,
+		ReadsOutRate: a.sum.ReadsOutRate / n,
+	}
+	if len(a.sum.RejectRates) > 0 {
+		out.RejectRates = make(map[string]float64, len(a.sum.RejectRates))
+		for reason, r := range a.sum.RejectRates {
+			out.RejectRates[reason] = r / n
+		}
+	}
+	return out
+}
+
+// downsample promedia samples (ordenadas por T) en intervalos de step segundos.
+func downsample(samples []MetricSample, step int64) []MetricSample {
+	out := make([]MetricSample, 0, len(samples))
+	var acc sampleSum
+	for _, s := range samples {
+		start := s.T - s.T%step
+		if acc.n > 0 && acc.t != start {
+			out = append(out, acc.avg())
+			acc = sampleSum{}
+		}
+		acc.t = start
+		acc.add(s)
+	}
+	if acc.n > 0 {
+		out = append(out, acc.avg())
+	}
+	return out
+}
+
+// historyTier es un nivel de resolución del historial.
+type historyTier struct {
+	step    time.Duration
+	keep    time.Duration
+	samples []MetricSample // ordenadas por T
+	acc     sampleSum      // intervalo en curso (niveles agregados)
+}
+
+// push agrega s al nivel y descarta las muestras más viejas que keep.
+func (t *historyTier) push(s MetricSample) {
+	// Si el reloj retrocedió, las muestras "del futuro" se descartan para mantener el orden
+	for len(t.samples) > 0 && t.samples[len(t.samples)-1].T >= s.T {
+		t.samples = t.samples[:len(t.samples)-1]
+	}
+	t.samples = append(t.samples, s)
+	t.trim(s.T)
+}
+
+// trim descarta las muestras más viejas que keep respecto de now (Unix).
+func (t *historyTier) trim(now int64) {
+	cutoff := now - int64(t.keep/time.Second)
+	if i := sort.Search(len(t.samples), func(i int) bool { return t.samples[i].T > cutoff }); i > 0 {
+		t.samples = append(t.samples[:0], t.samples[i:]...)
+	}
+}
+
+// add registra una muestra de 10s en el nivel: el primero la guarda tal cual y
+// los demás la acumulan hasta completar su intervalo.
+func (t *historyTier) add(s MetricSample, raw bool) {
+	if raw {
+		t.push(s)
+		return
+	}
+	start := s.T - s.T%int64(t.step/time.Second)
+	if t.acc.n > 0 && t.acc.t != start {
+		t.push(t.acc.avg())
+		t.acc = sampleSum{}
+	}
+	t.acc.t = start
+	t.acc.add(s)
+}
+
+type metricsHistory struct {
+	mu          sync.Mutex
+	tiers       []*historyTier
+	lastRej     uint64
+	lastReasons map[string]uint64
+	lastTraffic proxy.Traffic
+	lastT       time.Time
+}
+
+func newMetricsHistory() *metricsHistory {
+	h := &metricsHistory{}
+	for _, spec := range historyTiers {
+		h.tiers = append(h.tiers, &historyTier{step: spec.step, keep: spec.keep})
+	}
+	return h
+}
+
+// record agrega una muestra y la retorna; byReason son los rechazos acumulados por
+// motivo (nil si no se cuentan por motivo).
+func (h *metricsHistory) record(active int, totalRej uint64, byReason map[string]uint64, traffic proxy.Traffic) MetricSample {
+	now := time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sample := MetricSample{T: now.Unix(), ActiveConns: active}
+	if !h.lastT.IsZero() {
+		elapsed := now.Sub(h.lastT).Seconds()
+		if elapsed > 0 {
+			diff := totalRej - h.lastRej
+			sample.RejectRate = float64(diff) / elapsed
+			sample.BytesInRate = float64(traffic.BytesIn-h.lastTraffic.BytesIn) / elapsed
+			sample.BytesOutRate = float64(traffic.BytesOut-h.lastTraffic.BytesOut) / elapsed
+			sample.ReadsInRate = float64(traffic.ReadsIn-h.lastTraffic.ReadsIn) / elapsed
+			sample.ReadsOutRate = float64(traffic.ReadsOut-h.lastTraffic.ReadsOut) / elapsed
+			if byReason != nil {
+				sample.RejectRates = common.RejectRates(h.lastReasons, byReason, elapsed)
+			}
+		}
+	}
+	h.lastRej = totalRej
+	h.lastReasons = byReason
+	h.lastTraffic = traffic
+	h.lastT = now
+
+	for i, t := range h.tiers {
+		t.add(sample, i == 0)
+	}
+	return sample
+}
+
+// query retorna las muestras con from <= T <= to (Unix). Usa el nivel más fino
+// que todavía conserva from, o uno más grueso si su paso no supera step; si step
+// es mayor que el paso del nivel, las muestras se promedian en intervalos de step.
+// step = 0 usa el paso del nivel.
+func (h *metricsHistory) query(from, to int64, step time.Duration) []MetricSample {
+	now := time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	i := 0
+	for i < len(h.tiers)-1 && from < now.Add(-h.tiers[i].keep).Unix() {
+		i++
+	}
+	for i < len(h.tiers)-1 && h.tiers[i+1].step <= step {
+		i++
+	}
+	t := h.tiers[i]
+	lo := sort.Search(len(t.samples), func(j int) bool { return t.samples[j].T >= from })
+	hi := sort.Search(len(t.samples), func(j int) bool { return t.samples[j].T > to })
+	if lo >= hi {
+		return []MetricSample{}
+	}
+	if step > t.step {
+		return downsample(t.samples[lo:hi], int64(step/time.Second))
+	}
+	out := make([]MetricSample, hi-lo)
+	copy(out, t.samples[lo:hi])
+	return out
+}
+
+// ─── Persistencia del historial ───────────────────────────────────────────────
+
+// historyVersion es la versión del formato del archivo de historial.
+const historyVersion = 1
+
+// historyFile es el contenido persistido en disco.
+type historyFile struct {
+	Version int               `json:"version"`
+	Profile string            `json:"profile"`
+	SavedAt int64             `json:"saved_at"`
+	Tiers   []historyFileTier `json:"tiers"`
+}
+
+// historyFileTier es un nivel del historial con su intervalo en curso.
+type historyFileTier struct {
+	Step     int64          `json:"step"` // segundos
+	Samples  []MetricSample `json:"samples"`
+	Partial  MetricSample   `json:"partial"`   // suma del intervalo en curso
+	PartialN int            `json:"partial_n"` // muestras en Partial
+}
+
+// load lee el historial de path; un archivo inexistente, de otra versión o con
+// otros niveles se trata como vacío (los niveles que no coinciden se ignoran).
+func (h *metricsHistory) load(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var f historyFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		log.Printf("[WARN] admin: historial %s inválido, se ignora: %v", path, err)
+		return nil
+	}
+	if f.Version != historyVersion {
+		log.Printf("[WARN] admin: historial %s con versión %d (esperada %d), se ignora", path, f.Version, historyVersion)
+		return nil
+	}
+	now := time.Now().Unix()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, ft := range f.Tiers {
+		for _, t := range h.tiers {
+			if int64(t.step/time.Second) != ft.Step {
+				continue
+			}
+			sort.Slice(ft.Samples, func(i, j int) bool { return ft.Samples[i].T < ft.Samples[j].T })
+			t.samples = ft.Samples
+			t.trim(now)
+			if ft.PartialN > 0 {
+				t.acc = sampleSum{t: ft.Partial.T, n: ft.PartialN, sum: ft.Partial}
+			}
+		}
+	}
+	return nil
+}
+
+// save escribe el historial en path de forma atómica (archivo temporal + rename).
+func (h *metricsHistory) save(path, profile string) error {
+	f := historyFile{Version: historyVersion, Profile: profile, SavedAt: time.Now().Unix()}
+	h.mu.Lock()
+	for _, t := range h.tiers {
+		ft := historyFileTier{Step: int64(t.step / time.Second), Samples: t.samples}
+		if t.acc.n > 0 {
+			ft.Partial, ft.PartialN = t.acc.sum, t.acc.n
+			ft.Partial.T = t.acc.t
+		}
+		f.Tiers = append(f.Tiers, ft)
+	}
+	data, err := json.Marshal(f)
+	h.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// SetHistoryFile carga el historial de métricas de path y hace que se guarde ahí
+// cada minuto y al detener el servidor. Debe llamarse antes de Start.
+func (s *Server) SetHistoryFile(path string) error {
+	if err := s.history.load(path); err != nil {
+		return fmt.Errorf("historial de métricas: %w", err)
+	}
+	s.historyFile = path
+	return nil
+}
+
+// saveHistory guarda el historial si hay archivo configurado.
+func (s *Server) saveHistory() {
+	if s.historyFile == "" {
+		return
+	}
+	if err := s.history.save(s.historyFile, s.profile); err != nil {
+		log.Printf("[WARN] admin [%s]: no se pudo guardar el historial de métricas: %v", s.profile, err)
+	}
+}
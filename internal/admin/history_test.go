@@ -0,0 +1,160 @@
+package admin
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fillHistory carga en h una muestra cada 10s de from a to (Unix), como lo haría
+// record. Dentro de cada minuto los valores van de 0 a 5, así el promedio de
+// cualquier intervalo alineado es 2.5.
+func fillHistory(h *metricsHistory, from, to int64) {
+	for t := from; t <= to; t += 10 {
+		v := float64((t / 10) % 6)
+		s := MetricSample{T: t, ActiveConns: int(v), RejectRate: v, BytesInRate: 100 * v, RejectRates: map[string]float64{"rate": v}}
+		for i, tier := range h.tiers {
+			tier.add(s, i == 0)
+		}
+	}
+}
+
+// historyEnd retorna el instante de la última muestra de los tests: ahora,
+// alineado a 10 minutos para que todos los niveles cierren intervalos completos.
+func historyEnd() int64 {
+	now := time.Now().Unix()
+	return now - now%600
+}
+
+func TestHistoryTiers(t *testing.T) {
+	h := newMetricsHistory()
+	end := historyEnd()
+	fillHistory(h, end-7200, end)
+
+	// Nivel de 10s: solo la última hora, tal cual
+	raw := h.tiers[0].samples
+	if len(raw) != 360 || raw[0].T != end-3590 || raw[len(raw)-1].T != end {
+		t.Fatalf("nivel 10s: %d muestras de %d a %d", len(raw), raw[0].T-end, raw[len(raw)-1].T-end)
+	}
+
+	// Niveles agregados: un promedio por intervalo completo; el que está en curso
+	// queda acumulado
+	for i, want := range []struct {
+		step  int64
+		count int
+	}{{60, 120}, {600, 12}} {
+		tier := h.tiers[i+1]
+		if len(tier.samples) != want.count {
+			t.Fatalf("nivel %ds: %d muestras, se esperaban %d", want.step, len(tier.samples), want.count)
+		}
+		for _, s := range tier.samples {
+			if s.T%want.step != 0 || s.RejectRate != 2.5 || s.BytesInRate != 250 || s.RejectRates["rate"] != 2.5 || s.ActiveConns != 3 {
+				t.Fatalf("nivel %ds: muestra %+v, se esperaba el promedio 2.5 alineado", want.step, s)
+			}
+		}
+		if tier.acc.n != 1 || tier.acc.t != end {
+			t.Fatalf("nivel %ds: intervalo en curso con %d muestras desde %d", want.step, tier.acc.n, tier.acc.t-end)
+		}
+	}
+}
+
+func TestHistoryQuery(t *testing.T) {
+	h := newMetricsHistory()
+	end := historyEnd()
+	fillHistory(h, end-7200, end)
+
+	cases := []struct {
+		name      string
+		from, to  int64
+		step      time.Duration
+		count     int
+		firstT    int64
+		spacing   int64
+		firstRate float64
+	}{
+		{"últimos 5 minutos", end - 300, end, 0, 31, end - 300, 10, 0},
+		{"más de una hora usa el nivel de 1m", end - 7200, end, 0, 120, end - 7200, 60, 2.5},
+		{"step de 1m usa el nivel de 1m", end - 600, end, time.Minute, 10, end - 600, 60, 2.5},
+		{"step de 30s promedia el nivel de 10s", end - 600, end, 30 * time.Second, 21, end - 600, 30, 1},
+		{"to recorta", end - 300, end - 200, 0, 11, end - 300, 10, 0},
+		{"rango vacío", end - 100, end - 200, 0, 0, 0, 0, 0},
+		{"antes del historial", end - 40*86400, end - 35*86400, 0, 0, 0, 0, 0},
+	}
+	for _, tc := range cases {
+		got := h.query(tc.from, tc.to, tc.step)
+		if got == nil || len(got) != tc.count {
+			t.Fatalf("%s: %d muestras, se esperaban %d", tc.name, len(got), tc.count)
+		}
+		if tc.count == 0 {
+			continue
+		}
+		if got[0].T != tc.firstT || got[0].RejectRate != tc.firstRate {
+			t.Fatalf("%s: primera muestra %+v, se esperaba T=%d rate=%v", tc.name, got[0], tc.firstT-end, tc.firstRate)
+		}
+		for i := 1; i < len(got); i++ {
+			if got[i].T-got[i-1].T != tc.spacing {
+				t.Fatalf("%s: muestras separadas %ds, se esperaban %ds", tc.name, got[i].T-got[i-1].T, tc.spacing)
+			}
+		}
+	}
+}
+
+func TestHistorySaveLoad(t *testing.T) {
+	h := newMetricsHistory()
+	end := historyEnd()
+	fillHistory(h, end-7200, end-10)
+	path := filepath.Join(t.TempDir(), "metrics-login.json")
+	if err := h.save(path, "login"); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := newMetricsHistory()
+	if err := loaded.load(path); err != nil {
+		t.Fatal(err)
+	}
+	for i := range h.tiers {
+		// La carga recorta con el reloj actual: del nivel de 10s puede quedar solo
+		// la parte más nueva
+		want := h.tiers[i].samples
+		got := loaded.tiers[i].samples
+		if i == 0 && len(got) > 0 && len(got) <= len(want) {
+			want = want[len(want)-len(got):]
+		}
+		if len(got) == 0 || !reflect.DeepEqual(got, want) {
+			t.Fatalf("nivel %v: las muestras cargadas no coinciden", h.tiers[i].step)
+		}
+		if loaded.tiers[i].acc.n != h.tiers[i].acc.n || loaded.tiers[i].acc.t != h.tiers[i].acc.t {
+			t.Fatalf("nivel %v: intervalo en curso %d/%d, se esperaba %d/%d", h.tiers[i].step,
+				loaded.tiers[i].acc.n, loaded.tiers[i].acc.t, h.tiers[i].acc.n, h.tiers[i].acc.t)
+		}
+	}
+	// El intervalo en curso sigue acumulándose tras la carga (reinicio o traspaso)
+	fillHistory(h, end, end)
+	fillHistory(loaded, end, end)
+	if !reflect.DeepEqual(loaded.tiers[2].samples, h.tiers[2].samples) {
+		t.Fatal("el intervalo que quedó a medias al guardar se cerró distinto tras la carga")
+	}
+
+	// Archivo ausente, inválido o de otra versión: historial vacío, sin error
+	for name, content := range map[string]string{
+		"ausente.json":  "",
+		"invalido.json": "{no es json",
+		"version.json":  `{"version":99,"tiers":[{"step":10,"samples":[{"t":1}]}]}`,
+	} {
+		p := filepath.Join(t.TempDir(), name)
+		if content != "" {
+			if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		empty := newMetricsHistory()
+		if err := empty.load(p); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(empty.tiers[0].samples) != 0 {
+			t.Fatalf("%s: se cargaron muestras", name)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package admin
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"guard/internal/proxy"
+)
+
+// ProxyStats son los contadores de conexiones del proxy (ver proxy.Live).
+type ProxyStats interface {
+	Accepts() uint64
+	DialStats() []proxy.DialStats
+}
+
+// SetProxyStats establece de dónde salen aceptadas y latencia de dial para /metrics.
+func (s *Server) SetProxyStats(p ProxyStats) {
+	s.proxyStats = p
+}
+
+// SetOverloadFn establece la función que indica si el proceso detectó sobrecarga.
+func (s *Server) SetOverloadFn(fn func() bool) {
+	s.overloadFn = fn
+}
+
+// promWriter escribe métricas en el formato de texto de Prometheus. Todas las
+// series llevan la etiqueta profile.
+type promWriter struct {
+	w       *bufio.Writer
+	profile string
+}
+
+// metric escribe los comentarios HELP y TYPE de name.
+func (p *promWriter) metric(name, typ, help string) {
+	fmt.Fprintf(p.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample escribe una serie; labels son pares nombre, valor.
+func (p *promWriter) sample(name string, v float64, labels ...string) {
+	p.w.WriteString(name)
+	p.w.WriteString(`{profile="`)
+	p.w.WriteString(escapeLabel(p.profile))
+	p.w.WriteByte('"')
+	for i := 0; i+1 < len(labels); i += 2 {
+		fmt.Fprintf(p.w, `,%s="%s"`, labels[i], escapeLabel(labels[i+1]))
+	}
+	p.w.WriteString("} ")
+	p.w.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+	p.w.WriteByte('\n')
+}
+
+// single escribe una métrica con una sola serie.
+func (p *promWriter) single(name, typ, help string, v float64) {
+	p.metric(name, typ, help)
+	p.sample(name, v)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func boolFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// handlePrometheus expone las métricas del proceso en formato de texto de
+// Prometheus (GET /metrics), con las mismas reglas de acceso que /api.
+func (s *Server) handlePrometheus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	p := &promWriter{w: bufio.NewWriter(w), profile: s.profile}
+	defer p.w.Flush()
+
+	// Conexiones
+	active, ipCount := s.lim.Stats()
+	s.aclMu.RLock()
+	maxConns := s.maxConns
+	s.aclMu.RUnlock()
+	p.single("guard_active_conns", "gauge", "Conexiones aceptadas y no liberadas (slots del limiter).", float64(active))
+	p.single("guard_max_conns", "gauge", "Límite global de conexiones (max_total_conns).", float64(maxConns))
+	p.single("guard_tracked_ips", "gauge", "IPs rastreadas por el limiter.", float64(ipCount))
+	if s.sessionsFn != nil {
+		p.single("guard_sessions", "gauge", "Sesiones proxyadas en curso.", float64(s.sessionsFn()))
+	}
+	p.single("guard_rejects_total", "counter", "Rechazos desde el arranque.", float64(s.rejectFn()))
+	if s.proxyStats != nil {
+		p.single("guard_accepts_total", "counter", "Conexiones que pasaron los límites desde el arranque.", float64(s.proxyStats.Accepts()))
+	}
+	if rejects := s.rejectsByReason(); rejects != nil {
+		reasons := make([]string, 0, len(rejects))
+		for r := range rejects {
+			reasons = append(reasons, r)
+		}
+		sort.Strings(reasons)
+		p.metric("guard_rejects_by_reason_total", "counter", "Rechazos desde el arranque por motivo.")
+		for _, r := range reasons {
+			p.sample("guard_rejects_by_reason_total", float64(rejects[r]), "reason", r)
+		}
+	}
+
+	// Bans
+	ipBlocks, subnetBlocks := s.lim.BlockCounts()
+	p.metric("guard_tempblocks_total", "counter", "Bloqueos temporales del limiter desde el arranque.")
+	p.sample("guard_tempblocks_total", float64(ipBlocks), "kind", "ip")
+	p.sample("guard_tempblocks_total", float64(subnetBlocks), "kind", "subnet")
+	if s.fw != nil {
+		st := s.fw.Stats()
+		p.single("guard_firewall_bans_total", "counter", "Bans de firewall programados desde el arranque.", float64(st.Bans))
+		p.single("guard_firewall_blocked", "gauge", "IPs y rangos con regla de firewall programada.", float64(st.Blocked))
+		p.single("guard_firewall_queue", "gauge", "Bans nuevos que esperan al próximo batch del firewall.", float64(st.Queued))
+	}
+
+	// Estado
+	if s.drainFn != nil {
+		p.single("guard_drain_mode", "gauge", "1 si el listener está cerrado por modo drain.", boolFloat(s.drainFn()))
+	}
+	if s.overloadFn != nil {
+		p.single("guard_overloaded", "gauge", "1 si el proceso detectó sobrecarga.", boolFloat(s.overloadFn()))
+	}
+	if s.loadPctFn != nil {
+		p.single("guard_load_ratio", "gauge", "Carga actual respecto del límite global (0-1).", s.loadPctFn()/100)
+	}
+	s.drainSinceMu.Lock()
+	shuttingDown := !s.shutdownSince.IsZero()
+	s.drainSinceMu.Unlock()
+	p.single("guard_shutting_down", "gauge", "1 durante el apagado ordenado.", boolFloat(shuttingDown))
+
+	// Tráfico
+	if s.traffic != nil {
+		t := s.traffic.TotalTraffic()
+		p.metric("guard_bytes_total", "counter", "Bytes proxyados por sentido (in = cliente a backend).")
+		p.sample("guard_bytes_total", float64(t.BytesIn), "direction", "in")
+		p.sample("guard_bytes_total", float64(t.BytesOut), "direction", "out")
+		p.metric("guard_reads_total", "counter", "Lecturas (aprox. paquetes) proxyadas por sentido.")
+		p.sample("guard_reads_total", float64(t.ReadsIn), "direction", "in")
+		p.sample("guard_reads_total", float64(t.ReadsOut), "direction", "out")
+	}
+
+	// Backends
+	if s.backendsFn != nil {
+		backends := s.backendsFn()
+		p.metric("guard_backend_up", "gauge", "1 si el backend está sano.")
+		for _, b := range backends {
+			p.sample("guard_backend_up", boolFloat(b.Healthy), "backend", b.Addr)
+		}
+		p.metric("guard_backend_breaker_open", "gauge", "1 si el circuit breaker del backend no está cerrado.")
+		for _, b := range backends {
+			p.sample("guard_backend_breaker_open", boolFloat(b.Breaker != "closed"), "backend", b.Addr)
+		}
+		p.metric("guard_backend_active_conns", "gauge", "Sesiones en curso por backend.")
+		for _, b := range backends {
+			p.sample("guard_backend_active_conns", float64(b.ActiveConns), "backend", b.Addr)
+		}
+	}
+	if s.proxyStats != nil {
+		dials := s.proxyStats.DialStats()
+		p.metric("guard_backend_dial_seconds", "histogram", "Latencia de los dials exitosos a cada backend.")
+		for _, d := range dials {
+			for i, le := range proxy.DialBuckets {
+				p.sample("guard_backend_dial_seconds_bucket", float64(d.Buckets[i]), "backend", d.Addr, "le", strconv.FormatFloat(le, 'g', -1, 64))
+			}
+			p.sample("guard_backend_dial_seconds_bucket", float64(d.Count), "backend", d.Addr, "le", "+Inf")
+			p.sample("guard_backend_dial_seconds_sum", d.Sum, "backend", d.Addr)
+			p.sample("guard_backend_dial_seconds_count", float64(d.Count), "backend", d.Addr)
+		}
+		p.metric("guard_backend_dial_failures_total", "counter", "Dials fallidos a cada backend.")
+		for _, d := range dials {
+			p.sample("guard_backend_dial_failures_total", float64(d.Failures), "backend", d.Addr)
+		}
+	}
+
+	// Proceso (lo mismo que /api/sysinfo)
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	p.single("guard_goroutines", "gauge", "Goroutines en ejecución.", float64(runtime.NumGoroutine()))
+	p.single("guard_heap_inuse_bytes", "gauge", "Bytes de heap en uso.", float64(ms.HeapInuse))
+	p.single("guard_sys_bytes", "gauge", "Bytes obtenidos del sistema operativo.", float64(ms.Sys))
+	p.single("guard_gc_cycles_total", "counter", "Ciclos de GC completados.", float64(ms.NumGC))
+	p.single("guard_start_time_seconds", "gauge", "Inicio del proceso (Unix).", float64(s.startTime.Unix()))
+	p.single("guard_uptime_seconds", "gauge", "Segundos desde el inicio del proceso.", time.Since(s.startTime).Seconds())
+}
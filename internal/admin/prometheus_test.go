@@ -0,0 +1,117 @@
+package admin
+
+import (
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"guard/internal/common"
+	"guard/internal/limiter"
+	"guard/internal/proxy"
+)
+
+var update = flag.Bool("update", false, "reescribe los archivos de testdata con la salida actual")
+
+// fakeProxy es una fuente fija de contadores del proxy.
+type fakeProxy struct{}
+
+func (fakeProxy) Accepts() uint64 { return 1234 }
+
+func (fakeProxy) DialStats() []proxy.DialStats {
+	buckets := make([]uint64, len(proxy.DialBuckets))
+	for i := range buckets {
+		buckets[i] = uint64(min(i*2, 10))
+	}
+	return []proxy.DialStats{{Addr: "127.0.0.1:7667", Buckets: buckets, Count: 12, Sum: 0.0375, Failures: 3}}
+}
+
+func (fakeProxy) TotalTraffic() proxy.Traffic {
+	return proxy.Traffic{BytesIn: 1 << 20, BytesOut: 5 << 20, ReadsIn: 300, ReadsOut: 900}
+}
+
+func (fakeProxy) TrafficByIP() []proxy.IPTraffic { return nil }
+
+// processMetrics son las métricas del runtime, cuyo valor cambia en cada llamada:
+// el golden termina antes de ellas.
+const processMetrics = "# HELP guard_goroutines "
+
+func TestPrometheusGolden(t *testing.T) {
+	lim := limiter.New(10, 100, 100, 3, 60, 1000, 300, 60)
+	defer lim.Stop()
+	s := New(lim, nil, "login", func() bool { return false }, func() uint64 { return 42 }, 5000)
+	defer s.stream.Close()
+	rejects := common.NewRejectCounters()
+	for _, r := range []string{"rate", "rate", "tempblock", `raro"con\barra` + "\n"} {
+		rejects.Inc("login", r)
+	}
+	rejects.Inc("game", "rate") // otro perfil: no debe aparecer
+	s.SetRejectCounters(rejects)
+	s.SetSessionsFn(func() int64 { return 17 })
+	s.SetOverloadFn(func() bool { return true })
+	s.SetLoadPctFn(func() float64 { return 25 })
+	s.SetProxyStats(fakeProxy{})
+	s.SetTrafficSource(fakeProxy{})
+	s.SetBackendsFn(func() []proxy.BackendStatus {
+		return []proxy.BackendStatus{
+			{Addr: "127.0.0.1:7667", Healthy: true, ActiveConns: 10, Breaker: "closed"},
+			{Addr: `[::1]:7667`, Healthy: false, ActiveConns: 0, Breaker: "open"},
+		}
+	})
+
+	rec := httptest.NewRecorder()
+	s.handlePrometheus(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("Content-Type %q", ct)
+	}
+	out := rec.Body.String()
+
+	// Todas las series llevan la etiqueta profile y cada métrica su HELP y TYPE
+	typed := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSuffix(out, "\n"), "\n") {
+		if name, ok := strings.CutPrefix(line, "# TYPE "); ok {
+			typed[strings.Fields(name)[0]] = true
+			continue
+		}
+		if strings.HasPrefix(line, "# HELP ") {
+			continue
+		}
+		name, rest, ok := strings.Cut(line, `{profile="login"`)
+		if !ok {
+			t.Fatalf("serie sin profile: %q", line)
+		}
+		base := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(name, "_bucket"), "_sum"), "_count")
+		if !typed[name] && !typed[base] {
+			t.Fatalf("serie %s sin TYPE previo", name)
+		}
+		if !strings.Contains(rest, "} ") {
+			t.Fatalf("serie mal formada: %q", line)
+		}
+	}
+	for _, name := range []string{"guard_goroutines", "guard_heap_inuse_bytes", "guard_sys_bytes", "guard_gc_cycles_total", "guard_start_time_seconds", "guard_uptime_seconds"} {
+		if !typed[name] {
+			t.Errorf("falta %s", name)
+		}
+	}
+
+	got, _, ok := strings.Cut(out, processMetrics)
+	if !ok {
+		t.Fatal("faltan las métricas del proceso")
+	}
+	golden := filepath.Join("testdata", "metrics.golden")
+	if *update {
+		if err := os.WriteFile(golden, []byte(got), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Fatalf("salida distinta de %s (go test -run Prometheus -update para regenerarlo):\n%s", golden, got)
+	}
+}
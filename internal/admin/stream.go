@@ -0,0 +1,57 @@
+package admin
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// ─── Stream de eventos (SSE) ──────────────────────────────────────────────────
+
+const (
+	streamBuffer         = 1000            // mensajes que se reenvían a un cliente que se reconecta
+	streamStatusInterval = 2 * time.Second // cada cuánto se publican los cambios de /api/status
+)
+
+// handleStream envía como Server-Sent Events los eventos ("event"), las muestras de
+// métricas ("metrics") y los campos de /api/status que cambian ("status_delta").
+// Un cliente nuevo, o que se perdió más mensajes de los que hay en el buffer,
+// recibe además el estado completo ("status").
+func (s *Server) handleStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.stream.Serve(w, r, func() (string, any) {
+		return "status", s.status()
+	})
+}
+
+// publishStatusDelta publica los campos de /api/status que cambiaron desde la
+// llamada anterior; los que desaparecieron (omitempty) se envían como null.
+func (s *Server) publishStatusDelta() {
+	data, err := json.Marshal(s.status())
+	if err != nil {
+		return
+	}
+	var cur map[string]json.RawMessage
+	if err := json.Unmarshal(data, &cur); err != nil {
+		return
+	}
+	delta := make(map[string]json.RawMessage)
+	for k, v := range cur {
+		if !bytes.Equal(s.lastStatus[k], v) {
+			delta[k] = v
+		}
+	}
+	for k := range s.lastStatus {
+		if _, ok := cur[k]; !ok {
+			delta[k] = json.RawMessage("null")
+		}
+	}
+	s.lastStatus = cur
+	if len(delta) > 0 {
+		s.stream.Publish("status_delta", delta)
+	}
+}
@@ -0,0 +1,400 @@
+// Package capture guarda muestras de los primeros bytes que envían los clientes
+// rechazados o sospechosos, para tener algo más que la línea de log cuando hay un
+// ataque. Las muestras se escriben en archivos rotativos JSONL (un registro con el
+// payload en hex por línea) o pcap-ng (paquetes TCP sintéticos que abre Wireshark)
+// y se descargan desde la API admin.
+//
+// Se captura una conexión cuando su motivo de rechazo está en Policy.Reasons o
+// cuando su IP fue marcada con Flag (en ese caso también las sesiones aceptadas),
+// con un tope de muestras por IP por minuto para que un flood no llene el disco.
+package capture
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Formatos de archivo soportados.
+const (
+	FormatJSONL  = "jsonl"
+	FormatPcapNG = "pcapng"
+)
+
+const (
+	maxPerMinute = 600   // tope global de muestras por minuto, además del tope por IP
+	maxSample    = 60000 // bytes por muestra como máximo (entran en un paquete IP)
+)
+
+// Options configura los archivos de un Writer. Los valores cero usan los defaults.
+type Options struct {
+	Dir      string // directorio de los archivos (se crea si no existe)
+	Profile  string // perfil (login, game): prefijo de los archivos
+	Format   string // FormatJSONL (default) o FormatPcapNG
+	FileSize int64  // tamaño a partir del cual se rota; default 10 MB
+	Keep     int    // archivos que se conservan, incluido el actual; default 10
+}
+
+// Policy decide qué se captura. Se puede cambiar en caliente (SetPolicy).
+type Policy struct {
+	Bytes          int      // bytes por muestra; default 512
+	Reasons        []string // motivos de rechazo que se capturan para cualquier IP
+	PerIPPerMinute int      // tope de muestras por IP por minuto; default 5
+}
+
+// Record es una muestra en formato JSONL.
+type Record struct {
+	Time    time.Time `json:"time"`
+	Profile string    `json:"profile"`
+	IP      string    `json:"ip"`
+	Client  string    `json:"client"` // ip:puerto del cliente
+	Local   string    `json:"local"`  // ip:puerto en el que se aceptó
+	Reason  string    `json:"reason"` // motivo de rechazo, o "flagged" para una sesión aceptada
+	Len     int       `json:"len"`
+	Hex     string    `json:"hex"`
+}
+
+// FileInfo describe un archivo de capturas para /api/captures.
+type FileInfo struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Modified int64  `json:"modified"` // Unix
+}
+
+// Flag es una IP o rango marcado para captura.
+type Flag struct {
+	Target string `json:"target"`
+	Until  int64  `json:"until"` // Unix
+}
+
+// Writer escribe las muestras de un perfil. Es seguro para uso concurrente.
+type Writer struct {
+	opts   Options
+	policy atomic.Pointer[Policy]
+
+	mu       sync.Mutex // archivo actual
+	f        *os.File
+	size     int64
+	lastBase string // nombre base y sufijo del último archivo abierto: en el mismo
+	lastSeq  int    // segundo no se reusa un sufijo aunque Keep ya lo haya borrado
+
+	budgetMu sync.Mutex
+	window   time.Time      // inicio del minuto en curso
+	perIP    map[string]int // muestras por IP en el minuto en curso
+	total    int
+
+	flagMu sync.Mutex
+	flags  map[string]time.Time // IP o rango → vencimiento
+}
+
+// New crea un Writer. El primer archivo se abre con la primera muestra.
+func New(opts Options, p Policy) (*Writer, error) {
+	switch opts.Format {
+	case "":
+		opts.Format = FormatJSONL
+	case FormatJSONL, FormatPcapNG:
+	default:
+		return nil, fmt.Errorf("capture: formato desconocido %q (jsonl | pcapng)", opts.Format)
+	}
+	if opts.FileSize <= 0 {
+		opts.FileSize = 10 << 20
+	}
+	if opts.Keep <= 0 {
+		opts.Keep = 10
+	}
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("capture: %w", err)
+	}
+	w := &Writer{opts: opts, perIP: make(map[string]int), flags: make(map[string]time.Time)}
+	w.SetPolicy(p)
+	return w, nil
+}
+
+// SetPolicy cambia qué se captura.
+func (w *Writer) SetPolicy(p Policy) {
+	if p.Bytes <= 0 {
+		p.Bytes = 512
+	}
+	p.Bytes = min(p.Bytes, maxSample)
+	if p.PerIPPerMinute <= 0 {
+		p.PerIPPerMinute = 5
+	}
+	w.policy.Store(&p)
+}
+
+// Want indica cuántos bytes capturar de una conexión de ip con motivo reason
+// ("flagged" para una sesión aceptada); 0 = no capturar. Si retorna > 0 ya
+// descontó la muestra del tope por IP.
+func (w *Writer) Want(ip, reason string) int {
+	p := w.policy.Load()
+	if !w.Flagged(ip) && (reason == "flagged" || !slices.Contains(p.Reasons, reason)) {
+		return 0
+	}
+	if !w.take(ip, p.PerIPPerMinute) {
+		return 0
+	}
+	return p.Bytes
+}
+
+// take descuenta una muestra de los topes del minuto en curso.
+func (w *Writer) take(ip string, perIP int) bool {
+	now := time.Now()
+	w.budgetMu.Lock()
+	defer w.budgetMu.Unlock()
+	if now.Sub(w.window) >= time.Minute {
+		w.window = now
+		clear(w.perIP)
+		w.total = 0
+	}
+	if w.total >= maxPerMinute || w.perIP[ip] >= perIP {
+		return false
+	}
+	w.perIP[ip]++
+	w.total++
+	return true
+}
+
+// Capture escribe una muestra. client y local pueden ser inválidos si no se
+// conocen (en pcap-ng se usan direcciones cero).
+func (w *Writer) Capture(ip, reason string, client, local netip.AddrPort, data []byte) {
+	now := time.Now()
+	var rec []byte
+	if w.opts.Format == FormatPcapNG {
+		rec = pcapPacket(now, client, local, data, fmt.Sprintf("profile=%s ip=%s reason=%s", w.opts.Profile, ip, reason))
+	} else {
+		line, err := json.Marshal(Record{
+			Time:    now,
+			Profile: w.opts.Profile,
+			IP:      ip,
+			Client:  addrString(client),
+			Local:   addrString(local),
+			Reason:  reason,
+			Len:     len(data),
+			Hex:     hex.EncodeToString(data),
+		})
+		if err != nil {
+			return
+		}
+		rec = append(line, '\n')
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil || w.size+int64(len(rec)) > w.opts.FileSize {
+		if err := w.rotate(now); err != nil {
+			log.Printf("[WARN] capture: %v", err)
+			return
+		}
+	}
+	n, err := w.f.Write(rec)
+	w.size += int64(n)
+	if err != nil {
+		log.Printf("[WARN] capture: escribiendo %s: %v", w.f.Name(), err)
+	}
+}
+
+// rotate cierra el archivo actual, abre uno nuevo y borra los más viejos que
+// excedan Keep. Se llama con mu tomado.
+func (w *Writer) rotate(now time.Time) error {
+	if w.f != nil {
+		w.f.Close()
+		w.f = nil
+	}
+	base := w.prefix() + now.Format("20060102-150405")
+	var f *os.File
+	i := 0
+	if base == w.lastBase {
+		i = w.lastSeq + 1
+	}
+	for ; ; i++ {
+		name := base + "." + w.opts.Format
+		if i > 0 {
+			name = fmt.Sprintf("%s-%03d.%s", base, i, w.opts.Format)
+		}
+		var err error
+		f, err = os.OpenFile(filepath.Join(w.opts.Dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+	}
+	w.f, w.size = f, 0
+	w.lastBase, w.lastSeq = base, i
+	if w.opts.Format == FormatPcapNG {
+		n, err := f.Write(pcapHeader())
+		w.size = int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	files, err := w.Files()
+	if err != nil {
+		return nil
+	}
+	for i := 0; i < len(files)-w.opts.Keep; i++ {
+		_ = os.Remove(filepath.Join(w.opts.Dir, files[i].Name))
+	}
+	return nil
+}
+
+// Close cierra el archivo actual.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Close()
+	w.f = nil
+	return err
+}
+
+// prefix es el prefijo de los archivos de este perfil.
+func (w *Writer) prefix() string {
+	return "capture-" + w.opts.Profile + "-"
+}
+
+// isCaptureFile indica si name es un archivo de capturas de este perfil.
+func (w *Writer) isCaptureFile(name string) bool {
+	return strings.HasPrefix(name, w.prefix()) &&
+		(strings.HasSuffix(name, "."+FormatJSONL) || strings.HasSuffix(name, "."+FormatPcapNG))
+}
+
+// Files retorna los archivos de capturas, del más viejo al más nuevo.
+func (w *Writer) Files() ([]FileInfo, error) {
+	entries, err := os.ReadDir(w.opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var out []FileInfo
+	for _, e := range entries {
+		if e.IsDir() || !w.isCaptureFile(e.Name()) {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		out = append(out, FileInfo{Name: e.Name(), Size: fi.Size(), Modified: fi.ModTime().Unix()})
+	}
+	// Se compara sin la extensión para que "…-150405.jsonl" quede antes que
+	// "…-150405-001.jsonl", abierto después en el mismo segundo
+	sort.Slice(out, func(i, j int) bool {
+		return strings.TrimSuffix(out[i].Name, filepath.Ext(out[i].Name)) < strings.TrimSuffix(out[j].Name, filepath.Ext(out[j].Name))
+	})
+	return out, nil
+}
+
+// Open abre un archivo de capturas para descargarlo. name debe ser uno de los que
+// retorna Files.
+func (w *Writer) Open(name string) (*os.File, error) {
+	if name != filepath.Base(name) || !w.isCaptureFile(name) {
+		return nil, fmt.Errorf("archivo de captura inválido %q", name)
+	}
+	return os.Open(filepath.Join(w.opts.Dir, name))
+}
+
+// Flag marca una IP o rango ("2001:db8::/64") para capturar también sus sesiones
+// aceptadas y todos sus rechazos durante d.
+func (w *Writer) Flag(target string, d time.Duration) error {
+	key, err := flagKey(target)
+	if err != nil {
+		return err
+	}
+	w.flagMu.Lock()
+	w.flags[key] = time.Now().Add(d)
+	w.flagMu.Unlock()
+	return nil
+}
+
+// Unflag quita la marca de target. Retorna false si no estaba marcado.
+func (w *Writer) Unflag(target string) bool {
+	key, err := flagKey(target)
+	if err != nil {
+		return false
+	}
+	w.flagMu.Lock()
+	defer w.flagMu.Unlock()
+	_, ok := w.flags[key]
+	delete(w.flags, key)
+	return ok
+}
+
+// Flags retorna las marcas vigentes.
+func (w *Writer) Flags() []Flag {
+	now := time.Now()
+	w.flagMu.Lock()
+	out := make([]Flag, 0, len(w.flags))
+	for k, until := range w.flags {
+		if now.Before(until) {
+			out = append(out, Flag{Target: k, Until: until.Unix()})
+		}
+	}
+	w.flagMu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Target < out[j].Target })
+	return out
+}
+
+// Flagged indica si ip está marcada, directamente o por un rango.
+func (w *Writer) Flagged(ip string) bool {
+	now := time.Now()
+	w.flagMu.Lock()
+	defer w.flagMu.Unlock()
+	if len(w.flags) == 0 {
+		return false
+	}
+	var addr netip.Addr
+	for k, until := range w.flags {
+		if !now.Before(until) {
+			delete(w.flags, k)
+			continue
+		}
+		if k == ip {
+			return true
+		}
+		if strings.Contains(k, "/") {
+			if !addr.IsValid() {
+				a, err := netip.ParseAddr(ip)
+				if err != nil {
+					continue
+				}
+				addr = a
+			}
+			if p, err := netip.ParsePrefix(k); err == nil && p.Contains(addr) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// flagKey normaliza una IP o rango.
+func flagKey(target string) (string, error) {
+	if p, err := netip.ParsePrefix(target); err == nil {
+		return p.Masked().String(), nil
+	}
+	a, err := netip.ParseAddr(target)
+	if err != nil {
+		return "", fmt.Errorf("IP o rango inválido %q", target)
+	}
+	return a.Unmap().String(), nil
+}
+
+func addrString(a netip.AddrPort) string {
+	if !a.IsValid() {
+		return ""
+	}
+	return a.String()
+}
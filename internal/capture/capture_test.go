@@ -0,0 +1,254 @@
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newWriter crea un Writer sobre un directorio temporal.
+func newWriter(t *testing.T, opts Options, p Policy) *Writer {
+	t.Helper()
+	opts.Dir = t.TempDir()
+	if opts.Profile == "" {
+		opts.Profile = "login"
+	}
+	w, err := New(opts, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { w.Close() })
+	return w
+}
+
+// pcapBlock es un bloque leído de un archivo pcap-ng.
+type pcapBlock struct {
+	typ  uint32
+	body []byte
+}
+
+// readBlocks separa data en bloques pcap-ng y verifica el largo de cada uno.
+func readBlocks(t *testing.T, data []byte) []pcapBlock {
+	t.Helper()
+	var out []pcapBlock
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatalf("bloque truncado: %d bytes", len(data))
+		}
+		total := le.Uint32(data[4:])
+		if total%4 != 0 || int(total) > len(data) {
+			t.Fatalf("largo de bloque %d inválido (quedan %d bytes)", total, len(data))
+		}
+		if trailer := le.Uint32(data[total-4:]); trailer != total {
+			t.Fatalf("largo final %d distinto del inicial %d", trailer, total)
+		}
+		out = append(out, pcapBlock{typ: le.Uint32(data), body: data[8 : total-4]})
+		data = data[total:]
+	}
+	return out
+}
+
+func TestPcapNGLayout(t *testing.T) {
+	w := newWriter(t, Options{Format: FormatPcapNG}, Policy{})
+	samples := []struct {
+		client, local netip.AddrPort
+		data          []byte
+	}{
+		{netip.MustParseAddrPort("203.0.113.7:51000"), netip.MustParseAddrPort("192.0.2.1:7666"), []byte("GET / HTTP/1.0\r\n\r\n\x01")}, // largo impar
+		{netip.MustParseAddrPort("[2001:db8::7]:51000"), netip.MustParseAddrPort("[2001:db8::1]:7666"), []byte{0x01, 0x02, 0x03, 0x04}},
+		{netip.MustParseAddrPort("203.0.113.8:51000"), netip.AddrPort{}, []byte("x")}, // local desconocido
+	}
+	for _, s := range samples {
+		w.Capture(s.client.Addr().String(), "bad_handshake", s.client, s.local, s.data)
+	}
+	w.Close()
+
+	files, err := w.Files()
+	if err != nil || len(files) != 1 || !strings.HasSuffix(files[0].Name, ".pcapng") {
+		t.Fatalf("archivos %v, %v", files, err)
+	}
+	data, err := os.ReadFile(filepath.Join(w.opts.Dir, files[0].Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := readBlocks(t, data)
+	if len(blocks) != 2+len(samples) {
+		t.Fatalf("%d bloques, se esperaban SHB, IDB y %d EPB", len(blocks), len(samples))
+	}
+	if blocks[0].typ != blockSHB || le.Uint32(blocks[0].body) != byteOrderMag || le.Uint16(blocks[0].body[4:]) != 1 {
+		t.Fatalf("SHB inválido: %x", blocks[0].body)
+	}
+	if blocks[1].typ != blockIDB || le.Uint16(blocks[1].body) != linktypeRaw {
+		t.Fatalf("IDB inválido: %x", blocks[1].body)
+	}
+
+	for i, s := range samples {
+		b := blocks[2+i]
+		if b.typ != blockEPB {
+			t.Fatalf("bloque %d de tipo %#x, se esperaba EPB", 2+i, b.typ)
+		}
+		capLen, origLen := le.Uint32(b.body[12:]), le.Uint32(b.body[16:])
+		if capLen != origLen {
+			t.Fatalf("muestra %d: captured %d != original %d", i, capLen, origLen)
+		}
+		pkt := b.body[20 : 20+capLen]
+		var tcp, pseudo []byte
+		if s.client.Addr().Is4() {
+			if pkt[0] != 0x45 || checksum(pkt[:20]) != 0 {
+				t.Fatalf("muestra %d: header IPv4 inválido", i)
+			}
+			tcp = pkt[20:]
+			pseudo = append(append([]byte{}, pkt[12:20]...), 0, 6, byte(len(tcp)>>8), byte(len(tcp)))
+		} else {
+			if pkt[0]>>4 != 6 || int(binary.BigEndian.Uint16(pkt[4:])) != len(pkt)-40 {
+				t.Fatalf("muestra %d: header IPv6 inválido", i)
+			}
+			tcp = pkt[40:]
+			pseudo = binary.BigEndian.AppendUint32(append([]byte{}, pkt[8:40]...), uint32(len(tcp)))
+			pseudo = append(pseudo, 0, 0, 0, 6)
+		}
+		if checksum(pseudo, tcp) != 0 {
+			t.Fatalf("muestra %d: checksum TCP inválido", i)
+		}
+		if binary.BigEndian.Uint16(tcp) != s.client.Port() || !bytes.Equal(tcp[20:], s.data) {
+			t.Fatalf("muestra %d: puerto %d, payload %q", i, binary.BigEndian.Uint16(tcp), tcp[20:])
+		}
+		// Opciones: comentario con el motivo y opt_endofopt
+		opts := b.body[20+(capLen+3)/4*4:]
+		if le.Uint16(opts) != optComment {
+			t.Fatalf("muestra %d: opción %d, se esperaba comentario", i, le.Uint16(opts))
+		}
+		comment := string(opts[4 : 4+le.Uint16(opts[2:])])
+		if !strings.Contains(comment, "profile=login") || !strings.Contains(comment, "reason=bad_handshake") {
+			t.Fatalf("muestra %d: comentario %q", i, comment)
+		}
+		if end := opts[len(opts)-4:]; !bytes.Equal(end, []byte{0, 0, 0, 0}) {
+			t.Fatalf("muestra %d: sin opt_endofopt", i)
+		}
+	}
+}
+
+func TestWantPerIPPerMinute(t *testing.T) {
+	w := newWriter(t, Options{}, Policy{Bytes: 64, Reasons: []string{"rate"}, PerIPPerMinute: 3})
+	for i := 0; i < 3; i++ {
+		if n := w.Want("203.0.113.7", "rate"); n != 64 {
+			t.Fatalf("muestra %d: Want = %d, se esperaba 64", i+1, n)
+		}
+	}
+	if n := w.Want("203.0.113.7", "rate"); n != 0 {
+		t.Fatalf("cuarta muestra del minuto: Want = %d, se esperaba 0", n)
+	}
+	if n := w.Want("203.0.113.8", "rate"); n != 64 {
+		t.Fatal("el tope de una IP afectó a otra")
+	}
+	if n := w.Want("203.0.113.9", "tempblock"); n != 0 {
+		t.Fatal("se capturó un motivo que no está en Reasons")
+	}
+	if n := w.Want("203.0.113.9", "flagged"); n != 0 {
+		t.Fatal("se capturó una sesión aceptada de una IP no marcada")
+	}
+
+	// Las IPs marcadas se capturan con cualquier motivo, con el mismo tope
+	if err := w.Flag("198.51.100.0/24", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if n := w.Want("198.51.100.20", "flagged"); n != 64 {
+		t.Fatalf("IP marcada por rango: Want = %d", n)
+	}
+
+	// Pasado el minuto se renueva el tope
+	w.budgetMu.Lock()
+	w.window = w.window.Add(-time.Minute)
+	w.budgetMu.Unlock()
+	if n := w.Want("203.0.113.7", "rate"); n != 64 {
+		t.Fatalf("minuto siguiente: Want = %d, se esperaba 64", n)
+	}
+}
+
+func TestOpenRejectsOtherFiles(t *testing.T) {
+	w := newWriter(t, Options{}, Policy{})
+	w.Capture("203.0.113.7", "rate", netip.AddrPort{}, netip.AddrPort{}, []byte("x"))
+	files, err := w.Files()
+	if err != nil || len(files) != 1 {
+		t.Fatalf("archivos %v, %v", files, err)
+	}
+	f, err := w.Open(files[0].Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if err := os.WriteFile(filepath.Join(w.opts.Dir, "config.json"), []byte("{}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{
+		"../x",
+		"../" + files[0].Name,
+		"sub/" + files[0].Name,
+		"/etc/passwd",
+		"config.json",
+		"capture-game-20250101-120000.jsonl", // otro perfil
+		"capture-login-20250101-120000.txt",
+		"",
+	} {
+		if f, err := w.Open(name); err == nil {
+			f.Close()
+			t.Errorf("Open(%q) aceptado", name)
+		}
+	}
+}
+
+func TestRotationKeep(t *testing.T) {
+	w := newWriter(t, Options{FileSize: 600, Keep: 3}, Policy{})
+	for i := 0; i < 40; i++ {
+		w.Capture("203.0.113.7", "rate", netip.AddrPort{}, netip.AddrPort{}, []byte{byte(i)})
+	}
+	w.Close()
+
+	files, err := w.Files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("%d archivos, se esperaban 3 (keep)", len(files))
+	}
+	// Se conservan los más nuevos: la última muestra está en el último archivo y
+	// los registros siguen en orden a lo largo de los archivos
+	last := -1
+	for _, fi := range files {
+		if fi.Size > 600 {
+			t.Fatalf("%s mide %d bytes, más que FileSize", fi.Name, fi.Size)
+		}
+		f, err := w.Open(fi.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			var rec Record
+			if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+				t.Fatal(err)
+			}
+			b, err := hex.DecodeString(rec.Hex)
+			if err != nil || len(b) != 1 {
+				t.Fatalf("payload %q: %v", rec.Hex, err)
+			}
+			if int(b[0]) != last+1 && last != -1 {
+				t.Fatalf("%s: muestra %d después de %d", fi.Name, b[0], last)
+			}
+			last = int(b[0])
+		}
+		f.Close()
+	}
+	if last != 39 {
+		t.Fatalf("última muestra conservada %d, se esperaba 39", last)
+	}
+}
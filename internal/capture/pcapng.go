@@ -0,0 +1,143 @@
+package capture
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"time"
+)
+
+// pcap-ng: cada archivo empieza con un Section Header Block y una sola interfaz
+// LINKTYPE_RAW; cada muestra es un Enhanced Packet Block con un paquete IP+TCP
+// sintético (cliente → puerto local, PSH|ACK) cuyo payload son los bytes
+// capturados, y el motivo en el comentario del paquete.
+const (
+	blockSHB     = 0x0A0D0D0A
+	blockIDB     = 0x00000001
+	blockEPB     = 0x00000006
+	linktypeRaw  = 101
+	optComment   = 1
+	byteOrderMag = 0x1A2B3C4D
+)
+
+var le = binary.LittleEndian
+
+// pcapHeader retorna el SHB y el IDB con que empieza cada archivo.
+func pcapHeader() []byte {
+	shb := make([]byte, 16)
+	le.PutUint32(shb[0:], byteOrderMag)
+	le.PutUint16(shb[4:], 1) // versión 1.0
+	le.PutUint64(shb[8:], ^uint64(0))
+	idb := make([]byte, 8)
+	le.PutUint16(idb[0:], linktypeRaw)
+	return append(block(blockSHB, shb), block(blockIDB, idb)...)
+}
+
+// pcapPacket retorna el EPB de una muestra.
+func pcapPacket(t time.Time, client, local netip.AddrPort, data []byte, comment string) []byte {
+	pkt := tcpPacket(client, local, data)
+	ts := uint64(t.UnixMicro())
+	body := make([]byte, 20, 20+len(pkt)+8+len(comment)+8)
+	le.PutUint32(body[4:], uint32(ts>>32))
+	le.PutUint32(body[8:], uint32(ts))
+	le.PutUint32(body[12:], uint32(len(pkt)))
+	le.PutUint32(body[16:], uint32(len(pkt)))
+	body = pad(append(body, pkt...))
+	opt := make([]byte, 4)
+	le.PutUint16(opt[0:], optComment)
+	le.PutUint16(opt[2:], uint16(len(comment)))
+	body = pad(append(append(body, opt...), comment...))
+	body = append(body, 0, 0, 0, 0) // opt_endofopt
+	return block(blockEPB, body)
+}
+
+// block arma un bloque pcap-ng: tipo, largo total, cuerpo y largo total de nuevo.
+func block(typ uint32, body []byte) []byte {
+	total := uint32(12 + len(body))
+	b := make([]byte, 8, total)
+	le.PutUint32(b[0:], typ)
+	le.PutUint32(b[4:], total)
+	b = append(b, body...)
+	return le.AppendUint32(b, total)
+}
+
+func pad(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// tcpPacket arma un paquete IPv4 o IPv6 con un segmento TCP que lleva data. Si
+// local no es de la misma familia que client se usa la dirección cero.
+func tcpPacket(client, local netip.AddrPort, data []byte) []byte {
+	src, dst := client.Addr().Unmap(), local.Addr().Unmap()
+	if !src.IsValid() {
+		src = netip.IPv4Unspecified()
+	}
+	if !dst.IsValid() || dst.Is4() != src.Is4() {
+		dst = netip.IPv4Unspecified()
+		if src.Is6() {
+			dst = netip.IPv6Unspecified()
+		}
+	}
+
+	tcp := make([]byte, 20, 20+len(data))
+	binary.BigEndian.PutUint16(tcp[0:], client.Port())
+	binary.BigEndian.PutUint16(tcp[2:], local.Port())
+	binary.BigEndian.PutUint32(tcp[4:], 1) // seq
+	binary.BigEndian.PutUint32(tcp[8:], 1) // ack
+	tcp[12] = 5 << 4                       // data offset
+	tcp[13] = 0x18                         // PSH|ACK
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	tcp = append(tcp, data...)
+
+	// Pseudo-header para el checksum TCP
+	s, d := src.AsSlice(), dst.AsSlice()
+	pseudo := append(append([]byte{}, s...), d...)
+	if src.Is4() {
+		pseudo = append(pseudo, 0, 6, byte(len(tcp)>>8), byte(len(tcp)))
+	} else {
+		pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(len(tcp)))
+		pseudo = append(pseudo, 0, 0, 0, 6)
+	}
+	binary.BigEndian.PutUint16(tcp[16:], checksum(pseudo, tcp))
+
+	if src.Is4() {
+		ip := make([]byte, 20, 20+len(tcp))
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+		binary.BigEndian.PutUint16(ip[6:], 0x4000) // DF
+		ip[8] = 64                                 // TTL
+		ip[9] = 6                                  // TCP
+		copy(ip[12:], s)
+		copy(ip[16:], d)
+		binary.BigEndian.PutUint16(ip[10:], checksum(ip))
+		return append(ip, tcp...)
+	}
+	ip := make([]byte, 40, 40+len(tcp))
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:], uint16(len(tcp)))
+	ip[6] = 6  // TCP
+	ip[7] = 64 // hop limit
+	copy(ip[8:], s)
+	copy(ip[24:], d)
+	return append(ip, tcp...)
+}
+
+// checksum es el checksum de Internet (RFC 1071) de la concatenación de parts.
+// Solo la última parte puede tener largo impar.
+func checksum(parts ...[]byte) uint16 {
+	var sum uint32
+	for _, p := range parts {
+		for i := 0; i+1 < len(p); i += 2 {
+			sum += uint32(p[i])<<8 | uint32(p[i+1])
+		}
+		if len(p)%2 == 1 {
+			sum += uint32(p[len(p)-1]) << 8
+		}
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
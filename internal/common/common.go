@@ -64,21 +64,27 @@ func (t *IPLogThrottle) Allow(ip string) bool {
 
 // Logger maneja el logging con throttling por IP
 type Logger struct {
-	level      int
+	level      atomic.Int32
 	throttle   *IPLogThrottle
 	rejectCnt  atomic.Uint64
 	lastReject atomic.Uint64
 }
 
 func NewLogger(level int) *Logger {
-	return &Logger{
-		level:    level,
+	l := &Logger{
 		throttle: NewIPLogThrottle(2 * time.Second),
 	}
+	l.level.Store(int32(level))
+	return l
+}
+
+// SetLevel cambia el nivel de log en caliente.
+func (l *Logger) SetLevel(level int) {
+	l.level.Store(int32(level))
 }
 
 func (l *Logger) LogMsg(lvl int, ip, msg string, args ...interface{}) {
-	if lvl < l.level {
+	if int32(lvl) < l.level.Load() {
 		return
 	}
 	if ip != "" && !l.throttle.Allow(ip) {
@@ -122,6 +128,20 @@ func IsConsolePresent() bool {
 	return (mode & os.ModeCharDevice) != 0
 }
 
+// ExePath resuelve una ruta relativa contra el directorio del ejecutable
+// (como servicio el directorio de trabajo suele ser C:\Windows\System32).
+// Las rutas absolutas y la ruta vacía se retornan sin cambios.
+func ExePath(p string) string {
+	if p == "" || filepath.IsAbs(p) {
+		return p
+	}
+	exeDir := filepath.Dir(os.Args[0])
+	if exeDir == "" {
+		exeDir = "."
+	}
+	return filepath.Join(exeDir, p)
+}
+
 // SetupInitialLogging configura logging básico antes de cargar la configuración
 func SetupInitialLogging(logName string) *os.File {
 	if !IsConsolePresent() {
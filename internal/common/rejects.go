@@ -0,0 +1,76 @@
+package common
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// RejectCounters cuenta los rechazos por perfil y motivo ("rate", "tempblock",
+// "overload", ...) desde el arranque. Es seguro para uso concurrente.
+type RejectCounters struct {
+	mu    sync.RWMutex
+	byKey map[rejectKey]*atomic.Uint64
+}
+
+type rejectKey struct {
+	profile, reason string
+}
+
+// NewRejectCounters crea un registro vacío.
+func NewRejectCounters() *RejectCounters {
+	return &RejectCounters{byKey: make(map[rejectKey]*atomic.Uint64)}
+}
+
+// Inc cuenta un rechazo de profile por reason.
+func (c *RejectCounters) Inc(profile, reason string) {
+	k := rejectKey{profile, reason}
+	c.mu.RLock()
+	n, ok := c.byKey[k]
+	c.mu.RUnlock()
+	if !ok {
+		c.mu.Lock()
+		if n, ok = c.byKey[k]; !ok {
+			n = &atomic.Uint64{}
+			c.byKey[k] = n
+		}
+		c.mu.Unlock()
+	}
+	n.Add(1)
+}
+
+// Snapshot retorna los rechazos de profile por motivo.
+func (c *RejectCounters) Snapshot(profile string) map[string]uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	out := make(map[string]uint64)
+	for k, n := range c.byKey {
+		if k.profile == profile {
+			out[k.reason] = n.Load()
+		}
+	}
+	return out
+}
+
+// Total retorna la suma de los rechazos de profile.
+func (c *RejectCounters) Total(profile string) uint64 {
+	var total uint64
+	for _, n := range c.Snapshot(profile) {
+		total += n
+	}
+	return total
+}
+
+// RejectRates retorna los rechazos por segundo de cada motivo entre dos Snapshot
+// tomados con secs segundos de diferencia. Omite los motivos sin rechazos nuevos.
+func RejectRates(prev, cur map[string]uint64, secs float64) map[string]float64 {
+	out := make(map[string]float64)
+	if secs <= 0 {
+		return out
+	}
+	for reason, n := range cur {
+		if n > prev[reason] {
+			out[reason] = float64(n-prev[reason]) / secs
+		}
+	}
+	return out
+}
@@ -1,34 +1,107 @@
 package config
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"net/netip"
 	"os"
 	"path/filepath"
+	"regexp"
 )
 
 // ProfileConfig representa la configuración de un perfil (login o game)
 type ProfileConfig struct {
-	ListenAddr                string  `json:"listen_addr"`
-	BackendAddr               string  `json:"backend_addr"`
-	MaxLiveConnsPerIP         int     `json:"max_live_conns_per_ip"`
-	AttemptRefillPerSec       float64 `json:"attempt_refill_per_sec"`
-	AttemptBurst              float64 `json:"attempt_burst"`
-	DeniesBeforeTempBlock     int     `json:"denies_before_tempblock"`
-	TempBlockSeconds          int     `json:"tempblock_seconds"`
-	MaxTotalConns             int     `json:"max_total_conns"`
-	IdleTimeoutSeconds        int     `json:"idle_timeout_seconds"`
-	StaleAfterSeconds         int     `json:"stale_after_seconds"`
-	CleanupEverySeconds       int     `json:"cleanup_every_seconds"`
-	EnableFirewallAutoban     bool    `json:"enable_firewall_autoban"`
-	FirewallBlockSeconds      int     `json:"firewall_block_seconds"`
-	LogLevel                  string  `json:"log_level"`
-	LogFile                   string  `json:"log_file"`
-	AdminListenAddr           string  `json:"admin_listen_addr"`
-	MaxDrainSeconds           int      `json:"max_drain_seconds"`            // 0=sin límite; default 60 para login
-	BackendDialTimeoutSeconds int      `json:"backend_dial_timeout_seconds"` // default 5 login, 10 game
-	AdminAllowIPs             []string `json:"admin_allow_ips"`              // IPs adicionales permitidas (panel remoto)
-	AdminToken                string   `json:"admin_token"`                  // token Bearer para acceso remoto
+	ListenAddr                string          `json:"listen_addr"`
+	BackendAddr               string          `json:"backend_addr"`
+	MaxLiveConnsPerIP         int             `json:"max_live_conns_per_ip"`
+	AttemptRefillPerSec       float64         `json:"attempt_refill_per_sec"`
+	AttemptBurst              float64         `json:"attempt_burst"`
+	DeniesBeforeTempBlock     int             `json:"denies_before_tempblock"`
+	TempBlockSeconds          int             `json:"tempblock_seconds"`
+	MaxTotalConns             int             `json:"max_total_conns"`
+	IdleTimeoutSeconds        int             `json:"idle_timeout_seconds"`
+	StaleAfterSeconds         int             `json:"stale_after_seconds"`
+	CleanupEverySeconds       int             `json:"cleanup_every_seconds"`
+	EnableFirewallAutoban     bool            `json:"enable_firewall_autoban"`
+	FirewallBlockSeconds      int             `json:"firewall_block_seconds"`
+	FirewallBackend           string          `json:"firewall_backend"`     // netsh | nftables | ipset; vacío = default del SO
+	FirewallStateFile         string          `json:"firewall_state_file"`  // expiraciones persistidas para reconciliar reglas al reiniciar
+	StoreFile                 string          `json:"store_file"`           // store persistente de bans/reputación ("" = deshabilitado)
+	StoreRetentionDays        int             `json:"store_retention_days"` // días que se conserva el historial de una IP; default 7
+	LogLevel                  string          `json:"log_level"`
+	LogFile                   string          `json:"log_file"`
+	AdminListenAddr           string          `json:"admin_listen_addr"`
+	MaxDrainSeconds           int             `json:"max_drain_seconds"`            // 0=sin límite; default 60 para login
+	BackendDialTimeoutSeconds int             `json:"backend_dial_timeout_seconds"` // default 5 login, 10 game
+	AdminAllowIPs             []string        `json:"admin_allow_ips"`              // IPs adicionales permitidas (panel remoto)
+	AdminToken                string          `json:"admin_token"`                  // token Bearer para acceso remoto
+	MetricsFile               string          `json:"metrics_file"`                 // historial de métricas de /api/metrics (10s por 1h, 1m por 1 día, 10m por 30 días)
+	AuditFile                 string          `json:"audit_file"`                   // eventos y acciones de la API admin (JSONL, solo agregado)
+	AuditFileMB               int             `json:"audit_file_mb"`                // tamaño a partir del cual se rota; default 10
+	AuditKeepFiles            int             `json:"audit_keep_files"`             // archivos de auditoría que se conservan; default 10
+	AllowCIDRs                []string        `json:"allow_cidrs"`                  // IPs/rangos sin límites por IP ni autoban (cuentan para max_total_conns)
+	DenyCIDRs                 []string        `json:"deny_cidrs"`                   // IPs/rangos rechazados siempre
+	ProxyProtocolTrusted      []string        `json:"proxy_protocol_trusted"`       // upstreams (HAProxy) que envían header PROXY v1/v2; vacío = deshabilitado
+	BackendProxyProtocol      string          `json:"backend_proxy_protocol"`       // "v1" | "v2": envía header PROXY al backend con la IP real; "" = no
+	IPv6ClientPrefix          int             `json:"ipv6_client_prefix"`           // las IPv6 del mismo /N cuentan como un cliente; default 64, 128 = sin agrupar
+	EnableSubnetLimit         bool            `json:"enable_subnet_limit"`          // segundo nivel de límites agregado por subred
+	SubnetV4Prefix            int             `json:"subnet_v4_prefix"`             // default 24
+	SubnetV6Prefix            int             `json:"subnet_v6_prefix"`             // default 64
+	SubnetRefillPerSec        float64         `json:"subnet_refill_per_sec"`        // -1 = sin token bucket por subred
+	SubnetBurst               float64         `json:"subnet_burst"`
+	SubnetMaxLiveConns        int             `json:"subnet_max_live_conns"`         // -1 = sin límite
+	SubnetBlockAfterIPs       int             `json:"subnet_block_after_ips"`        // IPs en tempblock que bloquean la subred; -1 = sin escalado
+	Backends                  []BackendConfig `json:"backends"`                      // varios backends con failover; vacío = solo backend_addr
+	BackendStrategy           string          `json:"backend_strategy"`              // round_robin | least_conn | primary_standby
+	HealthCheckIntervalSecs   int             `json:"health_check_interval_seconds"` // default 5; -1 = sin health checks activos
+	HealthCheckTimeoutSecs    int             `json:"health_check_timeout_seconds"`  // default 2
+	HealthCheckFall           int             `json:"health_check_fall"`             // fallos consecutivos para marcar un backend caído; default 3
+	HealthCheckRise           int             `json:"health_check_rise"`             // éxitos consecutivos para volver a usarlo; default 2
+	BreakerFailures           int             `json:"breaker_failures"`              // dials fallidos seguidos que abren el circuito de un backend; default 5, -1 = sin breaker
+	BreakerOpenSeconds        int             `json:"breaker_open_seconds"`          // tiempo con el circuito abierto antes de probar de nuevo; default 10
+	MaintenanceResponseFile   string          `json:"maintenance_response_file"`     // bytes que se envían al cliente si no hay backend disponible ("" = solo cerrar)
+	ShutdownGraceSeconds      int             `json:"shutdown_grace_seconds"`        // al detener, espera a las sesiones abiertas; default 15 login, 60 game; -1 = cortar de inmediato
+	HandshakeTimeoutSeconds   int             `json:"handshake_timeout_seconds"`     // espera del primer payload del cliente antes de conectar al backend; 0 = conectar de inmediato
+	HandshakeMinBytes         int             `json:"handshake_min_bytes"`           // bytes mínimos del primer payload; default 1
+	HandshakeRules            *HandshakeRules `json:"handshake_rules"`               // validación del primer payload (rechazo bad_handshake); nil = sin validar
+	ShapeInConnBytesPerSec    float64         `json:"shape_in_conn_bytes_per_sec"`   // caudal máximo cliente → backend por conexión; 0 = sin límite
+	ShapeInConnReadsPerSec    float64         `json:"shape_in_conn_reads_per_sec"`   // lecturas (≈ paquetes) por segundo cliente → backend por conexión
+	ShapeInIPBytesPerSec      float64         `json:"shape_in_ip_bytes_per_sec"`     // bytes por segundo cliente → backend, compartido entre las conexiones de la IP
+	ShapeInIPReadsPerSec      float64         `json:"shape_in_ip_reads_per_sec"`     // lecturas por segundo cliente → backend por IP
+	ShapeOutConnBytesPerSec   float64         `json:"shape_out_conn_bytes_per_sec"`  // caudal máximo backend → cliente por conexión
+	ShapeOutConnReadsPerSec   float64         `json:"shape_out_conn_reads_per_sec"`  // lecturas por segundo backend → cliente por conexión
+	ShapeOutIPBytesPerSec     float64         `json:"shape_out_ip_bytes_per_sec"`    // bytes por segundo backend → cliente por IP
+	ShapeOutIPReadsPerSec     float64         `json:"shape_out_ip_reads_per_sec"`    // lecturas por segundo backend → cliente por IP
+	ShapeBurstSeconds         float64         `json:"shape_burst_seconds"`           // ráfaga tolerada por encima del caudal; 0 = 2s
+	ShapeDisconnect           bool            `json:"shape_disconnect"`              // al exceder: cortar la sesión y contar un deny (si no, se demora la lectura)
+	HandoffSocket             string          `json:"handoff_socket"`                // socket Unix de control para traspasar el listener a un proceso nuevo (-takeover); "" = deshabilitado
+	HandoffTransferState      bool            `json:"handoff_transfer_state"`        // el proceso nuevo hereda también el estado del limiter (bloqueos, backoff, tokens)
+	CaptureDir                string          `json:"capture_dir"`                   // directorio de capturas de clientes rechazados o marcados; "" = deshabilitado
+	CaptureFormat             string          `json:"capture_format"`                // jsonl (default) | pcapng
+	CaptureBytes              int             `json:"capture_bytes"`                 // primeros bytes que se guardan por conexión; default 512
+	CaptureReasons            []string        `json:"capture_reasons"`               // motivos de rechazo que se capturan; default bad_handshake, handshake_timeout, tempblock
+	CapturePerIPPerMinute     int             `json:"capture_per_ip_per_minute"`     // tope de muestras por IP por minuto; default 5
+	CaptureFileMB             int             `json:"capture_file_mb"`               // tamaño a partir del cual se rota el archivo; default 10
+	CaptureKeepFiles          int             `json:"capture_keep_files"`            // archivos de captura que se conservan; default 10
+}
+
+// BackendConfig es un backend de la lista backends. Con primary_standby el orden
+// de la lista es la prioridad.
+type BackendConfig struct {
+	Addr   string `json:"addr"`
+	Weight int    `json:"weight"` // peso relativo para round_robin/least_conn; 0 = 1
+}
+
+// HandshakeRules son las reglas que debe cumplir el primer payload del cliente
+// antes de conectar al backend. Las listas vacías no restringen.
+type HandshakeRules struct {
+	LengthRanges       [][2]int `json:"length_ranges"`        // rangos [min, max] de largo permitidos (max 0 = sin tope)
+	PrefixesHex        []string `json:"prefixes_hex"`         // el payload debe empezar con alguno de estos bytes (hex)...
+	AllowRegex         []string `json:"allow_regex"`          // ...o cumplir alguno de estos patrones
+	DenyRegex          []string `json:"deny_regex"`           // se rechaza si cumple alguno (p. ej. "^(GET|POST|HEAD) ")
+	MaxHeaderBytes     int      `json:"max_header_bytes"`     // bytes máximos hasta header_delimiter_hex (o del payload); 0 = sin límite
+	HeaderDelimiterHex string   `json:"header_delimiter_hex"` // fin del header del protocolo (hex)
 }
 
 // Validate verifica que los campos críticos de la configuración sean válidos.
@@ -42,9 +115,108 @@ func Validate(cfg ProfileConfig) error {
 	if cfg.MaxLiveConnsPerIP <= 0 {
 		return fmt.Errorf("max_live_conns_per_ip debe ser > 0")
 	}
+	for _, c := range append(append([]string{}, cfg.AllowCIDRs...), cfg.DenyCIDRs...) {
+		if !validCIDR(c) {
+			return fmt.Errorf("allow_cidrs/deny_cidrs: entrada inválida %q", c)
+		}
+	}
+	for _, c := range cfg.ProxyProtocolTrusted {
+		if !validCIDR(c) {
+			return fmt.Errorf("proxy_protocol_trusted: entrada inválida %q", c)
+		}
+	}
+	if cfg.IPv6ClientPrefix < 1 || cfg.IPv6ClientPrefix > 128 {
+		return fmt.Errorf("ipv6_client_prefix debe estar entre 1 y 128")
+	}
+	if cfg.EnableSubnetLimit {
+		if cfg.SubnetV4Prefix < 1 || cfg.SubnetV4Prefix > 32 {
+			return fmt.Errorf("subnet_v4_prefix debe estar entre 1 y 32")
+		}
+		if cfg.SubnetV6Prefix < 1 || cfg.SubnetV6Prefix > 128 {
+			return fmt.Errorf("subnet_v6_prefix debe estar entre 1 y 128")
+		}
+		if cfg.SubnetRefillPerSec > 0 && cfg.SubnetBurst < 1 {
+			return fmt.Errorf("subnet_burst debe ser >= 1")
+		}
+	}
+	switch cfg.BackendProxyProtocol {
+	case "", "v1", "v2":
+	default:
+		return fmt.Errorf("backend_proxy_protocol inválido: %q (v1|v2)", cfg.BackendProxyProtocol)
+	}
+	for _, b := range cfg.Backends {
+		if b.Addr == "" {
+			return fmt.Errorf("backends: entrada sin addr")
+		}
+		if b.Weight < 0 {
+			return fmt.Errorf("backends: weight de %s debe ser >= 0", b.Addr)
+		}
+	}
+	switch cfg.BackendStrategy {
+	case "round_robin", "least_conn", "primary_standby":
+	default:
+		return fmt.Errorf("backend_strategy inválido: %q (round_robin|least_conn|primary_standby)", cfg.BackendStrategy)
+	}
+	if cfg.HandshakeTimeoutSeconds < 0 || cfg.HandshakeMinBytes < 0 {
+		return fmt.Errorf("handshake_timeout_seconds y handshake_min_bytes deben ser >= 0")
+	}
+	switch cfg.CaptureFormat {
+	case "", "jsonl", "pcapng":
+	default:
+		return fmt.Errorf("capture_format debe ser jsonl o pcapng")
+	}
+	if cfg.CaptureBytes < 0 || cfg.CapturePerIPPerMinute < 0 || cfg.CaptureFileMB < 0 || cfg.CaptureKeepFiles < 0 {
+		return fmt.Errorf("capture_bytes, capture_per_ip_per_minute, capture_file_mb y capture_keep_files deben ser >= 0")
+	}
+	if cfg.AuditFileMB < 0 || cfg.AuditKeepFiles < 0 {
+		return fmt.Errorf("audit_file_mb y audit_keep_files deben ser >= 0")
+	}
+	if r := cfg.HandshakeRules; r != nil {
+		for _, l := range r.LengthRanges {
+			if l[0] < 0 || l[1] < 0 || (l[1] > 0 && l[1] < l[0]) {
+				return fmt.Errorf("handshake_rules.length_ranges: rango inválido %v", l)
+			}
+		}
+		for _, h := range append(append([]string{}, r.PrefixesHex...), r.HeaderDelimiterHex) {
+			if _, err := hex.DecodeString(h); err != nil {
+				return fmt.Errorf("handshake_rules: hex inválido %q", h)
+			}
+		}
+		for _, p := range append(append([]string{}, r.AllowRegex...), r.DenyRegex...) {
+			if _, err := regexp.Compile(p); err != nil {
+				return fmt.Errorf("handshake_rules: patrón inválido %q: %v", p, err)
+			}
+		}
+		if r.MaxHeaderBytes < 0 {
+			return fmt.Errorf("handshake_rules.max_header_bytes debe ser >= 0")
+		}
+	}
+	for _, v := range []float64{
+		cfg.ShapeInConnBytesPerSec, cfg.ShapeInConnReadsPerSec, cfg.ShapeInIPBytesPerSec, cfg.ShapeInIPReadsPerSec,
+		cfg.ShapeOutConnBytesPerSec, cfg.ShapeOutConnReadsPerSec, cfg.ShapeOutIPBytesPerSec, cfg.ShapeOutIPReadsPerSec,
+		cfg.ShapeBurstSeconds,
+	} {
+		if v < 0 {
+			return fmt.Errorf("shape_*: los límites de caudal deben ser >= 0")
+		}
+	}
+	switch cfg.FirewallBackend {
+	case "", "netsh", "nftables", "ipset":
+	default:
+		return fmt.Errorf("firewall_backend inválido: %q (netsh|nftables|ipset)", cfg.FirewallBackend)
+	}
 	return nil
 }
 
+// validCIDR acepta una IP suelta o un rango CIDR.
+func validCIDR(s string) bool {
+	if _, err := netip.ParsePrefix(s); err == nil {
+		return true
+	}
+	_, err := netip.ParseAddr(s)
+	return err == nil
+}
+
 // MultiProfileConfig representa el archivo de configuración completo con múltiples perfiles
 type MultiProfileConfig struct {
 	Login ProfileConfig `json:"login"`
@@ -67,10 +239,30 @@ func DefaultLoginConfig() ProfileConfig {
 		CleanupEverySeconds:       30,
 		EnableFirewallAutoban:     true,
 		FirewallBlockSeconds:      900,
+		FirewallStateFile:         "firewall-login.json",
+		StoreRetentionDays:        7,
+		IPv6ClientPrefix:          64,
+		SubnetV4Prefix:            24,
+		SubnetV6Prefix:            64,
+		SubnetRefillPerSec:        8.0,
+		SubnetBurst:               24,
+		SubnetMaxLiveConns:        32,
+		SubnetBlockAfterIPs:       4,
+		BackendStrategy:           "round_robin",
+		HealthCheckIntervalSecs:   5,
+		HealthCheckTimeoutSecs:    2,
+		HealthCheckFall:           3,
+		HealthCheckRise:           2,
+		BreakerFailures:           5,
+		BreakerOpenSeconds:        10,
+		ShutdownGraceSeconds:      15,
 		LogLevel:                  "info",
 		AdminListenAddr:           "127.0.0.1:7771",
+		MetricsFile:               "metrics-login.json",
+		AuditFile:                 "audit-login.jsonl",
 		MaxDrainSeconds:           60,
 		BackendDialTimeoutSeconds: 5,
+		CaptureReasons:            []string{"bad_handshake", "handshake_timeout", "tempblock"},
 	}
 }
 
@@ -90,13 +282,56 @@ func DefaultGameConfig() ProfileConfig {
 		CleanupEverySeconds:       30,
 		EnableFirewallAutoban:     true,
 		FirewallBlockSeconds:      600,
+		FirewallStateFile:         "firewall-game.json",
+		StoreRetentionDays:        7,
+		IPv6ClientPrefix:          64,
+		SubnetV4Prefix:            24,
+		SubnetV6Prefix:            64,
+		SubnetRefillPerSec:        16.0,
+		SubnetBurst:               40,
+		SubnetMaxLiveConns:        64,
+		SubnetBlockAfterIPs:       6,
+		BackendStrategy:           "round_robin",
+		HealthCheckIntervalSecs:   5,
+		HealthCheckTimeoutSecs:    2,
+		HealthCheckFall:           3,
+		HealthCheckRise:           2,
+		BreakerFailures:           5,
+		BreakerOpenSeconds:        10,
+		ShutdownGraceSeconds:      60,
 		LogLevel:                  "info",
 		AdminListenAddr:           "127.0.0.1:7772",
+		MetricsFile:               "metrics-game.json",
+		AuditFile:                 "audit-game.jsonl",
 		MaxDrainSeconds:           0,
 		BackendDialTimeoutSeconds: 10,
+		CaptureReasons:            []string{"bad_handshake", "handshake_timeout", "tempblock"},
 	}
 }
 
+// FindPath retorna la ruta del archivo de configuración que usa LoadProfile: configPath
+// si no está vacío; si no, el primer config.json que exista en el directorio de trabajo
+// o junto al ejecutable. Retorna "" si no se encontró ninguno.
+func FindPath(configPath string) string {
+	if configPath != "" {
+		return configPath
+	}
+	possiblePaths := []string{
+		"config.json",
+		filepath.Join(filepath.Dir(os.Args[0]), "config.json"),
+	}
+	if exeDir := filepath.Dir(os.Args[0]); exeDir != "" {
+		possiblePaths = append(possiblePaths, filepath.Join(exeDir, "config.json"))
+	}
+
+	for _, p := range possiblePaths {
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	return ""
+}
+
 // LoadProfile carga un perfil específico desde un archivo de configuración
 // Si profileName está vacío, intenta detectarlo del nombre del ejecutable
 func LoadProfile(configPath, profileName string) (ProfileConfig, error) {
@@ -118,22 +353,7 @@ func LoadProfile(configPath, profileName string) (ProfileConfig, error) {
 	}
 
 	// Buscar el archivo de configuración
-	if configPath == "" {
-		possiblePaths := []string{
-			"config.json",
-			filepath.Join(filepath.Dir(os.Args[0]), "config.json"),
-		}
-		if exeDir := filepath.Dir(os.Args[0]); exeDir != "" {
-			possiblePaths = append(possiblePaths, filepath.Join(exeDir, "config.json"))
-		}
-
-		for _, p := range possiblePaths {
-			if _, err := os.Stat(p); err == nil {
-				configPath = p
-				break
-			}
-		}
-	}
+	configPath = FindPath(configPath)
 
 	// Si no se encontró config.json, usar valores por defecto
 	if configPath == "" {
@@ -224,6 +444,63 @@ func applyDefaults(cfg, defaults ProfileConfig) ProfileConfig {
 	if cfg.FirewallBlockSeconds == 0 {
 		cfg.FirewallBlockSeconds = defaults.FirewallBlockSeconds
 	}
+	if cfg.StoreRetentionDays == 0 {
+		cfg.StoreRetentionDays = defaults.StoreRetentionDays
+	}
+	if cfg.IPv6ClientPrefix == 0 {
+		cfg.IPv6ClientPrefix = defaults.IPv6ClientPrefix
+	}
+	if cfg.SubnetV4Prefix == 0 {
+		cfg.SubnetV4Prefix = defaults.SubnetV4Prefix
+	}
+	if cfg.SubnetV6Prefix == 0 {
+		cfg.SubnetV6Prefix = defaults.SubnetV6Prefix
+	}
+	if cfg.SubnetRefillPerSec == 0 {
+		cfg.SubnetRefillPerSec = defaults.SubnetRefillPerSec
+	}
+	if cfg.SubnetBurst == 0 {
+		cfg.SubnetBurst = defaults.SubnetBurst
+	}
+	if cfg.SubnetMaxLiveConns == 0 {
+		cfg.SubnetMaxLiveConns = defaults.SubnetMaxLiveConns
+	}
+	if cfg.SubnetBlockAfterIPs == 0 {
+		cfg.SubnetBlockAfterIPs = defaults.SubnetBlockAfterIPs
+	}
+	if cfg.BackendStrategy == "" {
+		cfg.BackendStrategy = defaults.BackendStrategy
+	}
+	if cfg.HealthCheckIntervalSecs == 0 {
+		cfg.HealthCheckIntervalSecs = defaults.HealthCheckIntervalSecs
+	}
+	if cfg.HealthCheckTimeoutSecs == 0 {
+		cfg.HealthCheckTimeoutSecs = defaults.HealthCheckTimeoutSecs
+	}
+	if cfg.HealthCheckFall == 0 {
+		cfg.HealthCheckFall = defaults.HealthCheckFall
+	}
+	if cfg.HealthCheckRise == 0 {
+		cfg.HealthCheckRise = defaults.HealthCheckRise
+	}
+	if cfg.BreakerFailures == 0 {
+		cfg.BreakerFailures = defaults.BreakerFailures
+	}
+	if cfg.BreakerOpenSeconds == 0 {
+		cfg.BreakerOpenSeconds = defaults.BreakerOpenSeconds
+	}
+	if cfg.ShutdownGraceSeconds == 0 {
+		cfg.ShutdownGraceSeconds = defaults.ShutdownGraceSeconds
+	}
+	if cfg.FirewallStateFile == "" {
+		cfg.FirewallStateFile = defaults.FirewallStateFile
+	}
+	if cfg.MetricsFile == "" {
+		cfg.MetricsFile = defaults.MetricsFile
+	}
+	if cfg.AuditFile == "" {
+		cfg.AuditFile = defaults.AuditFile
+	}
 	if cfg.LogLevel == "" {
 		cfg.LogLevel = defaults.LogLevel
 	}
@@ -234,6 +511,10 @@ func applyDefaults(cfg, defaults ProfileConfig) ProfileConfig {
 	if cfg.MaxDrainSeconds == 0 && defaults.MaxDrainSeconds != 0 {
 		cfg.MaxDrainSeconds = defaults.MaxDrainSeconds
 	}
+	// CaptureReasons: una lista vacía explícita significa capturar solo las IPs marcadas
+	if cfg.CaptureReasons == nil {
+		cfg.CaptureReasons = defaults.CaptureReasons
+	}
 	// LogFile puede estar vacío, no aplicar default
 	return cfg
 }
@@ -0,0 +1,109 @@
+package config
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// watchInterval es cada cuánto Watch revisa el archivo de configuración.
+const watchInterval = 2 * time.Second
+
+// restartKeys son los campos que no se pueden aplicar en caliente: cambian
+// recursos que se abren una sola vez al arrancar (firewall, store, logs, admin, handoff, capturas).
+var restartKeys = map[string]bool{
+	"enable_firewall_autoban": true,
+	"firewall_backend":        true,
+	"firewall_state_file":     true,
+	"store_file":              true,
+	"store_retention_days":    true,
+	"log_file":                true,
+	"admin_listen_addr":       true,
+	"metrics_file":            true,
+	"audit_file":              true,
+	"audit_file_mb":           true,
+	"audit_keep_files":        true,
+	"handoff_socket":          true,
+	"capture_dir":             true,
+	"capture_format":          true,
+	"capture_file_mb":         true,
+	"capture_keep_files":      true,
+}
+
+// Diff retorna los nombres JSON de los campos que difieren entre old y cur, en el
+// orden en que están declarados en ProfileConfig.
+func Diff(old, cur ProfileConfig) []string {
+	var changed []string
+	vo, vc := reflect.ValueOf(old), reflect.ValueOf(cur)
+	t := vo.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if reflect.DeepEqual(vo.Field(i).Interface(), vc.Field(i).Interface()) {
+			continue
+		}
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		changed = append(changed, name)
+	}
+	return changed
+}
+
+// Revert copia en next, desde old, los campos con nombre JSON en keys. En una
+// recarga se usa para los cambios que no se pudieron aplicar: quedan como en la
+// config vigente y la próxima recarga los vuelve a ver en Diff y los reintenta.
+func Revert(next *ProfileConfig, old ProfileConfig, keys ...string) {
+	vn, vo := reflect.ValueOf(next).Elem(), reflect.ValueOf(old)
+	t := vn.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		for _, k := range keys {
+			if k == name {
+				vn.Field(i).Set(vo.Field(i))
+				break
+			}
+		}
+	}
+}
+
+// RequiresRestart indica si el campo key (nombre JSON) solo se aplica al reiniciar.
+func RequiresRestart(key string) bool {
+	return restartKeys[key]
+}
+
+// Watch revisa path cada watchInterval y llama a fn cuando cambia (fecha de
+// modificación o tamaño). Espera a que el archivo deje de cambiar durante un
+// intervalo antes de avisar, para no leer una escritura a medias. Bloquea hasta
+// que ctx se cancele.
+func Watch(ctx context.Context, path string, fn func()) {
+	stat := func() (time.Time, int64) {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, -1
+		}
+		return fi.ModTime(), fi.Size()
+	}
+	lastMod, lastSize := stat()
+	pending := false
+	tick := time.NewTicker(watchInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			mod, size := stat()
+			if size < 0 {
+				continue // borrado o renombrado a mitad de un guardado
+			}
+			if !mod.Equal(lastMod) || size != lastSize {
+				lastMod, lastSize = mod, size
+				pending = true
+				continue
+			}
+			if pending {
+				pending = false
+				fn()
+			}
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package config
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRevertKeepsFailedFields(t *testing.T) {
+	old := ProfileConfig{ListenAddr: ":7000", MaxTotalConns: 100, DenyCIDRs: []string{"192.0.2.0/24"}}
+	next := ProfileConfig{ListenAddr: ":7001", MaxTotalConns: 200, DenyCIDRs: []string{"198.51.100.0/24"}}
+
+	Revert(&next, old, "listen_addr", "deny_cidrs")
+	if next.ListenAddr != ":7000" || !slices.Equal(next.DenyCIDRs, old.DenyCIDRs) {
+		t.Fatalf("Revert no restauró los campos pedidos: %+v", next)
+	}
+	if next.MaxTotalConns != 200 {
+		t.Fatalf("Revert tocó max_total_conns: %d", next.MaxTotalConns)
+	}
+	// Lo revertido ya no figura como cambio; la próxima recarga lo reintenta
+	if got := Diff(old, next); !slices.Equal(got, []string{"max_total_conns"}) {
+		t.Fatalf("Diff = %v, se esperaba [max_total_conns]", got)
+	}
+}
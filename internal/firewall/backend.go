@@ -0,0 +1,113 @@
+package firewall
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// Backend abstrae el mecanismo concreto de bloqueo (netsh, nftables, iptables+ipset).
+// El Manager se encarga del batching, límites y expiración; el backend mantiene un
+// número reducido de reglas/sets agregados y puede enumerar/limpiar lo que creó.
+type Backend interface {
+	// Name retorna el nombre del backend tal como se configura en firewall_backend.
+	Name() string
+	// Sync deja bloqueadas exactamente las IPs de ips (bloquea las nuevas y libera
+	// las que ya no están). ips puede incluir rangos CIDR ("1.2.3.0/24", ver
+	// Manager.BlockCIDR). Debe ser idempotente: ante un error el Manager vuelve
+	// a llamarlo con el conjunto completo en el próximo batch.
+	Sync(ctx context.Context, ips []string) error
+	// List retorna las IPs y rangos actualmente bloqueados por este backend.
+	List(ctx context.Context) ([]string, error)
+	// Flush elimina todos los bloqueos creados por este backend.
+	Flush(ctx context.Context) error
+}
+
+// Runner ejecuta un comando externo y retorna su salida combinada (stdout+stderr).
+// stdin puede ser nil. Los backends lo reciben por parámetro para poder sustituirlo
+// por un runner falso que registre los comandos sin tocar el sistema.
+type Runner func(ctx context.Context, stdin io.Reader, name string, args ...string) ([]byte, error)
+
+// ExecRunner es el Runner por defecto: ejecuta el comando con os/exec.
+func ExecRunner(ctx context.Context, stdin io.Reader, name string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdin = stdin
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	err := cmd.Run()
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return out.Bytes(), fmt.Errorf("timeout ejecutando %s", name)
+		}
+		if ctx.Err() == context.Canceled {
+			return out.Bytes(), fmt.Errorf("comando %s cancelado", name)
+		}
+		msg := strings.TrimSpace(out.String())
+		if msg != "" {
+			return out.Bytes(), fmt.Errorf("%s: %w: %s", name, err, msg)
+		}
+		return out.Bytes(), fmt.Errorf("%s: %w", name, err)
+	}
+	return out.Bytes(), nil
+}
+
+// Nombres de backend aceptados en firewall_backend.
+const (
+	BackendNetsh    = "netsh"
+	BackendNftables = "nftables"
+	BackendIpset    = "ipset"
+)
+
+// DefaultBackendName retorna el backend por defecto para el sistema operativo actual.
+func DefaultBackendName() string {
+	if runtime.GOOS == "windows" {
+		return BackendNetsh
+	}
+	return BackendNftables
+}
+
+// NewBackend crea el backend indicado por name. Si name está vacío usa el default del
+// sistema operativo; si run es nil usa ExecRunner.
+// profile ("login", "game") separa las reglas/sets de cada proceso guard del mismo host,
+// ya que cada Manager reescribe por completo los suyos en cada batch.
+func NewBackend(name, profile string, run Runner) (Backend, error) {
+	if run == nil {
+		run = ExecRunner
+	}
+	if name == "" {
+		name = DefaultBackendName()
+	}
+	switch name {
+	case BackendNetsh:
+		return NewNetsh(run, profile), nil
+	case BackendNftables:
+		return NewNftables(run, profile), nil
+	case BackendIpset:
+		return NewIpset(run, profile), nil
+	}
+	return nil, fmt.Errorf("firewall backend desconocido: %q (netsh|nftables|ipset)", name)
+}
+
+// profileTag normaliza el nombre de perfil para usarlo en nombres de reglas y sets.
+func profileTag(profile string) string {
+	if profile == "" {
+		return "default"
+	}
+	return strings.ToLower(profile)
+}
+
+// isIPv6 indica si ip (ya validada) es una dirección o rango IPv6.
+func isIPv6(ip string) bool {
+	return strings.Contains(ip, ":")
+}
+
+// isCIDR indica si ip es un rango CIDR en lugar de una IP suelta.
+func isCIDR(ip string) bool {
+	return strings.Contains(ip, "/")
+}
@@ -0,0 +1,430 @@
+package firewall
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// fakeRunner registra los comandos en lugar de ejecutarlos. output, si no es nil,
+// da la salida de cada comando (la línea completa, "nft list set ...").
+type fakeRunner struct {
+	calls  []fakeCall
+	output func(cmd string) ([]byte, error)
+}
+
+type fakeCall struct {
+	cmd   string
+	stdin string
+}
+
+func (f *fakeRunner) run(ctx context.Context, stdin io.Reader, name string, args ...string) ([]byte, error) {
+	c := fakeCall{cmd: strings.Join(append([]string{name}, args...), " ")}
+	if stdin != nil {
+		b, _ := io.ReadAll(stdin)
+		c.stdin = string(b)
+	}
+	f.calls = append(f.calls, c)
+	if f.output != nil {
+		return f.output(c.cmd)
+	}
+	return nil, nil
+}
+
+// cmds retorna los comandos registrados desde la llamada anterior y los olvida.
+func (f *fakeRunner) cmds() []fakeCall {
+	c := f.calls
+	f.calls = nil
+	return c
+}
+
+func cmdLines(calls []fakeCall) []string {
+	var out []string
+	for _, c := range calls {
+		out = append(out, c.cmd)
+	}
+	return out
+}
+
+func TestNetshSync(t *testing.T) {
+	ctx := context.Background()
+	f := &fakeRunner{}
+	n := NewNetsh(f.run, "login")
+
+	const del = "netsh advfirewall firewall delete rule name=TDN-AUTOBLOCK-LOGIN-000"
+	add := func(remote string) string {
+		return "netsh advfirewall firewall add rule name=TDN-AUTOBLOCK-LOGIN-000 dir=in action=block remoteip=" +
+			remote + " enable=yes profile=any protocol=any"
+	}
+	steps := []struct {
+		name string
+		ips  []string
+		want []string
+	}{
+		{"agregar", []string{"5.6.7.8", "1.2.3.4", "10.0.0.0/24"}, []string{del, add("1.2.3.4,10.0.0.0/24,5.6.7.8")}},
+		{"sin cambios", []string{"1.2.3.4", "5.6.7.8", "10.0.0.0/24"}, nil},
+		{"quitar", []string{"1.2.3.4", "10.0.0.0/24"}, []string{del, add("1.2.3.4,10.0.0.0/24")}},
+		{"agregar ipv6", []string{"1.2.3.4", "10.0.0.0/24", "2001:db8::/64"}, []string{del, add("1.2.3.4,10.0.0.0/24,2001:db8::/64")}},
+		{"vaciar", nil, []string{del}},
+	}
+	for _, s := range steps {
+		if err := n.Sync(ctx, s.ips); err != nil {
+			t.Fatalf("%s: %v", s.name, err)
+		}
+		if got := cmdLines(f.cmds()); !reflect.DeepEqual(got, s.want) {
+			t.Errorf("%s: comandos\n%q\nse esperaba\n%q", s.name, got, s.want)
+		}
+	}
+}
+
+func TestNetshSyncSplitsRules(t *testing.T) {
+	f := &fakeRunner{}
+	n := NewNetsh(f.run, "game")
+	ips := make([]string, netshIPsPerRule+1)
+	for i := range ips {
+		ips[i] = fmt.Sprintf("10.0.%d.%d", i/250, i%250+1)
+	}
+	if err := n.Sync(context.Background(), ips); err != nil {
+		t.Fatal(err)
+	}
+	var adds []string
+	for _, c := range f.cmds() {
+		if strings.Contains(c.cmd, " add rule ") {
+			adds = append(adds, strings.Fields(c.cmd)[5])
+		}
+	}
+	want := []string{"name=TDN-AUTOBLOCK-GAME-000", "name=TDN-AUTOBLOCK-GAME-001"}
+	if !reflect.DeepEqual(adds, want) {
+		t.Fatalf("reglas creadas %q, se esperaba %q", adds, want)
+	}
+}
+
+func TestNetshListAdoptsRules(t *testing.T) {
+	ctx := context.Background()
+	show := `
+Rule Name:                            TDN-AUTOBLOCK-LOGIN-000
+----------------------------------------------------------------------
+Enabled:                              Yes
+Direction:                            In
+RemoteIP:                             1.2.3.4/32,10.0.0.0/255.255.255.0,2001:db8::1/128
+
+Nombre de regla:                      TDN-AUTOBLOCK-GAME-000
+----------------------------------------------------------------------
+RemoteIP:                             9.9.9.9/32
+
+Rule Name:                            TDN-AUTOBLOCK-5-6-7-8
+----------------------------------------------------------------------
+RemoteIP:                             5.6.7.8/32
+Ok.
+`
+	f := &fakeRunner{output: func(cmd string) ([]byte, error) {
+		if strings.Contains(cmd, " show rule ") {
+			return []byte(show), nil
+		}
+		return nil, nil
+	}}
+	n := NewNetsh(f.run, "login")
+	ips, err := n.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(ips)
+	want := []string{"1.2.3.4", "10.0.0.0/24", "2001:db8::1", "5.6.7.8"}
+	if !reflect.DeepEqual(ips, want) {
+		t.Fatalf("List = %q, se esperaba %q (las reglas de otro perfil no se tocan)", ips, want)
+	}
+	f.cmds()
+
+	// Sync con lo mismo que ya está en la regla 000: solo se borra la regla por IP antigua
+	// y 5.6.7.8 pasa a la regla agregada
+	if err := n.Sync(ctx, want); err != nil {
+		t.Fatal(err)
+	}
+	got := cmdLines(f.cmds())
+	wantCmds := []string{
+		"netsh advfirewall firewall delete rule name=TDN-AUTOBLOCK-5-6-7-8",
+		"netsh advfirewall firewall delete rule name=TDN-AUTOBLOCK-LOGIN-000",
+		"netsh advfirewall firewall add rule name=TDN-AUTOBLOCK-LOGIN-000 dir=in action=block " +
+			"remoteip=1.2.3.4,10.0.0.0/24,2001:db8::1,5.6.7.8 enable=yes profile=any protocol=any",
+	}
+	if !reflect.DeepEqual(got, wantCmds) {
+		t.Fatalf("comandos\n%q\nse esperaba\n%q", got, wantCmds)
+	}
+}
+
+func TestNetshListNoRules(t *testing.T) {
+	// netsh retorna error cuando no hay reglas que coincidan
+	f := &fakeRunner{output: func(cmd string) ([]byte, error) {
+		return []byte("No rules match the specified criteria."), errors.New("exit status 1")
+	}}
+	ips, err := NewNetsh(f.run, "login").List(context.Background())
+	if err != nil || len(ips) != 0 {
+		t.Fatalf("List = %q, %v; se esperaba vacío sin error", ips, err)
+	}
+}
+
+func TestNftablesSync(t *testing.T) {
+	ctx := context.Background()
+	f := &fakeRunner{}
+	n := NewNftables(f.run, "login")
+
+	if err := n.Sync(ctx, []string{"1.2.3.4", "5.6.7.8", "2001:db8::1", "10.0.0.0/24", "2001:db8::/64"}); err != nil {
+		t.Fatal(err)
+	}
+	calls := f.cmds()
+	if len(calls) != 2 {
+		t.Fatalf("%d comandos, se esperaban 2 (setup y sync): %q", len(calls), cmdLines(calls))
+	}
+	if !strings.Contains(calls[0].stdin, "add table inet tdn_guard") || !strings.Contains(calls[0].stdin, "add chain inet tdn_guard input_login") {
+		t.Errorf("setup sin tabla o cadena del perfil:\n%s", calls[0].stdin)
+	}
+	want := `flush set inet tdn_guard autoblock4_login
+add element inet tdn_guard autoblock4_login { 1.2.3.4, 5.6.7.8 }
+flush set inet tdn_guard autoblock6_login
+add element inet tdn_guard autoblock6_login { 2001:db8::1 }
+flush set inet tdn_guard autoblocknet4_login
+add element inet tdn_guard autoblocknet4_login { 10.0.0.0/24 }
+flush set inet tdn_guard autoblocknet6_login
+add element inet tdn_guard autoblocknet6_login { 2001:db8::/64 }
+`
+	if calls[1].cmd != "nft -f -" || calls[1].stdin != want {
+		t.Errorf("sync %q:\n%s\nse esperaba:\n%s", calls[1].cmd, calls[1].stdin, want)
+	}
+
+	// Quitar todo: solo flush, el setup no se repite
+	if err := n.Sync(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	calls = f.cmds()
+	want = `flush set inet tdn_guard autoblock4_login
+flush set inet tdn_guard autoblock6_login
+flush set inet tdn_guard autoblocknet4_login
+flush set inet tdn_guard autoblocknet6_login
+`
+	if len(calls) != 1 || calls[0].stdin != want {
+		t.Errorf("sync vacío: %q, se esperaba un único script:\n%s", calls, want)
+	}
+}
+
+func TestNftablesList(t *testing.T) {
+	sets := map[string]string{
+		"autoblock4_game": `table inet tdn_guard {
+	set autoblock4_game {
+		type ipv4_addr
+		elements = { 1.2.3.4, 5.6.7.8,
+			     9.9.9.9 }
+	}
+}`,
+		"autoblock6_game": `table inet tdn_guard {
+	set autoblock6_game {
+		type ipv6_addr
+	}
+}`,
+		"autoblocknet4_game": `table inet tdn_guard {
+	set autoblocknet4_game {
+		type ipv4_addr
+		flags interval
+		elements = { 10.0.0.0/24 }
+	}
+}`,
+		"autoblocknet6_game": "",
+	}
+	f := &fakeRunner{output: func(cmd string) ([]byte, error) {
+		if strings.HasPrefix(cmd, "nft list set inet tdn_guard ") {
+			return []byte(sets[strings.TrimPrefix(cmd, "nft list set inet tdn_guard ")]), nil
+		}
+		return nil, nil
+	}}
+	ips, err := NewNftables(f.run, "game").List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"1.2.3.4", "5.6.7.8", "9.9.9.9", "10.0.0.0/24"}
+	if !reflect.DeepEqual(ips, want) {
+		t.Fatalf("List = %q, se esperaba %q", ips, want)
+	}
+
+	f.output = func(cmd string) ([]byte, error) { return nil, errors.New("nft: permiso denegado") }
+	if _, err := NewNftables(f.run, "game").List(context.Background()); err == nil {
+		t.Fatal("List no propagó el error de nft")
+	}
+}
+
+func TestIpsetSync(t *testing.T) {
+	ctx := context.Background()
+	f := &fakeRunner{output: func(cmd string) ([]byte, error) {
+		// Las reglas DROP no existen todavía
+		if strings.Contains(cmd, " -C ") {
+			return nil, errors.New("exit status 1")
+		}
+		return nil, nil
+	}}
+	s := NewIpset(f.run, "login")
+	if err := s.Sync(ctx, []string{"1.2.3.4", "2001:db8::1", "10.0.0.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	calls := f.cmds()
+	var setup []string
+	for _, c := range calls[:len(calls)-1] {
+		setup = append(setup, c.cmd)
+	}
+	wantSetup := []string{
+		"ipset create tdn-login4 hash:ip family inet maxelem 40000 -exist",
+		"iptables -C INPUT -m set --match-set tdn-login4 src -j DROP",
+		"iptables -I INPUT -m set --match-set tdn-login4 src -j DROP",
+		"ipset create tdn-login6 hash:ip family inet6 maxelem 40000 -exist",
+		"ip6tables -C INPUT -m set --match-set tdn-login6 src -j DROP",
+		"ip6tables -I INPUT -m set --match-set tdn-login6 src -j DROP",
+		"ipset create tdn-login-net4 hash:net family inet maxelem 40000 -exist",
+		"iptables -C INPUT -m set --match-set tdn-login-net4 src -j DROP",
+		"iptables -I INPUT -m set --match-set tdn-login-net4 src -j DROP",
+		"ipset create tdn-login-net6 hash:net family inet6 maxelem 40000 -exist",
+		"ip6tables -C INPUT -m set --match-set tdn-login-net6 src -j DROP",
+		"ip6tables -I INPUT -m set --match-set tdn-login-net6 src -j DROP",
+	}
+	if !reflect.DeepEqual(setup, wantSetup) {
+		t.Errorf("setup\n%q\nse esperaba\n%q", setup, wantSetup)
+	}
+	restore := calls[len(calls)-1]
+	want := `create tdn-login4-tmp hash:ip family inet maxelem 40000 -exist
+flush tdn-login4-tmp
+add tdn-login4-tmp 1.2.3.4 -exist
+swap tdn-login4-tmp tdn-login4
+destroy tdn-login4-tmp
+create tdn-login6-tmp hash:ip family inet6 maxelem 40000 -exist
+flush tdn-login6-tmp
+add tdn-login6-tmp 2001:db8::1 -exist
+swap tdn-login6-tmp tdn-login6
+destroy tdn-login6-tmp
+create tdn-login-net4-tmp hash:net family inet maxelem 40000 -exist
+flush tdn-login-net4-tmp
+add tdn-login-net4-tmp 10.0.0.0/24 -exist
+swap tdn-login-net4-tmp tdn-login-net4
+destroy tdn-login-net4-tmp
+create tdn-login-net6-tmp hash:net family inet6 maxelem 40000 -exist
+flush tdn-login-net6-tmp
+swap tdn-login-net6-tmp tdn-login-net6
+destroy tdn-login-net6-tmp
+`
+	if restore.cmd != "ipset restore" || restore.stdin != want {
+		t.Errorf("sync %q:\n%s\nse esperaba:\n%s", restore.cmd, restore.stdin, want)
+	}
+
+	// Quitar una IP: un solo restore sin la IP, el setup no se repite
+	if err := s.Sync(ctx, []string{"2001:db8::1", "10.0.0.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	calls = f.cmds()
+	if len(calls) != 1 || strings.Contains(calls[0].stdin, "1.2.3.4") {
+		t.Errorf("sync tras quitar 1.2.3.4: %q", calls)
+	}
+}
+
+func TestIpsetList(t *testing.T) {
+	f := &fakeRunner{output: func(cmd string) ([]byte, error) {
+		switch cmd {
+		case "ipset list tdn-game4":
+			return []byte("Name: tdn-game4\nType: hash:ip\nHeader: family inet hashsize 1024 maxelem 40000\n" +
+				"Size in memory: 200\nReferences: 1\nNumber of entries: 2\nMembers:\n1.2.3.4\n5.6.7.8 timeout 30\n"), nil
+		case "ipset list tdn-game-net6":
+			return []byte("Name: tdn-game-net6\nMembers:\n2001:db8::/64\n"), nil
+		}
+		return []byte("Name: x\nMembers:\n"), nil
+	}}
+	ips, err := NewIpset(f.run, "game").List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"1.2.3.4", "5.6.7.8", "2001:db8::/64"}
+	if !reflect.DeepEqual(ips, want) {
+		t.Fatalf("List = %q, se esperaba %q", ips, want)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	ctx := context.Background()
+	f := &fakeRunner{}
+	if err := NewNftables(f.run, "login").Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	got := cmdLines(f.cmds())[1:] // sin el setup
+	want := []string{
+		"nft flush set inet tdn_guard autoblock4_login",
+		"nft flush set inet tdn_guard autoblock6_login",
+		"nft flush set inet tdn_guard autoblocknet4_login",
+		"nft flush set inet tdn_guard autoblocknet6_login",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("nftables Flush\n%q\nse esperaba\n%q", got, want)
+	}
+
+	if err := NewIpset(f.run, "login").Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var flushes []string
+	for _, c := range cmdLines(f.cmds()) {
+		if strings.HasPrefix(c, "ipset flush ") {
+			flushes = append(flushes, c)
+		}
+	}
+	want = []string{"ipset flush tdn-login4", "ipset flush tdn-login6", "ipset flush tdn-login-net4", "ipset flush tdn-login-net6"}
+	if !reflect.DeepEqual(flushes, want) {
+		t.Errorf("ipset Flush\n%q\nse esperaba\n%q", flushes, want)
+	}
+}
+
+func TestParseNftElements(t *testing.T) {
+	cases := []struct {
+		out  string
+		want []string
+	}{
+		{"set x {\n\ttype ipv4_addr\n}", nil},
+		{"elements = { 1.2.3.4 }", []string{"1.2.3.4"}},
+		{"elements = { 1.2.3.4, 5.6.7.8,\n\t\t 9.9.9.9 }\n}", []string{"1.2.3.4", "5.6.7.8", "9.9.9.9"}},
+		{"elements = { 2001:db8::1, 2001:db8::/64 }", []string{"2001:db8::1", "2001:db8::/64"}},
+	}
+	for _, c := range cases {
+		if got := parseNftElements(c.out); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("parseNftElements(%q) = %q, se esperaba %q", c.out, got, c.want)
+		}
+	}
+}
+
+func TestParseIpsetMembers(t *testing.T) {
+	cases := []struct {
+		out  string
+		want []string
+	}{
+		{"Name: x\nMembers:\n", nil},
+		{"Name: x\nNumber of entries: 1\nMembers:\n1.2.3.4\n", []string{"1.2.3.4"}},
+		{"Members:\n1.2.3.4 timeout 30\n\n10.0.0.0/24\n", []string{"1.2.3.4", "10.0.0.0/24"}},
+	}
+	for _, c := range cases {
+		if got := parseIpsetMembers([]byte(c.out)); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("parseIpsetMembers(%q) = %q, se esperaba %q", c.out, got, c.want)
+		}
+	}
+}
+
+func TestParseRemoteIPs(t *testing.T) {
+	cases := []struct {
+		in   string
+		want []string
+	}{
+		{"Any", nil},
+		{" 1.2.3.4/32", []string{"1.2.3.4"}},
+		{"1.2.3.4/255.255.255.255,5.6.7.8/32", []string{"1.2.3.4", "5.6.7.8"}},
+		{"10.0.0.0/255.255.255.0,10.1.0.0/255.255.0.0", []string{"10.0.0.0/24", "10.1.0.0/16"}},
+		{"2001:db8::1/128,2001:db8::/64", []string{"2001:db8::1", "2001:db8::/64"}},
+	}
+	for _, c := range cases {
+		if got := parseRemoteIPs(c.in); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("parseRemoteIPs(%q) = %q, se esperaba %q", c.in, got, c.want)
+		}
+	}
+}
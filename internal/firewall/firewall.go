@@ -3,266 +3,250 @@ package firewall
 import (
 	"context"
 	"fmt"
-	"io"
 	"log"
 	"net"
-	"os/exec"
-	"strings"
+	"sort"
 	"sync"
 	"time"
 )
 
 const (
-	rulePrefix          = "TDN-AUTOBLOCK-"
-	maxConcurrentBlocks = 3                // Reducido para ser más conservador
-	netshTimeout        = 3 * time.Second  // netsh es nativo, mucho más rápido que PowerShell
-	maxBlockedIPs       = 1000             // Límite máximo de IPs bloqueadas simultáneamente
-	batchInterval       = 5 * time.Second // Procesar bloqueos cada 5 segundos
-	maxBatchSize        = 50              // Máximo de IPs por batch
+	rulePrefix    = "TDN-AUTOBLOCK-"
+	syncTimeout   = 30 * time.Second // Tiempo máximo para reescribir todas las reglas agregadas
+	maxBlockedIPs = 20000            // Límite máximo de IPs bloqueadas simultáneamente
+	batchInterval = 5 * time.Second  // Procesar bloqueos cada 5 segundos
 )
 
-// Manager gestiona reglas de firewall Windows por IP.
+// Manager gestiona bloqueos de firewall por IP sobre un Backend.
+//
+// scheduled es la fuente de verdad: cada batch (o cada desbloqueo) el Manager
+// entrega al backend la lista completa de IPs y el backend reescribe o parchea
+// sus reglas agregadas. Así un flood de miles de IPs se aplica con un puñado de
+// comandos en lugar de un proceso netsh por IP.
 type Manager struct {
-	mu           sync.Mutex
-	scheduled    map[string]time.Time // IP -> cuándo eliminar la regla
-	blockSec     int
-	workerSem    chan struct{} // Semáforo para limitar concurrencia de netsh
-	unblockQueue chan string
-	ctx          context.Context
-	cancel       context.CancelFunc
-	wg           sync.WaitGroup
-	// Batching de bloqueos
-	pendingBlocksMu sync.Mutex
-	pendingBlocks   map[string]bool // IPs pendientes de bloquear
+	mu         sync.Mutex
+	scheduled  map[string]time.Time // IP o rango CIDR -> cuándo eliminar la regla
+	dirty      bool                 // scheduled cambió desde el último Sync exitoso
+	queued     int                  // bans nuevos que todavía no llegaron al backend
+	bans       uint64               // bans programados desde el arranque
+	blockSec   int
+	v6Bits     int // las IPv6 se banean como su prefijo /v6Bits (128 = IP suelta)
+	backend    Backend
+	state      State // expiraciones persistidas (nil = sin persistencia)
+	reconciled ReconcileResult
+	syncNow    chan struct{} // fuerza un Sync inmediato (desbloqueos manuales)
+	ctx        context.Context
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
 }
 
 // New crea un Manager. blockSeconds es el tiempo que la regla permanece antes de eliminarse.
-func New(blockSeconds int) *Manager {
+// backend es el mecanismo de bloqueo (ver NewBackend). state es donde se persisten
+// las expiraciones (nil = sin persistencia); al crear el Manager se reconcilian las
+// reglas TDN-AUTOBLOCK- existentes contra ese estado (ver Reconciled).
+func New(blockSeconds int, backend Backend, state State) *Manager {
 	ctx, cancel := context.WithCancel(context.Background())
 	m := &Manager{
-		scheduled:      make(map[string]time.Time),
-		blockSec:       blockSeconds,
-		workerSem:      make(chan struct{}, maxConcurrentBlocks),
-		unblockQueue:   make(chan string, 200),
-		ctx:            ctx,
-		cancel:         cancel,
-		pendingBlocks: make(map[string]bool),
+		scheduled: make(map[string]time.Time),
+		blockSec:  blockSeconds,
+		v6Bits:    128,
+		backend:   backend,
+		state:     state,
+		syncNow:   make(chan struct{}, 1),
+		ctx:       ctx,
+		cancel:    cancel,
 	}
 
-	// Iniciar worker de batching que procesa bloqueos cada 5 segundos
-	m.wg.Add(1)
-	go m.batchProcessor()
+	m.reconciled = m.reconcile()
 
+	// Iniciar worker de batching que sincroniza las reglas cada 5 segundos
 	m.wg.Add(1)
-	go m.unblockWorker()
+	go m.batchProcessor()
 
 	return m
 }
 
-// BlockIP agrega una IP a la cola de bloqueo por lotes.
-// Retorna inmediatamente sin esperar (fire-and-forget).
+// SetBlockSeconds cambia la duración de los bans nuevos; los ya programados
+// conservan su expiración.
+func (m *Manager) SetBlockSeconds(blockSeconds int) {
+	m.mu.Lock()
+	m.blockSec = blockSeconds
+	m.mu.Unlock()
+}
+
+// SetIPv6Prefix hace que BlockIP banee las IPv6 como su prefijo /bits en lugar de la
+// dirección suelta, igual que el limiter agrupa a los clientes IPv6 (ver
+// limiter.ClientKey). 128 banea la dirección exacta.
+func (m *Manager) SetIPv6Prefix(bits int) {
+	m.mu.Lock()
+	m.v6Bits = bits
+	m.mu.Unlock()
+}
+
+// BlockIP programa el bloqueo de una IP; se aplica en el próximo batch.
+// Retorna inmediatamente sin esperar (fire-and-forget). Las IPv4-mapped se banean
+// como IPv4 y las IPv6 como su prefijo (ver SetIPv6Prefix); ip puede ser también
+// una clave de cliente ya agrupada ("2001:db8::/64").
 func (m *Manager) BlockIP(ip string) error {
-	if ip == "" || net.ParseIP(ip) == nil {
+	if isCIDR(ip) {
+		return m.BlockCIDR(ip)
+	}
+	parsed := net.ParseIP(ip)
+	if ip == "" || parsed == nil {
 		return fmt.Errorf("invalid ip: %s", ip)
 	}
 
 	m.mu.Lock()
-	// Verificar límite de IPs bloqueadas
-	if len(m.scheduled) >= maxBlockedIPs {
-		m.mu.Unlock()
-		log.Printf("[WARN] firewall: límite de %d IPs bloqueadas alcanzado, descartando ban de %s", maxBlockedIPs, ip)
-		return nil
-	}
+	defer m.mu.Unlock()
 
-	// Verificar si ya está programada o pendiente
+	ip = m.canonical(parsed)
+
+	// Verificar si ya está programada
 	if _, exists := m.scheduled[ip]; exists {
-		m.mu.Unlock()
 		return nil // ya programada, no duplicar
 	}
 
-	// Verificar si ya está pendiente de bloqueo
-	m.pendingBlocksMu.Lock()
-	if m.pendingBlocks[ip] {
-		m.pendingBlocksMu.Unlock()
-		m.mu.Unlock()
-		return nil // ya pendiente
+	// Verificar límite de IPs bloqueadas
+	if len(m.scheduled) >= maxBlockedIPs {
+		log.Printf("[WARN] firewall: límite de %d IPs bloqueadas alcanzado, descartando ban de %s", maxBlockedIPs, ip)
+		return nil
 	}
-	m.pendingBlocks[ip] = true
-	m.pendingBlocksMu.Unlock()
 
-	// Agregar a scheduled (se procesará en el próximo batch)
 	m.scheduled[ip] = time.Now().Add(time.Duration(m.blockSec) * time.Second)
-	m.mu.Unlock()
-
-	// Retornar inmediatamente (fire-and-forget)
+	m.dirty = true
+	m.queued++
+	m.bans++
 	return nil
 }
 
-// batchProcessor procesa bloqueos en lotes cada 5 segundos
-func (m *Manager) batchProcessor() {
-	defer m.wg.Done()
-	ticker := time.NewTicker(batchInterval)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-m.ctx.Done():
-			// Procesar batch final antes de salir
-			m.processBatch()
-			return
-		case <-ticker.C:
-			m.processBatch()
-		}
+// BlockCIDR programa el bloqueo de un rango completo ("1.2.3.0/24") como una sola
+// entrada; se aplica en el próximo batch igual que BlockIP. El rango se guarda
+// normalizado (dirección de red), que es la clave a usar en UnblockIP.
+func (m *Manager) BlockCIDR(cidr string) error {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return fmt.Errorf("invalid cidr: %s", cidr)
 	}
-}
+	key := ipnet.String()
 
-// processBatch procesa todas las IPs pendientes en lotes
-func (m *Manager) processBatch() {
-	m.pendingBlocksMu.Lock()
-	if len(m.pendingBlocks) == 0 {
-		m.pendingBlocksMu.Unlock()
-		return
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, exists := m.scheduled[key]; exists {
+		return nil
 	}
-
-	// Copiar IPs pendientes a un slice
-	ipsToBlock := make([]string, 0, len(m.pendingBlocks))
-	for ip := range m.pendingBlocks {
-		ipsToBlock = append(ipsToBlock, ip)
+	if len(m.scheduled) >= maxBlockedIPs {
+		log.Printf("[WARN] firewall: límite de %d IPs bloqueadas alcanzado, descartando ban de %s", maxBlockedIPs, key)
+		return nil
 	}
-	// Limpiar pendientes
-	m.pendingBlocks = make(map[string]bool)
-	m.pendingBlocksMu.Unlock()
+	m.scheduled[key] = time.Now().Add(time.Duration(m.blockSec) * time.Second)
+	m.dirty = true
+	m.queued++
+	m.bans++
+	return nil
+}
 
-	if len(ipsToBlock) == 0 {
-		return
+// UnblockIP quita la IP (o el rango) de las reglas. Se aplica de forma asíncrona
+// pero sin esperar al próximo batch.
+func (m *Manager) UnblockIP(ip string) error {
+	if ip == "" {
+		return nil
 	}
 
-	// Procesar en lotes de maxBatchSize
-	for i := 0; i < len(ipsToBlock); i += maxBatchSize {
-		end := i + maxBatchSize
-		if end > len(ipsToBlock) {
-			end = len(ipsToBlock)
-		}
-		batch := ipsToBlock[i:end]
-		
-		// Procesar batch en goroutine para no bloquear
-		go m.executeBatch(batch)
+	m.mu.Lock()
+	if _, ipnet, err := net.ParseCIDR(ip); err == nil {
+		ip = ipnet.String()
+	} else if parsed := net.ParseIP(ip); parsed != nil {
+		ip = m.canonical(parsed)
 	}
-}
-
-// executeBatch ejecuta bloqueos de un lote de IPs
-func (m *Manager) executeBatch(ips []string) {
-	for _, ip := range ips {
-		// Adquirir semáforo
-		select {
-		case m.workerSem <- struct{}{}:
-			// Ejecutar bloqueo
-			err := m.executeBlock(ip)
-			<-m.workerSem // Liberar semáforo
-			
-			if err != nil {
-				// Si falló, quitar de scheduled
-				m.mu.Lock()
-				delete(m.scheduled, ip)
-				m.mu.Unlock()
-			}
-		case <-m.ctx.Done():
-			return
-		}
+	if _, ok := m.scheduled[ip]; ok {
+		delete(m.scheduled, ip)
+		m.dirty = true
 	}
-}
-
-// executeBlock ejecuta el comando netsh para bloquear una IP
-func (m *Manager) executeBlock(ip string) error {
-	ruleName := rulePrefix + strings.ReplaceAll(ip, ".", "-")
-
-	ctx, cancel := context.WithTimeout(m.ctx, netshTimeout)
-	defer cancel()
+	m.mu.Unlock()
 
-	cmd := exec.CommandContext(ctx, "netsh", "advfirewall", "firewall", "add", "rule",
-		"name="+ruleName,
-		"dir=in",
-		"action=block",
-		"remoteip="+ip,
-		"enable=yes",
-		"profile=any",
-		"protocol=any",
-	)
-	cmd.Stdout = io.Discard
-	cmd.Stderr = io.Discard
-
-	err := cmd.Run()
-	if err != nil {
-		if ctx.Err() == context.DeadlineExceeded {
-			return fmt.Errorf("timeout ejecutando netsh para IP %s", ip)
-		}
-		if ctx.Err() == context.Canceled {
-			return fmt.Errorf("comando cancelado para IP %s", ip)
-		}
-		return fmt.Errorf("firewall block %s: %w", ip, err)
-	}
+	m.requestSync()
 	return nil
 }
 
-// UnblockIP elimina la regla para la IP.
-// Se ejecuta de forma asíncrona a través de la cola.
-func (m *Manager) UnblockIP(ip string) error {
-	if ip == "" {
-		return nil
+// canonical retorna la entrada de scheduled para ip: IPv4 para las IPv4-mapped y el
+// prefijo /v6Bits para las IPv6. Debe llamarse con m.mu.
+func (m *Manager) canonical(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return v4.String()
+	}
+	if m.v6Bits > 0 && m.v6Bits < 128 {
+		return (&net.IPNet{IP: ip.Mask(net.CIDRMask(m.v6Bits, 128)), Mask: net.CIDRMask(m.v6Bits, 128)}).String()
 	}
+	return ip.String()
+}
 
-	// Enviar a la cola de desbloqueo (no bloqueante)
+// requestSync pide un Sync inmediato al batchProcessor (no bloqueante).
+func (m *Manager) requestSync() {
 	select {
-	case m.unblockQueue <- ip:
-		return nil
+	case m.syncNow <- struct{}{}:
 	default:
-		// Si la cola está llena, ejecutar directamente en goroutine
-		go m.executeUnblock(ip)
-		m.mu.Lock()
-		delete(m.scheduled, ip)
-		m.pendingBlocksMu.Lock()
-		delete(m.pendingBlocks, ip)
-		m.pendingBlocksMu.Unlock()
-		m.mu.Unlock()
-		return nil
 	}
 }
 
-// unblockWorker procesa solicitudes de desbloqueo
-func (m *Manager) unblockWorker() {
+// batchProcessor sincroniza las reglas cada batchInterval o cuando se solicita
+func (m *Manager) batchProcessor() {
 	defer m.wg.Done()
+	ticker := time.NewTicker(batchInterval)
+	defer ticker.Stop()
+
 	for {
 		select {
 		case <-m.ctx.Done():
 			return
-		case ip := <-m.unblockQueue:
-			m.executeUnblock(ip)
-			// Quitar de scheduled y pending
-			m.mu.Lock()
-			delete(m.scheduled, ip)
-			m.mu.Unlock()
-			m.pendingBlocksMu.Lock()
-			delete(m.pendingBlocks, ip)
-			m.pendingBlocksMu.Unlock()
+		case <-ticker.C:
+			m.syncRules()
+		case <-m.syncNow:
+			m.syncRules()
 		}
 	}
 }
 
-// executeUnblock ejecuta el comando netsh para desbloquear una IP
-func (m *Manager) executeUnblock(ip string) error {
-	ruleName := rulePrefix + strings.ReplaceAll(ip, ".", "-")
+// syncRules entrega al backend el conjunto completo de IPs si hubo cambios.
+// Si el backend falla, scheduled queda marcado como sucio y se reintenta en el
+// próximo batch.
+func (m *Manager) syncRules() {
+	m.mu.Lock()
+	if !m.dirty {
+		m.mu.Unlock()
+		return
+	}
+	ips := make([]string, 0, len(m.scheduled))
+	snapshot := make(map[string]time.Time, len(m.scheduled))
+	for ip, until := range m.scheduled {
+		ips = append(ips, ip)
+		snapshot[ip] = until
+	}
+	m.dirty = false
+	queued := m.queued
+	m.queued = 0
+	m.mu.Unlock()
+
+	sort.Strings(ips)
 
-	ctx, cancel := context.WithTimeout(m.ctx, netshTimeout)
+	ctx, cancel := context.WithTimeout(m.ctx, syncTimeout)
 	defer cancel()
 
-	cmd := exec.CommandContext(ctx, "netsh", "advfirewall", "firewall", "delete", "rule",
-		"name="+ruleName,
-	)
-	cmd.Stdout = io.Discard
-	cmd.Stderr = io.Discard
+	start := time.Now()
+	if err := m.backend.Sync(ctx, ips); err != nil {
+		log.Printf("[WARN] firewall sync (%s) falló con %d IPs, se reintentará: %v", m.backend.Name(), len(ips), err)
+		m.mu.Lock()
+		m.dirty = true
+		m.queued += queued
+		m.mu.Unlock()
+		return
+	}
+	log.Printf("[INFO] firewall sync (%s): %d IPs bloqueadas en %v", m.backend.Name(), len(ips), time.Since(start).Round(time.Millisecond))
 
-	_ = cmd.Run() // Ignorar errores en desbloqueo (puede que la regla ya no exista)
-	return nil
+	if m.state != nil {
+		if err := m.state.SaveFirewall(snapshot); err != nil {
+			log.Printf("[WARN] firewall: no se pudo guardar estado: %v", err)
+		}
+	}
 }
 
 // RunScheduler debe ejecutarse en una goroutine; elimina reglas cuando expira el tiempo.
@@ -281,34 +265,39 @@ func (m *Manager) RunScheduler(ctxDone <-chan struct{}) {
 	}
 }
 
+// removeExpired quita de scheduled las IPs vencidas; las reglas agregadas se
+// reescriben en el próximo batch.
 func (m *Manager) removeExpired() {
 	now := time.Now()
 	m.mu.Lock()
-	var toRemove []string
+	defer m.mu.Unlock()
 	for ip, until := range m.scheduled {
 		if now.After(until) {
-			toRemove = append(toRemove, ip)
-		}
-	}
-	m.mu.Unlock()
-
-	// Enviar todas las IPs a desbloquear a la cola (no bloqueante)
-	for _, ip := range toRemove {
-		select {
-		case m.unblockQueue <- ip:
-		default:
-			// Si la cola está llena, ejecutar directamente en goroutine
-			go m.executeUnblock(ip)
-			m.mu.Lock()
 			delete(m.scheduled, ip)
-			m.mu.Unlock()
-			m.pendingBlocksMu.Lock()
-			delete(m.pendingBlocks, ip)
-			m.pendingBlocksMu.Unlock()
+			m.dirty = true
 		}
 	}
 }
 
+// Stats son contadores del Manager para métricas.
+type Stats struct {
+	Blocked int    // IPs y rangos con regla programada
+	Queued  int    // bans nuevos que esperan al próximo batch
+	Bans    uint64 // bans programados desde el arranque
+}
+
+// Stats retorna los contadores actuales.
+func (m *Manager) Stats() Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return Stats{Blocked: len(m.scheduled), Queued: m.queued, Bans: m.bans}
+}
+
+// BackendName retorna el nombre del backend en uso.
+func (m *Manager) BackendName() string {
+	return m.backend.Name()
+}
+
 // GetScheduledUnblocks retorna una copia del mapa IP → tiempo de desbloqueo.
 func (m *Manager) GetScheduledUnblocks() map[string]time.Time {
 	m.mu.Lock()
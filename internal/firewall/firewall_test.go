@@ -0,0 +1,127 @@
+package firewall
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCanonical(t *testing.T) {
+	cases := []struct {
+		ip     string
+		v6Bits int
+		want   string
+	}{
+		{"203.0.113.7", 64, "203.0.113.7"},
+		{"::ffff:203.0.113.7", 64, "203.0.113.7"},
+		{"::ffff:203.0.113.7", 128, "203.0.113.7"},
+		{"2001:db8:1:2:aaaa::1", 64, "2001:db8:1:2::/64"},
+		{"2001:db8:1:2:aaaa::1", 56, "2001:db8:1::/56"},
+		{"2001:db8:1:2:aaaa::1", 128, "2001:db8:1:2:aaaa::1"},
+	}
+	for _, c := range cases {
+		m := &Manager{v6Bits: c.v6Bits}
+		if got := m.canonical(net.ParseIP(c.ip)); got != c.want {
+			t.Errorf("canonical(%q) con /%d = %q, se esperaba %q", c.ip, c.v6Bits, got, c.want)
+		}
+	}
+}
+
+// fakeBackend registra los Sync; List retorna listed o listErr.
+type fakeBackend struct {
+	mu      sync.Mutex
+	listed  []string
+	listErr error
+	syncs   [][]string
+}
+
+func (b *fakeBackend) Name() string { return "fake" }
+
+func (b *fakeBackend) Sync(ctx context.Context, ips []string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.syncs = append(b.syncs, append([]string(nil), ips...))
+	return nil
+}
+
+func (b *fakeBackend) List(ctx context.Context) ([]string, error) {
+	return b.listed, b.listErr
+}
+
+func (b *fakeBackend) Flush(ctx context.Context) error { return nil }
+
+func (b *fakeBackend) syncCalls() [][]string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.syncs
+}
+
+// memState es un State en memoria.
+type memState struct {
+	saved map[string]time.Time
+}
+
+func (s *memState) LoadFirewall() map[string]time.Time { return s.saved }
+
+func (s *memState) SaveFirewall(scheduled map[string]time.Time) error {
+	s.saved = scheduled
+	return nil
+}
+
+func TestReconcile(t *testing.T) {
+	future := time.Now().Add(time.Hour)
+	backend := &fakeBackend{listed: []string{"1.1.1.1", "2.2.2.2"}}
+	state := &memState{saved: map[string]time.Time{
+		"1.1.1.1": future,                     // aplicada y vigente: se adopta
+		"3.3.3.3": future,                     // vigente pero no aplicada: se restaura
+		"4.4.4.4": time.Now().Add(-time.Hour), // vencida
+	}}
+	m := New(60, backend, state)
+	defer m.Stop()
+
+	res := m.Reconciled()
+	if res.Adopted != 1 || res.Removed != 1 || res.Restored != 1 || res.Err != "" {
+		t.Fatalf("reconciliación %s, se esperaba adopted=1 removed=1 restored=1", res)
+	}
+	syncs := backend.syncCalls()
+	if want := [][]string{{"1.1.1.1", "3.3.3.3"}}; !reflect.DeepEqual(syncs, want) {
+		t.Fatalf("Sync %q, se esperaba %q (2.2.2.2 huérfana eliminada)", syncs, want)
+	}
+}
+
+func TestReconcileListErrorKeepsRules(t *testing.T) {
+	future := time.Now().Add(time.Hour)
+	backend := &fakeBackend{listErr: errors.New("nft: permiso denegado")}
+	state := &memState{saved: map[string]time.Time{"1.1.1.1": future}}
+	m := New(60, backend, state)
+	defer m.Stop()
+
+	// Las persistidas quedan pendientes: no se verificó ni se aplicó nada
+	res := m.Reconciled()
+	if res.Err == "" || res.Pending != 1 || res.Restored != 0 {
+		t.Fatalf("reconciliación %+v, se esperaba error con pending=1 y restored=0", res)
+	}
+	if s := res.String(); s != "error=nft: permiso denegado pending=1" {
+		t.Fatalf("evento fw_reconcile %q", s)
+	}
+	// Un Sync solo con lo persistido borraría los bans que no se pudieron enumerar
+	if syncs := backend.syncCalls(); len(syncs) != 0 {
+		t.Fatalf("Sync forzado %q pese al error de List", syncs)
+	}
+	if _, ok := m.GetScheduledUnblocks()["1.1.1.1"]; !ok {
+		t.Fatal("la expiración persistida no quedó programada")
+	}
+
+	// El próximo batch con cambios aplica las persistidas junto con las nuevas
+	if err := m.BlockIP("5.5.5.5"); err != nil {
+		t.Fatal(err)
+	}
+	m.syncRules()
+	if syncs, want := backend.syncCalls(), [][]string{{"1.1.1.1", "5.5.5.5"}}; !reflect.DeepEqual(syncs, want) {
+		t.Fatalf("Sync %q, se esperaba %q", syncs, want)
+	}
+}
@@ -0,0 +1,154 @@
+package firewall
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Ipset bloquea IPs agregándolas a sets de ipset referenciados por una regla
+// DROP en la cadena INPUT de iptables/ip6tables. Los rangos CIDR van en sets
+// hash:net aparte.
+type Ipset struct {
+	run   Runner
+	set4  string
+	set6  string
+	net4  string
+	net6  string
+	mu    sync.Mutex
+	ready bool
+}
+
+// ipsetFamily describe uno de los sets del backend.
+type ipsetFamily struct {
+	set      string
+	kind     string // hash:ip | hash:net
+	family   string // inet | inet6
+	iptables string
+}
+
+// families retorna los cuatro sets del perfil: IPs y rangos, IPv4 e IPv6.
+func (s *Ipset) families() []ipsetFamily {
+	return []ipsetFamily{
+		{s.set4, "hash:ip", "inet", "iptables"},
+		{s.set6, "hash:ip", "inet6", "ip6tables"},
+		{s.net4, "hash:net", "inet", "iptables"},
+		{s.net6, "hash:net", "inet6", "ip6tables"},
+	}
+}
+
+// holds indica si ip (IP o rango) corresponde a este set.
+func (f ipsetFamily) holds(ip string) bool {
+	return (f.family == "inet6") == isIPv6(ip) && (f.kind == "hash:net") == isCIDR(ip)
+}
+
+// NewIpset crea un backend iptables+ipset para profile que ejecuta los comandos con run.
+func NewIpset(run Runner, profile string) *Ipset {
+	tag := profileTag(profile)
+	return &Ipset{
+		run:  run,
+		set4: "tdn-" + tag + "4",
+		set6: "tdn-" + tag + "6",
+		net4: "tdn-" + tag + "-net4",
+		net6: "tdn-" + tag + "-net6",
+	}
+}
+
+func (s *Ipset) Name() string { return BackendIpset }
+
+// ensure crea los sets y las reglas de iptables la primera vez que se usa el backend.
+func (s *Ipset) ensure(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ready {
+		return nil
+	}
+	for _, fam := range s.families() {
+		if _, err := s.run(ctx, nil, "ipset", "create", fam.set, fam.kind, "family", fam.family,
+			"maxelem", strconv.Itoa(2*maxBlockedIPs), "-exist"); err != nil {
+			return err
+		}
+		rule := []string{"INPUT", "-m", "set", "--match-set", fam.set, "src", "-j", "DROP"}
+		// -C falla si la regla no existe; en ese caso insertarla al principio de INPUT
+		if _, err := s.run(ctx, nil, fam.iptables, append([]string{"-C"}, rule...)...); err != nil {
+			if _, err := s.run(ctx, nil, fam.iptables, append([]string{"-I"}, rule...)...); err != nil {
+				return err
+			}
+		}
+	}
+	s.ready = true
+	return nil
+}
+
+// Sync carga el contenido completo en sets temporales con "ipset restore" y los
+// intercambia atómicamente con los sets en uso (swap), sin ventana sin bloqueo.
+func (s *Ipset) Sync(ctx context.Context, ips []string) error {
+	if err := s.ensure(ctx); err != nil {
+		return err
+	}
+	var script strings.Builder
+	for _, fam := range s.families() {
+		tmp := fam.set + "-tmp"
+		fmt.Fprintf(&script, "create %s %s family %s maxelem %d -exist\n", tmp, fam.kind, fam.family, 2*maxBlockedIPs)
+		fmt.Fprintf(&script, "flush %s\n", tmp)
+		for _, ip := range ips {
+			if fam.holds(ip) {
+				fmt.Fprintf(&script, "add %s %s -exist\n", tmp, ip)
+			}
+		}
+		fmt.Fprintf(&script, "swap %s %s\n", tmp, fam.set)
+		fmt.Fprintf(&script, "destroy %s\n", tmp)
+	}
+	_, err := s.run(ctx, strings.NewReader(script.String()), "ipset", "restore")
+	return err
+}
+
+func (s *Ipset) List(ctx context.Context) ([]string, error) {
+	if err := s.ensure(ctx); err != nil {
+		return nil, err
+	}
+	var ips []string
+	for _, set := range []string{s.set4, s.set6, s.net4, s.net6} {
+		out, err := s.run(ctx, nil, "ipset", "list", set)
+		if err != nil {
+			return nil, err
+		}
+		ips = append(ips, parseIpsetMembers(out)...)
+	}
+	return ips, nil
+}
+
+func (s *Ipset) Flush(ctx context.Context) error {
+	if err := s.ensure(ctx); err != nil {
+		return err
+	}
+	for _, set := range []string{s.set4, s.set6, s.net4, s.net6} {
+		if _, err := s.run(ctx, nil, "ipset", "flush", set); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseIpsetMembers extrae las líneas que siguen a "Members:" en la salida de "ipset list".
+func parseIpsetMembers(out []byte) []string {
+	var ips []string
+	members := false
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "Members:" {
+			members = true
+			continue
+		}
+		if members && line != "" {
+			// Los miembros pueden traer opciones ("1.2.3.4 timeout 30")
+			ips = append(ips, strings.Fields(line)[0])
+		}
+	}
+	return ips
+}
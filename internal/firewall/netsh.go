@@ -0,0 +1,275 @@
+package firewall
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// netshIPsPerRule limita las IPs por regla para no superar el largo máximo de la
+// línea de comandos (~32K) incluso con direcciones IPv6.
+const netshIPsPerRule = 400
+
+// Netsh bloquea IPs vía netsh advfirewall agrupándolas en reglas
+// TDN-AUTOBLOCK-<PERFIL>-NNN de hasta netshIPsPerRule remoteip cada una.
+type Netsh struct {
+	run    Runner
+	prefix string // prefijo de las reglas de este perfil
+
+	mu      sync.Mutex
+	rules   []map[string]bool // índice i → IPs asignadas a la regla i
+	applied []string          // índice i → remoteip aplicado en el firewall ("" = regla inexistente)
+	index   map[string]int    // IP → índice de regla
+	legacy  []string          // reglas por IP de versiones anteriores (TDN-AUTOBLOCK-1-2-3-4) a eliminar
+}
+
+// NewNetsh crea un backend netsh para profile que ejecuta los comandos con run.
+func NewNetsh(run Runner, profile string) *Netsh {
+	return &Netsh{
+		run:    run,
+		prefix: rulePrefix + strings.ToUpper(profileTag(profile)) + "-",
+		index:  make(map[string]int),
+	}
+}
+
+func (n *Netsh) Name() string { return BackendNetsh }
+
+// Sync asigna cada IP a una regla de forma estable (una IP no cambia de regla
+// mientras siga bloqueada), así un batch solo reescribe las reglas que cambiaron.
+func (n *Netsh) Sync(ctx context.Context, ips []string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	want := make(map[string]bool, len(ips))
+	for _, ip := range ips {
+		want[ip] = true
+	}
+	for ip, i := range n.index {
+		if !want[ip] {
+			delete(n.rules[i], ip)
+			delete(n.index, ip)
+		}
+	}
+	free := 0
+	for _, ip := range ips {
+		if _, ok := n.index[ip]; ok {
+			continue
+		}
+		for free < len(n.rules) && len(n.rules[free]) >= netshIPsPerRule {
+			free++
+		}
+		if free == len(n.rules) {
+			n.rules = append(n.rules, make(map[string]bool))
+			n.applied = append(n.applied, "")
+		}
+		n.rules[free][ip] = true
+		n.index[ip] = free
+	}
+
+	// Las reglas por IP de versiones anteriores quedan reemplazadas por las agregadas
+	for len(n.legacy) > 0 {
+		_, _ = n.run(ctx, nil, "netsh", "advfirewall", "firewall", "delete", "rule", "name="+n.legacy[0])
+		n.legacy = n.legacy[1:]
+	}
+
+	for i := range n.rules {
+		remote := joinRemoteIPs(n.rules[i])
+		if remote == n.applied[i] {
+			continue
+		}
+		if err := n.rewriteRule(ctx, n.ruleName(i), remote); err != nil {
+			return err
+		}
+		n.applied[i] = remote
+	}
+
+	// Recortar reglas vacías del final para no crecer indefinidamente
+	for len(n.rules) > 0 && len(n.rules[len(n.rules)-1]) == 0 && n.applied[len(n.rules)-1] == "" {
+		n.rules = n.rules[:len(n.rules)-1]
+		n.applied = n.applied[:len(n.applied)-1]
+	}
+	return nil
+}
+
+// rewriteRule reemplaza la regla name por una nueva con remote; remote vacío solo la borra.
+// Se borra antes de agregar porque netsh permite reglas duplicadas con el mismo nombre.
+func (n *Netsh) rewriteRule(ctx context.Context, name, remote string) error {
+	// Ignorar errores en el borrado (puede que la regla ya no exista)
+	_, _ = n.run(ctx, nil, "netsh", "advfirewall", "firewall", "delete", "rule", "name="+name)
+	if remote == "" {
+		return nil
+	}
+	_, err := n.run(ctx, nil, "netsh", "advfirewall", "firewall", "add", "rule",
+		"name="+name,
+		"dir=in",
+		"action=block",
+		"remoteip="+remote,
+		"enable=yes",
+		"profile=any",
+		"protocol=any",
+	)
+	return err
+}
+
+// List enumera las IPs de las reglas de este perfil y de las reglas por IP de
+// versiones anteriores. Además carga esas reglas como estado actual, de modo que
+// el siguiente Sync parchee (o elimine) las reglas existentes en lugar de duplicarlas.
+func (n *Netsh) List(ctx context.Context) ([]string, error) {
+	rules, err := n.listRules(ctx)
+	if err != nil {
+		return nil, err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var ips []string
+	seen := make(map[string]bool)
+	n.legacy = nil
+	for name, rule := range rules {
+		for _, ip := range rule {
+			if !seen[ip] {
+				seen[ip] = true
+				ips = append(ips, ip)
+			}
+		}
+		var i int
+		if !strings.HasPrefix(name, n.prefix) {
+			n.legacy = append(n.legacy, name)
+			continue
+		}
+		if _, err := fmt.Sscanf(strings.TrimPrefix(name, n.prefix), "%d", &i); err != nil || i < 0 {
+			n.legacy = append(n.legacy, name)
+			continue
+		}
+		for len(n.rules) <= i {
+			n.rules = append(n.rules, make(map[string]bool))
+			n.applied = append(n.applied, "")
+		}
+		actual := make(map[string]bool, len(rule))
+		for _, ip := range rule {
+			actual[ip] = true
+			if _, dup := n.index[ip]; !dup {
+				n.rules[i][ip] = true
+				n.index[ip] = i
+			}
+		}
+		// applied refleja lo que hay realmente en el firewall; si difiere de
+		// rules[i] (IP repetida en dos reglas) el próximo Sync la reescribe
+		n.applied[i] = joinRemoteIPs(actual)
+	}
+	return ips, nil
+}
+
+// listRules retorna nombre de regla → IPs remotas para las reglas de este perfil y
+// las reglas por IP de versiones anteriores; las de otros perfiles se ignoran. Se busca el prefijo en cualquier parte de la línea porque netsh traduce las
+// etiquetas ("Rule Name:", "Nombre de regla:") según el idioma del sistema;
+// "RemoteIP:" no se traduce.
+func (n *Netsh) listRules(ctx context.Context) (map[string][]string, error) {
+	out, err := n.run(ctx, nil, "netsh", "advfirewall", "firewall", "show", "rule", "name=all", "dir=in")
+	if err != nil {
+		// netsh retorna error si no hay reglas que coincidan
+		if bytes.Contains(out, []byte(rulePrefix)) {
+			return nil, err
+		}
+		return nil, nil
+	}
+	rules := make(map[string][]string)
+	current := ""
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		line := sc.Text()
+		if idx := strings.Index(line, rulePrefix); idx >= 0 {
+			current = ""
+			if name := strings.TrimSpace(line[idx:]); strings.HasPrefix(name, n.prefix) || legacyRuleIP(name) != "" {
+				current = name
+				rules[current] = nil
+			}
+			continue
+		}
+		if current == "" {
+			continue
+		}
+		if idx := strings.Index(line, "RemoteIP:"); idx >= 0 {
+			rules[current] = parseRemoteIPs(line[idx+len("RemoteIP:"):])
+			current = ""
+		}
+	}
+	return rules, nil
+}
+
+func (n *Netsh) Flush(ctx context.Context) error {
+	rules, err := n.listRules(ctx)
+	if err != nil {
+		return err
+	}
+	for name := range rules {
+		_, _ = n.run(ctx, nil, "netsh", "advfirewall", "firewall", "delete", "rule", "name="+name)
+	}
+	n.mu.Lock()
+	n.rules = nil
+	n.applied = nil
+	n.index = make(map[string]int)
+	n.legacy = nil
+	n.mu.Unlock()
+	return nil
+}
+
+// ruleName construye el nombre de la regla agregada i.
+func (n *Netsh) ruleName(i int) string {
+	return fmt.Sprintf("%s%03d", n.prefix, i)
+}
+
+// legacyRuleIP retorna la IP de una regla por IP de versiones anteriores
+// (TDN-AUTOBLOCK-1-2-3-4), o "" si name no tiene ese formato.
+func legacyRuleIP(name string) string {
+	s := strings.TrimPrefix(name, rulePrefix)
+	if s == name {
+		return ""
+	}
+	if !isIPv6(s) {
+		s = strings.ReplaceAll(s, "-", ".")
+	}
+	if net.ParseIP(s) == nil {
+		return ""
+	}
+	return s
+}
+
+// joinRemoteIPs arma el valor de remoteip (ordenado, para comparar con lo aplicado).
+func joinRemoteIPs(set map[string]bool) string {
+	ips := make([]string, 0, len(set))
+	for ip := range set {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	return strings.Join(ips, ",")
+}
+
+// parseRemoteIPs interpreta el valor de RemoteIP que muestra netsh
+// ("1.2.3.4/32,5.6.7.8/255.255.255.255,9.9.9.0/255.255.255.0"), quitando las
+// máscaras de host y pasando las máscaras de red a largo de prefijo (/24).
+func parseRemoteIPs(s string) []string {
+	var ips []string
+	for _, f := range strings.Split(strings.TrimSpace(s), ",") {
+		f = strings.TrimSpace(f)
+		for _, suffix := range []string{"/32", "/128", "/255.255.255.255"} {
+			f = strings.TrimSuffix(f, suffix)
+		}
+		if addr, mask, ok := strings.Cut(f, "/"); ok {
+			if m := net.ParseIP(mask).To4(); m != nil {
+				ones, _ := net.IPMask(m).Size()
+				f = fmt.Sprintf("%s/%d", addr, ones)
+			}
+		}
+		if f != "" && f != "Any" {
+			ips = append(ips, f)
+		}
+	}
+	return ips
+}
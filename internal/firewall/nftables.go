@@ -0,0 +1,150 @@
+package firewall
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const nftTable = "tdn_guard"
+
+// nftSetup crea la tabla, los sets y la cadena de input del perfil si no existen.
+// "add" es idempotente en nft, por lo que se puede reaplicar sin borrar nada; la
+// cadena es propia del perfil para no pisar las reglas del otro proceso guard.
+// Los rangos CIDR van en sets aparte con "flags interval" para no cambiar el tipo
+// de los sets de IPs ya existentes.
+const nftSetup = `add table inet %[1]s
+add set inet %[1]s %[2]s { type ipv4_addr; }
+add set inet %[1]s %[3]s { type ipv6_addr; }
+add set inet %[1]s %[5]s { type ipv4_addr; flags interval; }
+add set inet %[1]s %[6]s { type ipv6_addr; flags interval; }
+add chain inet %[1]s %[4]s { type filter hook input priority -10; policy accept; }
+flush chain inet %[1]s %[4]s
+add rule inet %[1]s %[4]s ip saddr @%[2]s drop
+add rule inet %[1]s %[4]s ip6 saddr @%[3]s drop
+add rule inet %[1]s %[4]s ip saddr @%[5]s drop
+add rule inet %[1]s %[4]s ip6 saddr @%[6]s drop
+`
+
+// Nftables bloquea IPs agregándolas a sets de una tabla nftables propia.
+type Nftables struct {
+	run   Runner
+	set4  string
+	set6  string
+	net4  string // rangos CIDR IPv4
+	net6  string // rangos CIDR IPv6
+	chain string
+	mu    sync.Mutex
+	ready bool
+}
+
+// NewNftables crea un backend nftables para profile que ejecuta los comandos con run.
+func NewNftables(run Runner, profile string) *Nftables {
+	tag := profileTag(profile)
+	return &Nftables{
+		run:   run,
+		set4:  "autoblock4_" + tag,
+		set6:  "autoblock6_" + tag,
+		net4:  "autoblocknet4_" + tag,
+		net6:  "autoblocknet6_" + tag,
+		chain: "input_" + tag,
+	}
+}
+
+func (n *Nftables) Name() string { return BackendNftables }
+
+// ensure aplica nftSetup la primera vez que se usa el backend.
+func (n *Nftables) ensure(ctx context.Context) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ready {
+		return nil
+	}
+	if _, err := n.run(ctx, strings.NewReader(fmt.Sprintf(nftSetup, nftTable, n.set4, n.set6, n.chain, n.net4, n.net6)), "nft", "-f", "-"); err != nil {
+		return err
+	}
+	n.ready = true
+	return nil
+}
+
+// Sync reemplaza el contenido de todos los sets en una única transacción de nft
+// (flush + add en el mismo script), sin ventana en la que los sets queden vacíos.
+func (n *Nftables) Sync(ctx context.Context, ips []string) error {
+	if err := n.ensure(ctx); err != nil {
+		return err
+	}
+	var v4, v6, net4, net6 []string
+	for _, ip := range ips {
+		switch {
+		case isCIDR(ip) && isIPv6(ip):
+			net6 = append(net6, ip)
+		case isCIDR(ip):
+			net4 = append(net4, ip)
+		case isIPv6(ip):
+			v6 = append(v6, ip)
+		default:
+			v4 = append(v4, ip)
+		}
+	}
+	var script strings.Builder
+	for _, set := range []struct {
+		name string
+		ips  []string
+	}{{n.set4, v4}, {n.set6, v6}, {n.net4, net4}, {n.net6, net6}} {
+		fmt.Fprintf(&script, "flush set inet %s %s\n", nftTable, set.name)
+		if len(set.ips) > 0 {
+			fmt.Fprintf(&script, "add element inet %s %s { %s }\n", nftTable, set.name, strings.Join(set.ips, ", "))
+		}
+	}
+	_, err := n.run(ctx, strings.NewReader(script.String()), "nft", "-f", "-")
+	return err
+}
+
+func (n *Nftables) List(ctx context.Context) ([]string, error) {
+	if err := n.ensure(ctx); err != nil {
+		return nil, err
+	}
+	var ips []string
+	for _, set := range []string{n.set4, n.set6, n.net4, n.net6} {
+		out, err := n.run(ctx, nil, "nft", "list", "set", "inet", nftTable, set)
+		if err != nil {
+			return nil, err
+		}
+		ips = append(ips, parseNftElements(string(out))...)
+	}
+	return ips, nil
+}
+
+func (n *Nftables) Flush(ctx context.Context) error {
+	if err := n.ensure(ctx); err != nil {
+		return err
+	}
+	for _, set := range []string{n.set4, n.set6, n.net4, n.net6} {
+		if _, err := n.run(ctx, nil, "nft", "flush", "set", "inet", nftTable, set); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseNftElements extrae los elementos de la salida de "nft list set", que tiene la forma
+// "elements = { 1.2.3.4, 5.6.7.8,\n\t\t 9.9.9.9 }" (puede ocupar varias líneas).
+func parseNftElements(out string) []string {
+	idx := strings.Index(out, "elements = {")
+	if idx < 0 {
+		return nil
+	}
+	rest := out[idx+len("elements = {"):]
+	if end := strings.Index(rest, "}"); end >= 0 {
+		rest = rest[:end]
+	}
+	var ips []string
+	for _, f := range strings.Split(rest, ",") {
+		f = strings.TrimSpace(f)
+		if f != "" {
+			ips = append(ips, f)
+		}
+	}
+	return ips
+}
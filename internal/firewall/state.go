@@ -0,0 +1,181 @@
+package firewall
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// State persiste las expiraciones de scheduled para poder reconciliar las reglas
+// después de un crash o reinicio. FileState es la implementación mínima; el store
+// persistente (internal/store) también la implementa.
+type State interface {
+	LoadFirewall() map[string]time.Time
+	SaveFirewall(scheduled map[string]time.Time) error
+}
+
+// stateVersion es la versión del formato del archivo de estado.
+const stateVersion = 1
+
+// stateFile es el contenido persistido en disco: la expiración de cada IP de
+// scheduled, para poder re-adoptar las reglas después de un crash o reinicio.
+type stateFile struct {
+	Version int              `json:"version"`
+	Backend string           `json:"backend"`
+	SavedAt int64            `json:"saved_at"`
+	Expires map[string]int64 `json:"expires"` // IP → Unix timestamp de desbloqueo
+}
+
+// ReconcileResult resume la reconciliación de reglas hecha al crear el Manager.
+type ReconcileResult struct {
+	Adopted  int    // reglas existentes con expiración persistida vigente
+	Removed  int    // reglas huérfanas eliminadas (sin expiración o ya vencidas)
+	Restored int    // IPs persistidas vigentes que no estaban en el firewall (p.ej. tras reboot)
+	Pending  int    // IPs persistidas vigentes sin verificar (falló List): se aplican con el próximo batch
+	Err      string // error al enumerar las reglas existentes, si lo hubo
+}
+
+func (r ReconcileResult) String() string {
+	if r.Err != "" {
+		return fmt.Sprintf("error=%s pending=%d", r.Err, r.Pending)
+	}
+	return fmt.Sprintf("adopted=%d removed=%d restored=%d", r.Adopted, r.Removed, r.Restored)
+}
+
+// FileState guarda las expiraciones en un archivo JSON propio.
+type FileState struct {
+	path    string
+	backend string
+}
+
+// NewFileState crea un State sobre path. backend se anota en el archivo como referencia.
+func NewFileState(path, backend string) *FileState {
+	return &FileState{path: path, backend: backend}
+}
+
+// LoadFirewall lee el archivo de estado; un archivo inexistente o de otra versión se
+// trata como vacío.
+func (fs *FileState) LoadFirewall() map[string]time.Time {
+	path := fs.path
+	result := make(map[string]time.Time)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[WARN] firewall: no se pudo leer estado %s: %v", path, err)
+		}
+		return result
+	}
+	var st stateFile
+	if err := json.Unmarshal(data, &st); err != nil {
+		log.Printf("[WARN] firewall: estado %s inválido, se ignora: %v", path, err)
+		return result
+	}
+	if st.Version != stateVersion {
+		log.Printf("[WARN] firewall: estado %s con versión %d (esperada %d), se ignora", path, st.Version, stateVersion)
+		return result
+	}
+	for ip, unix := range st.Expires {
+		result[ip] = time.Unix(unix, 0)
+	}
+	return result
+}
+
+// SaveFirewall escribe el estado de forma atómica (archivo temporal + rename).
+func (fs *FileState) SaveFirewall(scheduled map[string]time.Time) error {
+	path := fs.path
+	st := stateFile{
+		Version: stateVersion,
+		Backend: fs.backend,
+		SavedAt: time.Now().Unix(),
+		Expires: make(map[string]int64, len(scheduled)),
+	}
+	for ip, until := range scheduled {
+		st.Expires[ip] = until.Unix()
+	}
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// reconcile enumera las reglas existentes del backend y las compara con las
+// expiraciones persistidas: re-adopta las vigentes, elimina las huérfanas y
+// vuelve a aplicar las vigentes que faltan. Debe llamarse antes de arrancar
+// batchProcessor.
+func (m *Manager) reconcile() ReconcileResult {
+	var res ReconcileResult
+	saved := make(map[string]time.Time)
+	if m.state != nil {
+		saved = m.state.LoadFirewall()
+	}
+
+	ctx, cancel := context.WithTimeout(m.ctx, syncTimeout)
+	listed, err := m.backend.List(ctx)
+	cancel()
+	if err != nil {
+		res.Err = err.Error()
+		log.Printf("[WARN] firewall reconciliación (%s): no se pudieron enumerar reglas: %v", m.backend.Name(), err)
+	}
+
+	now := time.Now()
+	present := make(map[string]bool, len(listed))
+	m.mu.Lock()
+	for _, ip := range listed {
+		present[ip] = true
+		if until, ok := saved[ip]; ok && until.After(now) {
+			m.scheduled[ip] = until
+			res.Adopted++
+		} else {
+			res.Removed++
+		}
+	}
+	for ip, until := range saved {
+		if !present[ip] && until.After(now) && len(m.scheduled) < maxBlockedIPs {
+			m.scheduled[ip] = until
+			// Sin la lista no se sabe si faltaban, y no se aplican hasta el próximo batch
+			if err != nil {
+				res.Pending++
+			} else {
+				res.Restored++
+			}
+		}
+	}
+	// Siempre sincronizar: además de huérfanas y faltantes, netsh puede tener reglas
+	// por IP de versiones anteriores que hay que pasar a reglas agregadas. Salvo si
+	// no se pudo enumerar: nftables e ipset reemplazan el set entero, y aplicar solo
+	// lo persistido borraría los bans vigentes que no se llegaron a ver. Las vigentes
+	// quedan en scheduled y se aplican con el próximo batch que tenga cambios.
+	m.dirty = err == nil
+	m.mu.Unlock()
+
+	// Aplicar de inmediato: elimina huérfanas y restaura las faltantes
+	if err == nil {
+		m.syncRules()
+	}
+
+	log.Printf("[INFO] firewall reconciliación (%s): %s", m.backend.Name(), res)
+	return res
+}
+
+// Reconciled retorna el resultado de la reconciliación hecha en New.
+func (m *Manager) Reconciled() ReconcileResult {
+	return m.reconciled
+}
@@ -0,0 +1,47 @@
+package handoff
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+// passFD indica si el listener se pasa como fd por el socket de control.
+const passFD = true
+
+// oobSize es el espacio para recibir un único fd (SCM_RIGHTS).
+var oobSize = syscall.CmsgSpace(4)
+
+// listenerFile retorna una copia del fd de ln.
+func listenerFile(ln net.Listener) (*os.File, error) {
+	fl, ok := ln.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, errors.New("el listener no expone su fd")
+	}
+	return fl.File()
+}
+
+// rights arma el mensaje de control que transfiere el fd de f.
+func rights(f *os.File) []byte {
+	return syscall.UnixRights(int(f.Fd()))
+}
+
+// parseRights extrae el fd recibido en oob.
+func parseRights(oob []byte) (*os.File, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range msgs {
+		fds, err := syscall.ParseUnixRights(&m)
+		if err != nil || len(fds) == 0 {
+			continue
+		}
+		for _, fd := range fds[1:] {
+			syscall.Close(fd)
+		}
+		return os.NewFile(uintptr(fds[0]), "handoff-listener"), nil
+	}
+	return nil, errors.New("mensaje de control sin fd")
+}
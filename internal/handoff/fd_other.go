@@ -0,0 +1,25 @@
+//go:build !linux
+
+package handoff
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// passFD indica si el listener se pasa como fd por el socket de control. Fuera de
+// Linux el proceso nuevo vuelve a abrir el puerto cuando el anterior lo suelta.
+const passFD = false
+
+const oobSize = 0
+
+func listenerFile(net.Listener) (*os.File, error) {
+	return nil, errors.New("traspaso de fd no soportado")
+}
+
+func rights(*os.File) []byte { return nil }
+
+func parseRights([]byte) (*os.File, error) {
+	return nil, errors.New("traspaso de fd no soportado")
+}
@@ -0,0 +1,287 @@
+// Package handoff traspasa el listener de un proceso guard a otro nuevo (p. ej. al
+// actualizar el binario) sin dejar de atender: el proceso nuevo se conecta al
+// socket de control local del anterior, recibe el listener (en Linux, el mismo
+// socket por SCM_RIGHTS; en otros sistemas vuelve a abrir el puerto apenas el
+// anterior lo suelta) y opcionalmente el estado del limiter. El proceso anterior
+// deja de aceptar y termina sus sesiones en curso.
+//
+// Protocolo (mensajes JSON con prefijo de largo de 4 bytes):
+//
+//	nuevo    → anterior  request  {op: "takeover", profile, want_state}
+//	anterior → nuevo     offer    {op: "offer", listen_addr, fd, limiter} (+ fd)
+//	nuevo    → anterior  {op: "ready"}     el nuevo ya tiene el listener
+//	anterior → nuevo     {op: "released"}  el anterior dejó de aceptar y soltó store/firewall
+package handoff
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	maxMessage   = 64 << 20         // tope de un mensaje (el estado del limiter puede ser grande)
+	readyTimeout = 30 * time.Second // cuánto espera el anterior el "ready" del nuevo
+	releaseWait  = 30 * time.Second // cuánto espera el nuevo el "released" del anterior
+)
+
+// message es un mensaje del protocolo; cada op usa solo algunos campos.
+type message struct {
+	Op         string          `json:"op"`
+	Profile    string          `json:"profile,omitempty"`
+	WantState  bool            `json:"want_state,omitempty"`
+	ListenAddr string          `json:"listen_addr,omitempty"`
+	FD         bool            `json:"fd,omitempty"`
+	Limiter    json.RawMessage `json:"limiter,omitempty"`
+	Error      string          `json:"error,omitempty"`
+}
+
+// Offer es lo que el proceso anterior entrega al nuevo.
+type Offer struct {
+	ListenAddr string
+	Listener   net.Listener    // listener en uso (nil = el nuevo debe abrir ListenAddr)
+	Limiter    json.RawMessage // estado del limiter (nil si no se pidió o no hay)
+}
+
+// Serve atiende pedidos de traspaso en el socket Unix path hasta que ctx se
+// cancele o se complete un traspaso. profile debe coincidir con el del proceso
+// nuevo. offer arma lo que se entrega (wantState indica si el nuevo pidió el
+// estado del limiter); release se llama cuando el nuevo confirmó que tiene el
+// listener y debe dejar de aceptar y soltar los recursos compartidos antes de
+// retornar. Si path existe y nadie lo atiende (restos de un proceso caído) se borra.
+func Serve(ctx context.Context, path, profile string, offer func(wantState bool) (Offer, error), release func()) error {
+	if _, err := os.Stat(path); err == nil {
+		if c, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			c.Close()
+			return fmt.Errorf("handoff: %s ya está atendido por otro proceso", path)
+		}
+		_ = os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("handoff: %w", err)
+	}
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("handoff: %w", err)
+		}
+		done, err := serveConn(c.(*net.UnixConn), profile, offer, ln, release)
+		c.Close()
+		if err != nil {
+			log.Printf("[WARN] handoff: traspaso abortado: %v", err)
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+// serveConn atiende un pedido. Retorna true si el traspaso se completó; en ese
+// caso ln (el socket de control) ya está cerrado.
+func serveConn(c *net.UnixConn, profile string, offer func(bool) (Offer, error), ln net.Listener, release func()) (bool, error) {
+	_ = c.SetDeadline(time.Now().Add(readyTimeout))
+	var req message
+	if _, err := readMsg(c, &req, false); err != nil {
+		return false, err
+	}
+	if req.Op != "takeover" {
+		return false, fmt.Errorf("op inesperada %q", req.Op)
+	}
+	if req.Profile != profile {
+		_ = writeMsg(c, message{Op: "error", Error: fmt.Sprintf("este proceso atiende el perfil %q", profile)}, nil)
+		return false, fmt.Errorf("pedido para el perfil %q, este proceso atiende %q", req.Profile, profile)
+	}
+	o, err := offer(req.WantState)
+	if err != nil {
+		_ = writeMsg(c, message{Op: "error", Error: err.Error()}, nil)
+		return false, err
+	}
+	resp := message{Op: "offer", ListenAddr: o.ListenAddr, Limiter: o.Limiter}
+	var f *os.File
+	if passFD && o.Listener != nil {
+		if f, err = listenerFile(o.Listener); err != nil {
+			log.Printf("[WARN] handoff: no se pudo obtener el fd del listener, el proceso nuevo abrirá el puerto: %v", err)
+		} else {
+			defer f.Close()
+			resp.FD = true
+		}
+	}
+	if err := writeMsg(c, resp, f); err != nil {
+		return false, err
+	}
+	var ready message
+	if _, err := readMsg(c, &ready, false); err != nil {
+		return false, err
+	}
+	if ready.Op != "ready" {
+		return false, fmt.Errorf("op inesperada %q", ready.Op)
+	}
+	// Desde acá el traspaso es irreversible: liberar el path para el proceso nuevo
+	ln.Close()
+	release()
+	return true, writeMsg(c, message{Op: "released"}, nil)
+}
+
+// Handoff es un traspaso en curso del lado del proceso nuevo.
+type Handoff struct {
+	ListenAddr string
+	Listener   net.Listener    // listener heredado (nil = hay que abrir ListenAddr tras Ready)
+	Limiter    json.RawMessage // estado del limiter (nil si no se pidió)
+	conn       *net.UnixConn
+}
+
+// Takeover se conecta al proceso que atiende path y pide su listener (y su estado
+// del limiter si wantState). El proceso anterior sigue aceptando hasta Ready; si
+// el nuevo no puede continuar debe llamar a Abort.
+func Takeover(path, profile string, wantState bool, timeout time.Duration) (*Handoff, error) {
+	c, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("handoff: no se pudo conectar a %s: %w", path, err)
+	}
+	uc := c.(*net.UnixConn)
+	_ = uc.SetDeadline(time.Now().Add(timeout))
+	if err := writeMsg(uc, message{Op: "takeover", Profile: profile, WantState: wantState}, nil); err != nil {
+		uc.Close()
+		return nil, fmt.Errorf("handoff: %w", err)
+	}
+	var resp message
+	f, err := readMsg(uc, &resp, passFD)
+	if err != nil {
+		uc.Close()
+		return nil, fmt.Errorf("handoff: %w", err)
+	}
+	if resp.Op == "error" {
+		uc.Close()
+		return nil, fmt.Errorf("handoff: el proceso anterior rechazó el traspaso: %s", resp.Error)
+	}
+	h := &Handoff{ListenAddr: resp.ListenAddr, Limiter: resp.Limiter, conn: uc}
+	if f != nil {
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			uc.Close()
+			return nil, fmt.Errorf("handoff: listener heredado: %w", err)
+		}
+		h.Listener = ln
+	}
+	return h, nil
+}
+
+// Ready confirma al proceso anterior que el nuevo está listo y espera a que deje de
+// aceptar y suelte sus recursos. Si no se heredó el listener, el puerto queda libre
+// al retornar.
+func (h *Handoff) Ready() error {
+	defer h.conn.Close()
+	_ = h.conn.SetDeadline(time.Now().Add(releaseWait))
+	if err := writeMsg(h.conn, message{Op: "ready"}, nil); err != nil {
+		return fmt.Errorf("handoff: %w", err)
+	}
+	var resp message
+	if _, err := readMsg(h.conn, &resp, false); err != nil {
+		return fmt.Errorf("handoff: esperando al proceso anterior: %w", err)
+	}
+	if resp.Op != "released" {
+		return fmt.Errorf("handoff: op inesperada %q", resp.Op)
+	}
+	return nil
+}
+
+// Abort cancela el traspaso: el proceso anterior sigue atendiendo.
+func (h *Handoff) Abort() {
+	if h.Listener != nil {
+		h.Listener.Close()
+	}
+	h.conn.Close()
+}
+
+// ListenRetry abre addr reintentando durante hasta wait, para el caso en que el
+// puerto lo acaba de soltar el proceso anterior.
+func ListenRetry(addr string, wait time.Duration) (net.Listener, error) {
+	deadline := time.Now().Add(wait)
+	for {
+		ln, err := net.Listen("tcp", addr)
+		if err == nil || time.Now().After(deadline) {
+			return ln, err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// writeMsg envía m con prefijo de largo; si f no es nil, su fd viaja junto con el
+// primer byte del mensaje.
+func writeMsg(c *net.UnixConn, m message, f *os.File) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[4:], data)
+	if f != nil {
+		_, _, err = c.WriteMsgUnix(buf, rights(f), nil)
+		return err
+	}
+	_, err = c.Write(buf)
+	return err
+}
+
+// readMsg lee un mensaje en m. Si withFD, recibe además el fd que lo acompaña (nil
+// si no vino ninguno).
+func readMsg(c *net.UnixConn, m *message, withFD bool) (*os.File, error) {
+	var hdr [4]byte
+	var f *os.File
+	if withFD {
+		oob := make([]byte, oobSize)
+		n, oobn, _, _, err := c.ReadMsgUnix(hdr[:], oob)
+		if err != nil {
+			return nil, err
+		}
+		if oobn > 0 {
+			if f, err = parseRights(oob[:oobn]); err != nil {
+				return nil, err
+			}
+		}
+		if _, err := io.ReadFull(c, hdr[n:]); err != nil {
+			closeFile(f)
+			return nil, err
+		}
+	} else if _, err := io.ReadFull(c, hdr[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(hdr[:])
+	if size > maxMessage {
+		closeFile(f)
+		return nil, errors.New("mensaje demasiado grande")
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(c, data); err != nil {
+		closeFile(f)
+		return nil, err
+	}
+	if err := json.Unmarshal(data, m); err != nil {
+		closeFile(f)
+		return nil, err
+	}
+	return f, nil
+}
+
+func closeFile(f *os.File) {
+	if f != nil {
+		f.Close()
+	}
+}
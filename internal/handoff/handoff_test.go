@@ -0,0 +1,289 @@
+package handoff
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// socketPath retorna un path corto para el socket de control (los paths de
+// t.TempDir pueden pasar el límite de 108 bytes de los sockets Unix).
+func socketPath(t *testing.T) string {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "handoff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "h.sock")
+}
+
+// serve corre Serve en una goroutine (el proceso anterior) y retorna el canal con
+// su resultado. Espera a que el socket esté escuchando.
+func serve(t *testing.T, path, profile string, offer func(bool) (Offer, error), release func()) <-chan error {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- Serve(ctx, path, profile, offer, release) }()
+	t.Cleanup(cancel)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return errc
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Serve no empezó a escuchar")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// events registra, en orden, lo que ocurre de cada lado del traspaso.
+type events struct {
+	mu   sync.Mutex
+	list []string
+}
+
+func (e *events) add(ev string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.list = append(e.list, ev)
+}
+
+func (e *events) String() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return strings.Join(e.list, ",")
+}
+
+func TestHandoffProfileMismatch(t *testing.T) {
+	path := socketPath(t)
+	var ev events
+	errc := serve(t, path, "login", func(bool) (Offer, error) {
+		ev.add("offer")
+		return Offer{ListenAddr: ":7666"}, nil
+	}, func() { ev.add("release") })
+
+	_, err := Takeover(path, "game", false, 5*time.Second)
+	if err == nil || !strings.Contains(err.Error(), "perfil") {
+		t.Fatalf("Takeover con otro perfil: err %v, se esperaba rechazo por perfil", err)
+	}
+	if got := ev.String(); got != "" {
+		t.Fatalf("el rechazo llamó a %s", got)
+	}
+
+	// El proceso anterior sigue atendiendo y acepta el perfil correcto
+	h, err := Takeover(path, "login", false, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Ready(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if got := ev.String(); got != "offer,release" {
+		t.Fatalf("eventos %q, se esperaba offer,release", got)
+	}
+}
+
+func TestHandoffWantState(t *testing.T) {
+	path := socketPath(t)
+	state := json.RawMessage(`{"ips":{"203.0.113.7":3}}`)
+	var ev events
+	errc := serve(t, path, "game", func(wantState bool) (Offer, error) {
+		o := Offer{ListenAddr: ":7667"}
+		if wantState {
+			ev.add("offer+state")
+			o.Limiter = state
+		} else {
+			ev.add("offer")
+		}
+		return o, nil
+	}, func() { ev.add("release") })
+
+	// Sin want_state no viaja el limiter; el abort deja al anterior atendiendo
+	h, err := Takeover(path, "game", false, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Limiter != nil || h.ListenAddr != ":7667" {
+		t.Fatalf("oferta sin want_state: addr %q, limiter %s", h.ListenAddr, h.Limiter)
+	}
+	h.Abort()
+
+	h, err = Takeover(path, "game", true, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(h.Limiter) != string(state) {
+		t.Fatalf("limiter %s, se esperaba %s", h.Limiter, state)
+	}
+	if err := h.Ready(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if got := ev.String(); got != "offer,offer+state,release" {
+		t.Fatalf("eventos %q, se esperaba offer,offer+state,release", got)
+	}
+}
+
+func TestHandoffReadyReleasedOrder(t *testing.T) {
+	path := socketPath(t)
+	var ev events
+	errc := serve(t, path, "login", func(bool) (Offer, error) {
+		ev.add("offer")
+		return Offer{ListenAddr: ":7668"}, nil
+	}, func() {
+		// El anterior suelta sus recursos antes de avisar "released"
+		time.Sleep(50 * time.Millisecond)
+		ev.add("release")
+	})
+
+	h, err := Takeover(path, "login", false, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev.add("takeover")
+	// Hasta Ready el anterior sigue aceptando: no debe haber soltado nada
+	time.Sleep(50 * time.Millisecond)
+	if got := ev.String(); got != "offer,takeover" {
+		t.Fatalf("eventos %q antes de Ready, se esperaba offer,takeover", got)
+	}
+	if err := h.Ready(); err != nil {
+		t.Fatal(err)
+	}
+	ev.add("ready")
+	if got := ev.String(); got != "offer,takeover,release,ready" {
+		t.Fatalf("eventos %q, se esperaba offer,takeover,release,ready", got)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	// Completado el traspaso el path queda libre para el proceso nuevo
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("el socket de control sigue existiendo: %v", err)
+	}
+}
+
+func TestServeStaleSocket(t *testing.T) {
+	path := socketPath(t)
+	// Restos de un proceso caído: el archivo existe pero nadie escucha
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("no quedó el socket huérfano: %v", err)
+	}
+
+	offer := func(bool) (Offer, error) { return Offer{ListenAddr: ":7669"}, nil }
+	errc := serve(t, path, "login", offer, func() {})
+
+	// Un segundo proceso no puede pisar un socket atendido
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := Serve(ctx, path, "login", offer, func() {}); err == nil || !strings.Contains(err.Error(), "ya está atendido") {
+		t.Fatalf("Serve sobre un socket atendido: err %v", err)
+	}
+
+	h, err := Takeover(path, "login", false, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Ready(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandoffPassesListener(t *testing.T) {
+	if !passFD {
+		t.Skip("traspaso de fd solo en Linux")
+	}
+	old, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := socketPath(t)
+	errc := serve(t, path, "login", func(bool) (Offer, error) {
+		return Offer{ListenAddr: old.Addr().String(), Listener: old}, nil
+	}, func() { old.Close() })
+
+	h, err := Takeover(path, "login", false, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Listener == nil {
+		t.Fatal("no se recibió el listener por SCM_RIGHTS")
+	}
+	defer h.Listener.Close()
+	if h.Listener.Addr().String() != old.Addr().String() {
+		t.Fatalf("listener heredado en %s, se esperaba %s", h.Listener.Addr(), old.Addr())
+	}
+	if err := h.Ready(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	// Con el anterior cerrado, el heredado sigue aceptando en el mismo puerto
+	accepted := make(chan error, 1)
+	go func() {
+		c, err := h.Listener.Accept()
+		if err == nil {
+			c.Close()
+		}
+		accepted <- err
+	}()
+	c, err := net.Dial("tcp", old.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	select {
+	case err := <-accepted:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("el listener heredado no aceptó la conexión")
+	}
+}
+
+func TestListenRetry(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := busy.Addr().String()
+	if _, err := ListenRetry(addr, 0); err == nil {
+		t.Fatal("ListenRetry abrió un puerto ocupado")
+	}
+
+	// El proceso anterior suelta el puerto al rato
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		busy.Close()
+	}()
+	ln, err := ListenRetry(addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+}
@@ -0,0 +1,235 @@
+package limiter
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// CIDRList es un conjunto de prefijos IPv4/IPv6 con búsqueda por trie binario:
+// Contains recorre como máximo 32 (IPv4) o 128 (IPv6) nodos sin importar cuántos
+// prefijos haya cargados.
+//
+// El contenido tiene dos capas: la base, que reemplaza Replace (la config), y los
+// cambios hechos con Add/Remove (la API admin), que se conservan en cada Replace
+// hasta reiniciar el proceso.
+type CIDRList struct {
+	mu      sync.RWMutex
+	root4   *trieNode
+	root6   *trieNode
+	prefix  map[netip.Prefix]struct{} // contenido vigente (base + cambios)
+	overlay map[netip.Prefix]bool     // true = agregado con Add, false = quitado con Remove
+}
+
+type trieNode struct {
+	child [2]*trieNode
+	term  bool // hay un prefijo que termina en este nodo
+}
+
+// NewCIDRList crea una lista vacía.
+func NewCIDRList() *CIDRList {
+	return &CIDRList{
+		root4:   &trieNode{},
+		root6:   &trieNode{},
+		prefix:  make(map[netip.Prefix]struct{}),
+		overlay: make(map[netip.Prefix]bool),
+	}
+}
+
+// ParsePrefix interpreta "1.2.3.0/24", "2001:db8::/32" o una IP suelta (→ /32 o /128).
+// Las IPv4-mapped IPv6 se normalizan a IPv4.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("cidr inválido: %q", s)
+		}
+		if p.Addr().Is4In6() && p.Bits() >= 96 {
+			p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+		}
+		return p.Masked(), nil
+	}
+	a, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("ip o cidr inválido: %q", s)
+	}
+	a = a.Unmap()
+	return netip.PrefixFrom(a, a.BitLen()), nil
+}
+
+// ClientKey retorna la clave canónica de cliente para ip: las IPv4-mapped IPv6 se
+// pasan a IPv4 y las IPv6 se agrupan en su prefijo /v6Bits ("2001:db8:1:2::/64"),
+// ya que un único cliente residencial suele disponer de un /64 completo.
+// v6Bits fuera de 1-127 no agrupa. Si ip no es válida se retorna sin cambios.
+func ClientKey(ip string, v6Bits int) string {
+	a, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	a = a.Unmap().WithZone("")
+	if a.Is4() || v6Bits <= 0 || v6Bits >= 128 {
+		return a.String()
+	}
+	p, err := a.Prefix(v6Bits)
+	if err != nil {
+		return a.String()
+	}
+	return p.String()
+}
+
+func (c *CIDRList) root(a netip.Addr) *trieNode {
+	if a.Is4() {
+		return c.root4
+	}
+	return c.root6
+}
+
+// Add agrega un prefijo. Retorna false si ya estaba. El prefijo sigue en la lista
+// aunque un Replace posterior no lo incluya.
+func (c *CIDRList) Add(s string) (bool, error) {
+	p, err := ParsePrefix(s)
+	if err != nil {
+		return false, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.insert(p) {
+		return false, nil
+	}
+	c.overlay[p] = true
+	return true, nil
+}
+
+// Remove quita un prefijo exacto. Retorna false si no estaba. El prefijo sigue
+// afuera aunque un Replace posterior lo incluya.
+func (c *CIDRList) Remove(s string) (bool, error) {
+	p, err := ParsePrefix(s)
+	if err != nil {
+		return false, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.prefix[p]; !ok {
+		return false, nil
+	}
+	delete(c.prefix, p)
+	removeBits(c.root(p.Addr()), p.Addr().AsSlice(), 0, p.Bits())
+	c.overlay[p] = false
+	return true, nil
+}
+
+// insert agrega p al trie. Retorna false si ya estaba. Debe llamarse con c.mu.
+func (c *CIDRList) insert(p netip.Prefix) bool {
+	if _, ok := c.prefix[p]; ok {
+		return false
+	}
+	c.prefix[p] = struct{}{}
+	n := c.root(p.Addr())
+	b := p.Addr().AsSlice()
+	for i := 0; i < p.Bits(); i++ {
+		bit := (b[i/8] >> (7 - uint(i%8))) & 1
+		if n.child[bit] == nil {
+			n.child[bit] = &trieNode{}
+		}
+		n = n.child[bit]
+	}
+	n.term = true
+	return true
+}
+
+// removeBits desmarca el nodo del prefijo y poda las ramas que quedan vacías.
+// Retorna true si n quedó vacío.
+func removeBits(n *trieNode, b []byte, depth, bits int) bool {
+	if depth == bits {
+		n.term = false
+	} else {
+		bit := (b[depth/8] >> (7 - uint(depth%8))) & 1
+		if child := n.child[bit]; child != nil && removeBits(child, b, depth+1, bits) {
+			n.child[bit] = nil
+		}
+	}
+	return !n.term && n.child[0] == nil && n.child[1] == nil
+}
+
+// Contains indica si ip está cubierta por algún prefijo de la lista.
+func (c *CIDRList) Contains(ip string) bool {
+	a, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	return c.ContainsAddr(a)
+}
+
+// ContainsAddr es como Contains pero recibe la dirección ya parseada.
+func (c *CIDRList) ContainsAddr(a netip.Addr) bool {
+	a = a.Unmap()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.prefix) == 0 {
+		return false
+	}
+	n := c.root(a)
+	if n.term {
+		return true
+	}
+	b := a.AsSlice()
+	for i := 0; i < a.BitLen(); i++ {
+		n = n.child[(b[i/8]>>(7-uint(i%8)))&1]
+		if n == nil {
+			return false
+		}
+		if n.term {
+			return true
+		}
+	}
+	return false
+}
+
+// Replace reemplaza la base (ver CIDRList) y conserva los cambios hechos con
+// Add/Remove. Si alguna entrada es inválida no se modifica nada.
+func (c *CIDRList) Replace(entries []string) error {
+	base := make([]netip.Prefix, 0, len(entries))
+	for _, e := range entries {
+		p, err := ParsePrefix(e)
+		if err != nil {
+			return err
+		}
+		base = append(base, p)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.root4, c.root6, c.prefix = &trieNode{}, &trieNode{}, make(map[netip.Prefix]struct{})
+	for _, p := range base {
+		if added, ok := c.overlay[p]; !ok || added {
+			c.insert(p)
+		}
+	}
+	for p, added := range c.overlay {
+		if added {
+			c.insert(p)
+		}
+	}
+	return nil
+}
+
+// List retorna los prefijos cargados, ordenados.
+func (c *CIDRList) List() []string {
+	c.mu.RLock()
+	out := make([]string, 0, len(c.prefix))
+	for p := range c.prefix {
+		out = append(out, p.String())
+	}
+	c.mu.RUnlock()
+	sort.Strings(out)
+	return out
+}
+
+// Len retorna la cantidad de prefijos cargados.
+func (c *CIDRList) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.prefix)
+}
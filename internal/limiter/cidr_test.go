@@ -0,0 +1,292 @@
+package limiter
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestClientKey(t *testing.T) {
+	cases := []struct {
+		ip     string
+		v6Bits int
+		want   string
+	}{
+		{"203.0.113.7", 64, "203.0.113.7"},
+		{"::ffff:203.0.113.7", 64, "203.0.113.7"}, // IPv4-mapped de un listener dual-stack
+		{"::ffff:203.0.113.7", 128, "203.0.113.7"},
+		{"2001:db8:1:2:aaaa:bbbb:cccc:dddd", 64, "2001:db8:1:2::/64"},
+		{"2001:db8:1:2::1", 64, "2001:db8:1:2::/64"},
+		{"2001:db8:1:3::1", 64, "2001:db8:1:3::/64"},
+		{"2001:db8:1:2:aaaa::1", 48, "2001:db8:1::/48"},
+		{"2001:db8:1:2::1", 128, "2001:db8:1:2::1"},
+		{"2001:DB8::1", 128, "2001:db8::1"},
+		{"fe80::1%eth0", 128, "fe80::1"},
+		{"no-es-ip", 64, "no-es-ip"},
+	}
+	for _, c := range cases {
+		if got := ClientKey(c.ip, c.v6Bits); got != c.want {
+			t.Errorf("ClientKey(%q, %d) = %q, se esperaba %q", c.ip, c.v6Bits, got, c.want)
+		}
+	}
+}
+
+func TestIPv6ClientsShareState(t *testing.T) {
+	l := New(2, 100, 100, 10, 60, 1000, 300, 60)
+	defer l.Stop()
+	if err := l.SetIPv6Prefix(64); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	// Dos direcciones del mismo /64 cuentan como un único cliente
+	for _, ip := range []string{"2001:db8::1", "2001:db8::2"} {
+		if ok, reason := l.TryAccept(ip, now); !ok {
+			t.Fatalf("%s rechazada: %s", ip, reason)
+		}
+	}
+	if ok, reason := l.TryAccept("2001:db8::3", now); ok || reason != "live_limit" {
+		t.Fatalf("TryAccept = %v, %q; se esperaba live_limit del /64", ok, reason)
+	}
+	if ok, reason := l.TryAccept("2001:db8:0:1::1", now); !ok {
+		t.Fatalf("otro /64 rechazado: %s", reason)
+	}
+}
+
+func TestSetIPv6PrefixKeepsLiveConns(t *testing.T) {
+	l := New(10, 100, 100, 10, 60, 1000, 300, 60)
+	defer l.Stop()
+	if err := l.SetSubnetLimits(SubnetConfig{V4Bits: 24, V6Bits: 48, MaxLive: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.SetIPv6Prefix(64); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for _, ip := range []string{"2001:db8::1", "2001:db8::2"} {
+		if ok, reason := l.TryAccept(ip, now); !ok {
+			t.Fatalf("%s rechazada: %s", ip, reason)
+		}
+	}
+
+	// Cambio de agrupación con las conexiones abiertas: al cerrarse deben
+	// descontarse de la subred aunque su clave de cliente haya cambiado
+	if err := l.SetIPv6Prefix(128); err != nil {
+		t.Fatal(err)
+	}
+	l.Release("2001:db8::1")
+	l.Release("2001:db8::2")
+
+	for _, s := range l.GetSubnetStats() {
+		if s.LiveCount != 0 {
+			t.Fatalf("subred %s con %d conexiones vivas después de cerrarlas todas", s.Prefix, s.LiveCount)
+		}
+	}
+	if active, _ := l.Stats(); active != 0 {
+		t.Fatalf("%d slots globales en uso después de cerrar todo", active)
+	}
+	for _, ip := range []string{"2001:db8::5", "2001:db8::6"} {
+		if ok, reason := l.TryAccept(ip, now); !ok {
+			t.Fatalf("%s rechazada después del cambio de prefijo: %s", ip, reason)
+		}
+	}
+	if len(l.retired) != 0 {
+		t.Fatalf("quedaron %d agrupaciones anteriores sin conexiones", len(l.retired))
+	}
+}
+
+func TestSetCIDRsKeepsRuntimeChanges(t *testing.T) {
+	l := New(10, 100, 100, 10, 60, 1000, 300, 60)
+	defer l.Stop()
+	if err := l.SetCIDRs([]string{"10.0.0.0/8"}, []string{"192.0.2.0/24", "198.51.100.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	// Cambios desde la API admin
+	if _, err := l.Denylist().Add("203.0.113.7"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Denylist().Remove("198.51.100.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Allowlist().Add("172.16.0.0/12"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Recarga del archivo con las mismas listas y con una entrada nueva
+	for _, deny := range [][]string{
+		{"192.0.2.0/24", "198.51.100.0/24"},
+		{"192.0.2.0/24", "198.51.100.0/24", "233.252.0.0/24"},
+	} {
+		if err := l.SetCIDRs([]string{"10.0.0.0/8"}, deny); err != nil {
+			t.Fatal(err)
+		}
+		if !l.Denylist().Contains("203.0.113.7") {
+			t.Fatalf("deny %v: la recarga borró la entrada agregada por la API", deny)
+		}
+		if l.Denylist().Contains("198.51.100.9") {
+			t.Fatalf("deny %v: la recarga restauró la entrada quitada por la API", deny)
+		}
+		if !l.Allowlist().Contains("172.16.5.5") {
+			t.Fatalf("deny %v: la recarga borró el allow agregado por la API", deny)
+		}
+	}
+	if !l.Denylist().Contains("233.252.0.1") {
+		t.Fatal("la entrada nueva del archivo no se aplicó")
+	}
+	want := []string{"192.0.2.0/24", "203.0.113.7/32", "233.252.0.0/24"}
+	if got := l.Denylist().List(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("denylist = %v, se esperaba %v", got, want)
+	}
+
+	// Una entrada quitada del archivo desaparece si la API no la tocó
+	if err := l.SetCIDRs(nil, []string{"233.252.0.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	if l.Denylist().Contains("192.0.2.1") || l.Allowlist().Contains("10.1.1.1") {
+		t.Fatal("las entradas quitadas del archivo siguen vigentes")
+	}
+}
+
+func TestCIDRListContains(t *testing.T) {
+	c := NewCIDRList()
+	if err := c.Replace([]string{"10.0.0.0/8", "192.0.2.7", "2001:db8::/32", "::ffff:198.51.100.0/120", " 172.16.5.0/24 "}); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.0.0.0", true},
+		{"10.255.255.255", true},
+		{"11.0.0.0", false},
+		{"9.255.255.255", false},
+		{"192.0.2.7", true},
+		{"192.0.2.8", false},
+		{"198.51.100.42", true}, // cargada como IPv4-mapped
+		{"198.51.101.1", false},
+		{"172.16.5.200", true},
+		{"::ffff:10.1.2.3", true}, // dual-stack
+		{"2001:db8:ffff::1", true},
+		{"2001:db9::1", false},
+		{"::a00:1", false}, // misma secuencia de bits que 10.0.0.1, pero IPv6
+		{"no-es-ip", false},
+	}
+	for _, tc := range cases {
+		if got := c.Contains(tc.ip); got != tc.want {
+			t.Errorf("Contains(%q) = %v, se esperaba %v", tc.ip, got, tc.want)
+		}
+	}
+	if got := c.List(); fmt.Sprint(got) != "[10.0.0.0/8 172.16.5.0/24 192.0.2.7/32 198.51.100.0/24 2001:db8::/32]" {
+		t.Fatalf("List = %v", got)
+	}
+
+	all := NewCIDRList()
+	if _, err := all.Add("0.0.0.0/0"); err != nil {
+		t.Fatal(err)
+	}
+	if !all.Contains("203.0.113.7") || all.Contains("2001:db8::1") {
+		t.Fatal("0.0.0.0/0 debe cubrir todas las IPv4 y ninguna IPv6")
+	}
+}
+
+func TestCIDRListAddRemove(t *testing.T) {
+	c := NewCIDRList()
+	for _, s := range []string{"10.0.0.0/8", "10.1.0.0/16"} {
+		if added, err := c.Add(s); err != nil || !added {
+			t.Fatalf("Add(%q) = %v, %v", s, added, err)
+		}
+	}
+	if added, _ := c.Add("10.0.0.0/8"); added {
+		t.Fatal("Add de un prefijo repetido retornó true")
+	}
+	if added, _ := c.Add("10.9.9.9/8"); added {
+		t.Fatal("Add no normalizó 10.9.9.9/8 a 10.0.0.0/8")
+	}
+	if _, err := c.Add("10.0.0.0/33"); err == nil {
+		t.Fatal("Add aceptó un prefijo inválido")
+	}
+
+	// Quitar el /8 no debe podar la rama del /16 que cuelga de él
+	if removed, _ := c.Remove("10.0.0.0/8"); !removed {
+		t.Fatal("Remove no encontró 10.0.0.0/8")
+	}
+	if !c.Contains("10.1.2.3") || c.Contains("10.2.0.1") {
+		t.Fatal("después de quitar el /8 debe quedar solo el /16")
+	}
+	if removed, _ := c.Remove("10.0.0.0/8"); removed {
+		t.Fatal("Remove de un prefijo ausente retornó true")
+	}
+	if removed, _ := c.Remove("10.1.0.0/24"); removed {
+		t.Fatal("Remove quitó un prefijo que no coincide exacto")
+	}
+	if removed, _ := c.Remove("10.1.0.0/16"); !removed || c.Contains("10.1.2.3") || c.Len() != 0 {
+		t.Fatal("la lista no quedó vacía")
+	}
+}
+
+func TestCIDRListReplace(t *testing.T) {
+	c := NewCIDRList()
+	if err := c.Replace([]string{"192.0.2.0/24", "198.51.100.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Replace([]string{"203.0.113.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	if c.Contains("192.0.2.1") || !c.Contains("203.0.113.1") || c.Len() != 1 {
+		t.Fatalf("Replace no reemplazó la base: %v", c.List())
+	}
+	// Una entrada inválida descarta el reemplazo entero
+	if err := c.Replace([]string{"192.0.2.0/24", "no-es-cidr"}); err == nil {
+		t.Fatal("Replace aceptó una entrada inválida")
+	}
+	if c.Contains("192.0.2.1") || !c.Contains("203.0.113.1") {
+		t.Fatalf("un Replace inválido modificó la lista: %v", c.List())
+	}
+}
+
+func TestAllowlistOverDenylist(t *testing.T) {
+	l := New(1, 100, 100, 1, 60, 1000, 300, 60)
+	defer l.Stop()
+	if err := l.SetCIDRs([]string{"203.0.113.7"}, []string{"203.0.113.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if ok, reason := l.TryAccept("203.0.113.8", now); ok || reason != "denylist" {
+		t.Fatalf("TryAccept = %v, %q; se esperaba denylist", ok, reason)
+	}
+	// La allowlist gana sobre la denylist y sobre los límites por IP
+	for i := 0; i < 3; i++ {
+		if ok, reason := l.TryAccept("203.0.113.7", now); !ok {
+			t.Fatalf("conexión %d de la allowlist rechazada: %s", i+1, reason)
+		}
+		l.RecordViolation("203.0.113.7")
+	}
+	if ok, reason := l.TryAccept("203.0.113.7", now); !ok {
+		t.Fatalf("la allowlist quedó bloqueada por violaciones: %s", reason)
+	}
+}
+
+func TestAllowlistCountsAgainstMaxTotal(t *testing.T) {
+	l := New(10, 100, 100, 10, 60, 2, 300, 60)
+	defer l.Stop()
+	if err := l.SetCIDRs([]string{"192.0.2.0/24"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2"} {
+		if ok, reason := l.TryAccept(ip, now); !ok {
+			t.Fatalf("%s rechazada: %s", ip, reason)
+		}
+	}
+	for _, ip := range []string{"192.0.2.3", "203.0.113.7"} {
+		if ok, reason := l.TryAccept(ip, now); ok || reason != "global_limit" {
+			t.Fatalf("TryAccept(%s) = %v, %q; se esperaba global_limit", ip, ok, reason)
+		}
+	}
+	if active, _ := l.Stats(); active != 2 {
+		t.Fatalf("%d conexiones activas, se esperaban 2", active)
+	}
+	l.Release("192.0.2.1")
+	if ok, reason := l.TryAccept("203.0.113.7", now); !ok {
+		t.Fatalf("slot liberado por la allowlist no reutilizable: %s", reason)
+	}
+}
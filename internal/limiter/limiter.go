@@ -1,7 +1,10 @@
 package limiter
 
 import (
+	"fmt"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -12,16 +15,33 @@ type IpState struct {
 	Tokens      float64   // token bucket
 	LastTokenTs time.Time // última actualización de tokens
 	DenyCount   int       // rechazos consecutivos/contados
+	Violations  int       // violaciones tras el accept (ver RecordViolation); TryAccept no las resetea
 	BlockUntil  time.Time // bloqueo temporal hasta
 	LastSeen    time.Time // última actividad
 	BlockCount  int       // número de veces que fue bloqueado (para backoff exponencial)
+	subnet      string    // subred a la que se contaron las conexiones vivas de subnetLive
+	subnetLive  int       // conexiones vivas contadas también en la subred
+}
+
+// History persiste BlockCount/BlockUntil fuera del limiter, para que el backoff
+// exponencial sobreviva a reinicios y al cleanup de IPs inactivas (ver internal/store).
+type History interface {
+	// Lookup retorna el historial guardado de ip.
+	Lookup(ip string) (blockCount int, blockUntil time.Time, ok bool)
+	// Record guarda el historial de ip tras un bloqueo o desbloqueo.
+	Record(ip string, blockCount int, blockUntil time.Time)
 }
 
 // Limiter implementa límites por IP y global.
+//
+// Las IPs se rastrean por su clave canónica (ver ClientKey): los métodos reciben
+// la IP tal como llega del proxy y la normalizan internamente, de modo que todas
+// las direcciones de un mismo prefijo IPv6 comparten estado.
 type Limiter struct {
 	mu sync.RWMutex
-	// por IP
-	byIP map[string]*IpState
+	// por IP (clave canónica)
+	byIP   map[string]*IpState
+	v6Bits int // agrupación de IPv6 (128 = sin agrupar)
 	// parámetros
 	maxLivePerIP  int
 	refillPerSec  float64
@@ -30,11 +50,25 @@ type Limiter struct {
 	tempBlockSec  int
 	// global
 	maxTotalConns int
-	sem           chan struct{} // semáforo global (send=acquire, recv=release)
+	active        int // conexiones aceptadas y no liberadas (protegido por mu)
 	// cleanup
 	staleAfterSec   int
 	cleanupEverySec int
 	stopCleanup     chan struct{}
+	// historial persistente (opcional)
+	history History
+	// IPv6 con conexiones vivas de agrupaciones anteriores (ver SetIPv6Prefix)
+	retired []retiredV6
+	// listas CIDR: allow saltea límites por IP y autoban; deny rechaza siempre
+	allow *CIDRList
+	deny  *CIDRList
+	// segundo nivel por subred (nil = deshabilitado)
+	subnetCfg     *SubnetConfig
+	bySubnet      map[string]*subnetState
+	onSubnetBlock func(prefix string, ips int, until time.Time)
+	// contadores para métricas
+	tempBlocks   atomic.Uint64
+	subnetBlocks atomic.Uint64
 }
 
 // New crea un Limiter con la configuración dada.
@@ -42,54 +76,187 @@ func New(maxLivePerIP int, refillPerSec, burst float64, deniesToBlock, tempBlock
 	maxTotalConns int, staleAfterSec, cleanupEverySec int) *Limiter {
 	l := &Limiter{
 		byIP:            make(map[string]*IpState),
+		v6Bits:          128,
 		maxLivePerIP:    maxLivePerIP,
 		refillPerSec:    refillPerSec,
 		burst:           burst,
 		deniesToBlock:   deniesToBlock,
 		tempBlockSec:    tempBlockSec,
 		maxTotalConns:   maxTotalConns,
-		sem:             make(chan struct{}, maxTotalConns),
 		staleAfterSec:   staleAfterSec,
 		cleanupEverySec: cleanupEverySec,
 		stopCleanup:     make(chan struct{}),
+		allow:           NewCIDRList(),
+		deny:            NewCIDRList(),
+		bySubnet:        make(map[string]*subnetState),
 	}
 	go l.cleanupLoop()
 	return l
 }
 
+// SetParams cambia en caliente los parámetros de New (mismo orden). Las conexiones
+// vivas no se cortan: si max_total_conns o max_live_conns_per_ip bajan, solo se
+// rechazan las nuevas hasta volver por debajo del límite.
+func (l *Limiter) SetParams(maxLivePerIP int, refillPerSec, burst float64, deniesToBlock, tempBlockSec int,
+	maxTotalConns int, staleAfterSec, cleanupEverySec int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.maxLivePerIP = maxLivePerIP
+	l.refillPerSec = refillPerSec
+	l.burst = burst
+	l.deniesToBlock = deniesToBlock
+	l.tempBlockSec = tempBlockSec
+	l.maxTotalConns = maxTotalConns
+	l.staleAfterSec = staleAfterSec
+	l.cleanupEverySec = cleanupEverySec
+}
+
+// SetHistory configura el historial persistente. Debe llamarse antes de aceptar conexiones.
+func (l *Limiter) SetHistory(h History) {
+	l.mu.Lock()
+	l.history = h
+	l.mu.Unlock()
+}
+
+// retiredV6 guarda las IPv6 que tenían conexiones vivas cuando cambió la
+// agrupación: sus Release llegan con la IP original y se descuentan de la clave
+// con la que se aceptaron, hasta que terminan todas.
+type retiredV6 struct {
+	bits int
+	byIP map[string]*IpState
+}
+
+// SetIPv6Prefix configura la agrupación de direcciones IPv6: todas las IPs de un
+// mismo /bits se tratan como un único cliente. 128 desactiva la agrupación.
+// Si cambia en caliente se descarta el estado de las IPv6 rastreadas, ya que sus
+// claves dejan de corresponder (el límite global no se ve afectado). Las que
+// tienen conexiones vivas se conservan aparte hasta que se liberan, para que los
+// contadores de vivas de sus subredes no queden trabados.
+func (l *Limiter) SetIPv6Prefix(bits int) error {
+	if bits < 1 || bits > 128 {
+		return fmt.Errorf("prefijo IPv6 de cliente inválido: /%d", bits)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if bits == l.v6Bits {
+		return nil
+	}
+	gen := retiredV6{bits: l.v6Bits, byIP: make(map[string]*IpState)}
+	for key, s := range l.byIP {
+		if !strings.Contains(key, ":") {
+			continue
+		}
+		s.mu.Lock()
+		if s.LiveCount > 0 || s.subnetLive > 0 {
+			gen.byIP[key] = s
+		}
+		s.mu.Unlock()
+		delete(l.byIP, key)
+	}
+	if len(gen.byIP) > 0 {
+		l.retired = append(l.retired, gen)
+	}
+	l.v6Bits = bits
+	return nil
+}
+
+// key retorna la clave canónica de ip. Debe llamarse con l.mu (lectura o escritura).
+func (l *Limiter) key(ip string) string {
+	return ClientKey(ip, l.v6Bits)
+}
+
+// SetCIDRs reemplaza la base de las listas de allow y deny (los cambios hechos con
+// Add/Remove se conservan, ver CIDRList). Si alguna entrada es inválida no se
+// modifica ninguna de las dos.
+func (l *Limiter) SetCIDRs(allow, deny []string) error {
+	for _, e := range append(append([]string{}, allow...), deny...) {
+		if _, err := ParsePrefix(e); err != nil {
+			return err
+		}
+	}
+	if err := l.allow.Replace(allow); err != nil {
+		return err
+	}
+	return l.deny.Replace(deny)
+}
+
+// Allowlist retorna la lista de prefijos que no tienen límites por IP ni autoban.
+func (l *Limiter) Allowlist() *CIDRList {
+	return l.allow
+}
+
+// Denylist retorna la lista de prefijos que se rechazan siempre.
+func (l *Limiter) Denylist() *CIDRList {
+	return l.deny
+}
+
 // TryAccept devuelve (allowed bool, reason string).
 // Si allowed es true, el llamador debe llamar Release() cuando cierre la conexión.
+// El allowlist tiene prioridad sobre el denylist, para que un rango amplio en deny
+// no pueda dejar afuera a una IP explícitamente permitida.
 func (l *Limiter) TryAccept(ip string, now time.Time) (allowed bool, reason string) {
+	allowlisted := l.allow.Contains(ip)
+	if !allowlisted && l.deny.Contains(ip) {
+		return false, "denylist"
+	}
+
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	// Semáforo global: intentar adquirir
-	select {
-	case l.sem <- struct{}{}:
-		// ok, tenemos slot global
-	default:
+	// Límite global: reservar slot (también para allowlist)
+	if l.active >= l.maxTotalConns {
 		return false, "global_limit"
 	}
+	l.active++
 
+	ip = l.key(ip)
 	state := l.getOrCreate(ip, now)
 	state.mu.Lock()
 
+	// Allowlist: sin tempblock, límite de vivas ni token bucket
+	if allowlisted {
+		state.LiveCount++
+		state.LastSeen = now
+		state.mu.Unlock()
+		return true, ""
+	}
+
+	// Subred: bloqueo por escalado (el resto de los límites de subred se evalúan
+	// después de los por IP para no consumir tokens de la subred en vano)
+	var sub *subnetState
+	subKey := ""
+	if l.subnetCfg != nil {
+		if subKey = subnetKey(ip, l.subnetCfg); subKey != "" {
+			sub = l.getOrCreateSubnet(subKey, now)
+			sub.mu.Lock()
+			blocked := now.Before(sub.BlockUntil)
+			sub.LastSeen = now
+			sub.mu.Unlock()
+			if blocked {
+				state.mu.Unlock()
+				l.active--
+				return false, "subnet_block"
+			}
+		}
+	}
+
 	// Bloqueo temporal
 	if now.Before(state.BlockUntil) {
 		state.mu.Unlock()
-		<-l.sem
+		l.active--
 		return false, "tempblock"
 	}
 	// Tempblock expirado: resetear DenyCount y BlockUntil pero NO BlockCount (para backoff exponencial)
 	if !state.BlockUntil.IsZero() {
 		state.DenyCount = 0
+		state.Violations = 0
 		state.BlockUntil = time.Time{}
 	}
 
 	// Límite de conexiones vivas por IP
 	if state.LiveCount >= l.maxLivePerIP {
 		state.mu.Unlock()
-		<-l.sem
+		l.active--
 		return false, "live_limit"
 	}
 
@@ -99,11 +266,34 @@ func (l *Limiter) TryAccept(ip string, now time.Time) (allowed bool, reason stri
 		// DenyCount es gestionado externamente por RecordDeny (llamado desde onReject)
 		// para evitar doble incremento
 		state.mu.Unlock()
-		<-l.sem
+		l.active--
 		return false, "rate"
 	}
+	if sub != nil {
+		sub.mu.Lock()
+		if l.subnetCfg.MaxLive > 0 && sub.LiveCount >= l.subnetCfg.MaxLive {
+			sub.mu.Unlock()
+			state.mu.Unlock()
+			l.active--
+			return false, "subnet_live_limit"
+		}
+		if l.subnetCfg.RefillPerSec > 0 {
+			sub.refill(l.subnetCfg.RefillPerSec, l.subnetCfg.Burst, now)
+			if sub.Tokens < 1 {
+				sub.mu.Unlock()
+				state.mu.Unlock()
+				l.active--
+				return false, "subnet_rate"
+			}
+			sub.Tokens--
+		}
+		sub.LiveCount++
+		sub.mu.Unlock()
+		state.subnet = subKey
+		state.subnetLive++
+	}
 	state.Tokens--
-	state.DenyCount = 0
+	state.DenyCount = 0 // Violations no: se cuentan después del accept
 	state.LiveCount++
 	state.LastSeen = now
 	state.mu.Unlock()
@@ -119,6 +309,15 @@ func (l *Limiter) getOrCreate(ip string, now time.Time) *IpState {
 			LastTokenTs: now,
 			LastSeen:    now,
 		}
+		// Recuperar backoff y bloqueo vigente de reinicios o evicciones anteriores
+		if l.history != nil {
+			if blockCount, blockUntil, ok := l.history.Lookup(ip); ok {
+				s.BlockCount = blockCount
+				if now.Before(blockUntil) {
+					s.BlockUntil = blockUntil
+				}
+			}
+		}
 		l.byIP[ip] = s
 	}
 	return s
@@ -138,53 +337,122 @@ func (s *IpState) refill(refillPerSec, burst float64, now time.Time) {
 func (l *Limiter) Release(ip string) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	if s, ok := l.byIP[ip]; ok {
+	if s, gen := l.liveState(ip); s != nil {
 		s.mu.Lock()
 		if s.LiveCount > 0 {
 			s.LiveCount--
 		}
 		s.LastSeen = time.Now()
+		if s.subnetLive > 0 {
+			s.subnetLive--
+			if sub, ok := l.bySubnet[s.subnet]; ok {
+				sub.mu.Lock()
+				if sub.LiveCount > 0 {
+					sub.LiveCount--
+				}
+				sub.LastSeen = s.LastSeen
+				sub.mu.Unlock()
+			}
+		}
+		drained := s.LiveCount == 0 && s.subnetLive == 0
 		s.mu.Unlock()
+		if gen >= 0 && drained {
+			l.dropRetired(gen, ip)
+		}
 	}
 	// Devolver slot global
-	select {
-	case <-l.sem:
-	default:
+	if l.active > 0 {
+		l.active--
 	}
 }
 
-// RecordDeny incrementa DenyCount para la IP (solo para rechazos por "rate").
-// No se llama para tempblock ni live_limit.
+// liveState retorna el estado al que se contó una conexión de ip y, si es de una
+// agrupación IPv6 anterior, su índice en l.retired (-1 si es el actual). Las
+// anteriores van primero: sus conexiones son las más viejas. Debe llamarse con l.mu.
+func (l *Limiter) liveState(ip string) (*IpState, int) {
+	for i, gen := range l.retired {
+		if s, ok := gen.byIP[ClientKey(ip, gen.bits)]; ok {
+			return s, i
+		}
+	}
+	if s, ok := l.byIP[l.key(ip)]; ok {
+		return s, -1
+	}
+	return nil, -1
+}
+
+// dropRetired descarta el estado de ip de la agrupación anterior gen, que ya no
+// tiene conexiones vivas, y la agrupación entera si quedó vacía. Debe llamarse con l.mu.
+func (l *Limiter) dropRetired(gen int, ip string) {
+	delete(l.retired[gen].byIP, ClientKey(ip, l.retired[gen].bits))
+	if len(l.retired[gen].byIP) == 0 {
+		l.retired = append(l.retired[:gen], l.retired[gen+1:]...)
+	}
+}
+
+// RecordDeny incrementa DenyCount para la IP (solo para rechazos por "rate" y
+// "subnet_rate"). No se llama para tempblock ni live_limit. Las IPs del allowlist
+// nunca se bloquean. Si el bloqueo completa el umbral de la subred, se bloquea
+// también la subred (ver OnSubnetBlock).
 func (l *Limiter) RecordDeny(ip string) {
+	l.recordDeny(ip, false)
+}
+
+// RecordViolation cuenta una violación de una conexión ya aceptada (no envió el
+// primer payload a tiempo, el payload no pasó las reglas, excedió el caudal). Se
+// cuentan aparte de DenyCount porque cada accept lo resetea: un cliente que abre
+// conexiones y no envía nada nunca acumularía más de un deny. Al llegar a
+// denies_before_tempblock violaciones la IP entra en tempblock, igual que con
+// RecordDeny.
+func (l *Limiter) RecordViolation(ip string) {
+	l.recordDeny(ip, true)
+}
+
+func (l *Limiter) recordDeny(ip string, violation bool) {
+	if l.allow.Contains(ip) {
+		return
+	}
 	l.mu.RLock()
+	ip = l.key(ip)
 	s, ok := l.byIP[ip]
+	history := l.history
+	deniesToBlock, tempBlockSec := l.deniesToBlock, l.tempBlockSec
 	l.mu.RUnlock()
 	if !ok {
 		return
 	}
 	s.mu.Lock()
-	s.DenyCount++
-	if s.DenyCount >= l.deniesToBlock {
+	count := &s.DenyCount
+	if violation {
+		count = &s.Violations
+	}
+	*count++
+	blocked := false
+	if *count >= deniesToBlock {
+		blocked = true
 		s.BlockCount++
-		shift := s.BlockCount - 1
-		if shift > 4 {
-			shift = 4 // cap 16x
-		}
-		multiplier := 1 << uint(shift) // 1,2,4,8,16
-		duration := time.Duration(l.tempBlockSec*multiplier) * time.Second
-		if duration > 24*time.Hour {
-			duration = 24 * time.Hour
-		}
-		s.BlockUntil = time.Now().Add(duration)
+		s.BlockUntil = time.Now().Add(backoff(tempBlockSec, s.BlockCount))
 	}
 	s.LastSeen = time.Now()
+	blockCount, blockUntil := s.BlockCount, s.BlockUntil
 	s.mu.Unlock()
+
+	if blocked && history != nil {
+		history.Record(ip, blockCount, blockUntil)
+	}
+	if blocked {
+		l.tempBlocks.Add(1)
+		l.recordSubnetBlock(ip, blockUntil)
+	}
 }
 
 // ShouldFirewallBlock indica si la IP está en tempblock (para decidir firewall ban).
 func (l *Limiter) IsTempBlocked(ip string) bool {
+	if l.allow.Contains(ip) {
+		return false
+	}
 	l.mu.RLock()
-	s, ok := l.byIP[ip]
+	s, ok := l.byIP[l.key(ip)]
 	l.mu.RUnlock()
 	if !ok {
 		return false
@@ -195,17 +463,28 @@ func (l *Limiter) IsTempBlocked(ip string) bool {
 	return blocked
 }
 
-// cleanupLoop elimina IPs sin conexiones y sin actividad reciente.
+// cleanupLoop elimina IPs sin conexiones y sin actividad reciente. Los intervalos
+// se releen en cada vuelta para aplicar los cambios de SetParams.
 func (l *Limiter) cleanupLoop() {
-	tick := time.NewTicker(time.Duration(l.cleanupEverySec) * time.Second)
+	l.mu.RLock()
+	every := l.cleanupEverySec
+	l.mu.RUnlock()
+	tick := time.NewTicker(time.Duration(every) * time.Second)
 	defer tick.Stop()
-	stale := time.Duration(l.staleAfterSec) * time.Second
 	for {
 		select {
 		case <-l.stopCleanup:
 			return
 		case <-tick.C:
+			l.mu.RLock()
+			stale := time.Duration(l.staleAfterSec) * time.Second
+			current := l.cleanupEverySec
+			l.mu.RUnlock()
 			l.cleanup(stale)
+			if current != every && current > 0 {
+				every = current
+				tick.Reset(time.Duration(every) * time.Second)
+			}
 		}
 	}
 }
@@ -225,6 +504,14 @@ func (l *Limiter) cleanup(stale time.Duration) {
 			delete(l.byIP, ip)
 		}
 	}
+	for key, s := range l.bySubnet {
+		s.mu.Lock()
+		remove := s.LiveCount == 0 && s.LastSeen.Before(cutoff) && !now.Before(s.BlockUntil) && s.blockedCount(now) == 0
+		s.mu.Unlock()
+		if remove {
+			delete(l.bySubnet, key)
+		}
+	}
 }
 
 // Stop detiene el cleanup loop.
@@ -232,15 +519,21 @@ func (l *Limiter) Stop() {
 	close(l.stopCleanup)
 }
 
-// Stats devuelve conexiones activas (slots en uso del semáforo) e IPs en memoria.
+// Stats devuelve conexiones activas (slots globales en uso) e IPs en memoria.
 func (l *Limiter) Stats() (activeConns int, ipCount int) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
-	activeConns = len(l.sem)
+	activeConns = l.active
 	ipCount = len(l.byIP)
 	return activeConns, ipCount
 }
 
+// BlockCounts retorna cuántos bloqueos temporales de IP y de subred hubo desde el
+// arranque.
+func (l *Limiter) BlockCounts() (ips, subnets uint64) {
+	return l.tempBlocks.Load(), l.subnetBlocks.Load()
+}
+
 // IPStat representa el estado de una IP para el panel de administración.
 type IPStat struct {
 	IP         string
@@ -271,33 +564,78 @@ func (l *Limiter) GetAllStats() []IPStat {
 	return result
 }
 
-// UnblockTempIP limpia el bloqueo temporal de una IP.
+// UnblockTempIP limpia el bloqueo temporal de una IP (o de su grupo IPv6), y el de
+// la subred si ip es un prefijo ("1.2.3.0/24").
 func (l *Limiter) UnblockTempIP(ip string) {
+	if isPrefix(ip) {
+		l.unblockSubnet(ip)
+	}
+	l.mu.RLock()
+	ip = l.key(ip)
+	l.mu.RUnlock()
+	l.recordSubnetUnblock(ip)
 	l.mu.RLock()
 	s, ok := l.byIP[ip]
+	history := l.history
 	l.mu.RUnlock()
 	if !ok {
+		// Puede estar bloqueada solo en el historial (IP ya evictada)
+		if history != nil {
+			if blockCount, blockUntil, found := history.Lookup(ip); found && !blockUntil.IsZero() {
+				history.Record(ip, blockCount, time.Time{})
+			}
+		}
 		return
 	}
 	s.mu.Lock()
 	s.BlockUntil = time.Time{}
 	s.DenyCount = 0
+	s.Violations = 0
+	blockCount := s.BlockCount
 	s.mu.Unlock()
+
+	if history != nil {
+		history.Record(ip, blockCount, time.Time{})
+	}
 }
 
 // UnblockAll limpia todos los bloqueos temporales y retorna cuántos fueron liberados.
 func (l *Limiter) UnblockAll() int {
+	type unblocked struct {
+		ip         string
+		blockCount int
+	}
+	var freed []unblocked
 	l.mu.Lock()
-	defer l.mu.Unlock()
+	history := l.history
 	count := 0
-	for _, s := range l.byIP {
+	for ip, s := range l.byIP {
 		s.mu.Lock()
 		if !s.BlockUntil.IsZero() {
 			s.BlockUntil = time.Time{}
 			s.DenyCount = 0
+			s.Violations = 0
+			count++
+			freed = append(freed, unblocked{ip, s.BlockCount})
+		}
+		s.mu.Unlock()
+	}
+	for _, s := range l.bySubnet {
+		s.mu.Lock()
+		if !s.BlockUntil.IsZero() {
+			s.BlockUntil = time.Time{}
 			count++
 		}
+		s.blocked = make(map[string]time.Time)
 		s.mu.Unlock()
 	}
+	l.mu.Unlock()
+
+	// El historial escribe al store: fuera de los locks para no frenar a TryAccept
+	if history != nil {
+		for _, u := range freed {
+			history.Record(u.ip, u.blockCount, time.Time{})
+		}
+	}
 	return count
 }
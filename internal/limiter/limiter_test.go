@@ -0,0 +1,177 @@
+package limiter
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// newTestLimiter crea un Limiter con token bucket amplio, así solo cuentan los
+// denies y violaciones que registra cada test.
+func newTestLimiter(deniesToBlock int) *Limiter {
+	return New(10, 100, 100, deniesToBlock, 60, 1000, 300, 60)
+}
+
+func TestViolationsSurviveAccept(t *testing.T) {
+	l := newTestLimiter(3)
+	defer l.Stop()
+	const ip = "203.0.113.7"
+	now := time.Now()
+
+	// Slowloris: cada conexión se acepta y se corta por handshake_timeout
+	for i := 0; i < 3; i++ {
+		if ok, reason := l.TryAccept(ip, now); !ok {
+			t.Fatalf("conexión %d rechazada antes de tiempo: %s", i+1, reason)
+		}
+		l.RecordViolation(ip)
+		l.Release(ip)
+	}
+	if !l.IsTempBlocked(ip) {
+		t.Fatal("3 handshake timeouts con denies_before_tempblock=3 no produjeron tempblock")
+	}
+	if ok, reason := l.TryAccept(ip, now); ok || reason != "tempblock" {
+		t.Fatalf("TryAccept = %v, %q; se esperaba tempblock", ok, reason)
+	}
+}
+
+func TestDenyCountResetsOnAccept(t *testing.T) {
+	l := newTestLimiter(2)
+	defer l.Stop()
+	const ip = "203.0.113.8"
+	now := time.Now()
+
+	// Los denies de rate se resetean al aceptar: un deny suelto entre accepts no bloquea
+	for i := 0; i < 3; i++ {
+		if ok, reason := l.TryAccept(ip, now); !ok {
+			t.Fatalf("conexión %d rechazada: %s", i+1, reason)
+		}
+		l.Release(ip)
+		l.RecordDeny(ip)
+	}
+	if l.IsTempBlocked(ip) {
+		t.Fatal("denies no consecutivos produjeron tempblock")
+	}
+}
+
+func TestViolationsResetOnUnblock(t *testing.T) {
+	l := newTestLimiter(2)
+	defer l.Stop()
+	const ip = "203.0.113.9"
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		l.TryAccept(ip, now)
+		l.RecordViolation(ip)
+		l.Release(ip)
+	}
+	if !l.IsTempBlocked(ip) {
+		t.Fatal("sin tempblock tras 2 violaciones")
+	}
+	l.UnblockTempIP(ip)
+	if ok, reason := l.TryAccept(ip, now); !ok {
+		t.Fatalf("rechazada después del unblock: %s", reason)
+	}
+	l.RecordViolation(ip)
+	l.Release(ip)
+	if l.IsTempBlocked(ip) {
+		t.Fatal("una violación después del unblock volvió a bloquear")
+	}
+}
+
+// lockCheckHistory es un History que, en cada Record, verifica que el limiter no
+// tenga el lock tomado (un Record lento no debe frenar a TryAccept).
+type lockCheckHistory struct {
+	l       *Limiter
+	records map[string]int
+	locked  bool
+}
+
+func (h *lockCheckHistory) Lookup(string) (int, time.Time, bool) { return 0, time.Time{}, false }
+
+func (h *lockCheckHistory) Record(ip string, blockCount int, blockUntil time.Time) {
+	if !h.l.mu.TryLock() {
+		h.locked = true
+	} else {
+		h.l.mu.Unlock()
+	}
+	h.records[ip] = blockCount
+}
+
+func TestUnblockAllRecordsOutsideLock(t *testing.T) {
+	l := newTestLimiter(1)
+	defer l.Stop()
+	ips := []string{"203.0.113.7", "203.0.113.8", "198.51.100.9"}
+	for _, ip := range ips {
+		if ok, reason := l.TryAccept(ip, time.Now()); !ok {
+			t.Fatalf("%s rechazada: %s", ip, reason)
+		}
+		l.RecordViolation(ip)
+		l.Release(ip)
+		if !l.IsTempBlocked(ip) {
+			t.Fatalf("%s no quedó en tempblock", ip)
+		}
+	}
+	h := &lockCheckHistory{l: l, records: map[string]int{}}
+	l.SetHistory(h)
+
+	if n := l.UnblockAll(); n != len(ips) {
+		t.Fatalf("UnblockAll liberó %d, se esperaban %d", n, len(ips))
+	}
+	if h.locked {
+		t.Fatal("UnblockAll llamó a History.Record con el lock del limiter tomado")
+	}
+	for _, ip := range ips {
+		if l.IsTempBlocked(ip) {
+			t.Fatalf("%s sigue en tempblock", ip)
+		}
+		if c, ok := h.records[ip]; !ok || c != 1 {
+			t.Fatalf("historial de %s: %d, %v; se esperaba blockCount 1", ip, c, ok)
+		}
+	}
+}
+
+func TestSubnetEscalatesOnce(t *testing.T) {
+	l := newTestLimiter(1)
+	defer l.Stop()
+	if err := l.SetSubnetLimits(SubnetConfig{V4Bits: 24, V6Bits: 64, BlockAfterIPs: 3}); err != nil {
+		t.Fatal(err)
+	}
+	type block struct {
+		prefix string
+		ips    int
+	}
+	var blocks []block
+	l.OnSubnetBlock(func(prefix string, ips int, until time.Time) {
+		if !until.After(time.Now()) {
+			t.Errorf("bloqueo de %s ya vencido: %v", prefix, until)
+		}
+		blocks = append(blocks, block{prefix, ips})
+	})
+
+	// Un atacante que rota 8 IPs del mismo /24: cada una cae en tempblock
+	now := time.Now()
+	for i := 1; i <= 8; i++ {
+		ip := fmt.Sprintf("203.0.113.%d", i)
+		if ok, reason := l.TryAccept(ip, now); ok {
+			l.RecordViolation(ip)
+			l.Release(ip)
+		} else if reason != "subnet_block" || i <= 3 {
+			t.Fatalf("%s rechazada por %q", ip, reason)
+		} else {
+			l.RecordDeny(ip) // sigue intentando: más tempblocks en la subred ya bloqueada
+		}
+	}
+
+	if len(blocks) != 1 || blocks[0] != (block{"203.0.113.0/24", 3}) {
+		t.Fatalf("bloqueos de subred %v, se esperaba uno de 203.0.113.0/24 con 3 IPs", blocks)
+	}
+	if _, subnets := l.BlockCounts(); subnets != 1 {
+		t.Fatalf("BlockCounts informa %d subredes bloqueadas, se esperaba 1", subnets)
+	}
+	if ok, reason := l.TryAccept("203.0.113.200", now); ok || reason != "subnet_block" {
+		t.Fatalf("TryAccept = %v, %q; se esperaba subnet_block", ok, reason)
+	}
+	if ok, reason := l.TryAccept("203.0.114.1", now); !ok {
+		t.Fatalf("IP de otra subred rechazada: %s", reason)
+	}
+}
@@ -0,0 +1,135 @@
+package limiter
+
+import "time"
+
+// SnapshotVersion es la versión del formato de Snapshot; Import rechaza otras.
+const SnapshotVersion = 1
+
+// Snapshot es el estado del limiter que se traspasa a otro proceso (ver
+// internal/handoff) para que tokens, bloqueos y backoff sobrevivan a una
+// actualización. Las conexiones vivas no se incluyen: siguen contadas en el
+// proceso que las atiende.
+type Snapshot struct {
+	Version int              `json:"version"`
+	IPs     []IPSnapshot     `json:"ips"`
+	Subnets []SubnetSnapshot `json:"subnets,omitempty"`
+}
+
+// IPSnapshot es el estado exportado de una IP (clave canónica). Los tiempos van en
+// segundos Unix (0 = sin valor).
+type IPSnapshot struct {
+	IP         string  `json:"ip"`
+	Tokens     float64 `json:"tokens"`
+	DenyCount  int     `json:"deny_count,omitempty"`
+	Violations int     `json:"violations,omitempty"`
+	BlockUntil int64   `json:"block_until,omitempty"`
+	BlockCount int     `json:"block_count,omitempty"`
+	LastSeen   int64   `json:"last_seen"`
+}
+
+// SubnetSnapshot es el estado exportado de una subred. Blocked son las IPs de la
+// subred en tempblock y hasta cuándo.
+type SubnetSnapshot struct {
+	Prefix     string           `json:"prefix"`
+	BlockUntil int64            `json:"block_until,omitempty"`
+	BlockCount int              `json:"block_count,omitempty"`
+	Blocked    map[string]int64 `json:"blocked,omitempty"`
+}
+
+// Export retorna el estado actual de las IPs y subredes rastreadas.
+func (l *Limiter) Export() Snapshot {
+	now := time.Now()
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	snap := Snapshot{Version: SnapshotVersion, IPs: make([]IPSnapshot, 0, len(l.byIP))}
+	for ip, s := range l.byIP {
+		s.mu.Lock()
+		s.refill(l.refillPerSec, l.burst, now)
+		snap.IPs = append(snap.IPs, IPSnapshot{
+			IP:         ip,
+			Tokens:     s.Tokens,
+			DenyCount:  s.DenyCount,
+			Violations: s.Violations,
+			BlockUntil: unixOrZero(s.BlockUntil),
+			BlockCount: s.BlockCount,
+			LastSeen:   s.LastSeen.Unix(),
+		})
+		s.mu.Unlock()
+	}
+	for key, s := range l.bySubnet {
+		s.mu.Lock()
+		if s.BlockCount > 0 || s.blockedCount(now) > 0 {
+			sub := SubnetSnapshot{
+				Prefix:     key,
+				BlockUntil: unixOrZero(s.BlockUntil),
+				BlockCount: s.BlockCount,
+				Blocked:    make(map[string]int64, len(s.blocked)),
+			}
+			for ip, until := range s.blocked {
+				sub.Blocked[ip] = until.Unix()
+			}
+			snap.Subnets = append(snap.Subnets, sub)
+		}
+		s.mu.Unlock()
+	}
+	return snap
+}
+
+// Import carga snap sobre el estado actual y retorna cuántas IPs restauró. Las IPs
+// que ya se están rastreando conservan su estado. Las subredes solo se restauran
+// si el nivel de subred está habilitado; debe llamarse antes de aceptar conexiones.
+func (l *Limiter) Import(snap Snapshot) int {
+	if snap.Version != SnapshotVersion {
+		return 0
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	for _, e := range snap.IPs {
+		ip := l.key(e.IP)
+		if _, ok := l.byIP[ip]; ok || ip == "" {
+			continue
+		}
+		s := &IpState{
+			Tokens:      min(e.Tokens, l.burst),
+			LastTokenTs: now,
+			DenyCount:   e.DenyCount,
+			Violations:  e.Violations,
+			BlockCount:  e.BlockCount,
+			LastSeen:    time.Unix(e.LastSeen, 0),
+		}
+		if until := time.Unix(e.BlockUntil, 0); e.BlockUntil != 0 && now.Before(until) {
+			s.BlockUntil = until
+		}
+		l.byIP[ip] = s
+		n++
+	}
+	if l.subnetCfg == nil {
+		return n
+	}
+	for _, e := range snap.Subnets {
+		if _, ok := l.bySubnet[e.Prefix]; ok {
+			continue
+		}
+		s := l.getOrCreateSubnet(e.Prefix, now)
+		s.BlockCount = e.BlockCount
+		if until := time.Unix(e.BlockUntil, 0); e.BlockUntil != 0 && now.Before(until) {
+			s.BlockUntil = until
+		}
+		for ip, until := range e.Blocked {
+			if t := time.Unix(until, 0); now.Before(t) {
+				s.blocked[ip] = t
+			}
+		}
+	}
+	return n
+}
+
+// unixOrZero retorna t en segundos Unix, o 0 si t es el valor cero.
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
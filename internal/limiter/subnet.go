@@ -0,0 +1,267 @@
+package limiter
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SubnetConfig configura el segundo nivel de límites, agregado por prefijo
+// (por defecto /24 en IPv4 y /64 en IPv6). Sirve contra atacantes que rotan
+// direcciones dentro del mismo rango para esquivar el token bucket por IP.
+type SubnetConfig struct {
+	V4Bits        int     // largo de prefijo IPv4 (1-32)
+	V6Bits        int     // largo de prefijo IPv6 (1-128)
+	RefillPerSec  float64 // tokens por segundo de la subred (0 = sin token bucket)
+	Burst         float64 // capacidad del token bucket de la subred
+	MaxLive       int     // conexiones vivas por subred (0 = sin límite)
+	BlockAfterIPs int     // IPs en tempblock simultáneo que bloquean la subred entera (0 = sin escalado)
+}
+
+// subnetState mantiene el estado de un prefijo. blocked registra las IPs de la
+// subred en tempblock y hasta cuándo, para decidir el escalado.
+type subnetState struct {
+	mu          sync.Mutex
+	LiveCount   int
+	Tokens      float64
+	LastTokenTs time.Time
+	BlockUntil  time.Time
+	BlockCount  int
+	LastSeen    time.Time
+	blocked     map[string]time.Time
+}
+
+// SubnetStat representa el estado de una subred para el panel de administración.
+type SubnetStat struct {
+	Prefix     string
+	LiveCount  int
+	BlockedIPs int
+	BlockUntil time.Time
+	BlockCount int
+	LastSeen   time.Time
+}
+
+// SetSubnetLimits habilita (o reconfigura en caliente) el nivel de límites por
+// subred. Si cambian los largos de prefijo se descarta el estado de las subredes.
+func (l *Limiter) SetSubnetLimits(c SubnetConfig) error {
+	if c.V4Bits < 1 || c.V4Bits > 32 {
+		return fmt.Errorf("prefijo IPv4 de subred inválido: /%d", c.V4Bits)
+	}
+	if c.V6Bits < 1 || c.V6Bits > 128 {
+		return fmt.Errorf("prefijo IPv6 de subred inválido: /%d", c.V6Bits)
+	}
+	l.mu.Lock()
+	if l.subnetCfg == nil || l.subnetCfg.V4Bits != c.V4Bits || l.subnetCfg.V6Bits != c.V6Bits {
+		l.bySubnet = make(map[string]*subnetState)
+	}
+	l.subnetCfg = &c
+	l.mu.Unlock()
+	return nil
+}
+
+// ClearSubnetLimits deshabilita el nivel de límites por subred y descarta su estado.
+func (l *Limiter) ClearSubnetLimits() {
+	l.mu.Lock()
+	l.subnetCfg = nil
+	l.bySubnet = make(map[string]*subnetState)
+	l.mu.Unlock()
+}
+
+// OnSubnetBlock registra fn, que se llama (fuera de los locks del limiter) cada vez
+// que una subred entra en bloqueo temporal por escalado. ips es la cantidad de IPs
+// de la subred en tempblock en ese momento.
+func (l *Limiter) OnSubnetBlock(fn func(prefix string, ips int, until time.Time)) {
+	l.mu.Lock()
+	l.onSubnetBlock = fn
+	l.mu.Unlock()
+}
+
+// SubnetOf retorna el prefijo al que pertenece ip según la configuración de subred,
+// o "" si el nivel de subred no está habilitado.
+func (l *Limiter) SubnetOf(ip string) string {
+	l.mu.RLock()
+	c := l.subnetCfg
+	l.mu.RUnlock()
+	if c == nil {
+		return ""
+	}
+	return subnetKey(ip, c)
+}
+
+// subnetKey calcula el prefijo de ip ("1.2.3.0/24"); "" si ip no es válida.
+// ip puede ser también una clave de cliente IPv6 agrupada ("2001:db8::/64"); en
+// ese caso la subred nunca es más chica que el grupo.
+func subnetKey(ip string, c *SubnetConfig) string {
+	var a netip.Addr
+	maxBits := 128
+	if p, err := netip.ParsePrefix(ip); err == nil {
+		a, maxBits = p.Addr(), p.Bits()
+	} else if a, err = netip.ParseAddr(ip); err != nil {
+		return ""
+	}
+	a = a.Unmap()
+	bits := c.V6Bits
+	if a.Is4() {
+		bits = c.V4Bits
+	} else if bits > maxBits {
+		bits = maxBits
+	}
+	p, err := a.Prefix(bits)
+	if err != nil {
+		return ""
+	}
+	return p.String()
+}
+
+// getOrCreateSubnet devuelve el subnetState de key; debe llamarse con l.mu mantenido.
+func (l *Limiter) getOrCreateSubnet(key string, now time.Time) *subnetState {
+	s, ok := l.bySubnet[key]
+	if !ok {
+		s = &subnetState{
+			Tokens:      l.subnetCfg.Burst,
+			LastTokenTs: now,
+			LastSeen:    now,
+			blocked:     make(map[string]time.Time),
+		}
+		l.bySubnet[key] = s
+	}
+	return s
+}
+
+// refill actualiza el token bucket de la subred. Debe llamarse con s.mu.
+func (s *subnetState) refill(refillPerSec, burst float64, now time.Time) {
+	elapsed := now.Sub(s.LastTokenTs).Seconds()
+	s.Tokens += elapsed * refillPerSec
+	if s.Tokens > burst {
+		s.Tokens = burst
+	}
+	s.LastTokenTs = now
+}
+
+// blockedCount cuenta las IPs de la subred en tempblock vigente y descarta las
+// vencidas. Debe llamarse con s.mu.
+func (s *subnetState) blockedCount(now time.Time) int {
+	for ip, until := range s.blocked {
+		if !now.Before(until) {
+			delete(s.blocked, ip)
+		}
+	}
+	return len(s.blocked)
+}
+
+// recordSubnetBlock anota que ip entró en tempblock hasta until y, si la subred
+// alcanzó BlockAfterIPs IPs bloqueadas, bloquea la subred entera con el mismo
+// backoff exponencial que las IPs.
+func (l *Limiter) recordSubnetBlock(ip string, until time.Time) {
+	l.mu.RLock()
+	c := l.subnetCfg
+	var s *subnetState
+	key := ""
+	if c != nil {
+		key = subnetKey(ip, c)
+		s = l.bySubnet[key]
+	}
+	fn := l.onSubnetBlock
+	tempBlockSec := l.tempBlockSec
+	l.mu.RUnlock()
+	if s == nil || c.BlockAfterIPs <= 0 {
+		return
+	}
+
+	now := time.Now()
+	s.mu.Lock()
+	s.blocked[ip] = until
+	count := s.blockedCount(now)
+	escalated := false
+	if count >= c.BlockAfterIPs && !now.Before(s.BlockUntil) {
+		escalated = true
+		s.BlockCount++
+		s.BlockUntil = now.Add(backoff(tempBlockSec, s.BlockCount))
+	}
+	blockUntil := s.BlockUntil
+	s.mu.Unlock()
+
+	if escalated {
+		l.subnetBlocks.Add(1)
+	}
+	if escalated && fn != nil {
+		fn(key, count, blockUntil)
+	}
+}
+
+// backoff retorna la duración del bloqueo número blockCount: tempBlockSec × 1,2,4,8,16
+// con tope de 24h.
+func backoff(tempBlockSec, blockCount int) time.Duration {
+	shift := blockCount - 1
+	if shift > 4 {
+		shift = 4 // cap 16x
+	}
+	multiplier := 1 << uint(shift) // 1,2,4,8,16
+	duration := time.Duration(tempBlockSec*multiplier) * time.Second
+	if duration > 24*time.Hour {
+		duration = 24 * time.Hour
+	}
+	return duration
+}
+
+// unblockSubnet limpia el bloqueo de la subred prefix y el registro de sus IPs bloqueadas.
+func (l *Limiter) unblockSubnet(prefix string) {
+	p, err := netip.ParsePrefix(prefix)
+	if err != nil {
+		return
+	}
+	l.mu.RLock()
+	s, ok := l.bySubnet[p.Masked().String()]
+	l.mu.RUnlock()
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	s.BlockUntil = time.Time{}
+	s.blocked = make(map[string]time.Time)
+	s.mu.Unlock()
+}
+
+// isPrefix indica si s es un rango CIDR en lugar de una IP suelta.
+func isPrefix(s string) bool {
+	return strings.Contains(s, "/")
+}
+
+// GetSubnetStats retorna el estado de las subredes rastreadas.
+func (l *Limiter) GetSubnetStats() []SubnetStat {
+	now := time.Now()
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	result := make([]SubnetStat, 0, len(l.bySubnet))
+	for key, s := range l.bySubnet {
+		s.mu.Lock()
+		result = append(result, SubnetStat{
+			Prefix:     key,
+			LiveCount:  s.LiveCount,
+			BlockedIPs: s.blockedCount(now),
+			BlockUntil: s.BlockUntil,
+			BlockCount: s.BlockCount,
+			LastSeen:   s.LastSeen,
+		})
+		s.mu.Unlock()
+	}
+	return result
+}
+
+// recordSubnetUnblock quita ip del registro de IPs bloqueadas de su subred.
+func (l *Limiter) recordSubnetUnblock(ip string) {
+	l.mu.RLock()
+	var s *subnetState
+	if l.subnetCfg != nil {
+		s = l.bySubnet[subnetKey(ip, l.subnetCfg)]
+	}
+	l.mu.RUnlock()
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	delete(s.blocked, ip)
+	s.mu.Unlock()
+}
@@ -0,0 +1,444 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Estrategias de selección de backend (Settings.Strategy).
+const (
+	StrategyRoundRobin     = "round_robin"     // round-robin ponderado por Weight
+	StrategyLeastConn      = "least_conn"      // menos sesiones activas en relación a Weight
+	StrategyPrimaryStandby = "primary_standby" // el primero sano de la lista; el resto es reserva
+)
+
+// Backend es uno de los destinos entre los que se reparten las conexiones.
+type Backend struct {
+	Addr   string
+	Weight int // 0 = 1
+}
+
+// HealthCheck configura el chequeo TCP activo de los backends.
+type HealthCheck struct {
+	Interval time.Duration // 0 = sin chequeo activo (los backends se consideran sanos)
+	Timeout  time.Duration // 0 usa 2s
+	Fall     int           // fallos consecutivos para marcar un backend caído (0 = 3)
+	Rise     int           // éxitos consecutivos para volver a usarlo (0 = 2)
+}
+
+// Breaker configura el circuit breaker de cada backend: tras Failures dials fallidos
+// seguidos el circuito se abre y las conexiones fallan de inmediato durante OpenFor;
+// después se deja pasar una sola conexión de prueba (half-open) que lo cierra si
+// conecta o lo vuelve a abrir si falla.
+type Breaker struct {
+	Failures int           // dials fallidos seguidos que abren el circuito (0 = sin breaker)
+	OpenFor  time.Duration // tiempo abierto antes de probar de nuevo (0 usa 10s)
+}
+
+// Estados del circuit breaker.
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+// errNoBackend indica que no hubo backend para intentar: todos con el circuito abierto.
+var errNoBackend = errors.New("ningún backend disponible (circuit breaker abierto)")
+
+// BackendStatus es el estado de un backend para /api/status.
+type BackendStatus struct {
+	Addr        string `json:"addr"`
+	Weight      int    `json:"weight"`
+	Healthy     bool   `json:"healthy"`
+	ActiveConns int64  `json:"active_conns"`
+	Fails       int    `json:"consecutive_fails"`
+	LastCheck   int64  `json:"last_check,omitempty"` // Unix
+	LastError   string `json:"last_error,omitempty"`
+	Breaker     string `json:"breaker"` // closed | open | half_open
+}
+
+// backendState es el estado de salud de un backend. active se actualiza sin lock
+// desde las sesiones; el resto se protege con pool.mu.
+type backendState struct {
+	addr      string
+	weight    int
+	healthy   bool
+	fails     int
+	passes    int
+	current   int // peso acumulado para el round-robin ponderado suave
+	lastCheck time.Time
+	lastErr   string
+	active    atomic.Int64
+
+	breaker   string    // estado del circuit breaker
+	dialFails int       // dials fallidos seguidos
+	openedAt  time.Time // cuándo se abrió el circuito
+	probing   bool      // half-open: hay una conexión de prueba en curso
+}
+
+// pool es el conjunto de backends vigente con su estado de salud.
+type pool struct {
+	mu       sync.Mutex
+	strategy string
+	list     []*backendState
+	breaker  Breaker
+	onChange func(addr string, healthy bool, detail string)
+	onTrip   func(addr string, open bool, detail string)
+}
+
+// backendsOf retorna la lista de backends de s: Backends o, si está vacía, BackendAddr.
+func backendsOf(s Settings) []Backend {
+	if len(s.Backends) > 0 {
+		return s.Backends
+	}
+	return []Backend{{Addr: s.BackendAddr, Weight: 1}}
+}
+
+// update reemplaza la lista de backends conservando el estado de salud y las
+// sesiones activas de los que siguen presentes. Los nuevos arrancan como sanos.
+func (p *pool) update(s Settings) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	prev := make(map[string]*backendState, len(p.list))
+	for _, b := range p.list {
+		prev[b.addr] = b
+	}
+	list := make([]*backendState, 0, len(s.Backends)+1)
+	for _, b := range backendsOf(s) {
+		st, ok := prev[b.Addr]
+		if !ok {
+			st = &backendState{addr: b.Addr, healthy: true, breaker: breakerClosed}
+		}
+		st.weight = b.Weight
+		if st.weight <= 0 {
+			st.weight = 1
+		}
+		list = append(list, st)
+	}
+	p.list = list
+	p.strategy = s.Strategy
+	p.breaker = s.Breaker
+	if p.breaker.Failures <= 0 {
+		// Breaker deshabilitado: no dejar circuitos abiertos de la config anterior
+		for _, b := range list {
+			b.breaker, b.dialFails, b.probing = breakerClosed, 0, false
+		}
+	}
+}
+
+// state retorna el estado del breaker de b sin modificarlo: un circuito abierto
+// cuyo OpenFor ya venció se informa como half-open, aunque el paso recién lo haga
+// allows al elegir backend. Debe llamarse con p.mu.
+func (p *pool) state(b *backendState, now time.Time) string {
+	if b.breaker != breakerOpen {
+		return b.breaker
+	}
+	openFor := p.breaker.OpenFor
+	if openFor <= 0 {
+		openFor = 10 * time.Second
+	}
+	if now.Sub(b.openedAt) < openFor {
+		return breakerOpen
+	}
+	return breakerHalfOpen
+}
+
+// isOpen indica si el breaker de b rechaza conexiones ahora, sin modificarlo: con
+// el circuito abierto o half-open con la conexión de prueba en curso. Debe
+// llamarse con p.mu.
+func (p *pool) isOpen(b *backendState, now time.Time) bool {
+	switch p.state(b, now) {
+	case breakerOpen:
+		return true
+	case breakerHalfOpen:
+		return b.breaker == breakerHalfOpen && b.probing
+	}
+	return false
+}
+
+// allows indica si el breaker de b deja intentar una conexión ahora; un circuito
+// abierto cuyo OpenFor ya venció pasa a half-open. Solo para elegir el backend a
+// conectar (ver pick); para informar usar state o isOpen. Debe llamarse con p.mu.
+func (p *pool) allows(b *backendState, now time.Time) bool {
+	if p.isOpen(b, now) {
+		return false
+	}
+	if b.breaker == breakerOpen {
+		b.breaker, b.probing = breakerHalfOpen, false
+	}
+	return true
+}
+
+// available indica si hay al menos un backend que el breaker deja intentar. No
+// modifica los breakers: no reserva la conexión de prueba de un half-open.
+func (p *pool) available() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for _, b := range p.list {
+		if !p.isOpen(b, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialed anota el resultado de un dial en el breaker de b y avisa por onTrip si el
+// circuito se abrió o se cerró.
+func (p *pool) dialed(b *backendState, err error) {
+	p.mu.Lock()
+	if p.breaker.Failures <= 0 {
+		p.mu.Unlock()
+		return
+	}
+	prev := b.breaker
+	b.probing = false
+	if err == nil {
+		b.dialFails = 0
+		b.breaker = breakerClosed
+	} else {
+		b.dialFails++
+		if b.breaker == breakerHalfOpen || b.dialFails >= p.breaker.Failures {
+			b.breaker = breakerOpen
+			b.openedAt = time.Now()
+		}
+	}
+	state, fails, fn := b.breaker, b.dialFails, p.onTrip
+	p.mu.Unlock()
+
+	if fn == nil {
+		return
+	}
+	switch {
+	case state == breakerOpen && prev == breakerClosed:
+		fn(b.addr, true, fmt.Sprintf("fallos=%d: %v", fails, err))
+	case state == breakerClosed && prev != breakerClosed:
+		fn(b.addr, false, "conexión de prueba exitosa")
+	}
+}
+
+// pick elige el próximo backend según la estrategia, salteando los de tried y los
+// que tienen el circuito abierto. Si no queda ninguno sano se intenta igual con los
+// caídos: el chequeo puede ir atrasado y es preferible a rechazar sin intentar.
+// Retorna nil si no queda ninguno para intentar.
+func (p *pool) pick(tried map[*backendState]bool) *backendState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	usable := make([]*backendState, 0, len(p.list))
+	for _, b := range p.list {
+		if !tried[b] && p.allows(b, now) {
+			usable = append(usable, b)
+		}
+	}
+	cands := make([]*backendState, 0, len(usable))
+	for _, b := range usable {
+		if b.healthy {
+			cands = append(cands, b)
+		}
+	}
+	if len(cands) == 0 {
+		cands = usable
+	}
+	if len(cands) == 0 {
+		return nil
+	}
+	b := p.choose(cands)
+	if b.breaker == breakerHalfOpen {
+		b.probing = true
+	}
+	return b
+}
+
+// choose aplica la estrategia sobre cands (no vacío). Debe llamarse con p.mu.
+func (p *pool) choose(cands []*backendState) *backendState {
+	switch p.strategy {
+	case StrategyPrimaryStandby:
+		return cands[0]
+	case StrategyLeastConn:
+		best := cands[0]
+		for _, b := range cands[1:] {
+			// active/weight menor, sin divisiones
+			if b.active.Load()*int64(best.weight) < best.active.Load()*int64(b.weight) {
+				best = b
+			}
+		}
+		return best
+	default:
+		// Round-robin ponderado suave (como nginx): reparte según Weight sin ráfagas
+		total := 0
+		var best *backendState
+		for _, b := range cands {
+			b.current += b.weight
+			total += b.weight
+			if best == nil || b.current > best.current {
+				best = b
+			}
+		}
+		best.current -= total
+		return best
+	}
+}
+
+// record anota el resultado de un chequeo (o de un dial fallido) y avisa por
+// onChange si el backend cambió de estado. rise/fall en 0 usan 2 y 3.
+func (p *pool) record(b *backendState, err error, rise, fall int) {
+	if rise <= 0 {
+		rise = 2
+	}
+	if fall <= 0 {
+		fall = 3
+	}
+	p.mu.Lock()
+	b.lastCheck = time.Now()
+	changed := false
+	if err == nil {
+		b.fails = 0
+		b.passes++
+		b.lastErr = ""
+		if !b.healthy && b.passes >= rise {
+			b.healthy = true
+			changed = true
+		}
+	} else {
+		b.passes = 0
+		b.fails++
+		b.lastErr = err.Error()
+		if b.healthy && b.fails >= fall {
+			b.healthy = false
+			changed = true
+		}
+	}
+	healthy, detail, fn := b.healthy, b.lastErr, p.onChange
+	p.mu.Unlock()
+
+	if changed && fn != nil {
+		fn(b.addr, healthy, detail)
+	}
+}
+
+// check hace un chequeo TCP a todos los backends en paralelo.
+func (p *pool) check(ctx context.Context, hc HealthCheck) {
+	timeout := hc.Timeout
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	p.mu.Lock()
+	list := append([]*backendState(nil), p.list...)
+	p.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, b := range list {
+		wg.Add(1)
+		go func(b *backendState) {
+			defer wg.Done()
+			d := net.Dialer{Timeout: timeout}
+			conn, err := d.DialContext(ctx, "tcp", b.addr)
+			if err == nil {
+				_ = conn.Close()
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			p.record(b, err, hc.Rise, hc.Fall)
+		}(b)
+	}
+	wg.Wait()
+}
+
+// status retorna el estado de los backends en el orden de la lista.
+func (p *pool) status() []BackendStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	out := make([]BackendStatus, 0, len(p.list))
+	for _, b := range p.list {
+		bs := BackendStatus{
+			Addr:        b.addr,
+			Weight:      b.weight,
+			Healthy:     b.healthy,
+			ActiveConns: b.active.Load(),
+			Fails:       b.fails,
+			LastError:   b.lastErr,
+			Breaker:     p.state(b, now),
+		}
+		if !b.lastCheck.IsZero() {
+			bs.LastCheck = b.lastCheck.Unix()
+		}
+		out = append(out, bs)
+	}
+	return out
+}
+
+// healthLoop chequea los backends cada HealthCheck.Interval. El intervalo se relee
+// en cada vuelta, así que se puede habilitar o cambiar en caliente.
+func (l *Live) healthLoop(ctx context.Context) {
+	for {
+		wait := l.Get().HealthCheck.Interval
+		if wait <= 0 {
+			wait = 5 * time.Second // deshabilitado: solo volver a mirar la config
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		if hc := l.Get().HealthCheck; hc.Interval > 0 {
+			l.pool.check(ctx, hc)
+		}
+	}
+}
+
+// dialBackend conecta con un backend elegido según la estrategia. Si el dial falla
+// prueba con otro backend antes de rendirse; con chequeo activo habilitado, el
+// fallo cuenta como un chequeo fallido. Retorna el error del último intento, o
+// errNoBackend si todos tenían el circuito abierto.
+func (l *Live) dialBackend(st Settings, timeout time.Duration) (net.Conn, *backendState, error) {
+	tried := make(map[*backendState]bool)
+	lastErr := errNoBackend
+	for {
+		b := l.pool.pick(tried)
+		if b == nil {
+			return nil, nil, lastErr
+		}
+		start := time.Now()
+		conn, err := net.DialTimeout("tcp", b.addr, timeout)
+		l.stats.dial(b.addr).observe(time.Since(start), err)
+		l.pool.dialed(b, err)
+		if err == nil {
+			b.active.Add(1)
+			return conn, b, nil
+		}
+		lastErr = err
+		tried[b] = true
+		if st.HealthCheck.Interval > 0 {
+			l.pool.record(b, err, st.HealthCheck.Rise, st.HealthCheck.Fall)
+		}
+	}
+}
+
+// Backends retorna el estado de salud de los backends configurados.
+func (l *Live) Backends() []BackendStatus {
+	return l.pool.status()
+}
+
+// OnBackendChange registra fn, que se llama cuando un backend pasa a caído
+// (healthy=false, detail = último error) o vuelve a estar sano.
+func (l *Live) OnBackendChange(fn func(addr string, healthy bool, detail string)) {
+	l.pool.mu.Lock()
+	l.pool.onChange = fn
+	l.pool.mu.Unlock()
+}
+
+// OnBreakerChange registra fn, que se llama cuando el circuit breaker de un backend
+// se abre (open=true, detail = último error) o se vuelve a cerrar.
+func (l *Live) OnBreakerChange(fn func(addr string, open bool, detail string)) {
+	l.pool.mu.Lock()
+	l.pool.onTrip = fn
+	l.pool.mu.Unlock()
+}
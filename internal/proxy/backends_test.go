@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// openPool retorna un pool de un backend con el circuito recién abierto.
+func openPool(t *testing.T, openFor time.Duration) (*pool, *backendState) {
+	t.Helper()
+	p := &pool{}
+	p.update(Settings{BackendAddr: "127.0.0.1:1", Breaker: Breaker{Failures: 1, OpenFor: openFor}})
+	b := p.list[0]
+	p.dialed(b, errors.New("connection refused"))
+	if b.breaker != breakerOpen {
+		t.Fatalf("breaker %q tras un dial fallido con failures=1, se esperaba open", b.breaker)
+	}
+	return p, b
+}
+
+func TestBreakerStatusDoesNotMutate(t *testing.T) {
+	p, b := openPool(t, 20*time.Millisecond)
+	if p.available() {
+		t.Fatal("available con el circuito abierto")
+	}
+	if got := p.status()[0].Breaker; got != breakerOpen {
+		t.Fatalf("status informa %q, se esperaba open", got)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	// Consultar el estado no debe pasar el circuito a half-open ni gastar la prueba
+	for i := 0; i < 3; i++ {
+		if !p.available() {
+			t.Fatalf("consulta %d: no available con OpenFor vencido", i+1)
+		}
+		if got := p.status()[0].Breaker; got != breakerHalfOpen {
+			t.Fatalf("consulta %d: status informa %q, se esperaba half_open", i+1, got)
+		}
+	}
+	if b.breaker != breakerOpen {
+		t.Fatalf("las consultas movieron el breaker a %q", b.breaker)
+	}
+
+	// Elegir el backend sí toma la conexión de prueba
+	if got := p.pick(nil); got != b {
+		t.Fatal("pick no eligió el backend half-open")
+	}
+	if !b.probing {
+		t.Fatal("pick no marcó la conexión de prueba")
+	}
+	if p.available() {
+		t.Fatal("available con la conexión de prueba en curso")
+	}
+	if got := p.pick(nil); got != nil {
+		t.Fatal("pick eligió un backend con la conexión de prueba en curso")
+	}
+
+	p.dialed(b, nil)
+	if got := p.status()[0].Breaker; got != breakerClosed {
+		t.Fatalf("status informa %q tras la prueba exitosa, se esperaba closed", got)
+	}
+}
+
+func TestBreakerProbeFailureReopens(t *testing.T) {
+	p, b := openPool(t, 20*time.Millisecond)
+	time.Sleep(30 * time.Millisecond)
+	if got := p.pick(nil); got != b {
+		t.Fatal("pick no eligió el backend half-open")
+	}
+	p.dialed(b, errors.New("connection refused"))
+	if p.available() {
+		t.Fatal("available tras fallar la conexión de prueba")
+	}
+	if got := p.status()[0].Breaker; got != breakerOpen {
+		t.Fatalf("status informa %q tras fallar la prueba, se esperaba open", got)
+	}
+}
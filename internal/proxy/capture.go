@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// captureReadTimeout es cuánto se espera el payload de una conexión rechazada que
+// se quiere capturar antes de cerrarla.
+const captureReadTimeout = 2 * time.Second
+
+// Capturer recibe muestras de los primeros bytes que envían los clientes
+// rechazados o marcados (ver internal/capture).
+type Capturer interface {
+	// Want indica cuántos bytes capturar de una conexión de ip rechazada con
+	// reason, o "flagged" para una sesión aceptada; 0 = no capturar.
+	Want(ip, reason string) int
+	Capture(ip, reason string, client, local netip.AddrPort, data []byte)
+}
+
+// SetCapturer establece dónde se envían las muestras. Debe llamarse antes de RunLive.
+func (l *Live) SetCapturer(c Capturer) {
+	l.capture = c
+}
+
+// capturePayload captura lo que ya se leyó de una conexión rechazada (el primer
+// payload del handshake), si el Capturer la quiere.
+func (l *Live) capturePayload(ip, reason string, client, local netip.AddrPort, data []byte) {
+	if l.capture == nil || len(data) == 0 {
+		return
+	}
+	if n := l.capture.Want(ip, reason); n > 0 {
+		l.capture.Capture(ip, reason, client, local, data[:min(n, len(data))])
+	}
+}
+
+// captureRead lee y captura lo que envía una conexión rechazada antes del
+// handshake, si el Capturer la quiere. Espera hasta captureReadTimeout.
+func (l *Live) captureRead(conn net.Conn, ip, reason string, client, local netip.AddrPort) {
+	if l.capture == nil {
+		return
+	}
+	n := l.capture.Want(ip, reason)
+	if n <= 0 {
+		return
+	}
+	buf := make([]byte, n)
+	_ = conn.SetReadDeadline(time.Now().Add(captureReadTimeout))
+	m, _ := conn.Read(buf)
+	if m > 0 {
+		l.capture.Capture(ip, reason, client, local, buf[:m])
+	}
+}
+
+// captureTap junta los primeros bytes que envía el cliente en una sesión marcada
+// y los entrega al Capturer al completarse o al terminar la sesión.
+type captureTap struct {
+	mu    sync.Mutex
+	buf   []byte
+	max   int
+	done  bool
+	flush func(data []byte)
+}
+
+// newCaptureTap retorna el tap de una sesión aceptada de ip, o nil si no se captura.
+func (l *Live) newCaptureTap(ip string, client, local netip.AddrPort) *captureTap {
+	if l.capture == nil {
+		return nil
+	}
+	n := l.capture.Want(ip, "flagged")
+	if n <= 0 {
+		return nil
+	}
+	c := l.capture
+	return &captureTap{max: n, flush: func(data []byte) {
+		c.Capture(ip, "flagged", client, local, data)
+	}}
+}
+
+func (t *captureTap) write(p []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return
+	}
+	t.buf = append(t.buf, p[:min(len(p), t.max-len(t.buf))]...)
+	if len(t.buf) >= t.max {
+		t.done = true
+		t.flush(t.buf)
+	}
+}
+
+// close entrega lo juntado si la sesión terminó antes de completar la muestra.
+func (t *captureTap) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.done && len(t.buf) > 0 {
+		t.done = true
+		t.flush(t.buf)
+	}
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// handshakeBufSize es el tamaño inicial del buffer del primer payload.
+const handshakeBufSize = 4096
+
+// Handshake configura la fase previa al dial: el cliente debe enviar al menos
+// MinBytes dentro de Timeout, y recién entonces se conecta al backend y se le
+// reenvía lo recibido. Así un cliente que conecta y no envía nada no ocupa una
+// conexión al backend. Solo sirve para protocolos en los que el cliente habla
+// primero.
+type Handshake struct {
+	Timeout  time.Duration // 0 = sin fase de handshake (dial inmediato)
+	MinBytes int           // 0 = 1
+}
+
+var (
+	// errHandshakeTimeout indica que el cliente no envió el primer payload a tiempo.
+	errHandshakeTimeout = errors.New("timeout esperando el primer payload del cliente")
+	// errHandshakeAborted indica que la espera se cortó por stop (drain).
+	errHandshakeAborted = errors.New("espera del primer payload cortada")
+)
+
+// readHandshake lee de conn hasta juntar hs.MinBytes, hasta que vence hs.Timeout o
+// hasta que se cierra stop. Retorna lo leído, que debe reenviarse al backend antes
+// de la copia.
+func readHandshake(conn net.Conn, hs Handshake, stop <-chan struct{}) ([]byte, error) {
+	minBytes := max(hs.MinBytes, 1)
+	_ = conn.SetReadDeadline(time.Now().Add(hs.Timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	// stop adelanta el deadline; se espera a que la goroutine termine para que no
+	// lo pise después de limpiarlo
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-stop:
+			_ = conn.SetReadDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	defer func() {
+		close(done)
+		<-exited
+	}()
+
+	buf := make([]byte, max(minBytes, handshakeBufSize))
+	n := 0
+	for n < minBytes {
+		m, err := conn.Read(buf[n:])
+		n += m
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				select {
+				case <-stop:
+					return buf[:n], errHandshakeAborted
+				default:
+				}
+				return buf[:n], errHandshakeTimeout
+			}
+			return buf[:n], err
+		}
+	}
+	return buf[:n], nil
+}
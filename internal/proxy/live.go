@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Settings es la configuración de RunLive que se puede cambiar en caliente.
+type Settings struct {
+	ListenAddr         string
+	BackendAddr        string        // destino único si Backends está vacío
+	IdleTimeout        time.Duration // 0 = sin timeout
+	BackendDialTimeout time.Duration // 0 usa 5s
+	Options            Options
+
+	// Backends reparte las conexiones entre varios destinos con failover; vacío usa
+	// solo BackendAddr. Strategy es una de las constantes Strategy* ("" = round-robin).
+	Backends    []Backend
+	Strategy    string
+	HealthCheck HealthCheck
+	Breaker     Breaker
+
+	// Maintenance, si no está vacío, se envía tal cual al cliente cuando no se pudo
+	// conectar con ningún backend, antes de cerrar la conexión.
+	Maintenance []byte
+
+	// Handshake retiene el dial al backend hasta recibir el primer payload del
+	// cliente (ver Handshake). El valor cero conecta de inmediato.
+	Handshake Handshake
+
+	// Validator, si no es nil, inspecciona el primer payload antes del dial (implica
+	// la fase de handshake, con 5s de timeout si Handshake no lo fija).
+	Validator Validator
+
+	// Shaping limita el caudal de cada sesión y de cada IP (ver Shaping).
+	Shaping Shaping
+
+	// ShutdownGrace es cuánto se sigue proxyando a las sesiones establecidas después
+	// de cerrar el listener (ver Drain). 0 = cortarlas de inmediato.
+	ShutdownGrace time.Duration
+}
+
+// Live guarda los Settings vigentes de un RunLive. Las conexiones nuevas toman la
+// configuración al aceptarse; el idle timeout se relee en cada operación, así que
+// también aplica a las sesiones ya abiertas.
+type Live struct {
+	mu     sync.Mutex // serializa Set
+	cur    atomic.Pointer[Settings]
+	rebind chan net.Listener // listener nuevo para RunLive tras un cambio de ListenAddr
+	pool   *pool             // backends con su estado de salud
+
+	// Las sesiones no dependen del contexto de RunLive: al cancelarlo solo se cierra
+	// el listener y las sesiones siguen hasta que Drain las corta.
+	sessCtx    context.Context
+	sessCancel context.CancelFunc
+	hsCtx      context.Context // se cancela al empezar Drain: corta las esperas de handshake
+	hsCancel   context.CancelFunc
+	sessions   atomic.Int64 // conexiones en curso, desde el accept
+	reg        registry     // sesiones en curso, para listarlas y cortarlas
+	capture    Capturer     // muestras de clientes rechazados o marcados (nil = sin captura)
+	stats      stats        // aceptadas y latencia de dial
+
+	lnMu      sync.Mutex
+	inherited net.Listener        // listener heredado para el próximo RunLive (ver UseListener)
+	current   func() net.Listener // listener en uso por RunLive; nil si no está corriendo
+}
+
+// NewLive crea un Live con los Settings iniciales.
+func NewLive(s Settings) *Live {
+	l := &Live{rebind: make(chan net.Listener, 1), pool: &pool{}}
+	l.sessCtx, l.sessCancel = context.WithCancel(context.Background())
+	l.hsCtx, l.hsCancel = context.WithCancel(l.sessCtx)
+	l.pool.update(s)
+	l.cur.Store(&s)
+	return l
+}
+
+// Get retorna los Settings vigentes (sin locks).
+func (l *Live) Get() Settings {
+	return *l.cur.Load()
+}
+
+// Set aplica s. Si cambia ListenAddr, abre primero el listener nuevo y recién
+// entonces RunLive cierra el anterior: las sesiones ya establecidas no se cortan y
+// no hay ventana sin listener. Si el puerto nuevo no se puede abrir se conserva el
+// ListenAddr anterior, se aplica el resto y se retorna el error. Los backends que
+// siguen en la lista conservan su estado de salud.
+func (l *Live) Set(s Settings) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	old := l.Get()
+	var err error
+	if s.ListenAddr != old.ListenAddr {
+		ln, lerr := net.Listen("tcp", s.ListenAddr)
+		if lerr != nil {
+			err = fmt.Errorf("no se pudo abrir listener en %s, se mantiene %s: %w", s.ListenAddr, old.ListenAddr, lerr)
+			s.ListenAddr = old.ListenAddr
+		} else {
+			select {
+			case l.rebind <- ln:
+			default:
+				_ = ln.Close()
+				err = fmt.Errorf("cambio de listener anterior aún pendiente, se mantiene %s", old.ListenAddr)
+				s.ListenAddr = old.ListenAddr
+			}
+		}
+	}
+	l.pool.update(s)
+	l.cur.Store(&s)
+	return err
+}
+
+// UseListener hace que el próximo RunLive acepte en ln (p. ej. heredado de otro
+// proceso, ver internal/handoff) en lugar de abrir ListenAddr.
+func (l *Live) UseListener(ln net.Listener) {
+	l.lnMu.Lock()
+	l.inherited = ln
+	l.lnMu.Unlock()
+}
+
+// Listener retorna el listener en el que RunLive está aceptando, o nil si no está
+// corriendo o el listener está cerrado temporalmente (modo drain).
+func (l *Live) Listener() net.Listener {
+	l.lnMu.Lock()
+	fn := l.current
+	l.lnMu.Unlock()
+	if fn == nil {
+		return nil
+	}
+	return fn()
+}
+
+// takeInherited retorna (y olvida) el listener de UseListener.
+func (l *Live) takeInherited() net.Listener {
+	l.lnMu.Lock()
+	defer l.lnMu.Unlock()
+	ln := l.inherited
+	l.inherited = nil
+	return ln
+}
+
+// setCurrent registra cómo obtener el listener en uso de RunLive.
+func (l *Live) setCurrent(fn func() net.Listener) {
+	l.lnMu.Lock()
+	l.current = fn
+	l.lnMu.Unlock()
+}
+
+// Sessions retorna la cantidad de conexiones en curso, contadas desde el accept
+// (incluye las que están en la fase de handshake o conectando al backend).
+func (l *Live) Sessions() int64 {
+	return l.sessions.Load()
+}
+
+// Drain espera, una vez que RunLive retornó, a que terminen las sesiones en curso
+// durante hasta grace; progress (si no es nil) se llama cada 5s con las que quedan
+// y el tiempo restante. Las conexiones que aún esperan el primer payload se cortan
+// de inmediato. Al vencer grace corta las que sigan abiertas y retorna cuántas
+// fueron. CloseSessions adelanta el corte.
+func (l *Live) Drain(grace time.Duration, progress func(remaining int64, left time.Duration)) int64 {
+	l.hsCancel()
+	deadline := time.Now().Add(grace)
+	poll := time.NewTicker(250 * time.Millisecond)
+	defer poll.Stop()
+	lastReport := time.Now()
+	for l.sessions.Load() > 0 && time.Now().Before(deadline) {
+		select {
+		case <-l.sessCtx.Done():
+			deadline = time.Now()
+		case <-poll.C:
+		}
+		if progress != nil && time.Since(lastReport) >= 5*time.Second {
+			lastReport = time.Now()
+			progress(l.sessions.Load(), time.Until(deadline))
+		}
+	}
+	forced := l.sessions.Load()
+	l.sessCancel()
+	// Los cierres son inmediatos; esperar un momento a que las sesiones se desarmen
+	for i := 0; i < 20 && l.sessions.Load() > 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	return forced
+}
+
+// CloseSessions corta todas las sesiones en curso (p. ej. segunda señal de stop
+// durante Drain).
+func (l *Live) CloseSessions() {
+	l.sessCancel()
+}
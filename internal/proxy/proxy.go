@@ -2,10 +2,13 @@ package proxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/netip"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -25,22 +28,42 @@ var bufferPool = sync.Pool{
 // backendDialTimeout es el timeout para conectar al backend; 0 usa 5s como fallback.
 // shouldDrain es una función que retorna true si el listener debe entrar en modo drain (cerrar temporalmente).
 // Si shouldDrain es nil, nunca entrará en modo drain.
+// opts agrega comportamiento opcional (PROXY protocol, ver Options); el valor cero no cambia nada.
 func Run(ctx context.Context, listenAddr, backendAddr string, idleTimeout time.Duration,
 	backendDialTimeout time.Duration,
 	tryAccept func(ip string) (allow bool, reason string),
 	onAccept func(ip string), onReject func(ip, reason string), onRelease func(ip string),
 	shouldDrain func() bool,
+	opts Options,
+) error {
+	live := NewLive(Settings{
+		ListenAddr:         listenAddr,
+		BackendAddr:        backendAddr,
+		IdleTimeout:        idleTimeout,
+		BackendDialTimeout: backendDialTimeout,
+		Options:            opts,
+	})
+	err := RunLive(ctx, live, tryAccept, onAccept, onReject, onRelease, shouldDrain)
+	live.Drain(0, nil)
+	return err
+}
+
+// RunLive es como Run pero toma la configuración de live, que puede cambiarse
+// mientras corre (ver Live.Set) sin cortar las sesiones establecidas. Al cancelar
+// ctx cierra el listener y retorna sin cortar las sesiones en curso: el llamador
+// debe llamar a live.Drain para esperarlas y cerrarlas.
+func RunLive(ctx context.Context, live *Live,
+	tryAccept func(ip string) (allow bool, reason string),
+	onAccept func(ip string), onReject func(ip, reason string), onRelease func(ip string),
+	shouldDrain func() bool,
 ) error {
-	if backendDialTimeout <= 0 {
-		backendDialTimeout = 5 * time.Second
-	}
 	var ln net.Listener
 	var err error
 	var mu sync.Mutex
 
 	// Función para crear/cerrar listener
 	createListener := func() (net.Listener, error) {
-		return net.Listen("tcp", listenAddr)
+		return net.Listen("tcp", live.Get().ListenAddr)
 	}
 
 	closeListener := func() {
@@ -52,15 +75,44 @@ func Run(ctx context.Context, listenAddr, backendAddr string, idleTimeout time.D
 		mu.Unlock()
 	}
 
-	// Crear listener inicial
-	ln, err = createListener()
-	if err != nil {
-		return fmt.Errorf("no se pudo crear listener en %s: %w", listenAddr, err)
+	// Crear listener inicial (o usar el heredado de un traspaso)
+	if ln = live.takeInherited(); ln == nil {
+		ln, err = createListener()
+		if err != nil {
+			return fmt.Errorf("no se pudo crear listener en %s: %w", live.Get().ListenAddr, err)
+		}
 	}
+	live.setCurrent(func() net.Listener {
+		mu.Lock()
+		defer mu.Unlock()
+		return ln
+	})
+	defer live.setCurrent(nil)
+
+	go live.healthLoop(ctx)
 
 	go func() {
-		<-ctx.Done()
-		closeListener()
+		for {
+			select {
+			case <-ctx.Done():
+				closeListener()
+				return
+			case newLn := <-live.rebind:
+				// Cambio de listen_addr: el listener nuevo ya está abierto, cerrar el viejo
+				mu.Lock()
+				old := ln
+				if old != nil {
+					ln = newLn
+				} else {
+					// En drain: se reabrirá con la dirección nueva al salir
+					_ = newLn.Close()
+				}
+				mu.Unlock()
+				if old != nil {
+					_ = old.Close()
+				}
+			}
+		}
 	}()
 
 	// Contador de rechazos recientes para backoff adaptativo
@@ -133,6 +185,11 @@ func Run(ctx context.Context, listenAddr, backendAddr string, idleTimeout time.D
 						}
 					}
 					mu.Lock()
+					if ctx.Err() != nil {
+						mu.Unlock()
+						_ = newLn.Close()
+						return nil
+					}
 					ln = newLn
 					mu.Unlock()
 				}
@@ -153,6 +210,11 @@ func Run(ctx context.Context, listenAddr, backendAddr string, idleTimeout time.D
 		// Asegurar que el listener esté abierto
 		mu.Lock()
 		if ln == nil {
+			// Con el contexto cancelado no reabrir: closeListener ya corrió
+			if ctx.Err() != nil {
+				mu.Unlock()
+				return nil
+			}
 			newLn, err := createListener()
 			if err != nil {
 				mu.Unlock()
@@ -172,8 +234,8 @@ func Run(ctx context.Context, listenAddr, backendAddr string, idleTimeout time.D
 		client, err := currentLn.Accept()
 		if err != nil {
 			mu.Lock()
-			// Si el listener fue cerrado, intentar recrearlo
-			if ln == nil {
+			// Si el listener fue cerrado o reemplazado, seguir con el actual
+			if ln != currentLn {
 				mu.Unlock()
 				continue
 			}
@@ -207,7 +269,7 @@ func Run(ctx context.Context, listenAddr, backendAddr string, idleTimeout time.D
 				incrementRejectCount()
 				originalOnReject(ip, reason)
 			}
-			handleConn(ctx, c, backendAddr, idleTimeout, backendDialTimeout, tryAccept, onAccept, wrappedOnReject, onRelease)
+			handleConn(live.sessCtx, c, live, tryAccept, onAccept, wrappedOnReject, onRelease)
 			// Si no fue rechazada, resetear contador parcialmente
 			if !wasRejected {
 				rejectCountMu.Lock()
@@ -220,44 +282,165 @@ func Run(ctx context.Context, listenAddr, backendAddr string, idleTimeout time.D
 	}
 }
 
-func handleConn(ctx context.Context, client net.Conn, backendAddr string, idleTimeout time.Duration,
-	backendDialTimeout time.Duration,
+func handleConn(ctx context.Context, client net.Conn, live *Live,
 	tryAccept func(ip string) (allow bool, reason string),
 	onAccept func(ip string), onReject func(ip, reason string), onRelease func(ip string),
 ) {
 	defer client.Close()
+	// Se cuenta desde el accept para que Drain también espere a las conexiones que
+	// aún no llegaron al backend
+	live.sessions.Add(1)
+	defer live.sessions.Add(-1)
+	st := live.Get()
+	opts := &st.Options
+	backendDialTimeout := st.BackendDialTimeout
+	if backendDialTimeout <= 0 {
+		backendDialTimeout = 5 * time.Second
+	}
+	raw := client // conexión TCP original (client puede quedar envuelta abajo)
 	ip := remoteIP(client)
-	if tryAccept != nil {
+	local := addrPort(raw.LocalAddr())
+
+	// PROXY protocol: los upstreams confiables deben enviar el header y la IP real
+	// del cliente sale de ahí; al resto se le vigila el primer bloque
+	var guard *untrustedGuard
+	limit := tryAccept != nil
+	src := addrPort(raw.RemoteAddr())
+	if len(opts.TrustedProxies) > 0 {
+		if opts.trusted(ip) {
+			realSrc, conn, err := readProxyHeader(client)
+			if err != nil {
+				onReject(ip, "proxy_header")
+				return
+			}
+			client = conn
+			src = realSrc
+			if realSrc.IsValid() {
+				ip = realSrc.Addr().String()
+			} else {
+				// LOCAL/UNKNOWN: conexión propia del balanceador (health check), sin límites
+				limit = false
+			}
+		} else {
+			guard = &untrustedGuard{Conn: client}
+			client = guard
+		}
+	}
+
+	// Circuit breaker: con todos los backends abiertos se rechaza antes de ocupar
+	// un slot del limiter y sin esperar el timeout de dial
+	if !live.pool.available() {
+		onReject(ip, "backend_unavailable")
+		sendMaintenance(client, st.Maintenance)
+		return
+	}
+
+	if limit {
 		allow, reason := tryAccept(ip)
 		if !allow {
 			onReject(ip, reason)
+			live.captureRead(client, ip, reason, src, local)
 			return
 		}
 		defer onRelease(ip)
 		onAccept(ip)
 	}
+	live.stats.accepts.Add(1)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Registro de sesiones (/api/sessions) desde el accept, con el backend vacío
+	// hasta el dial: cancel permite cortarla desde la API admin también durante
+	// el handshake
+	clientAddr := raw.RemoteAddr().String()
+	if src.IsValid() {
+		clientAddr = src.String()
+	}
+	sess := &session{client: clientAddr, ip: ip, start: time.Now(), cancel: cancel}
+	live.reg.add(sess, st.Shaping)
+	defer live.reg.remove(sess)
+	go func() {
+		<-ctx.Done()
+		_ = client.Close()
+	}()
 
-	backend, err := net.DialTimeout("tcp", backendAddr, backendDialTimeout)
+	// Fase de handshake: no se conecta al backend hasta recibir el primer payload,
+	// que se valida antes del dial si hay Validator
+	var first []byte
+	hs := st.Handshake
+	if hs.Timeout <= 0 && st.Validator != nil {
+		hs.Timeout = defaultValidateTimeout
+	}
+	if hs.Timeout > 0 {
+		data, err := readHandshake(client, hs, live.hsCtx.Done())
+		switch {
+		case errors.Is(err, errHandshakeAborted):
+			return // drain: no es culpa del cliente, no cuenta como violación
+		case errors.Is(err, errHandshakeTimeout):
+			onReject(ip, "handshake_timeout")
+			live.capturePayload(ip, "handshake_timeout", src, local, data)
+			return
+		case errors.Is(err, errUntrustedProxyHeader):
+			onReject(ip, "proxy_untrusted")
+			return
+		case err != nil:
+			return // el cliente cerró antes de completar el primer payload
+		}
+		first = data
+		if st.Validator != nil {
+			if err := st.Validator.Validate(first); err != nil {
+				onReject(ip, "bad_handshake")
+				live.capturePayload(ip, "bad_handshake", src, local, first)
+				return
+			}
+		}
+	}
+
+	backend, be, err := live.dialBackend(st, backendDialTimeout)
 	if err != nil {
-		onReject(ip, "backend_fail")
+		if errors.Is(err, errNoBackend) {
+			onReject(ip, "backend_unavailable")
+		} else {
+			onReject(ip, "backend_fail")
+		}
+		sendMaintenance(client, st.Maintenance)
 		return
 	}
+	defer be.active.Add(-1)
 	defer backend.Close()
+	if ctx.Err() != nil {
+		return // sesión cortada durante el dial
+	}
+	live.reg.setBackend(sess, be.addr)
 
-	if tcp, ok := client.(*net.TCPConn); ok {
+	// Header PROXY hacia el backend con la dirección real del cliente
+	if opts.SendProxy != "" {
+		_ = backend.SetWriteDeadline(time.Now().Add(backendDialTimeout))
+		err := writeProxyHeader(backend, opts.SendProxy, src, local)
+		_ = backend.SetWriteDeadline(time.Time{})
+		if err != nil {
+			onReject(ip, "backend_fail")
+			return
+		}
+	}
+
+	if tcp, ok := raw.(*net.TCPConn); ok {
 		tcp.SetKeepAlive(true)
 	}
 	if tcp, ok := backend.(*net.TCPConn); ok {
 		tcp.SetKeepAlive(true)
 	}
 
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
+	// IP marcada para captura: se guardan los primeros bytes que envía el cliente
+	tap := live.newCaptureTap(ip, src, local)
+	if tap != nil {
+		defer tap.close()
+	}
 
-	// Cerrar ambos al cerrar cualquiera
+	// Cerrar ambos al cerrar cualquiera (el cliente ya lo cierra la goroutine del registro)
 	go func() {
 		<-ctx.Done()
-		_ = client.Close()
 		_ = backend.Close()
 	}()
 
@@ -267,27 +450,73 @@ func handleConn(ctx context.Context, client net.Conn, backendAddr string, idleTi
 	// Esto permite que los usuarios se queden quietos sin perder la conexión,
 	// mientras que TCP keep-alive detecta conexiones muertas automáticamente.
 
+	// Reenviar el primer payload retenido durante el handshake
+	if len(first) > 0 {
+		if tap != nil {
+			tap.write(first)
+		}
+		sess.in.bytes.Add(int64(len(first)))
+		sess.in.reads.Add(1)
+		// Cuenta para el caudal como cualquier lectura: no se puede meter la ráfaga en el handshake
+		if sess.inShape != nil {
+			if err := sess.inShape.throttle(len(first), ctx.Done()); err != nil {
+				onReject(ip, "throughput")
+				return
+			}
+		}
+		_ = backend.SetWriteDeadline(time.Now().Add(backendDialTimeout))
+		_, err := backend.Write(first)
+		_ = backend.SetWriteDeadline(time.Time{})
+		if err != nil {
+			return
+		}
+	}
+
 	// Copia bidireccional con io.CopyBuffer y buffers del pool (uno por dirección)
 	buf1 := bufferPool.Get().(*[]byte)
 	buf2 := bufferPool.Get().(*[]byte)
 	defer bufferPool.Put(buf1)
 	defer bufferPool.Put(buf2)
 	done := make(chan struct{}, 2)
-	srcClient := &deadlineConn{Conn: client, timeout: idleTimeout}
-	srcBackend := &deadlineConn{Conn: backend, timeout: idleTimeout}
+	srcClient := &deadlineConn{Conn: client, live: live, read: &sess.in, last: &sess.last, shape: sess.inShape, tap: tap, done: ctx.Done()}
+	srcBackend := &deadlineConn{Conn: backend, live: live, read: &sess.out, last: &sess.last, shape: sess.outShape, done: ctx.Done()}
+	spoofed := false
+	var shaped atomic.Bool
 	go func() {
 		defer func() { done <- struct{}{} }()
-		io.CopyBuffer(srcBackend, srcClient, *buf1)
+		_, err := io.CopyBuffer(srcBackend, srcClient, *buf1)
+		spoofed = errors.Is(err, errUntrustedProxyHeader)
+		if errors.Is(err, errThroughput) {
+			shaped.Store(true)
+		}
 		_ = backend.Close()
 	}()
 	go func() {
 		defer func() { done <- struct{}{} }()
-		io.CopyBuffer(srcClient, srcBackend, *buf2)
+		_, err := io.CopyBuffer(srcClient, srcBackend, *buf2)
+		if errors.Is(err, errThroughput) {
+			shaped.Store(true)
+		}
 		_ = client.Close()
 	}()
 	<-done
 	cancel()
 	<-done
+	if guard != nil && spoofed {
+		onReject(ip, "proxy_untrusted")
+	}
+	if shaped.Load() {
+		onReject(ip, "throughput")
+	}
+}
+
+// sendMaintenance envía la respuesta de mantenimiento configurada (si hay) al cliente.
+func sendMaintenance(client net.Conn, msg []byte) {
+	if len(msg) == 0 {
+		return
+	}
+	_ = client.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	_, _ = client.Write(msg)
 }
 
 // deadlineConn aplica timeout solo a operaciones de I/O activas (Read/Write).
@@ -296,19 +525,38 @@ func handleConn(ctx context.Context, client net.Conn, backendAddr string, idleTi
 // El timeout aquí es para evitar que operaciones de I/O se queden colgadas indefinidamente.
 type deadlineConn struct {
 	net.Conn
-	timeout time.Duration
+	live  *Live           // el timeout se relee en cada operación para aplicar recargas de config
+	read  *counter        // bytes y lecturas de este sentido (contadores de la sesión)
+	last  *atomic.Int64   // UnixNano de la última lectura
+	shape *shaper         // límites de caudal de este sentido (nil = sin límite)
+	tap   *captureTap     // captura de los primeros bytes (nil = sin captura)
+	done  <-chan struct{} // fin de la sesión: interrumpe la espera del shaping
 }
 
 func (c *deadlineConn) Read(b []byte) (n int, err error) {
-	if c.timeout > 0 {
-		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	if timeout := c.live.Get().IdleTimeout; timeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(timeout))
 	}
-	return c.Conn.Read(b)
+	n, err = c.Conn.Read(b)
+	if n > 0 {
+		c.read.bytes.Add(int64(n))
+		c.read.reads.Add(1)
+		c.last.Store(time.Now().UnixNano())
+		if c.tap != nil {
+			c.tap.write(b[:n])
+		}
+		if c.shape != nil {
+			if err := c.shape.throttle(n, c.done); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, err
 }
 
 func (c *deadlineConn) Write(b []byte) (n int, err error) {
-	if c.timeout > 0 {
-		c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	if timeout := c.live.Get().IdleTimeout; timeout > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(timeout))
 	}
 	return c.Conn.Write(b)
 }
@@ -316,6 +564,10 @@ func (c *deadlineConn) Write(b []byte) (n int, err error) {
 func remoteIP(conn net.Conn) string {
 	if addr := conn.RemoteAddr(); addr != nil {
 		if t, ok := addr.(*net.TCPAddr); ok {
+			// Forma canónica: en listeners dual-stack las IPv4 llegan como ::ffff:a.b.c.d
+			if a, ok := netip.AddrFromSlice(t.IP); ok {
+				return a.Unmap().String()
+			}
 			return t.IP.String()
 		}
 		return addr.String()
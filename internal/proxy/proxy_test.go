@@ -0,0 +1,357 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"guard/internal/limiter"
+)
+
+// testBackend acepta conexiones y descarta lo que recibe.
+func testBackend(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(io.Discard, c)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// rejectLog recibe los rechazos que informa el proxy, en orden.
+type rejectLog struct {
+	ch chan string
+}
+
+func newRejectLog() *rejectLog {
+	return &rejectLog{ch: make(chan string, 100)}
+}
+
+func (r *rejectLog) add(reason string) {
+	r.ch <- reason
+}
+
+// wait espera el próximo rechazo.
+func (r *rejectLog) wait(t *testing.T) string {
+	t.Helper()
+	select {
+	case reason := <-r.ch:
+		return reason
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout esperando un rechazo")
+		return ""
+	}
+}
+
+// startProxy corre RunLive con live sobre un listener local y lim como limiter. Los
+// rechazos se cuentan en lim como en los mains (denies de rate y violaciones de
+// conexiones ya aceptadas) y se informan en rejects. Retorna la dirección del proxy.
+func startProxy(t *testing.T, live *Live, lim *limiter.Limiter, rejects *rejectLog) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	live.UseListener(ln)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = RunLive(ctx, live,
+			func(ip string) (bool, string) { return lim.TryAccept(ip, time.Now()) },
+			func(ip string) {},
+			func(ip, reason string) {
+				switch reason {
+				case "rate", "subnet_rate":
+					lim.RecordDeny(ip)
+				case "handshake_timeout", "bad_handshake", "throughput":
+					lim.RecordViolation(ip)
+				}
+				rejects.add(reason)
+			},
+			lim.Release,
+			nil)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		live.Drain(0, nil)
+	})
+	return ln.Addr().String()
+}
+
+func TestRepeatedBadHandshakeTempblocks(t *testing.T) {
+	rules, err := CompileRules(nil, []string{"0102"}, nil, nil, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	live := NewLive(Settings{
+		BackendAddr: testBackend(t),
+		Handshake:   Handshake{Timeout: 2 * time.Second},
+		Validator:   rules,
+	})
+	lim := limiter.New(10, 100, 100, 3, 60, 1000, 300, 60)
+	defer lim.Stop()
+	rejects := newRejectLog()
+	addr := startProxy(t, live, lim, rejects)
+
+	// Un scanner que envía HTTP en cada conexión
+	for i := 0; i < 3; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = c.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+		if reason := rejects.wait(t); reason != "bad_handshake" {
+			t.Fatalf("conexión %d: rechazo %q, se esperaba bad_handshake", i+1, reason)
+		}
+		c.Close()
+	}
+	if !lim.IsTempBlocked("127.0.0.1") {
+		t.Fatal("3 bad_handshake con denies_before_tempblock=3 no produjeron tempblock")
+	}
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if reason := rejects.wait(t); reason != "tempblock" {
+		t.Fatalf("rechazo %q, se esperaba tempblock", reason)
+	}
+}
+
+func TestShapeDisconnectOnFirstPayload(t *testing.T) {
+	live := NewLive(Settings{
+		BackendAddr: testBackend(t),
+		Handshake:   Handshake{Timeout: 2 * time.Second, MinBytes: 1000},
+		Shaping: Shaping{
+			In:         ShapeLimit{ConnBytesPerSec: 100},
+			Burst:      time.Second,
+			Disconnect: true,
+		},
+	})
+	lim := limiter.New(10, 100, 100, 2, 60, 1000, 300, 60)
+	defer lim.Stop()
+	rejects := newRejectLog()
+	addr := startProxy(t, live, lim, rejects)
+
+	// Toda la ráfaga en el primer payload: 1000 bytes con 100 B/s y 1s de ráfaga
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = c.Write(make([]byte, 1000))
+		if reason := rejects.wait(t); reason != "throughput" {
+			t.Fatalf("conexión %d: rechazo %q, se esperaba throughput", i+1, reason)
+		}
+		c.Close()
+	}
+	if !lim.IsTempBlocked("127.0.0.1") {
+		t.Fatal("2 cortes por caudal con denies_before_tempblock=2 no produjeron tempblock")
+	}
+}
+
+func TestShapeDelaysFirstPayload(t *testing.T) {
+	got := make(chan time.Time, 1)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		buf := make([]byte, 1)
+		if _, err := c.Read(buf); err == nil {
+			got <- time.Now()
+		}
+	}()
+	live := NewLive(Settings{
+		BackendAddr: ln.Addr().String(),
+		Handshake:   Handshake{Timeout: 2 * time.Second, MinBytes: 300},
+		Shaping: Shaping{
+			In:    ShapeLimit{ConnBytesPerSec: 1000},
+			Burst: 100 * time.Millisecond,
+		},
+	})
+	lim := limiter.New(10, 100, 100, 2, 60, 1000, 300, 60)
+	defer lim.Stop()
+	addr := startProxy(t, live, lim, newRejectLog())
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	start := time.Now()
+	_, _ = c.Write(make([]byte, 300))
+	// 300 bytes a 1000 B/s con 100ms de ráfaga: ~200ms de demora antes del backend
+	select {
+	case at := <-got:
+		if d := at.Sub(start); d < 150*time.Millisecond {
+			t.Fatalf("el primer payload llegó al backend en %v, sin demora de caudal", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("el primer payload no llegó al backend")
+	}
+}
+
+func TestRemoteIPDualStack(t *testing.T) {
+	ln, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Skipf("sin listener dual-stack: %v", err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	for _, c := range []struct{ dial, want string }{
+		{"127.0.0.1", "127.0.0.1"}, // llega como ::ffff:127.0.0.1
+		{"::1", "::1"},
+	} {
+		conn, err := net.Dial("tcp", net.JoinHostPort(c.dial, fmt.Sprint(port)))
+		if err != nil {
+			t.Logf("no se pudo conectar a %s: %v", c.dial, err)
+			continue
+		}
+		srv, err := ln.Accept()
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := remoteIP(srv); got != c.want {
+			t.Errorf("remoteIP de una conexión desde %s = %q, se esperaba %q", c.dial, got, c.want)
+		}
+		srv.Close()
+	}
+}
+
+func TestDrainCutsHandshakeWait(t *testing.T) {
+	live := NewLive(Settings{
+		BackendAddr: testBackend(t),
+		Handshake:   Handshake{Timeout: 10 * time.Second},
+	})
+	lim := limiter.New(10, 100, 100, 3, 60, 1000, 300, 60)
+	defer lim.Stop()
+	rejects := newRejectLog()
+	addr := startProxy(t, live, lim, rejects)
+
+	// Cliente que conecta y no envía nada: queda en la fase de handshake
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for live.Sessions() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Sessions() = %d durante el handshake, se esperaba 1", live.Sessions())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	start := time.Now()
+	if forced := live.Drain(5*time.Second, nil); forced != 0 {
+		t.Fatalf("Drain cortó %d sesiones por grace, se esperaba 0", forced)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("Drain tardó %v: no cortó la espera del handshake", d)
+	}
+	select {
+	case reason := <-rejects.ch:
+		t.Fatalf("el corte por drain se informó como rechazo %q", reason)
+	default:
+	}
+}
+
+// waitSessions espera a que el registro de live cumpla ok y retorna las sesiones.
+func waitSessions(t *testing.T, live *Live, ok func([]SessionInfo) bool) []SessionInfo {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		list := live.ListSessions()
+		if ok(list) {
+			return list
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("sesiones %+v", list)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSessionsListAndKillByIP(t *testing.T) {
+	backendAddr := testBackend(t)
+	live := NewLive(Settings{
+		BackendAddr: backendAddr,
+		Handshake:   Handshake{Timeout: 10 * time.Second},
+	})
+	lim := limiter.New(10, 100, 100, 3, 60, 1000, 300, 60)
+	defer lim.Stop()
+	rejects := newRejectLog()
+	addr := startProxy(t, live, lim, rejects)
+
+	// Un cliente en la fase de handshake ya figura, sin backend
+	waiting, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer waiting.Close()
+	list := waitSessions(t, live, func(l []SessionInfo) bool { return len(l) == 1 })
+	if s := list[0]; s.Backend != "" || s.IP != "127.0.0.1" || s.Client != waiting.LocalAddr().String() {
+		t.Fatalf("sesión en handshake %+v", s)
+	}
+
+	// Otro que envía el primer payload pasa al backend
+	active, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer active.Close()
+	if _, err := active.Write([]byte("hola")); err != nil {
+		t.Fatal(err)
+	}
+	list = waitSessions(t, live, func(l []SessionInfo) bool { return len(l) == 2 && l[1].Backend != "" })
+	if list[0].Backend != "" || list[1].Backend != backendAddr || list[1].BytesIn != 4 {
+		t.Fatalf("sesiones %+v, se esperaba la segunda en %s con 4 bytes", list, backendAddr)
+	}
+
+	if n := live.KillSessionsByIP("198.51.100.7"); n != 0 {
+		t.Fatalf("KillSessionsByIP de otra IP cortó %d sesiones", n)
+	}
+	if n := live.KillSessionsByIP("127.0.0.0/8"); n != 2 {
+		t.Fatalf("KillSessionsByIP cortó %d sesiones, se esperaban 2", n)
+	}
+	for _, c := range []net.Conn{waiting, active} {
+		_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("lectura tras el corte: %v, se esperaba EOF", err)
+		}
+	}
+	waitSessions(t, live, func(l []SessionInfo) bool { return len(l) == 0 })
+	select {
+	case reason := <-rejects.ch:
+		t.Fatalf("el corte desde la API se informó como rechazo %q", reason)
+	default:
+	}
+}
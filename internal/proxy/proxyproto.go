@@ -0,0 +1,266 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyHeaderTimeout es el tiempo máximo para recibir el header PROXY de un upstream confiable.
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyV1MaxLen es el largo máximo de un header PROXY v1, incluyendo CRLF.
+const proxyV1MaxLen = 107
+
+// proxyV2Sig es la firma de 12 bytes con la que empieza un header PROXY v2.
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errUntrustedProxyHeader = errors.New("header PROXY desde origen no confiable")
+
+// Options agrupa las opciones de Run que no son obligatorias. El valor cero
+// desactiva todas.
+type Options struct {
+	// TrustedProxies son los upstreams (HAProxy, balanceadores) que envían un header
+	// PROXY protocol v1 o v2. Las conexiones desde estos rangos deben traerlo y la IP
+	// del cliente pasa a ser la del header; las demás que intenten enviarlo se cortan.
+	// Vacío = PROXY protocol deshabilitado.
+	TrustedProxies []netip.Prefix
+
+	// SendProxy, si es "v1" o "v2", hace que se envíe un header PROXY de esa versión
+	// al backend apenas se conecta, con la dirección real del cliente. "" = no enviar.
+	SendProxy string
+}
+
+// trusted indica si ip pertenece a alguno de los upstreams confiables.
+func (o *Options) trusted(ip string) bool {
+	a, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	a = a.Unmap()
+	for _, p := range o.TrustedProxies {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// bufferedConn es una net.Conn cuyas lecturas pasan por r, para no perder los bytes
+// que quedaron en el buffer después de leer el header PROXY.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// readProxyHeader lee un header PROXY v1 o v2 de conn. Retorna la dirección de origen
+// del cliente real, inválida si el header no trae dirección (v1 UNKNOWN, v2 LOCAL:
+// health checks del propio balanceador), y la conexión a usar de ahí en adelante.
+func readProxyHeader(conn net.Conn) (netip.AddrPort, net.Conn, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	r := bufio.NewReader(conn)
+	bc := &bufferedConn{Conn: conn, r: r}
+	sig, err := r.Peek(5)
+	if err != nil {
+		return netip.AddrPort{}, nil, fmt.Errorf("header PROXY: %w", err)
+	}
+	if string(sig) == "PROXY" {
+		ip, err := readProxyV1(r)
+		return ip, bc, err
+	}
+	sig, err = r.Peek(len(proxyV2Sig))
+	if err != nil || !bytes.Equal(sig, proxyV2Sig) {
+		return netip.AddrPort{}, nil, errors.New("header PROXY ausente o inválido")
+	}
+	ip, err := readProxyV2(r)
+	return ip, bc, err
+}
+
+// readProxyV1 interpreta "PROXY TCP4 <src> <dst> <sport> <dport>\r\n".
+func readProxyV1(r *bufio.Reader) (netip.AddrPort, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return netip.AddrPort{}, fmt.Errorf("header PROXY v1: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return netip.AddrPort{}, errors.New("header PROXY v1 sin CRLF o demasiado largo")
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return netip.AddrPort{}, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return netip.AddrPort{}, fmt.Errorf("header PROXY v1 inválido: %q", line)
+	}
+	src, err := netip.ParseAddr(fields[2])
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("header PROXY v1: dirección inválida %q", fields[2])
+	}
+	sport, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("header PROXY v1: puerto inválido %q", fields[4])
+	}
+	return netip.AddrPortFrom(src.Unmap(), uint16(sport)), nil
+}
+
+// readProxyV2 interpreta el header binario v2 (firma, versión/comando, familia,
+// largo y direcciones; los TLV se descartan).
+func readProxyV2(r *bufio.Reader) (netip.AddrPort, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return netip.AddrPort{}, fmt.Errorf("header PROXY v2: %w", err)
+	}
+	if hdr[12]>>4 != 2 {
+		return netip.AddrPort{}, fmt.Errorf("header PROXY v2: versión %d no soportada", hdr[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return netip.AddrPort{}, fmt.Errorf("header PROXY v2: %w", err)
+	}
+	switch hdr[12] & 0x0f {
+	case 0x0: // LOCAL
+		return netip.AddrPort{}, nil
+	case 0x1: // PROXY
+	default:
+		return netip.AddrPort{}, fmt.Errorf("header PROXY v2: comando %d inválido", hdr[12]&0x0f)
+	}
+	switch hdr[13] >> 4 {
+	case 0x1: // AF_INET
+		if len(payload) < 12 {
+			return netip.AddrPort{}, errors.New("header PROXY v2: direcciones IPv4 truncadas")
+		}
+		return netip.AddrPortFrom(netip.AddrFrom4([4]byte(payload[0:4])), binary.BigEndian.Uint16(payload[8:10])), nil
+	case 0x2: // AF_INET6
+		if len(payload) < 36 {
+			return netip.AddrPort{}, errors.New("header PROXY v2: direcciones IPv6 truncadas")
+		}
+		return netip.AddrPortFrom(netip.AddrFrom16([16]byte(payload[0:16])).Unmap(), binary.BigEndian.Uint16(payload[32:34])), nil
+	}
+	// AF_UNSPEC / AF_UNIX: sin dirección utilizable
+	return netip.AddrPort{}, nil
+}
+
+// untrustedGuard corta la conexión si lo primero que envía un cliente no confiable
+// es un header PROXY (intento de falsificar su IP). Los primeros bytes se retienen
+// hasta poder decidir, aunque la firma llegue partida en varios segmentos.
+type untrustedGuard struct {
+	net.Conn
+	head    []byte // bytes leídos mientras todavía podían ser una firma PROXY
+	checked bool
+}
+
+func (c *untrustedGuard) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	for !c.checked {
+		n, err := c.Conn.Read(b)
+		c.head = append(c.head, b[:n]...)
+		if looksLikeProxyHeader(c.head) {
+			return 0, errUntrustedProxyHeader
+		}
+		if err != nil || !couldBeProxyHeader(c.head) {
+			c.checked = true
+		}
+		if err != nil && len(c.head) == 0 {
+			return 0, err
+		}
+	}
+	if len(c.head) > 0 {
+		n := copy(b, c.head)
+		c.head = c.head[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// looksLikeProxyHeader indica si p empieza con la firma de PROXY v1 o v2.
+func looksLikeProxyHeader(p []byte) bool {
+	if len(p) >= 6 && string(p[:6]) == "PROXY " {
+		return true
+	}
+	return len(p) >= len(proxyV2Sig) && bytes.Equal(p[:len(proxyV2Sig)], proxyV2Sig)
+}
+
+// couldBeProxyHeader indica si p es el comienzo de una firma PROXY v1 o v2, es
+// decir, si hay que leer más antes de decidir.
+func couldBeProxyHeader(p []byte) bool {
+	return bytes.HasPrefix([]byte("PROXY "), p) || bytes.HasPrefix(proxyV2Sig, p)
+}
+
+// writeProxyHeader envía a w un header PROXY de la versión indicada ("v1" o "v2")
+// con src (cliente) y dst (dirección local de guard). Si src no es válida se envía
+// v1 UNKNOWN o v2 LOCAL. Si las familias difieren, ambas se expresan como IPv6.
+func writeProxyHeader(w io.Writer, version string, src, dst netip.AddrPort) error {
+	srcIP, dstIP := src.Addr().Unmap(), dst.Addr().Unmap()
+	if src.IsValid() && dst.IsValid() && srcIP.Is4() != dstIP.Is4() {
+		srcIP, dstIP = netip.AddrFrom16(srcIP.As16()), netip.AddrFrom16(dstIP.As16())
+	}
+	var buf bytes.Buffer
+	switch version {
+	case "v1":
+		switch {
+		case !src.IsValid() || !dst.IsValid():
+			buf.WriteString("PROXY UNKNOWN\r\n")
+		case srcIP.Is4():
+			fmt.Fprintf(&buf, "PROXY TCP4 %s %s %d %d\r\n", srcIP, dstIP, src.Port(), dst.Port())
+		default:
+			fmt.Fprintf(&buf, "PROXY TCP6 %s %s %d %d\r\n", srcIP, dstIP, src.Port(), dst.Port())
+		}
+	case "v2":
+		buf.Write(proxyV2Sig)
+		var ports [4]byte
+		binary.BigEndian.PutUint16(ports[0:2], src.Port())
+		binary.BigEndian.PutUint16(ports[2:4], dst.Port())
+		switch {
+		case !src.IsValid() || !dst.IsValid():
+			buf.Write([]byte{0x20, 0x00, 0, 0}) // LOCAL, AF_UNSPEC
+		case srcIP.Is4():
+			buf.Write([]byte{0x21, 0x11, 0, 12}) // PROXY, TCP sobre IPv4
+			s4, d4 := srcIP.As4(), dstIP.As4()
+			buf.Write(s4[:])
+			buf.Write(d4[:])
+			buf.Write(ports[:])
+		default:
+			buf.Write([]byte{0x21, 0x21, 0, 36}) // PROXY, TCP sobre IPv6
+			s16, d16 := srcIP.As16(), dstIP.As16()
+			buf.Write(s16[:])
+			buf.Write(d16[:])
+			buf.Write(ports[:])
+		}
+	default:
+		return fmt.Errorf("versión de PROXY protocol desconocida: %q", version)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// addrPort retorna la dirección TCP de addr en forma canónica (IPv4-mapped → IPv4).
+func addrPort(addr net.Addr) netip.AddrPort {
+	if t, ok := addr.(*net.TCPAddr); ok {
+		ap := t.AddrPort()
+		return netip.AddrPortFrom(ap.Addr().Unmap().WithZone(""), ap.Port())
+	}
+	return netip.AddrPort{}
+}
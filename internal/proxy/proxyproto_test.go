@@ -0,0 +1,336 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"guard/internal/limiter"
+)
+
+// proxyV2 arma un header PROXY v2 con el byte de versión/comando, el de familia y
+// el bloque de direcciones (más los TLV que se quieran agregar).
+func proxyV2(verCmd, fam byte, addrs []byte) []byte {
+	b := append([]byte{}, proxyV2Sig...)
+	b = append(b, verCmd, fam, 0, 0)
+	binary.BigEndian.PutUint16(b[14:16], uint16(len(addrs)))
+	return append(b, addrs...)
+}
+
+// v2Addrs4 y v2Addrs6 arman el bloque de direcciones de src:sport → dst:dport.
+func v2Addrs4(src, dst string, sport, dport uint16) []byte {
+	s, d := netip.MustParseAddr(src).As4(), netip.MustParseAddr(dst).As4()
+	b := append(append([]byte{}, s[:]...), d[:]...)
+	return binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(b, sport), dport)
+}
+
+func v2Addrs6(src, dst string, sport, dport uint16) []byte {
+	s, d := netip.MustParseAddr(src).As16(), netip.MustParseAddr(dst).As16()
+	b := append(append([]byte{}, s[:]...), d[:]...)
+	return binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(b, sport), dport)
+}
+
+// pipeHeader escribe data en un extremo de un net.Pipe (y lo cierra) y retorna el
+// otro extremo, como lo vería readProxyHeader.
+func pipeHeader(t *testing.T, data []byte) net.Conn {
+	t.Helper()
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	go func() {
+		_, _ = client.Write(data)
+		client.Close()
+	}()
+	return server
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	tlv := []byte{0x04, 0x00, 0x04, 'a', 'b', 'c', 'd'} // PP2_TYPE_NOOP
+	cases := []struct {
+		name   string
+		header []byte
+		want   string // "" = sin dirección (LOCAL/UNKNOWN)
+		err    bool
+	}{
+		{"v1 TCP4", []byte("PROXY TCP4 203.0.113.7 192.0.2.1 51000 7000\r\n"), "203.0.113.7:51000", false},
+		{"v1 TCP6", []byte("PROXY TCP6 2001:db8::7 2001:db8::1 51000 7000\r\n"), "[2001:db8::7]:51000", false},
+		{"v1 TCP6 mapeada", []byte("PROXY TCP6 ::ffff:203.0.113.7 ::ffff:192.0.2.1 51000 7000\r\n"), "203.0.113.7:51000", false},
+		{"v1 UNKNOWN", []byte("PROXY UNKNOWN\r\n"), "", false},
+		{"v1 sin CRLF", []byte("PROXY TCP4 203.0.113.7 192.0.2.1 51000 7000\n"), "", true},
+		{"v1 demasiado largo", []byte("PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n"), "", true},
+		{"v1 protocolo inválido", []byte("PROXY UDP4 203.0.113.7 192.0.2.1 51000 7000\r\n"), "", true},
+		{"v1 dirección inválida", []byte("PROXY TCP4 203.0.113.999 192.0.2.1 51000 7000\r\n"), "", true},
+		{"v1 puerto inválido", []byte("PROXY TCP4 203.0.113.7 192.0.2.1 70000 7000\r\n"), "", true},
+		{"v2 TCP4", proxyV2(0x21, 0x11, v2Addrs4("203.0.113.7", "192.0.2.1", 51000, 7000)), "203.0.113.7:51000", false},
+		{"v2 TCP6", proxyV2(0x21, 0x21, v2Addrs6("2001:db8::7", "2001:db8::1", 51000, 7000)), "[2001:db8::7]:51000", false},
+		{"v2 LOCAL", proxyV2(0x20, 0x00, nil), "", false},
+		{"v2 LOCAL con direcciones", proxyV2(0x20, 0x11, v2Addrs4("203.0.113.7", "192.0.2.1", 51000, 7000)), "", false},
+		{"v2 AF_UNSPEC", proxyV2(0x21, 0x00, nil), "", false},
+		{"v2 con TLV", proxyV2(0x21, 0x11, append(v2Addrs4("203.0.113.7", "192.0.2.1", 51000, 7000), tlv...)), "203.0.113.7:51000", false},
+		{"v2 IPv4 truncada", proxyV2(0x21, 0x11, v2Addrs4("203.0.113.7", "192.0.2.1", 51000, 7000)[:8]), "", true},
+		{"v2 IPv6 truncada", proxyV2(0x21, 0x21, v2Addrs4("203.0.113.7", "192.0.2.1", 51000, 7000)), "", true},
+		{"v2 largo mayor que los datos", append(append([]byte{}, proxyV2Sig...), 0x21, 0x11, 0, 12), "", true},
+		{"v2 versión inválida", proxyV2(0x11, 0x11, v2Addrs4("203.0.113.7", "192.0.2.1", 51000, 7000)), "", true},
+		{"v2 comando inválido", proxyV2(0x22, 0x11, v2Addrs4("203.0.113.7", "192.0.2.1", 51000, 7000)), "", true},
+		{"sin header", []byte("GET / HTTP/1.0\r\n\r\n"), "", true},
+		{"firma v2 incompleta", proxyV2Sig[:8], "", true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Los datos del cliente llegan en el mismo segmento que el header
+			conn := pipeHeader(t, append(append([]byte{}, tc.header...), "hola"...))
+			src, bc, err := readProxyHeader(conn)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("header aceptado (%v), se esperaba error", src)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			if src.IsValid() {
+				got = src.String()
+			}
+			if got != tc.want {
+				t.Fatalf("origen %q, se esperaba %q", got, tc.want)
+			}
+			rest, err := io.ReadAll(bc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(rest) != "hola" {
+				t.Fatalf("después del header quedó %q, se esperaba \"hola\"", rest)
+			}
+		})
+	}
+}
+
+func TestLooksLikeProxyHeader(t *testing.T) {
+	cases := []struct {
+		in   string
+		want bool
+	}{
+		{"PROXY TCP4 203.0.113.7 192.0.2.1 51000 7000\r\n", true},
+		{"PROXY UNKNOWN\r\n", true},
+		{string(proxyV2Sig) + "\x21\x11\x00\x0c", true},
+		{"PROXYX", false},
+		{"PROX", false},
+		{string(proxyV2Sig[:11]), false},
+		{"GET / HTTP/1.0\r\n", false},
+		{"", false},
+	}
+	for _, tc := range cases {
+		if got := looksLikeProxyHeader([]byte(tc.in)); got != tc.want {
+			t.Errorf("looksLikeProxyHeader(%q) = %v, se esperaba %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestUntrustedGuard(t *testing.T) {
+	cases := []struct {
+		name   string
+		chunks []string
+		want   string // lo que debe leerse si no es un header
+		err    bool
+	}{
+		{"v1 en un segmento", []string{"PROXY TCP4 203.0.113.7 192.0.2.1 51000 7000\r\n"}, "", true},
+		{"v1 partido", []string{"PROX", "Y TCP4 203.0.113.7 192.0.2.1 51000 7000\r\n"}, "", true},
+		{"v1 de a un byte", []string{"P", "R", "O", "X", "Y", " ", "TCP4"}, "", true},
+		{"v2 partido", []string{string(proxyV2Sig[:5]), string(proxyV2Sig[5:]) + "\x21\x11"}, "", true},
+		{"datos normales", []string{"\x01\x02\x03", "\x04"}, "\x01\x02\x03\x04", false},
+		{"prefijo que no sigue", []string{"PRO", "GRAMA"}, "PROGRAMA", false},
+		{"prefijo v2 que no sigue", []string{"\r\n\r", "\nhola"}, "\r\n\r\nhola", false},
+		{"prefijo y cierre", []string{"PROX"}, "PROX", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			go func() {
+				defer client.Close()
+				for _, c := range tc.chunks {
+					if _, err := client.Write([]byte(c)); err != nil {
+						return
+					}
+				}
+			}()
+			got, err := io.ReadAll(&untrustedGuard{Conn: server})
+			if tc.err {
+				if !errors.Is(err, errUntrustedProxyHeader) {
+					t.Fatalf("leído %q, err %v; se esperaba errUntrustedProxyHeader", got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tc.want {
+				t.Fatalf("leído %q, se esperaba %q", got, tc.want)
+			}
+		})
+	}
+}
+
+// recordBackend acepta conexiones y envía por el canal todo lo que recibió cada una
+// al cerrarse.
+func recordBackend(t *testing.T) (string, <-chan []byte) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	got := make(chan []byte, 10)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				data, _ := io.ReadAll(c)
+				got <- data
+			}()
+		}
+	}()
+	return ln.Addr().String(), got
+}
+
+func TestProxyHeaderFromTrustedUpstream(t *testing.T) {
+	backend, got := recordBackend(t)
+	live := NewLive(Settings{
+		BackendAddr: backend,
+		Options:     Options{TrustedProxies: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}},
+	})
+	lim := limiter.New(10, 100, 100, 3, 60, 1000, 300, 60)
+	defer lim.Stop()
+	rejects := newRejectLog()
+	addr := startProxy(t, live, lim, rejects)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// Header y primer payload en un solo segmento: el payload no se puede perder
+	_, _ = c.Write([]byte("PROXY TCP4 203.0.113.7 192.0.2.1 51000 7000\r\nhola"))
+	_ = c.(*net.TCPConn).CloseWrite()
+	select {
+	case data := <-got:
+		if string(data) != "hola" {
+			t.Fatalf("el backend recibió %q, se esperaba \"hola\"", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout esperando los datos en el backend")
+	}
+
+	// Los límites se aplican a la IP del header, no a la del balanceador
+	if _, err := lim.Denylist().Add("203.0.113.7/32"); err != nil {
+		t.Fatal(err)
+	}
+	c2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	_, _ = c2.Write([]byte("PROXY TCP4 203.0.113.7 192.0.2.1 51001 7000\r\n"))
+	if reason := rejects.wait(t); reason != "denylist" {
+		t.Fatalf("rechazo %q, se esperaba denylist", reason)
+	}
+}
+
+func TestProxyHeaderFromUntrustedSource(t *testing.T) {
+	for _, hs := range []time.Duration{0, 2 * time.Second} {
+		backend, got := recordBackend(t)
+		live := NewLive(Settings{
+			BackendAddr: backend,
+			Handshake:   Handshake{Timeout: hs},
+			Options:     Options{TrustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}},
+		})
+		lim := limiter.New(10, 100, 100, 3, 60, 1000, 300, 60)
+		defer lim.Stop()
+		rejects := newRejectLog()
+		addr := startProxy(t, live, lim, rejects)
+
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = c.Write([]byte("PROXY TCP4 203.0.113.7 192.0.2.1 51000 7000\r\nhola"))
+		if reason := rejects.wait(t); reason != "proxy_untrusted" {
+			t.Fatalf("handshake %v: rechazo %q, se esperaba proxy_untrusted", hs, reason)
+		}
+		c.Close()
+		select {
+		case data := <-got:
+			if len(data) > 0 {
+				t.Fatalf("handshake %v: el backend recibió %q de un header falsificado", hs, data)
+			}
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func TestWriteProxyHeaderRoundTrip(t *testing.T) {
+	v4, v4b := netip.MustParseAddrPort("203.0.113.7:51000"), netip.MustParseAddrPort("192.0.2.1:7000")
+	v6, v6b := netip.MustParseAddrPort("[2001:db8::7]:51000"), netip.MustParseAddrPort("[2001:db8::1]:7000")
+	cases := []struct {
+		name     string
+		src, dst netip.AddrPort
+		v1       string // línea v1 esperada
+		fam      byte   // byte de familia v2 esperado
+		want     netip.AddrPort
+	}{
+		{"IPv4", v4, v4b, "PROXY TCP4 203.0.113.7 192.0.2.1 51000 7000\r\n", 0x11, v4},
+		{"IPv6", v6, v6b, "PROXY TCP6 2001:db8::7 2001:db8::1 51000 7000\r\n", 0x21, v6},
+		{"cliente IPv4, guard IPv6", v4, v6b, "PROXY TCP6 ::ffff:203.0.113.7 2001:db8::1 51000 7000\r\n", 0x21, v4},
+		{"cliente IPv6, guard IPv4", v6, v4b, "PROXY TCP6 2001:db8::7 ::ffff:192.0.2.1 51000 7000\r\n", 0x21, v6},
+		{"IPv4 mapeada", netip.MustParseAddrPort("[::ffff:203.0.113.7]:51000"), v4b, "PROXY TCP4 203.0.113.7 192.0.2.1 51000 7000\r\n", 0x11, v4},
+		{"origen inválido", netip.AddrPort{}, v4b, "PROXY UNKNOWN\r\n", 0x00, netip.AddrPort{}},
+	}
+	for _, tc := range cases {
+		for _, version := range []string{"v1", "v2"} {
+			t.Run(tc.name+" "+version, func(t *testing.T) {
+				var buf bytes.Buffer
+				if err := writeProxyHeader(&buf, version, tc.src, tc.dst); err != nil {
+					t.Fatal(err)
+				}
+				header := buf.Bytes()
+				if version == "v1" && string(header) != tc.v1 {
+					t.Fatalf("header %q, se esperaba %q", header, tc.v1)
+				}
+				if version == "v2" {
+					cmd := byte(0x21)
+					if !tc.want.IsValid() {
+						cmd = 0x20 // LOCAL
+					}
+					if header[12] != cmd || header[13] != tc.fam {
+						t.Fatalf("versión/comando %#x familia %#x, se esperaban %#x %#x", header[12], header[13], cmd, tc.fam)
+					}
+				}
+				src, _, err := readProxyHeader(pipeHeader(t, header))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if src != tc.want {
+					t.Fatalf("readProxyHeader leyó %v, se esperaba %v", src, tc.want)
+				}
+			})
+		}
+	}
+
+	if err := writeProxyHeader(io.Discard, "v3", v4, v4b); err == nil {
+		t.Fatal("writeProxyHeader aceptó la versión v3")
+	}
+}
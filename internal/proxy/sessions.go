@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"context"
+	"net/netip"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SessionInfo es una sesión proxyada en curso, para /api/sessions.
+type SessionInfo struct {
+	ID           uint64 `json:"id"`
+	Client       string `json:"client"` // ip:puerto del cliente (el real si vino por PROXY protocol)
+	IP           string `json:"ip"`
+	Backend      string `json:"backend"`       // vacío hasta conectar (handshake o dial en curso)
+	Start        int64  `json:"start"`         // Unix
+	LastActivity int64  `json:"last_activity"` // Unix
+	Traffic
+}
+
+// session es una entrada del registro. Los contadores se actualizan sin lock
+// desde la copia de datos.
+type session struct {
+	id      uint64
+	client  string
+	ip      string
+	backend string
+	start   time.Time
+	in      counter      // cliente → backend
+	out     counter      // backend → cliente
+	last    atomic.Int64 // UnixNano de la última lectura en cualquier sentido
+	cancel  context.CancelFunc
+
+	inShape, outShape *shaper // límites de caudal (nil = sin límite en ese sentido)
+}
+
+// traffic retorna los contadores actuales de la sesión.
+func (s *session) traffic() Traffic {
+	return Traffic{
+		BytesIn:  s.in.bytes.Load(),
+		BytesOut: s.out.bytes.Load(),
+		ReadsIn:  s.in.reads.Load(),
+		ReadsOut: s.out.reads.Load(),
+	}
+}
+
+// registry es el conjunto de sesiones en curso de un Live, con el tráfico
+// acumulado por IP y total de las sesiones ya terminadas.
+type registry struct {
+	mu        sync.Mutex
+	next      uint64
+	byID      map[uint64]*session
+	byIP      map[string]*ipTraffic
+	total     Traffic // sesiones terminadas
+	lastPrune time.Time
+}
+
+// add registra una sesión nueva, le asigna id y arma sus límites de caudal según sh.
+func (r *registry) add(s *session, sh Shaping) {
+	s.last.Store(s.start.UnixNano())
+	r.mu.Lock()
+	if r.byID == nil {
+		r.byID = make(map[uint64]*session)
+		r.byIP = make(map[string]*ipTraffic)
+	}
+	r.next++
+	s.id = r.next
+	r.byID[s.id] = s
+	it, ok := r.byIP[s.ip]
+	if !ok {
+		it = &ipTraffic{}
+		r.byIP[s.ip] = it
+	}
+	it.live++
+	it.in = ipBucketsFor(it.in, sh.In, sh)
+	it.out = ipBucketsFor(it.out, sh.Out, sh)
+	s.inShape = newShaper(sh.In, sh, it.in)
+	s.outShape = newShaper(sh.Out, sh, it.out)
+	r.mu.Unlock()
+}
+
+// setBackend anota el backend de la sesión una vez conectado.
+func (r *registry) setBackend(s *session, addr string) {
+	r.mu.Lock()
+	s.backend = addr
+	r.mu.Unlock()
+}
+
+// remove saca la sesión del registro y suma su tráfico al acumulado de su IP.
+func (r *registry) remove(s *session) {
+	t := s.traffic()
+	now := time.Now()
+	r.mu.Lock()
+	delete(r.byID, s.id)
+	r.total.add(t)
+	if it, ok := r.byIP[s.ip]; ok {
+		it.closed.add(t)
+		it.live--
+		it.last = now
+	}
+	if now.Sub(r.lastPrune) >= time.Minute {
+		r.lastPrune = now
+		r.prune(now)
+	}
+	r.mu.Unlock()
+}
+
+// ListSessions retorna las sesiones en curso, de la más antigua a la más nueva.
+func (l *Live) ListSessions() []SessionInfo {
+	l.reg.mu.Lock()
+	out := make([]SessionInfo, 0, len(l.reg.byID))
+	for _, s := range l.reg.byID {
+		out = append(out, SessionInfo{
+			ID:           s.id,
+			Client:       s.client,
+			IP:           s.ip,
+			Backend:      s.backend,
+			Start:        s.start.Unix(),
+			Traffic:      s.traffic(),
+			LastActivity: time.Unix(0, s.last.Load()).Unix(),
+		})
+	}
+	l.reg.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// KillSession corta la sesión id. Retorna la IP del cliente y false si no existe.
+func (l *Live) KillSession(id uint64) (string, bool) {
+	l.reg.mu.Lock()
+	s, ok := l.reg.byID[id]
+	l.reg.mu.Unlock()
+	if !ok {
+		return "", false
+	}
+	s.cancel()
+	return s.ip, true
+}
+
+// KillSessionsByIP corta todas las sesiones de ip, que puede ser también un rango
+// ("2001:db8::/64"), y retorna cuántas fueron.
+func (l *Live) KillSessionsByIP(ip string) int {
+	match := func(s string) bool { return s == ip }
+	if p, err := netip.ParsePrefix(ip); err == nil {
+		match = func(s string) bool {
+			a, err := netip.ParseAddr(s)
+			return err == nil && p.Contains(a)
+		}
+	}
+	var kill []*session
+	l.reg.mu.Lock()
+	for _, s := range l.reg.byID {
+		if match(s.ip) {
+			kill = append(kill, s)
+		}
+	}
+	l.reg.mu.Unlock()
+	for _, s := range kill {
+		s.cancel()
+	}
+	return len(kill)
+}
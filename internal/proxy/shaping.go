@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// errThroughput corta una sesión que excedió su límite de caudal (Shaping.Disconnect).
+var errThroughput = errors.New("límite de caudal excedido")
+
+// ShapeLimit son los límites de caudal de un sentido. 0 = sin límite.
+type ShapeLimit struct {
+	ConnBytesPerSec float64 // por conexión
+	ConnReadsPerSec float64
+	IPBytesPerSec   float64 // compartido entre todas las conexiones de la IP
+	IPReadsPerSec   float64
+}
+
+func (s ShapeLimit) enabled() bool {
+	return s.ConnBytesPerSec > 0 || s.ConnReadsPerSec > 0 || s.IPBytesPerSec > 0 || s.IPReadsPerSec > 0
+}
+
+// Shaping limita el caudal de las sesiones con token buckets por conexión y por IP.
+// In es cliente → backend y Out backend → cliente. Al agotar el burst la lectura
+// se demora hasta recuperar tokens, o con Disconnect la sesión se corta y se
+// rechaza con "throughput". El valor cero no limita nada.
+type Shaping struct {
+	In         ShapeLimit
+	Out        ShapeLimit
+	Burst      time.Duration // ráfaga tolerada por encima del caudal (0 usa 2s)
+	Disconnect bool
+}
+
+// rateBucket es un token bucket sin locks (GCRA): tat es el instante teórico en que
+// el bucket vuelve a estar lleno. Un consumo siempre se descuenta; si deja tat más
+// allá de la ráfaga tolerada, take retorna cuánto hay que esperar.
+type rateBucket struct {
+	tat      atomic.Int64 // UnixNano
+	interval float64      // ns por unidad (byte o lectura)
+	burst    int64        // ns de tolerancia
+}
+
+// newRateBucket crea un bucket de rate unidades/s; nil si rate <= 0.
+func newRateBucket(rate float64, burst time.Duration) *rateBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateBucket{interval: float64(time.Second) / rate, burst: int64(burst)}
+}
+
+// take consume cost unidades y retorna la espera necesaria para respetar el caudal
+// (0 si está dentro de la ráfaga). Un bucket nil no limita.
+func (b *rateBucket) take(cost int, now int64) time.Duration {
+	if b == nil {
+		return 0
+	}
+	for {
+		old := b.tat.Load()
+		tat := max(old, now) + int64(float64(cost)*b.interval)
+		if b.tat.CompareAndSwap(old, tat) {
+			return time.Duration(max(tat-now-b.burst, 0))
+		}
+	}
+}
+
+// ipBuckets son los buckets de un sentido compartidos por las sesiones de una IP.
+type ipBuckets struct {
+	limit ShapeLimit
+	burst time.Duration
+	bytes *rateBucket
+	reads *rateBucket
+}
+
+// shaper aplica los límites de un sentido de una sesión.
+type shaper struct {
+	connBytes, connReads *rateBucket
+	ip                   *ipBuckets
+	disconnect           bool
+}
+
+// wait descuenta una lectura de n bytes y retorna la espera mayor de los buckets.
+func (s *shaper) wait(n int) time.Duration {
+	now := time.Now().UnixNano()
+	d := max(s.connBytes.take(n, now), s.connReads.take(1, now))
+	if s.ip != nil {
+		d = max(d, s.ip.bytes.take(n, now), s.ip.reads.take(1, now))
+	}
+	return d
+}
+
+// throttle descuenta una lectura de n bytes y espera lo necesario para respetar el
+// caudal, o hasta que se cierre done. Con disconnect no espera: retorna errThroughput.
+func (s *shaper) throttle(n int, done <-chan struct{}) error {
+	wait := s.wait(n)
+	if wait <= 0 {
+		return nil
+	}
+	if s.disconnect {
+		return errThroughput
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-done:
+	}
+	return nil
+}
+
+// newShaper arma el shaper de un sentido; nil si ese sentido no tiene límites.
+// ip son los buckets compartidos de la IP para ese sentido (ver registry.add).
+func newShaper(l ShapeLimit, sh Shaping, ip *ipBuckets) *shaper {
+	if !l.enabled() {
+		return nil
+	}
+	burst := shapeBurst(sh)
+	return &shaper{
+		connBytes:  newRateBucket(l.ConnBytesPerSec, burst),
+		connReads:  newRateBucket(l.ConnReadsPerSec, burst),
+		ip:         ip,
+		disconnect: sh.Disconnect,
+	}
+}
+
+// ipBucketsFor retorna b si sigue correspondiendo a los límites vigentes, o
+// buckets nuevos si cambiaron (recarga de config). nil si no hay límite por IP.
+func ipBucketsFor(b *ipBuckets, l ShapeLimit, sh Shaping) *ipBuckets {
+	if l.IPBytesPerSec <= 0 && l.IPReadsPerSec <= 0 {
+		return nil
+	}
+	burst := shapeBurst(sh)
+	if b != nil && b.limit == l && b.burst == burst {
+		return b
+	}
+	return &ipBuckets{
+		limit: l,
+		burst: burst,
+		bytes: newRateBucket(l.IPBytesPerSec, burst),
+		reads: newRateBucket(l.IPReadsPerSec, burst),
+	}
+}
+
+func shapeBurst(sh Shaping) time.Duration {
+	if sh.Burst <= 0 {
+		return 2 * time.Second
+	}
+	return sh.Burst
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DialBuckets son los límites superiores, en segundos, del histograma de latencia
+// de dial a los backends.
+var DialBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// DialStats es el histograma de latencia de dial de un backend.
+type DialStats struct {
+	Addr     string
+	Buckets  []uint64 // dials exitosos con latencia <= DialBuckets[i] (acumulado)
+	Count    uint64   // dials exitosos
+	Sum      float64  // segundos
+	Failures uint64
+}
+
+// dialHistogram acumula latencias de dial sin locks.
+type dialHistogram struct {
+	counts   []atomic.Uint64 // por bucket de DialBuckets (no acumulado) + Inf
+	sumNs    atomic.Int64
+	failures atomic.Uint64
+}
+
+func (h *dialHistogram) observe(d time.Duration, err error) {
+	if err != nil {
+		h.failures.Add(1)
+		return
+	}
+	secs := d.Seconds()
+	i := sort.Search(len(DialBuckets), func(i int) bool { return secs <= DialBuckets[i] })
+	h.counts[i].Add(1)
+	h.sumNs.Add(int64(d))
+}
+
+func (h *dialHistogram) stats(addr string) DialStats {
+	s := DialStats{Addr: addr, Buckets: make([]uint64, len(DialBuckets)), Failures: h.failures.Load()}
+	for i := range h.counts {
+		s.Count += h.counts[i].Load()
+		if i < len(s.Buckets) {
+			s.Buckets[i] = s.Count
+		}
+	}
+	s.Sum = time.Duration(h.sumNs.Load()).Seconds()
+	return s
+}
+
+// stats son los contadores de conexiones de un Live desde el arranque.
+type stats struct {
+	accepts atomic.Uint64
+	mu      sync.Mutex
+	dials   map[string]*dialHistogram
+}
+
+// dial retorna el histograma de addr; se conserva aunque el backend salga de la
+// config para que los contadores no retrocedan.
+func (s *stats) dial(addr string) *dialHistogram {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dials == nil {
+		s.dials = make(map[string]*dialHistogram)
+	}
+	h, ok := s.dials[addr]
+	if !ok {
+		h = &dialHistogram{counts: make([]atomic.Uint64, len(DialBuckets)+1)}
+		s.dials[addr] = h
+	}
+	return h
+}
+
+// Accepts retorna las conexiones que pasaron los límites desde el arranque.
+func (l *Live) Accepts() uint64 {
+	return l.stats.accepts.Load()
+}
+
+// DialStats retorna el histograma de latencia de dial de cada backend, ordenado
+// por dirección.
+func (l *Live) DialStats() []DialStats {
+	l.stats.mu.Lock()
+	out := make([]DialStats, 0, len(l.stats.dials))
+	for addr, h := range l.stats.dials {
+		out = append(out, h.stats(addr))
+	}
+	l.stats.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Addr < out[j].Addr })
+	return out
+}
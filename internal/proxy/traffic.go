@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// trafficRetention es cuánto se conserva el tráfico acumulado de una IP sin
+// sesiones abiertas.
+const trafficRetention = 10 * time.Minute
+
+// Traffic son contadores de tráfico por sentido: In es cliente → backend y Out
+// backend → cliente. Reads cuenta las lecturas del socket, que en protocolos de
+// juego equivalen aproximadamente a paquetes.
+type Traffic struct {
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+	ReadsIn  int64 `json:"reads_in"`
+	ReadsOut int64 `json:"reads_out"`
+}
+
+func (t *Traffic) add(o Traffic) {
+	t.BytesIn += o.BytesIn
+	t.BytesOut += o.BytesOut
+	t.ReadsIn += o.ReadsIn
+	t.ReadsOut += o.ReadsOut
+}
+
+// IPTraffic es el tráfico acumulado de una IP (sesiones abiertas y terminadas en
+// los últimos minutos).
+type IPTraffic struct {
+	IP       string `json:"ip"`
+	Sessions int    `json:"sessions"`
+	Traffic
+}
+
+// counter cuenta bytes y lecturas de un sentido de una sesión. Se actualiza con
+// atómicos desde la copia, sin locks; el resumen por IP y total se arma al consultar.
+type counter struct {
+	bytes atomic.Int64
+	reads atomic.Int64
+}
+
+// ipTraffic es el acumulado de una IP en el registro (protegido por registry.mu).
+type ipTraffic struct {
+	closed Traffic // sesiones terminadas
+	live   int
+	last   time.Time  // fin de la última sesión
+	in     *ipBuckets // límites de caudal compartidos por sus sesiones (ver Shaping)
+	out    *ipBuckets
+}
+
+// prune descarta las IPs sin sesiones abiertas y sin actividad en trafficRetention.
+// Debe llamarse con r.mu.
+func (r *registry) prune(now time.Time) {
+	for ip, it := range r.byIP {
+		if it.live == 0 && now.Sub(it.last) > trafficRetention {
+			delete(r.byIP, ip)
+		}
+	}
+}
+
+// TotalTraffic retorna el tráfico total desde el arranque.
+func (l *Live) TotalTraffic() Traffic {
+	l.reg.mu.Lock()
+	defer l.reg.mu.Unlock()
+	t := l.reg.total
+	for _, s := range l.reg.byID {
+		t.add(s.traffic())
+	}
+	return t
+}
+
+// TrafficByIP retorna el tráfico acumulado por IP de cliente, incluyendo las
+// sesiones abiertas.
+func (l *Live) TrafficByIP() []IPTraffic {
+	l.reg.mu.Lock()
+	defer l.reg.mu.Unlock()
+	byIP := make(map[string]*IPTraffic, len(l.reg.byIP))
+	for ip, it := range l.reg.byIP {
+		byIP[ip] = &IPTraffic{IP: ip, Sessions: it.live, Traffic: it.closed}
+	}
+	for _, s := range l.reg.byID {
+		if e, ok := byIP[s.ip]; ok {
+			e.add(s.traffic())
+		}
+	}
+	out := make([]IPTraffic, 0, len(byIP))
+	for _, e := range byIP {
+		out = append(out, *e)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].IP < out[j].IP })
+	return out
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// defaultValidateTimeout es la espera del primer payload cuando hay Validator pero
+// no se configuró Handshake.Timeout.
+const defaultValidateTimeout = 5 * time.Second
+
+// Validator inspecciona el primer payload del cliente antes de conectar al backend.
+// Si retorna error la conexión se rechaza con "bad_handshake".
+type Validator interface {
+	Validate(first []byte) error
+}
+
+// LengthRange es un rango de largos permitido, ambos extremos inclusive.
+type LengthRange struct {
+	Min, Max int
+}
+
+// Rules es el Validator configurable por perfil: reglas sobre el primer payload.
+// Las listas vacías no restringen.
+type Rules struct {
+	Lengths   []LengthRange    // el largo debe caer en alguno de los rangos
+	Prefixes  [][]byte         // debe empezar con alguno de estos bytes, o
+	Allow     []*regexp.Regexp // cumplir alguno de estos patrones
+	Deny      []*regexp.Regexp // se rechaza si cumple alguno (HTTP, scanners)
+	MaxHeader int              // bytes máximos hasta Delimiter (o del payload si no hay Delimiter); 0 = sin límite
+	Delimiter []byte           // fin del header del protocolo
+}
+
+// CompileRules arma un Rules a partir de la config: prefijos y delimitador en hex,
+// patrones como expresiones regulares sobre el payload.
+func CompileRules(lengths [][2]int, prefixesHex, allow, deny []string, maxHeader int, delimiterHex string) (*Rules, error) {
+	r := &Rules{MaxHeader: maxHeader}
+	for _, l := range lengths {
+		r.Lengths = append(r.Lengths, LengthRange{Min: l[0], Max: l[1]})
+	}
+	for _, h := range prefixesHex {
+		b, err := hex.DecodeString(h)
+		if err != nil {
+			return nil, fmt.Errorf("prefijo hex inválido %q: %w", h, err)
+		}
+		r.Prefixes = append(r.Prefixes, b)
+	}
+	for _, p := range allow {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("patrón inválido %q: %w", p, err)
+		}
+		r.Allow = append(r.Allow, re)
+	}
+	for _, p := range deny {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("patrón inválido %q: %w", p, err)
+		}
+		r.Deny = append(r.Deny, re)
+	}
+	if delimiterHex != "" {
+		b, err := hex.DecodeString(delimiterHex)
+		if err != nil {
+			return nil, fmt.Errorf("delimitador hex inválido %q: %w", delimiterHex, err)
+		}
+		r.Delimiter = b
+	}
+	return r, nil
+}
+
+// Validate implementa Validator.
+func (r *Rules) Validate(p []byte) error {
+	for _, re := range r.Deny {
+		if re.Match(p) {
+			return fmt.Errorf("payload coincide con patrón prohibido %q", re)
+		}
+	}
+	if len(r.Lengths) > 0 {
+		ok := false
+		for _, l := range r.Lengths {
+			if len(p) >= l.Min && (l.Max <= 0 || len(p) <= l.Max) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("largo %d fuera de los rangos permitidos", len(p))
+		}
+	}
+	if len(r.Prefixes) > 0 || len(r.Allow) > 0 {
+		ok := false
+		for _, pre := range r.Prefixes {
+			if bytes.HasPrefix(p, pre) {
+				ok = true
+				break
+			}
+		}
+		for _, re := range r.Allow {
+			if ok {
+				break
+			}
+			ok = re.Match(p)
+		}
+		if !ok {
+			return fmt.Errorf("payload no coincide con ningún prefijo o patrón permitido")
+		}
+	}
+	if r.MaxHeader > 0 {
+		if len(r.Delimiter) == 0 {
+			if len(p) > r.MaxHeader {
+				return fmt.Errorf("header de %d bytes supera el máximo de %d", len(p), r.MaxHeader)
+			}
+		} else if i := bytes.Index(p, r.Delimiter); i > r.MaxHeader || (i < 0 && len(p) > r.MaxHeader) {
+			return fmt.Errorf("header sin delimitador en los primeros %d bytes", r.MaxHeader)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+// Package sse implementa un broker de Server-Sent Events con números de
+// secuencia. Los últimos mensajes quedan en un buffer: un cliente que se
+// reconecta con Last-Event-ID recibe los que se perdió, y uno nuevo (o que se
+// perdió más de lo que hay en el buffer) recibe además una foto del estado actual.
+package sse
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	subBuffer    = 256              // mensajes encolados por cliente antes de cortarlo
+	keepAlive    = 15 * time.Second // comentario periódico para que proxies no corten la conexión
+	writeTimeout = 10 * time.Second // por escritura; reemplaza al WriteTimeout del http.Server
+	retryMs      = 3000             // reintento sugerido al navegador
+)
+
+// Message es un mensaje del stream. Data es JSON.
+type Message struct {
+	ID   uint64
+	Type string
+	Data json.RawMessage
+}
+
+// Hub reparte los mensajes publicados a los clientes conectados. Es seguro para
+// uso concurrente.
+type Hub struct {
+	mu     sync.Mutex
+	seq    uint64
+	buf    []Message // últimos size mensajes, en orden
+	size   int
+	subs   map[chan Message]struct{}
+	closed bool
+}
+
+// New crea un Hub que conserva los últimos size mensajes para reenviarlos.
+func New(size int) *Hub {
+	return &Hub{size: size, subs: make(map[chan Message]struct{})}
+}
+
+// Publish envía v (serializado como JSON) con el tipo de evento typ a todos los
+// clientes. Un cliente que no alcanza a leer se desconecta; al reconectarse con
+// Last-Event-ID recupera lo que quedó en el buffer.
+func (h *Hub) Publish(typ string, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+	h.seq++
+	m := Message{ID: h.seq, Type: typ, Data: data}
+	h.buf = append(h.buf, m)
+	if len(h.buf) > h.size {
+		h.buf = append(h.buf[:0], h.buf[len(h.buf)-h.size:]...)
+	}
+	for ch := range h.subs {
+		select {
+		case ch <- m:
+		default:
+			close(ch)
+			delete(h.subs, ch)
+		}
+	}
+}
+
+// Close desconecta a todos los clientes; los Publish posteriores se ignoran.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for ch := range h.subs {
+		close(ch)
+		delete(h.subs, ch)
+	}
+}
+
+// subscribe registra un cliente. Si resume, retorna los mensajes posteriores a
+// lastID que siguen en el buffer; complete indica que no falta ninguno.
+func (h *Hub) subscribe(lastID uint64, resume bool) (ch chan Message, backlog []Message, complete bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, nil, false
+	}
+	ch = make(chan Message, subBuffer)
+	h.subs[ch] = struct{}{}
+	if !resume {
+		return ch, nil, false
+	}
+	// Un ID mayor que la secuencia actual viene de antes de un reinicio del proceso
+	if lastID > h.seq {
+		return ch, append([]Message(nil), h.buf...), false
+	}
+	for i, m := range h.buf {
+		if m.ID > lastID {
+			return ch, append([]Message(nil), h.buf[i:]...), i > 0 || m.ID == lastID+1
+		}
+	}
+	return ch, nil, true
+}
+
+func (h *Hub) unsubscribe(ch chan Message) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[ch]; ok {
+		close(ch)
+		delete(h.subs, ch)
+	}
+}
+
+// Serve atiende un cliente SSE hasta que se desconecta o se cierra el Hub. Si el
+// cliente es nuevo o se perdió mensajes que ya no están en el buffer y snapshot
+// no es nil, después de los mensajes pendientes se envía la foto que retorna
+// snapshot (sin ID, para no alterar la posición del cliente en la secuencia).
+func (h *Hub) Serve(w http.ResponseWriter, r *http.Request, snapshot func() (typ string, v any)) {
+	var lastID uint64
+	resume := false
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		if n, err := strconv.ParseUint(v, 10, 64); err == nil {
+			lastID, resume = n, true
+		}
+	}
+	ch, backlog, complete := h.subscribe(lastID, resume)
+	if ch == nil {
+		http.Error(w, "stream cerrado", http.StatusServiceUnavailable)
+		return
+	}
+	defer h.unsubscribe(ch)
+
+	rc := http.NewResponseController(w)
+	send := func(write func() error) bool {
+		_ = rc.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if err := write(); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if !send(func() error { _, err := fmt.Fprintf(w, "retry: %d\n\n", retryMs); return err }) {
+		return
+	}
+	for _, m := range backlog {
+		if !send(func() error { return writeMessage(w, m) }) {
+			return
+		}
+	}
+	if !complete && snapshot != nil {
+		typ, v := snapshot()
+		data, err := json.Marshal(v)
+		if err == nil && !send(func() error { return writeMessage(w, Message{Type: typ, Data: data}) }) {
+			return
+		}
+	}
+
+	ping := time.NewTicker(keepAlive)
+	defer ping.Stop()
+	for {
+		select {
+		case m, ok := <-ch:
+			if !ok {
+				return
+			}
+			if !send(func() error { return writeMessage(w, m) }) {
+				return
+			}
+		case <-ping.C:
+			if !send(func() error { _, err := io.WriteString(w, ": ping\n\n"); return err }) {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// writeMessage escribe m en formato SSE. Data es JSON de una sola línea.
+func writeMessage(w io.Writer, m Message) error {
+	var err error
+	if m.ID != 0 {
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", m.ID, m.Type, m.Data)
+	} else {
+		_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", m.Type, m.Data)
+	}
+	return err
+}
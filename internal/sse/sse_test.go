@@ -0,0 +1,160 @@
+package sse
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// event es un evento leído del stream; id vacío para la foto.
+type event struct {
+	id, typ, data string
+}
+
+// connect abre el stream de srv con Last-Event-ID lastID (sin header si es vacío).
+func connect(t *testing.T, srv *httptest.Server, lastID string) *bufio.Reader {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status %d, content-type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	return bufio.NewReader(resp.Body)
+}
+
+// next lee el siguiente evento, salteando el retry y los pings.
+func next(t *testing.T, br *bufio.Reader) event {
+	t.Helper()
+	var ev event
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("stream cortado: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if ev.typ != "" {
+				return ev
+			}
+		case strings.HasPrefix(line, "id: "):
+			ev.id = line[4:]
+		case strings.HasPrefix(line, "event: "):
+			ev.typ = line[7:]
+		case strings.HasPrefix(line, "data: "):
+			ev.data = line[6:]
+		}
+	}
+}
+
+// expect lee los eventos y verifica sus IDs; "snap" es la foto sin ID.
+func expect(t *testing.T, br *bufio.Reader, ids ...string) {
+	t.Helper()
+	for _, want := range ids {
+		ev := next(t, br)
+		switch {
+		case want == "snap" && (ev.id != "" || ev.typ != "snapshot"):
+			t.Fatalf("evento %+v, se esperaba la foto", ev)
+		case want != "snap" && (ev.id != want || ev.typ != "msg" || ev.data != want):
+			t.Fatalf("evento %+v, se esperaba el %s", ev, want)
+		}
+	}
+}
+
+func TestResumeLastEventID(t *testing.T) {
+	h := New(5)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.Serve(w, r, func() (string, any) { return "snapshot", map[string]int{"active": 1} })
+	}))
+	defer srv.Close()
+	defer h.Close() // antes que srv.Close, que espera a los handlers
+	for i := 1; i <= 10; i++ {
+		h.Publish("msg", i)
+	}
+
+	cases := []struct {
+		name   string
+		lastID string
+		want   []string
+	}{
+		{"al día con el buffer", "7", []string{"8", "9", "10"}},
+		{"sin mensajes perdidos", "10", nil},
+		{"justo antes del buffer", "5", []string{"6", "7", "8", "9", "10"}},
+		{"se perdió más que el buffer", "2", []string{"6", "7", "8", "9", "10", "snap"}},
+		{"ID de antes de un reinicio", "99", []string{"6", "7", "8", "9", "10", "snap"}},
+		{"ID inválido", "x", []string{"snap"}},
+		{"cliente nuevo", "", []string{"snap"}},
+	}
+	var streams []*bufio.Reader
+	for _, tc := range cases {
+		t.Log(tc.name)
+		br := connect(t, srv, tc.lastID)
+		expect(t, br, tc.want...)
+		streams = append(streams, br)
+	}
+	// Después del backlog todos siguen con los mensajes en vivo, sin repetir
+	h.Publish("msg", 11)
+	for _, br := range streams {
+		expect(t, br, "11")
+	}
+}
+
+func TestSlowClientEvicted(t *testing.T) {
+	h := New(2 * subBuffer)
+	defer h.Close()
+	slow, _, _ := h.subscribe(0, false)
+	fast, _, _ := h.subscribe(0, false)
+
+	// El rápido lee cada mensaje; el lento no lee nada y se llena su cola
+	for i := 1; i <= subBuffer+10; i++ {
+		h.Publish("msg", i)
+		if m := <-fast; m.ID != uint64(i) {
+			t.Fatalf("el rápido recibió el %d, se esperaba el %d", m.ID, i)
+		}
+	}
+
+	h.mu.Lock()
+	_, slowSub := h.subs[slow]
+	_, fastSub := h.subs[fast]
+	h.mu.Unlock()
+	if slowSub || !fastSub {
+		t.Fatalf("suscriptos: lento %v, rápido %v; se esperaba cortar solo al lento", slowSub, fastSub)
+	}
+	// El lento recibe lo que alcanzó a encolar y después el cierre
+	var last uint64
+	n := 0
+	for m := range slow {
+		n++
+		last = m.ID
+	}
+	if n != subBuffer || last != subBuffer {
+		t.Fatalf("el lento recibió %d mensajes hasta el %d, se esperaban %d", n, last, subBuffer)
+	}
+	h.unsubscribe(slow) // lo que haría Serve al salir; no debe cerrar dos veces
+
+	// Al reconectarse con Last-Event-ID recupera el resto desde el buffer
+	ch, backlog, complete := h.subscribe(last, true)
+	defer h.unsubscribe(ch)
+	if !complete || len(backlog) != 10 || backlog[0].ID != last+1 {
+		t.Fatalf("reconexión: %d mensajes (completo %v), se esperaban los 10 siguientes al %d", len(backlog), complete, last)
+	}
+	for i, m := range backlog {
+		if string(m.Data) != strconv.Itoa(int(last)+1+i) {
+			t.Fatalf("mensaje %d con data %s", m.ID, m.Data)
+		}
+	}
+	h.unsubscribe(fast)
+}
@@ -0,0 +1,370 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FormatVersion es la versión del formato del archivo. Se escribe en la primera
+// línea (header); un archivo con otra versión no se carga.
+const FormatVersion = 1
+
+// rename reemplaza el archivo al compactar (os.Rename; los tests simulan que falla).
+var rename = os.Rename
+
+const (
+	compactEvery     = 10 * time.Minute // intervalo de compactación periódica
+	compactAfterOps  = 50000            // compactar antes si el log acumuló muchas líneas
+	defaultRetention = 7 * 24 * time.Hour
+)
+
+// record es una línea del archivo (JSONL). Op indica el tipo:
+//
+//	"header" → Version
+//	"ip"     → historial de bloqueos de IP (BlockCount, BlockUntil, LastBlock)
+//	"fw"     → expiración de ban de firewall de IP (Until; 0 = eliminado)
+type record struct {
+	Op         string `json:"op"`
+	Version    int    `json:"version,omitempty"`
+	IP         string `json:"ip,omitempty"`
+	BlockCount int    `json:"block_count,omitempty"`
+	BlockUntil int64  `json:"block_until,omitempty"`
+	LastBlock  int64  `json:"last_block,omitempty"`
+	Until      int64  `json:"until,omitempty"`
+}
+
+// ipRecord es el historial persistido de una IP.
+type ipRecord struct {
+	BlockCount int
+	BlockUntil time.Time
+	LastBlock  time.Time
+}
+
+// Store persiste historial de bloqueos del limiter y expiraciones del firewall
+// en un archivo local append-only (una línea JSON por cambio). Al abrir se
+// reproduce el archivo completo; periódicamente se compacta reescribiendo solo
+// el estado vigente.
+type Store struct {
+	mu        sync.Mutex
+	path      string
+	f         *os.File
+	ops       int  // líneas agregadas desde la última compactación
+	closed    bool // Close ya se llamó: no se vuelve a escribir el archivo
+	retention time.Duration
+	ips       map[string]*ipRecord
+	fw        map[string]time.Time
+}
+
+// Open abre (o crea) el store en path y carga su contenido. retention es cuánto se
+// conserva el historial de una IP desde su último bloqueo (0 = 7 días).
+func Open(path string, retention time.Duration) (*Store, error) {
+	if retention <= 0 {
+		retention = defaultRetention
+	}
+	s := &Store{
+		path:      path,
+		retention: retention,
+		ips:       make(map[string]*ipRecord),
+		fw:        make(map[string]time.Time),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	// Compactar al abrir: descarta lo vencido y deja el archivo con header actual
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load reproduce el archivo. Una última línea truncada (crash a mitad de escritura)
+// se ignora.
+func (s *Store) load() error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("store: %w", err)
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	first := true
+	line := 0
+	for sc.Scan() {
+		line++
+		var r record
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			log.Printf("[WARN] store: %s línea %d inválida, se ignora: %v", s.path, line, err)
+			continue
+		}
+		if first {
+			first = false
+			if r.Op != "header" || r.Version != FormatVersion {
+				return fmt.Errorf("store: %s tiene formato versión %d (esperada %d)", s.path, r.Version, FormatVersion)
+			}
+			continue
+		}
+		s.apply(r)
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("store: leyendo %s: %w", s.path, err)
+	}
+	return nil
+}
+
+// apply aplica un record al estado en memoria. Debe llamarse con s.mu (o durante load).
+func (s *Store) apply(r record) {
+	switch r.Op {
+	case "ip":
+		rec := &ipRecord{BlockCount: r.BlockCount, LastBlock: time.Unix(r.LastBlock, 0)}
+		if r.BlockUntil != 0 {
+			rec.BlockUntil = time.Unix(r.BlockUntil, 0)
+		}
+		s.ips[r.IP] = rec
+	case "fw":
+		if r.Until == 0 {
+			delete(s.fw, r.IP)
+		} else {
+			s.fw[r.IP] = time.Unix(r.Until, 0)
+		}
+	}
+}
+
+// appendRecords escribe los records en una sola escritura. Si el archivo quedó
+// cerrado por una compactación fallida se intenta reabrir; si no se puede, los
+// records no se pierden de memoria pero se retorna error. Debe llamarse con s.mu.
+func (s *Store) appendRecords(recs []record) error {
+	if s.closed || len(recs) == 0 {
+		return nil
+	}
+	if s.f == nil {
+		if err := s.openLog(); err != nil {
+			return err
+		}
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, r := range recs {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	if _, err := s.f.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("store: escribiendo %s: %w", s.path, err)
+	}
+	s.ops += len(recs)
+	return nil
+}
+
+// compact reescribe el archivo con el estado vigente (header + un record por entrada)
+// y lo reemplaza de forma atómica.
+func (s *Store) compact() error {
+	if s.closed {
+		return nil
+	}
+	now := time.Now()
+	for ip, rec := range s.ips {
+		if now.After(rec.BlockUntil) && now.Sub(rec.LastBlock) > s.retention {
+			delete(s.ips, ip)
+		}
+	}
+	for ip, until := range s.fw {
+		if now.After(until) {
+			delete(s.fw, ip)
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	_ = enc.Encode(record{Op: "header", Version: FormatVersion})
+	for ip, rec := range s.ips {
+		_ = enc.Encode(ipToRecord(ip, rec))
+	}
+	for ip, until := range s.fw {
+		_ = enc.Encode(record{Op: "fw", IP: ip, Until: until.Unix()})
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("store: %w", err)
+	}
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("store: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("store: %w", err)
+	}
+	// En Windows no se puede reemplazar un archivo abierto
+	if s.f != nil {
+		s.f.Close()
+		s.f = nil
+	}
+	if err := rename(tmp.Name(), s.path); err != nil {
+		os.Remove(tmp.Name())
+		// El archivo anterior quedó intacto (p.ej. lo tenía abierto un antivirus o
+		// un backup): se sigue agregando ahí y se reintenta en la próxima compactación
+		if _, statErr := os.Stat(s.path); statErr == nil {
+			if rerr := s.openLog(); rerr != nil {
+				log.Printf("[WARN] %v", rerr)
+			}
+		}
+		return fmt.Errorf("store: compactando %s: %w", s.path, err)
+	}
+	if err := s.openLog(); err != nil {
+		return err
+	}
+	s.ops = 0
+	return nil
+}
+
+// openLog abre el archivo para agregar records. Debe llamarse con s.mu.
+func (s *Store) openLog() error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("store: %w", err)
+	}
+	s.f = f
+	return nil
+}
+
+func ipToRecord(ip string, rec *ipRecord) record {
+	r := record{Op: "ip", IP: ip, BlockCount: rec.BlockCount, LastBlock: rec.LastBlock.Unix()}
+	if !rec.BlockUntil.IsZero() {
+		r.BlockUntil = rec.BlockUntil.Unix()
+	}
+	return r
+}
+
+// Run compacta el store periódicamente hasta que ctx se cancele.
+func (s *Store) Run(ctx context.Context) {
+	tick := time.NewTicker(compactEvery)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			s.mu.Lock()
+			if err := s.compact(); err != nil {
+				log.Printf("[WARN] %v", err)
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// Close compacta y cierra el archivo. Las llamadas siguientes no hacen nada, de
+// modo que tras un traspaso (ver internal/handoff) el proceso anterior no pisa el
+// archivo que ya usa el nuevo.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.compact()
+	if s.f != nil {
+		s.f.Close()
+		s.f = nil
+	}
+	s.closed = true
+	return err
+}
+
+// maybeCompact compacta si el log creció demasiado. Debe llamarse con s.mu.
+func (s *Store) maybeCompact() {
+	if s.ops < compactAfterOps {
+		return
+	}
+	if err := s.compact(); err != nil {
+		log.Printf("[WARN] %v", err)
+	}
+}
+
+// ─── Historial del limiter (implementa limiter.History) ──────────────────────
+
+// Lookup retorna el historial persistido de ip.
+func (s *Store) Lookup(ip string) (blockCount int, blockUntil time.Time, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.ips[ip]
+	if !ok {
+		return 0, time.Time{}, false
+	}
+	return rec.BlockCount, rec.BlockUntil, true
+}
+
+// Record guarda el historial de ip tras un bloqueo o desbloqueo.
+func (s *Store) Record(ip string, blockCount int, blockUntil time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.ips[ip]
+	if !ok {
+		rec = &ipRecord{}
+		s.ips[ip] = rec
+	}
+	if blockCount > rec.BlockCount || !blockUntil.IsZero() {
+		rec.LastBlock = time.Now()
+	}
+	rec.BlockCount = blockCount
+	rec.BlockUntil = blockUntil
+	if err := s.appendRecords([]record{ipToRecord(ip, rec)}); err != nil {
+		log.Printf("[WARN] %v", err)
+	}
+	s.maybeCompact()
+}
+
+// ─── Expiraciones del firewall (implementa firewall.State) ──────────────────
+
+// LoadFirewall retorna las expiraciones de ban de firewall persistidas.
+func (s *Store) LoadFirewall() map[string]time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]time.Time, len(s.fw))
+	for ip, until := range s.fw {
+		out[ip] = until
+	}
+	return out
+}
+
+// SaveFirewall persiste el conjunto completo de expiraciones; solo se escriben
+// las diferencias respecto a lo ya guardado.
+func (s *Store) SaveFirewall(scheduled map[string]time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var recs []record
+	for ip := range s.fw {
+		if _, ok := scheduled[ip]; !ok {
+			delete(s.fw, ip)
+			recs = append(recs, record{Op: "fw", IP: ip})
+		}
+	}
+	for ip, until := range scheduled {
+		if prev, ok := s.fw[ip]; ok && prev.Unix() == until.Unix() {
+			continue
+		}
+		s.fw[ip] = until
+		recs = append(recs, record{Op: "fw", IP: ip, Until: until.Unix()})
+	}
+	err := s.appendRecords(recs)
+	s.maybeCompact()
+	return err
+}
+
+// Stats retorna la cantidad de IPs con historial y de bans de firewall guardados.
+func (s *Store) Stats() (ips, firewall int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.ips), len(s.fw)
+}
@@ -0,0 +1,88 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCompactRenameFailureKeepsAppending(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "guard.db")
+	s, err := Open(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	until := time.Now().Add(time.Hour)
+	s.Record("1.1.1.1", 1, until)
+
+	// Simular que el archivo está tomado por otro proceso al reemplazarlo
+	rename = func(string, string) error { return errors.New("archivo en uso") }
+	s.mu.Lock()
+	err = s.compact()
+	s.mu.Unlock()
+	rename = os.Rename
+	if err == nil {
+		t.Fatal("compact con rename fallido no retornó error")
+	}
+
+	s.Record("2.2.2.2", 1, until)
+	if err := s.SaveFirewall(map[string]time.Time{"3.3.3.3": until}); err != nil {
+		t.Fatalf("SaveFirewall tras compactación fallida: %v", err)
+	}
+	// Sin Close: lo que se lee es solo lo que llegó al archivo
+	s.mu.Lock()
+	s.f.Close()
+	s.f = nil
+	s.closed = true
+	s.mu.Unlock()
+
+	r, err := Open(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for _, ip := range []string{"1.1.1.1", "2.2.2.2"} {
+		if _, _, ok := r.Lookup(ip); !ok {
+			t.Errorf("historial de %s perdido tras la compactación fallida", ip)
+		}
+	}
+	if _, ok := r.LoadFirewall()["3.3.3.3"]; !ok {
+		t.Error("ban de firewall perdido tras la compactación fallida")
+	}
+}
+
+func TestAppendWithoutFileFails(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "guard.db")
+	s, err := Open(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Archivo cerrado por una compactación fallida que además no se puede reabrir
+	s.mu.Lock()
+	s.f.Close()
+	s.f = nil
+	s.path = filepath.Join(dir, "no-existe", "guard.db")
+	s.mu.Unlock()
+
+	if err := s.SaveFirewall(map[string]time.Time{"3.3.3.3": time.Now().Add(time.Hour)}); err == nil {
+		t.Fatal("SaveFirewall sin archivo abierto no retornó error")
+	}
+}
+
+func TestAppendAfterCloseIsNoop(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "guard.db"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveFirewall(map[string]time.Time{"3.3.3.3": time.Now().Add(time.Hour)}); err != nil {
+		t.Fatalf("SaveFirewall tras Close: %v", err)
+	}
+}